@@ -0,0 +1,77 @@
+package authbyemail
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Personal access tokens start with this prefix, so that they can be told apart from
+// bearer tokens meant for the website behind us.
+const accessTokenPrefix = "abe_"
+
+// An AccessToken lets scripts and other clients that can not log in by e-mail act as
+// the user who made it, by sending it in a header `Authorization: Bearer <token>`.
+// Only a hash of the token itself is stored.
+type AccessToken struct {
+	// Identifies the token in listings, without revealing it.
+	ID string
+
+	// UserID corresponding to this token.
+	UserID UserID
+
+	// The name the user gave the token, so that they can recognise it later on.
+	Name string
+
+	// The sanitised paths the token can be used for, which may end in the wildcard '*'.
+	// If there are none, the token can be used for all paths the user may access.
+	Scopes []string
+
+	// When the token was made, last used, and when it will expire. LastUsed is zero
+	// if the token was never used.
+	CreatedAt time.Time
+	LastUsed  time.Time
+	ExpiresAt time.Time
+}
+
+// Allows checks whether the token can be used for the given sanitised url.
+func (t *AccessToken) Allows(url string) bool {
+	if len(t.Scopes) == 0 {
+		return true
+	}
+	for _, scope := range t.Scopes {
+		if pathMatches(url, scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// newAccessToken generates a fresh personal access token.
+func newAccessToken() string {
+	return accessTokenPrefix + newRandom()
+}
+
+// bearerAccessToken returns the personal access token in the Authorization header of
+// the request, or the empty string if there is none.
+func bearerAccessToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return ""
+	}
+	token := strings.TrimSpace(header[7:])
+	if !strings.HasPrefix(token, accessTokenPrefix) {
+		return ""
+	}
+	return token
+}
+
+// ParseScopes parses a list of paths separated by commas or spaces, as entered by a
+// user, into the sanitised scopes of an access token.
+func ParseScopes(input string) []string {
+	var scopes []string
+	for _, path := range strings.FieldsFunc(input, func(c rune) bool { return c == ',' || c == ' ' }) {
+		scopes = append(scopes, strings.TrimLeft(strings.ToLower(path), "/"))
+	}
+	return scopes
+}
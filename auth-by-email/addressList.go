@@ -0,0 +1,162 @@
+package authbyemail
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// An AddressList matches e-mail addresses against patterns, as given to the
+// `whitelistdomains` and `blockdomains` directives. A pattern is one of
+//
+//	example.com          the domain itself
+//	*.example.com        any subdomain, but not the domain itself
+//	.example.com         the domain and any subdomain
+//	user@example.com     one address
+//	/^[a-z]+@example\./  a regular expression, which must match the whole address
+//	file:/etc/list.txt   the patterns in a file, one per line
+//
+// Domains and addresses are kept in maps, so that lists of many thousands of domains
+// (such as those of disposable e-mail services) can be matched quickly.
+type AddressList struct {
+	patterns   []string
+	domains    map[string]bool
+	subdomains map[string]bool
+	addresses  map[string]bool
+	regexps    []*regexp.Regexp
+}
+
+// NewAddressList parses the given patterns, and reads the files among them. Empty lines
+// and lines starting with # are skipped in files.
+func NewAddressList(patterns []string) (*AddressList, error) {
+	l := &AddressList{
+		domains:    make(map[string]bool),
+		subdomains: make(map[string]bool),
+		addresses:  make(map[string]bool),
+	}
+	if err := l.Add(patterns); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Add parses more patterns into the list.
+func (l *AddressList) Add(patterns []string) error {
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "file:") {
+			if err := l.addFile(pattern[5:]); err != nil {
+				return err
+			}
+		} else if err := l.add(pattern); err != nil {
+			return err
+		}
+		l.patterns = append(l.patterns, pattern)
+	}
+	return nil
+}
+
+func (l *AddressList) addFile(filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := l.add(line); err != nil {
+			return errors.New(err.Error() + " in " + filename)
+		}
+	}
+	return scanner.Err()
+}
+
+// add parses one pattern that is not a file.
+func (l *AddressList) add(pattern string) error {
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		re, err := regexp.Compile("^(?:" + pattern[1:len(pattern)-1] + ")$")
+		if err != nil {
+			return errors.New("Could not parse regular expression " + pattern)
+		}
+		l.regexps = append(l.regexps, re)
+		return nil
+	}
+
+	if strings.Contains(pattern, "@") {
+		email, err := NewEmailAddrFromString(pattern)
+		if err != nil || email.User == "" || email.Domain == "" {
+			return errors.New("Could not parse e-mail address " + pattern)
+		}
+		l.addresses[email.String()] = true
+		return nil
+	}
+
+	wildcard, suffix := strings.HasPrefix(pattern, "*."), strings.HasPrefix(pattern, ".")
+	domain, err := idna.ToASCII(strings.ToLower(strings.TrimPrefix(strings.TrimPrefix(pattern, "*"), ".")))
+	if err != nil || domain == "" || strings.ContainsAny(domain, "*/") {
+		return errors.New("Could not parse domain " + pattern)
+	}
+	if !wildcard {
+		l.domains[domain] = true
+	}
+	if wildcard || suffix {
+		l.subdomains[domain] = true
+	}
+	return nil
+}
+
+// Patterns returns the patterns the list was made from, with files as they were given.
+func (l *AddressList) Patterns() []string {
+	if l == nil {
+		return nil
+	}
+	return l.patterns
+}
+
+// Matches checks whether the given address matches any pattern. A nil list matches
+// nothing.
+func (l *AddressList) Matches(e *EmailAddr) bool {
+	if l == nil {
+		return false
+	}
+	if l.MatchesAddress(e) || l.MatchesDomain(e.Domain) {
+		return true
+	}
+	for _, re := range l.regexps {
+		if re.MatchString(e.String()) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesAddress checks whether the given address is in the list by itself, rather
+// than by its domain.
+func (l *AddressList) MatchesAddress(e *EmailAddr) bool {
+	return l != nil && l.addresses[e.String()]
+}
+
+// MatchesDomain checks whether the given domain matches a domain pattern.
+func (l *AddressList) MatchesDomain(domain string) bool {
+	if l == nil {
+		return false
+	}
+	if l.domains[domain] {
+		return true
+	}
+	for i := strings.Index(domain, "."); i >= 0; i = strings.Index(domain, ".") {
+		domain = domain[i+1:]
+		if l.subdomains[domain] {
+			return true
+		}
+	}
+	return false
+}
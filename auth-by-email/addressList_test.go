@@ -0,0 +1,56 @@
+package authbyemail
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAddressList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "addresslist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "disposable.txt")
+	ioutil.WriteFile(file, []byte("# Disposable e-mail services\nmailinator.com\n\n  .trashmail.net  \n"), 0600)
+
+	l, err := NewAddressList([]string{"example.com", "*.example.org", ".Example.NET", "boss@gmail.com", `/[a-z]+\+spam@.*/`, "file:" + file, "bücher.de"})
+	if err != nil {
+		t.Fatalf("Could not make the list, %v", err)
+	}
+
+	for address, expected := range map[string]bool{
+		"user@example.com":          true,
+		"user@sub.example.com":      false,
+		"user@example.org":          false,
+		"user@sub.example.org":      true,
+		"user@deep.sub.example.org": true,
+		"user@example.net":          true,
+		"user@sub.example.net":      true,
+		"user@notexample.net":       false,
+		"Boss@Gmail.com":            true,
+		"other@gmail.com":           false,
+		"me+spam@example.io":        true,
+		"me+spam-not@example.io":    false,
+		"user@mailinator.com":       true,
+		"user@a.trashmail.net":      true,
+		"user@trashmail.net":        true,
+		"user@xn--bcher-kva.de":     true,
+	} {
+		email, _ := NewEmailAddrFromString(address)
+		if l.Matches(email) != expected {
+			t.Errorf("Expected %v to match: %v", address, expected)
+		}
+	}
+
+	if patterns := l.Patterns(); len(patterns) != 7 || patterns[5] != "file:"+file {
+		t.Errorf("Patterns not kept as given, got %v", patterns)
+	}
+
+	var none *AddressList
+	if email, _ := NewEmailAddrFromString("user@example.com"); none.Matches(email) {
+		t.Error("The nil list matched an address")
+	}
+}
@@ -0,0 +1,190 @@
+package authbyemail
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// The number of cookies a CachedDatabase remembers, and for how long. Cookies that
+// expire are noticed after at most cookieCacheTTL.
+const (
+	cookieCacheSize = 10000
+	cookieCacheTTL  = 30 * time.Second
+)
+
+// cookieVersionInterval is how often a CachedDatabase checks whether another process
+// changed the cookies, in which case it forgets them all.
+var cookieVersionInterval = time.Second
+
+// A CachedDatabase remembers the most recently used cookies of another Database, so
+// that checking the cookie of each request (including every image and script) does
+// not need a query. All other calls are passed on as they are.
+//
+// Cookies changed through the CachedDatabase are forgotten at once. Changes by other
+// processes (e.g. the usermod tool) are noticed through CookieVersion, which is checked
+// at most every cookieVersionInterval.
+type CachedDatabase struct {
+	Database
+
+	size int
+	ttl  time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element // of *cookieCacheEntry, by cookie
+	order   *list.List               // most recently used first
+
+	// Lookups that started before a cookie was forgotten must not store what they found.
+	// They can tell by the generation, which increases whenever cookies are forgotten.
+	generation int64
+
+	version          int64
+	versionCheckedAt time.Time
+}
+
+type cookieCacheEntry struct {
+	cookie    string
+	token     CookieToken
+	cachedAt  time.Time
+	touchedAt time.Time
+}
+
+// NewCachedDatabase returns a CachedDatabase that remembers at most size cookies of the
+// given database, each for at most ttl.
+func NewCachedDatabase(database Database, size int, ttl time.Duration) *CachedDatabase {
+	return &CachedDatabase{
+		Database: database,
+		size:     size,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		version:  database.CookieVersion(),
+	}
+}
+
+// GetCookieToken returns a copy of the cookie information, from the cache if possible.
+func (c *CachedDatabase) GetCookieToken(cookieText string) *CookieToken {
+	c.checkVersion()
+	c.mutex.Lock()
+	if element, ok := c.entries[cookieText]; ok {
+		entry := element.Value.(*cookieCacheEntry)
+		if time.Since(entry.cachedAt) < c.ttl {
+			c.order.MoveToFront(element)
+			token := entry.token
+			c.mutex.Unlock()
+			return &token
+		}
+		c.remove(element)
+	}
+	generation := c.generation
+	c.mutex.Unlock()
+
+	token := c.Database.GetCookieToken(cookieText)
+	if token == nil {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if generation == c.generation {
+		if element, ok := c.entries[cookieText]; ok {
+			c.remove(element)
+		}
+		c.entries[cookieText] = c.order.PushFront(&cookieCacheEntry{cookie: cookieText, token: *token, cachedAt: time.Now()})
+		for c.order.Len() > c.size {
+			c.remove(c.order.Back())
+		}
+	}
+	return token
+}
+
+// TouchCookieToken passes on at most one touch per cookie per cookieTouchInterval, so
+// that cached cookies do not need a query either.
+func (c *CachedDatabase) TouchCookieToken(cookieText string) {
+	c.mutex.Lock()
+	if element, ok := c.entries[cookieText]; ok {
+		entry := element.Value.(*cookieCacheEntry)
+		if time.Since(entry.touchedAt) < cookieTouchInterval {
+			c.mutex.Unlock()
+			return
+		}
+		entry.touchedAt = time.Now()
+	}
+	c.mutex.Unlock()
+
+	c.Database.TouchCookieToken(cookieText)
+}
+
+func (c *CachedDatabase) ValidateCookieToken(cookieText string) error {
+	defer c.forget(func(entry *cookieCacheEntry) bool { return entry.cookie == cookieText })
+	return c.Database.ValidateCookieToken(cookieText)
+}
+
+func (c *CachedDatabase) ClaimCookieToken(cookieText string, user UserID) error {
+	defer c.forget(func(entry *cookieCacheEntry) bool { return entry.cookie == cookieText })
+	return c.Database.ClaimCookieToken(cookieText, user)
+}
+
+func (c *CachedDatabase) DeleteCookieToken(cookieText string) error {
+	defer c.forget(func(entry *cookieCacheEntry) bool { return entry.cookie == cookieText })
+	return c.Database.DeleteCookieToken(cookieText)
+}
+
+func (c *CachedDatabase) ValidateLoginCode(cookieText string, code string) error {
+	defer c.forget(func(entry *cookieCacheEntry) bool { return entry.cookie == cookieText })
+	return c.Database.ValidateLoginCode(cookieText, code)
+}
+
+func (c *CachedDatabase) DelUser(user UserID) error {
+	defer c.forget(func(entry *cookieCacheEntry) bool { return entry.token.UserID == user })
+	return c.Database.DelUser(user)
+}
+
+func (c *CachedDatabase) SetUserExpiry(user UserID, expiresAt time.Time) error {
+	defer c.forget(func(entry *cookieCacheEntry) bool { return entry.token.UserID == user })
+	return c.Database.SetUserExpiry(user, expiresAt)
+}
+
+// forget removes the cookies for which the given function returns true from the cache.
+func (c *CachedDatabase) forget(matches func(*cookieCacheEntry) bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.generation++
+	for _, element := range c.entries {
+		if matches(element.Value.(*cookieCacheEntry)) {
+			c.remove(element)
+		}
+	}
+}
+
+// checkVersion forgets all cookies if another process changed any of them. It must be
+// called without the mutex held, so that other lookups need not wait for the query: the
+// version is read without it, and only stored if no other check stored one meanwhile.
+func (c *CachedDatabase) checkVersion() {
+	c.mutex.Lock()
+	if time.Since(c.versionCheckedAt) < cookieVersionInterval {
+		c.mutex.Unlock()
+		return
+	}
+	c.versionCheckedAt = time.Now()
+	seen := c.version
+	c.mutex.Unlock()
+
+	version := c.Database.CookieVersion()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if version != seen && c.version == seen {
+		c.version = version
+		c.generation++
+		c.entries = make(map[string]*list.Element)
+		c.order.Init()
+	}
+}
+
+// remove removes one element from the cache. It must be called with the mutex held.
+func (c *CachedDatabase) remove(element *list.Element) {
+	delete(c.entries, element.Value.(*cookieCacheEntry).cookie)
+	c.order.Remove(element)
+}
@@ -0,0 +1,187 @@
+package authbyemail
+
+import (
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+)
+
+// countingDatabase counts the cookie lookups that reach the database
+type countingDatabase struct {
+	Database
+	lookups int
+}
+
+func (c *countingDatabase) GetCookieToken(cookieText string) *CookieToken {
+	c.lookups++
+	return c.Database.GetCookieToken(cookieText)
+}
+
+// slowVersionDatabase lets a test hold up the version check, once channels are given
+type slowVersionDatabase struct {
+	Database
+	entered, release chan struct{}
+}
+
+func (s *slowVersionDatabase) CookieVersion() int64 {
+	if s.entered != nil {
+		s.entered <- struct{}{}
+		<-s.release
+	}
+	return s.Database.CookieVersion()
+}
+
+func TestCachedDatabase(t *testing.T) {
+	userID := UserID("test")
+
+	t.Run("Lookups are cached", func(t *testing.T) {
+		inner := &countingDatabase{Database: NewMapBasedDatabase()}
+		db := NewCachedDatabase(inner, 2, time.Minute)
+		db.AddUser(userID)
+		c1, _ := db.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: "cde"})
+		c2, _ := db.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: "cde"})
+		c3, _ := db.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: "cde"})
+
+		for i := 0; i < 3; i++ {
+			if ct := db.GetCookieToken(c1); ct == nil || ct.UserID != userID {
+				t.Fatalf("Got wrong cookie from the cache, %#v", ct)
+			}
+		}
+		if inner.lookups != 1 {
+			t.Errorf("Expected 1 lookup in the database, got %v", inner.lookups)
+		}
+
+		// Only the two most recently used cookies are kept
+		db.GetCookieToken(c2)
+		db.GetCookieToken(c1)
+		db.GetCookieToken(c3)
+		inner.lookups = 0
+		db.GetCookieToken(c1)
+		db.GetCookieToken(c2)
+		if inner.lookups != 1 {
+			t.Errorf("Expected only the least recently used cookie to be forgotten, got %v lookups", inner.lookups)
+		}
+
+		// Unknown cookies are not cached
+		inner.lookups = 0
+		db.GetCookieToken("does not exist")
+		db.GetCookieToken("does not exist")
+		if inner.lookups != 2 {
+			t.Errorf("Expected 2 lookups for an unknown cookie, got %v", inner.lookups)
+		}
+	})
+
+	t.Run("Lookups do not wait for the version check", func(t *testing.T) {
+		inner := &slowVersionDatabase{Database: NewMapBasedDatabase()}
+		db := NewCachedDatabase(inner, 2, time.Minute)
+		db.AddUser(userID)
+		c, _ := db.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: "cde"})
+		db.GetCookieToken(c)
+
+		// The next lookup checks the version, which takes long
+		db.versionCheckedAt = time.Time{}
+		inner.entered, inner.release = make(chan struct{}), make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			db.GetCookieToken(c)
+			close(done)
+		}()
+		<-inner.entered
+
+		result := make(chan *CookieToken)
+		go func() { result <- db.GetCookieToken(c) }()
+		select {
+		case ct := <-result:
+			if ct == nil || ct.UserID != userID {
+				t.Errorf("Got wrong cookie from the cache, %#v", ct)
+			}
+		case <-time.After(time.Second):
+			t.Error("Lookup waited for the version check of another")
+		}
+		close(inner.release)
+		<-done
+	})
+
+	t.Run("Lookups expire", func(t *testing.T) {
+		inner := &countingDatabase{Database: NewMapBasedDatabase()}
+		db := NewCachedDatabase(inner, 2, 10*time.Millisecond)
+		c, _ := db.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: "cde"})
+
+		db.GetCookieToken(c)
+		time.Sleep(20 * time.Millisecond)
+		db.GetCookieToken(c)
+		if inner.lookups != 2 {
+			t.Errorf("Expected 2 lookups in the database, got %v", inner.lookups)
+		}
+	})
+
+	t.Run("Changes are not cached", func(t *testing.T) {
+		db := NewCachedDatabase(NewMapBasedDatabase(), 10, time.Minute)
+		db.AddUser(userID)
+		c, _ := db.NewCookieToken(CookieToken{UserID: userID, IsValidated: false, BrowserContext: "cde"})
+		code, _ := db.NewLoginCode(c, time.Minute)
+
+		db.GetCookieToken(c)
+		db.ValidateLoginCode(c, code)
+		if ct := db.GetCookieToken(c); ct == nil || !ct.IsValidated {
+			t.Errorf("Cookie not validated after using its code, %#v", ct)
+		}
+		db.DeleteCookieToken(c)
+		if ct := db.GetCookieToken(c); ct != nil {
+			t.Errorf("Cookie still exists after being deleted, %#v", ct)
+		}
+
+		c, _ = db.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: "cde"})
+		db.GetCookieToken(c)
+		db.DelUser(userID)
+		if ct := db.GetCookieToken(c); ct != nil {
+			t.Errorf("Cookie still exists after deleting its user, %#v", ct)
+		}
+	})
+
+	t.Run("Changes by other processes are noticed", func(t *testing.T) {
+		defer func(interval time.Duration) { cookieVersionInterval = interval }(cookieVersionInterval)
+		cookieVersionInterval = 10 * time.Millisecond
+
+		disk := testSetup()
+		defer testTeardown(disk)
+		other := NewDiskBackedDatabase(disk.config, log.New(ioutil.Discard, "", log.LstdFlags))
+		defer other.Close()
+
+		db := NewCachedDatabase(disk, 10, time.Minute)
+		db.AddUser(userID)
+		c, _ := db.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: "cde"})
+		db.GetCookieToken(c)
+
+		other.DelUser(userID)
+		time.Sleep(20 * time.Millisecond)
+		if ct := db.GetCookieToken(c); ct != nil {
+			t.Errorf("Cookie still exists after another process deleted its user, %#v", ct)
+		}
+	})
+}
+
+func BenchmarkGetCookieToken(b *testing.B) {
+	disk := testSetup()
+	defer testTeardown(disk)
+	disk.AddUser(UserID("test"))
+	c, _ := disk.NewCookieToken(CookieToken{UserID: UserID("test"), IsValidated: true, BrowserContext: "cde"})
+
+	for _, bench := range []struct {
+		name string
+		db   Database
+	}{
+		{"Disk backed db", disk},
+		{"Cached disk backed db", NewCachedDatabase(disk, cookieCacheSize, cookieCacheTTL)},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if bench.db.GetCookieToken(c) == nil {
+					b.Fatal("Cookie not found")
+				}
+				bench.db.TouchCookieToken(c)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+// Package caddyplugin registers auth-by-email as a plugin for Caddy v1. Import it
+// for its side effects in your Caddy main package.
+//
+// See README.md for general usage information.
+package caddyplugin
+
+import (
+	"github.com/TNO/auth-by-email/auth-by-email"
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+)
+
+// init is called at Caddy's startup, and registers our plugin
+func init() {
+	caddy.RegisterPlugin("authbyemail", caddy.Plugin{
+		ServerType: "http",
+		Action:     setup,
+	})
+}
+
+// setup initialises our plugin. This entails parsing our block in the
+// Caddyfile, and then registering our handler as "http middleware".
+func setup(c *caddy.Controller) error {
+	config, err := NewConfigFromCaddy(c)
+	if err != nil {
+		return err
+	}
+
+	httpserver.GetConfig(c).AddMiddleware(func(next httpserver.Handler) httpserver.Handler {
+		return authbyemail.NewHandler(next, config)
+	})
+
+	return nil
+}
+
+// NewConfigFromCaddy parses the caddyfile, and populates a new Config with
+// values found there. It returns an error if these values are erroneous, or
+// if mandatory parameters were not given.
+func NewConfigFromCaddy(c *caddy.Controller) (*authbyemail.Config, error) {
+	config := authbyemail.NewConfig()
+
+	// Initialise options we can find out by ourselves
+	config.FilesystemRoot = httpserver.GetConfig(c).Root
+	config.SiteURL = httpserver.GetConfig(c).Addr.String()
+
+	// Check that mandatory parameters were found
+	if config.FilesystemRoot == "" {
+		return nil, c.Err("Error finding out the filesystem root from Caddy")
+	}
+	if config.SiteURL == "" {
+		return nil, c.Err("Error finding out the site URL from Caddy")
+	}
+
+	// Process options from the Caddyfile
+	c.Next() // Skip "authbyemail" literal
+
+	if len(c.RemainingArgs()) > 1 {
+		return nil, c.Err("Unexpected `" + c.Val() + "` after `authbyemail` keyword. Open a block {} instead.")
+	}
+
+	for c.NextBlock() {
+		if c.Val() == "adminroutes" {
+			if err := parseAdminRoutes(c, config); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := config.ParseDirective(c.Val(), c.RemainingArgs()); err != nil {
+			return nil, c.Err(err.Error())
+		}
+	}
+
+	// Check that mandatory parameters were given
+	if err := config.Validate(); err != nil {
+		return nil, c.Err(err.Error())
+	}
+
+	return config, nil
+}
+
+// parseAdminRoutes parses a block of admin routes, which holds one `adminroute` per
+// line, like
+//
+//	adminroutes {
+//	    *.example.com  sysadmin@example.com
+//	    partner.org    approvals 2 sysadmin@example.com liaison@partner.org
+//	    *              sysadmin@example.com
+//	}
+func parseAdminRoutes(c *caddy.Controller, config *authbyemail.Config) error {
+	if !c.NextArg() || c.Val() != "{" {
+		return c.Err("Please open a block {} after `adminroutes`, with a domain pattern and admins on each line")
+	}
+	for c.Next() {
+		if c.Val() == "}" {
+			return nil
+		}
+		if err := config.ParseDirective("adminroute", append([]string{c.Val()}, c.RemainingArgs()...)); err != nil {
+			return c.Err(err.Error())
+		}
+	}
+	return c.EOFErr()
+}
@@ -0,0 +1,446 @@
+// Package caddyv2 registers auth-by-email as the http.handlers.authbyemail module for
+// Caddy v2. Import it for its side effects in your Caddy main package, or build Caddy
+// with xcaddy.
+//
+// See README.md for general usage information.
+package caddyv2
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/TNO/auth-by-email/auth-by-email"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// init is called at Caddy's startup, and registers our module and its Caddyfile directive
+func init() {
+	caddy.RegisterModule(AuthByEmail{})
+	httpcaddyfile.RegisterHandlerDirective("authbyemail", parseCaddyfile)
+	httpcaddyfile.RegisterDirectiveOrder("authbyemail", httpcaddyfile.Before, "basic_auth")
+}
+
+// AuthByEmail is the Caddy v2 module. Its fields are the parameters of the `authbyemail`
+// Caddyfile block, which are described in README.md.
+type AuthByEmail struct {
+	SiteName         string            `json:"site_name,omitempty"`
+	SiteURL          string            `json:"site_url,omitempty"`
+	Root             string            `json:"root,omitempty"`
+	Admins           []string          `json:"admins,omitempty"`
+	AdminRoutes      []AdminRoute      `json:"admin_routes,omitempty"`
+	WhitelistDomains []string          `json:"whitelist_domains,omitempty"`
+	BlockDomains     []string          `json:"block_domains,omitempty"`
+	MailerFrom       string            `json:"mailer_from,omitempty"`
+	Database         string            `json:"database,omitempty"`
+	Unprotected      []string          `json:"unprotected,omitempty"`
+	Redirect         string            `json:"redirect,omitempty"`
+	CookieValidity   caddy.Duration    `json:"cookie_validity,omitempty"`
+	QRLogin          bool              `json:"qr_login,omitempty"`
+	APITokens        map[string]string `json:"api_tokens,omitempty"`
+	GroupRules       []GroupRule       `json:"group_rules,omitempty"`
+	IdentityHeaders  bool              `json:"identity_headers,omitempty"`
+	CookieDomain     string            `json:"cookie_domain,omitempty"`
+
+	// Enables personal access tokens, which can be valid for at most the given duration
+	AccessTokens           bool           `json:"access_tokens,omitempty"`
+	MaxAccessTokenValidity caddy.Duration `json:"max_access_token_validity,omitempty"`
+
+	// Enables signed session tokens, which are checked against the database after the
+	// given duration
+	SessionTokens        bool           `json:"session_tokens,omitempty"`
+	SessionTokenValidity caddy.Duration `json:"session_token_validity,omitempty"`
+
+	// Limits on logging in, like `ratelimit`. A nil ResendCooldown keeps the default.
+	LoginRateLimits   []LoginRateLimit `json:"login_rate_limits,omitempty"`
+	ResendCooldown    *caddy.Duration  `json:"resend_cooldown,omitempty"`
+	PersistRateLimits bool             `json:"persist_rate_limits,omitempty"`
+
+	// A challenge the login form must answer, like `challenge`
+	Challenge *LoginChallenge `json:"challenge,omitempty"`
+
+	// Websites that may use us to log in their users, as an OpenID Connect provider
+	OIDCClients []OIDCClient `json:"oidc_clients,omitempty"`
+
+	config  *authbyemail.Config
+	handler *authbyemail.AuthByEmailHandler
+}
+
+// An AdminRoute asks the given admins to approve users matching the pattern, like
+// `adminroute`. The pattern "*" is the fallback for users matching no other route.
+// New users are let in once Approvals of the admins approved them, by default one.
+type AdminRoute struct {
+	Users     string   `json:"users"`
+	Admins    []string `json:"admins"`
+	Approvals int      `json:"approvals,omitempty"`
+}
+
+// newAdminRoute makes an AdminRoute from the arguments of a valid `adminroute`.
+func newAdminRoute(args []string) AdminRoute {
+	route := AdminRoute{Users: args[0], Admins: args[1:]}
+	if route.Admins[0] == "approvals" {
+		route.Approvals, _ = strconv.Atoi(route.Admins[1])
+		route.Admins = route.Admins[2:]
+	}
+	return route
+}
+
+// A GroupRule restricts the given paths to members of a group, like `require group`.
+type GroupRule struct {
+	Group string   `json:"group"`
+	Paths []string `json:"paths"`
+}
+
+// A LoginRateLimit allows Count login attempts per Period, per client address (kind
+// "ip"), per e-mail address ("email") or per admin asked for approval ("admin"), like
+// `ratelimit`. It is disabled if Count is zero.
+type LoginRateLimit struct {
+	Kind   string         `json:"kind"`
+	Count  int            `json:"count,omitempty"`
+	Period caddy.Duration `json:"period,omitempty"`
+}
+
+// A LoginChallenge is a proof of work (type "pow") with the given number of bits, or a
+// captcha of type "hcaptcha" or "turnstile", like `challenge`. Bits and VerifyURL are
+// optional.
+type LoginChallenge struct {
+	Type      string `json:"type"`
+	Bits      int    `json:"bits,omitempty"`
+	SiteKey   string `json:"site_key,omitempty"`
+	Secret    string `json:"secret,omitempty"`
+	VerifyURL string `json:"verify_url,omitempty"`
+}
+
+// An OIDCClient is a website that may use us as its OpenID Connect provider, like
+// `oidcclient`. Public clients have no secret.
+type OIDCClient struct {
+	ID           string   `json:"id"`
+	Secret       string   `json:"secret,omitempty"`
+	RedirectURIs []string `json:"redirect_uris"`
+}
+
+// CaddyModule returns the Caddy module information.
+func (AuthByEmail) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.authbyemail",
+		New: func() caddy.Module { return new(AuthByEmail) },
+	}
+}
+
+// directives lists the parameters as they would appear in an `authbyemail` block, so
+// that they are checked and processed by the same code as for Caddy v1.
+func (m *AuthByEmail) directives() [][]string {
+	var directives [][]string
+	add := func(name string, args ...string) {
+		directives = append(directives, append([]string{name}, args...))
+	}
+
+	if m.SiteName != "" {
+		add("sitename", m.SiteName)
+	}
+	if m.SiteURL != "" {
+		add("siteurl", m.SiteURL)
+	}
+	if m.Root != "" {
+		add("root", m.Root)
+	}
+	if len(m.Admins) > 0 {
+		add("admin", m.Admins...)
+	}
+	for _, route := range m.AdminRoutes {
+		args := []string{route.Users}
+		if route.Approvals > 0 {
+			args = append(args, "approvals", strconv.Itoa(route.Approvals))
+		}
+		add("adminroute", append(args, route.Admins...)...)
+	}
+	if len(m.WhitelistDomains) > 0 {
+		add("whitelistdomains", m.WhitelistDomains...)
+	}
+	if len(m.BlockDomains) > 0 {
+		add("blockdomains", m.BlockDomains...)
+	}
+	if m.MailerFrom != "" {
+		add("mailerfrom", m.MailerFrom)
+	}
+	if m.Database != "" {
+		add("database", m.Database)
+	}
+	if len(m.Unprotected) > 0 {
+		add("unprotected", m.Unprotected...)
+	}
+	if m.Redirect != "" {
+		add("redirect", m.Redirect)
+	}
+	if m.CookieValidity != 0 {
+		add("cookievalidity", strconv.FormatInt(int64(time.Duration(m.CookieValidity)/time.Second), 10))
+	}
+	if m.QRLogin {
+		add("qrlogin")
+	}
+	for name, token := range m.APITokens {
+		add("apitoken", name, token)
+	}
+	for _, rule := range m.GroupRules {
+		add("require", append([]string{"group", rule.Group}, rule.Paths...)...)
+	}
+	if m.IdentityHeaders {
+		add("identityheaders")
+	}
+	if m.CookieDomain != "" {
+		add("cookiedomain", m.CookieDomain)
+	}
+	if m.AccessTokens && m.MaxAccessTokenValidity != 0 {
+		add("accesstokens", strconv.FormatInt(int64(time.Duration(m.MaxAccessTokenValidity)/(24*time.Hour)), 10))
+	} else if m.AccessTokens {
+		add("accesstokens")
+	}
+	if m.SessionTokens && m.SessionTokenValidity != 0 {
+		add("sessiontokens", strconv.FormatInt(int64(time.Duration(m.SessionTokenValidity)/time.Second), 10))
+	} else if m.SessionTokens {
+		add("sessiontokens")
+	}
+	for _, limit := range m.LoginRateLimits {
+		if limit.Count == 0 {
+			add("ratelimit", limit.Kind, "off")
+		} else {
+			add("ratelimit", limit.Kind, strconv.Itoa(limit.Count), strconv.FormatInt(int64(time.Duration(limit.Period)/time.Second), 10))
+		}
+	}
+	if m.ResendCooldown != nil {
+		add("ratelimit", "cooldown", strconv.FormatInt(int64(time.Duration(*m.ResendCooldown)/time.Second), 10))
+	}
+	if m.PersistRateLimits {
+		add("ratelimit", "persist")
+	}
+	if c := m.Challenge; c != nil {
+		switch {
+		case c.Type == "pow" && c.Bits != 0:
+			add("challenge", c.Type, strconv.Itoa(c.Bits))
+		case c.Type == "pow":
+			add("challenge", c.Type)
+		case c.VerifyURL != "":
+			add("challenge", c.Type, c.SiteKey, c.Secret, c.VerifyURL)
+		default:
+			add("challenge", c.Type, c.SiteKey, c.Secret)
+		}
+	}
+	for _, client := range m.OIDCClients {
+		secret := client.Secret
+		if secret == "" {
+			secret = "-"
+		}
+		add("oidcclient", append([]string{client.ID, secret}, client.RedirectURIs...)...)
+	}
+	return directives
+}
+
+// Provision processes the parameters, and initialises the handler with its database
+// and mailer.
+func (m *AuthByEmail) Provision(ctx caddy.Context) (err error) {
+	m.config = authbyemail.NewConfig()
+	for _, directive := range m.directives() {
+		if err := m.config.ParseDirective(directive[0], directive[1:]); err != nil {
+			return err
+		}
+	}
+
+	// NewHandler panics if it can not initialise its parts, which would take Caddy down
+	// with it during a reload.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("could not initialise auth-by-email: %v", r)
+		}
+	}()
+	handler := authbyemail.NewHandler(nil, m.config)
+	m.handler = &handler
+	return nil
+}
+
+// Validate checks that the mandatory parameters were given.
+func (m *AuthByEmail) Validate() error {
+	return m.config.Validate()
+}
+
+// Cleanup releases the database when Caddy stops using this configuration.
+func (m *AuthByEmail) Cleanup() error {
+	if m.handler == nil {
+		return nil
+	}
+	return m.handler.Close()
+}
+
+// ServeHTTP serves the request with our handler, which passes it on to next if the
+// user may see it.
+func (m *AuthByEmail) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	var nextErr error
+	h := *m.handler
+	h.Next = nextHandler(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		nextErr = next.ServeHTTP(w, r)
+		return 0, nil
+	})
+
+	status, err := h.ServeHTTP(w, r)
+	if nextErr != nil {
+		return nextErr
+	}
+	if status != 0 {
+		// Let Caddy write the error page, as it did in v1
+		return caddyhttp.Error(status, err)
+	}
+	return nil
+}
+
+// nextHandler turns a function into an authbyemail.Handler.
+type nextHandler func(http.ResponseWriter, *http.Request) (int, error)
+
+func (n nextHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	return n(w, r)
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens, which look like
+//
+//	authbyemail {
+//	    sitename My Cool Site
+//	    siteurl https://example.com
+//	    mailerfrom sysadmin@example.com
+//	    ...
+//	}
+//
+// The parameters are the same as for Caddy v1, with siteurl now being mandatory.
+func (m *AuthByEmail) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip "authbyemail" literal
+	if d.NextArg() {
+		return d.Errf("Unexpected `%v` after `authbyemail` keyword. Open a block {} instead.", d.Val())
+	}
+
+	for d.NextBlock(0) {
+		name, args := d.Val(), d.RemainingArgs()
+
+		// A block of admin routes holds one `adminroute` per line
+		if name == "adminroutes" && len(args) == 0 {
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				route := append([]string{d.Val()}, d.RemainingArgs()...)
+				if err := authbyemail.NewConfig().ParseDirective("adminroute", route); err != nil {
+					return d.Err(err.Error())
+				}
+				m.AdminRoutes = append(m.AdminRoutes, newAdminRoute(route))
+			}
+			continue
+		}
+
+		// Check the arguments like Caddy v1 would, so that the errors point at the Caddyfile
+		if err := authbyemail.NewConfig().ParseDirective(name, args); err != nil {
+			return d.Err(err.Error())
+		}
+
+		switch name {
+		case "sitename":
+			m.SiteName = strings.Join(args, " ")
+		case "siteurl":
+			m.SiteURL = args[0]
+		case "root":
+			m.Root = args[0]
+		case "admin":
+			m.Admins = args
+		case "adminroute":
+			m.AdminRoutes = append(m.AdminRoutes, newAdminRoute(args))
+		case "whitelistdomains":
+			m.WhitelistDomains = append(m.WhitelistDomains, args...)
+		case "blockdomains":
+			m.BlockDomains = append(m.BlockDomains, args...)
+		case "mailerfrom":
+			m.MailerFrom = args[0]
+		case "database":
+			m.Database = args[0]
+		case "unprotected":
+			m.Unprotected = args
+		case "redirect":
+			m.Redirect = args[0]
+		case "cookievalidity":
+			seconds, _ := strconv.ParseUint(args[0], 10, 32)
+			m.CookieValidity = caddy.Duration(time.Duration(seconds) * time.Second)
+		case "qrlogin":
+			m.QRLogin = true
+		case "apitoken":
+			if m.APITokens == nil {
+				m.APITokens = make(map[string]string)
+			}
+			m.APITokens[args[0]] = args[1]
+		case "require":
+			m.GroupRules = append(m.GroupRules, GroupRule{Group: args[1], Paths: args[2:]})
+		case "identityheaders":
+			m.IdentityHeaders = true
+		case "cookiedomain":
+			m.CookieDomain = args[0]
+		case "accesstokens":
+			m.AccessTokens = true
+			if len(args) == 1 {
+				days, _ := strconv.ParseUint(args[0], 10, 16)
+				m.MaxAccessTokenValidity = caddy.Duration(time.Duration(days*24) * time.Hour)
+			}
+		case "sessiontokens":
+			m.SessionTokens = true
+			if len(args) == 1 {
+				seconds, _ := strconv.ParseUint(args[0], 10, 32)
+				m.SessionTokenValidity = caddy.Duration(time.Duration(seconds) * time.Second)
+			}
+		case "ratelimit":
+			switch {
+			case args[0] == "persist":
+				m.PersistRateLimits = true
+			case args[0] == "cooldown":
+				seconds, _ := strconv.ParseUint(args[1], 10, 32)
+				cooldown := caddy.Duration(time.Duration(seconds) * time.Second)
+				m.ResendCooldown = &cooldown
+			case args[1] == "off":
+				m.LoginRateLimits = append(m.LoginRateLimits, LoginRateLimit{Kind: args[0]})
+			default:
+				count, _ := strconv.Atoi(args[1])
+				seconds, _ := strconv.ParseUint(args[2], 10, 32)
+				m.LoginRateLimits = append(m.LoginRateLimits, LoginRateLimit{Kind: args[0], Count: count, Period: caddy.Duration(time.Duration(seconds) * time.Second)})
+			}
+		case "challenge":
+			m.Challenge = &LoginChallenge{Type: args[0]}
+			if args[0] == "pow" && len(args) == 2 {
+				m.Challenge.Bits, _ = strconv.Atoi(args[1])
+			} else if args[0] != "pow" {
+				m.Challenge.SiteKey, m.Challenge.Secret = args[1], args[2]
+				if len(args) == 4 {
+					m.Challenge.VerifyURL = args[3]
+				}
+			}
+		case "oidcclient":
+			client := OIDCClient{ID: args[0], Secret: args[1], RedirectURIs: args[2:]}
+			if client.Secret == "-" {
+				client.Secret = ""
+			}
+			m.OIDCClients = append(m.OIDCClients, client)
+		default:
+			return d.Errf("The parameter %v is not supported with Caddy v2", name)
+		}
+	}
+
+	return nil
+}
+
+// parseCaddyfile unmarshals the `authbyemail` directive into a handler.
+func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	m := new(AuthByEmail)
+	err := m.UnmarshalCaddyfile(h.Dispenser)
+	return m, err
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*AuthByEmail)(nil)
+	_ caddy.Validator             = (*AuthByEmail)(nil)
+	_ caddy.CleanerUpper          = (*AuthByEmail)(nil)
+	_ caddyhttp.MiddlewareHandler = (*AuthByEmail)(nil)
+	_ caddyfile.Unmarshaler       = (*AuthByEmail)(nil)
+)
@@ -0,0 +1,166 @@
+package caddyv2
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestUnmarshalCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	authbyemail {
+		sitename My Cool Site
+		siteurl https://example.com/
+		admin sysadmin@example.com sysadmin@domain.org
+		adminroutes {
+			*.example.com sysadmin@example.com
+			* sysadmin@example.com sysadmin@domain.org
+		}
+		adminroute partner.org approvals 2 liaison@partner.org sysadmin@example.com
+		blockdomains mailinator.com *.spam.example.com
+		mailerfrom sysadmin@example.com
+		cookievalidity 1296000
+		qrlogin
+		require group finance /reports/*
+		accesstokens 90
+		sessiontokens 60
+		ratelimit ip 100 3600
+		ratelimit admin off
+		ratelimit cooldown 0
+		challenge pow 20
+		oidcclient app - https://app.example.com/callback
+	}`)
+
+	m := new(AuthByEmail)
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("Could not parse a valid Caddyfile: %v", err)
+	}
+	if m.SiteName != "My Cool Site" || len(m.Admins) != 2 || !m.QRLogin {
+		t.Errorf("Parameters were not set from the Caddyfile: %#v", m)
+	}
+
+	// The parameters should be turned back into the same directives
+	expected := [][]string{
+		{"sitename", "My Cool Site"},
+		{"siteurl", "https://example.com/"},
+		{"admin", "sysadmin@example.com", "sysadmin@domain.org"},
+		{"adminroute", "*.example.com", "sysadmin@example.com"},
+		{"adminroute", "*", "sysadmin@example.com", "sysadmin@domain.org"},
+		{"adminroute", "partner.org", "approvals", "2", "liaison@partner.org", "sysadmin@example.com"},
+		{"blockdomains", "mailinator.com", "*.spam.example.com"},
+		{"mailerfrom", "sysadmin@example.com"},
+		{"cookievalidity", "1296000"},
+		{"qrlogin"},
+		{"require", "group", "finance", "/reports/*"},
+		{"accesstokens", "90"},
+		{"sessiontokens", "60"},
+		{"ratelimit", "ip", "100", "3600"},
+		{"ratelimit", "admin", "off"},
+		{"ratelimit", "cooldown", "0"},
+		{"challenge", "pow", "20"},
+		{"oidcclient", "app", "-", "https://app.example.com/callback"},
+	}
+	if directives := m.directives(); !reflect.DeepEqual(directives, expected) {
+		t.Errorf("Expected directives %v, got %v", expected, directives)
+	}
+}
+
+func TestUnmarshalCaddyfileErrors(t *testing.T) {
+	for _, input := range []string{
+		`authbyemail extra { }`,
+		`authbyemail { unknownparameter }`,
+		`authbyemail { cookievalidity soon }`,
+		`authbyemail { require finance /reports }`,
+		`authbyemail { oidcclient app - }`,
+		`authbyemail { ratelimit ip 100 }`,
+		`authbyemail { challenge pow many }`,
+		"authbyemail {\n adminroutes {\n partner.org nobody\n }\n}",
+	} {
+		m := new(AuthByEmail)
+		if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input)); err == nil {
+			t.Errorf("No error for invalid Caddyfile `%v`", input)
+		}
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	os.Setenv("AUTH_BY_EMAIL_KEY", "1234567890123456789012345678901212345678901234567890123456789012")
+	os.Setenv("SENDINBLUE_API_KEY", "not used") // The mailer is not used in this test
+
+	m := &AuthByEmail{
+		SiteName:    "Test",
+		SiteURL:     "http://example.com",
+		MailerFrom:  "admin@example.com",
+		Unprotected: []string{"public", "broken"},
+	}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Could not provision: %v", err)
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatalf("Valid configuration was rejected: %v", err)
+	}
+	defer m.Cleanup()
+
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if r.URL.Path == "/broken" {
+			return errors.New("Broken page")
+		}
+		fmt.Fprintf(w, "Page")
+		return nil
+	})
+
+	test := func(t *testing.T, path string, desiredStatus int, desiredBody string, desiredErrorStatus int) {
+		w := httptest.NewRecorder()
+		err := m.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com"+path, nil), next)
+
+		var handlerErr caddyhttp.HandlerError
+		if errors.As(err, &handlerErr) {
+			if handlerErr.StatusCode != desiredErrorStatus {
+				t.Errorf("Request of %v should give error %v but gave %v", path, desiredErrorStatus, handlerErr.StatusCode)
+			}
+		} else if (err != nil) != (desiredErrorStatus != 0) {
+			t.Errorf("Request of %v gave unexpected error %v", path, err)
+		}
+		if desiredStatus != 0 && w.Result().StatusCode != desiredStatus {
+			t.Errorf("Request of %v should be %v but was %v", path, desiredStatus, w.Result().StatusCode)
+		}
+		if desiredBody != "" && w.Body.String() != desiredBody {
+			t.Errorf("Request of %v should serve %q but served %q", path, desiredBody, w.Body.String())
+		}
+	}
+
+	t.Run("Protected path", func(t *testing.T) {
+		test(t, "/", 403, "", 0)
+	})
+
+	t.Run("Unprotected path", func(t *testing.T) {
+		test(t, "/public", 200, "Page", 0)
+	})
+
+	t.Run("Errors of the next handler are passed on", func(t *testing.T) {
+		test(t, "/broken", 0, "", -1)
+	})
+
+	t.Run("Our own endpoints", func(t *testing.T) {
+		test(t, "/auth/etc", 404, "", 0)
+	})
+}
+
+func TestValidate(t *testing.T) {
+	m := &AuthByEmail{SiteName: "Test", MailerFrom: "admin@example.com"}
+	if err := m.Provision(caddy.Context{}); err != nil {
+		t.Fatalf("Could not provision: %v", err)
+	}
+	defer m.Cleanup()
+	if err := m.Validate(); err == nil {
+		t.Errorf("A configuration without site_url was accepted")
+	}
+}
@@ -0,0 +1,205 @@
+package authbyemail
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"math/bits"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Challenge keeps bots from asking for log-in links, by making the login form ask
+// something of the browser that is hard for a bot to do. It is set with the `challenge`
+// directive, but programs using this package may also set their own in the Config.
+type Challenge interface {
+	// Describe tells the script on the login page (see /auth/challenge.js) what to ask
+	// of the browser. It is called for every login page that is shown.
+	Describe() (ChallengeDescription, error)
+
+	// Verify checks the answer in a posted login form, and returns an error if it is
+	// missing or wrong.
+	Verify(r *http.Request) error
+}
+
+// A ChallengeDescription is sent as JSON by /auth/challenge. Type "pow" asks for a
+// proof of work, and type "captcha" for a widget of an outside service.
+type ChallengeDescription struct {
+	Type string `json:"type"`
+
+	// For a proof of work: a nonce must be found for the challenge, such that the SHA-256
+	// hash of "<challenge>:<nonce>" starts with the given number of zero bits.
+	Challenge string `json:"challenge,omitempty"`
+	Bits      int    `json:"bits,omitempty"`
+
+	// For a captcha: the script of the service, which makes the elements with the given
+	// class into widgets, and the key of our site at the service.
+	Script  string `json:"script,omitempty"`
+	Class   string `json:"class,omitempty"`
+	SiteKey string `json:"sitekey,omitempty"`
+}
+
+// The default difficulty of a proof of work, which takes a second or so in a browser,
+// and how long a browser may take to solve it.
+const (
+	defaultProofOfWorkBits = 18
+	proofOfWorkValidity    = 10 * time.Minute
+)
+
+// A ProofOfWork is a hashcash-style challenge, which is made and verified by ourselves.
+// Challenges are signed rather than stored, so any process can verify them. Each can
+// only be used once, which is remembered in memory until it expires.
+type ProofOfWork struct {
+	Bits int
+
+	mutex sync.Mutex
+	used  map[string]time.Time
+}
+
+// NewProofOfWork returns a ProofOfWork asking for the given number of zero bits.
+func NewProofOfWork(bits int) *ProofOfWork {
+	return &ProofOfWork{Bits: bits, used: make(map[string]time.Time)}
+}
+
+// Describe makes a new challenge, like "<expiry>.<random>.<hmac>".
+func (p *ProofOfWork) Describe() (ChallengeDescription, error) {
+	payload := strconv.FormatInt(time.Now().Add(proofOfWorkValidity).Unix(), 10) + "." + newRandom()
+	return ChallengeDescription{
+		Type:      "pow",
+		Challenge: payload + "." + CRYPTO.computeHmac([]byte("pow/"+payload)),
+		Bits:      p.Bits,
+	}, nil
+}
+
+// Verify checks the form fields `challenge` and `nonce`.
+func (p *ProofOfWork) Verify(r *http.Request) error {
+	challenge, nonce := r.PostFormValue("challenge"), r.PostFormValue("nonce")
+	if challenge == "" || nonce == "" || len(nonce) > 32 {
+		return errors.New("No proof of work was given")
+	}
+
+	dot := strings.LastIndex(challenge, ".")
+	if dot < 0 || !hmac.Equal([]byte(challenge[dot+1:]), []byte(CRYPTO.computeHmac([]byte("pow/"+challenge[:dot])))) {
+		return errors.New("The proof of work is for a challenge we did not make")
+	}
+	unix, err := strconv.ParseInt(strings.SplitN(challenge, ".", 2)[0], 10, 64)
+	if err != nil {
+		return errors.New("The proof of work is for a challenge we did not make")
+	}
+	expiresAt := time.Unix(unix, 0)
+	if time.Now().After(expiresAt) {
+		return errors.New("The proof of work is for an expired challenge")
+	}
+
+	if leadingZeroBits(sha256.Sum256([]byte(challenge+":"+nonce))) < p.Bits {
+		return errors.New("The proof of work does not solve the challenge")
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	now := time.Now()
+	for used, expiry := range p.used {
+		if now.After(expiry) {
+			delete(p.used, used)
+		}
+	}
+	if _, ok := p.used[challenge]; ok {
+		return errors.New("The proof of work was used before")
+	}
+	p.used[challenge] = expiresAt
+	return nil
+}
+
+// leadingZeroBits counts the zero bits at the start of a hash.
+func leadingZeroBits(hash [sha256.Size]byte) int {
+	zeros := 0
+	for _, b := range hash {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros
+}
+
+// A CaptchaVerifier lets an outside service like hCaptcha or Cloudflare Turnstile show
+// a widget in the login form, and asks the service whether its answer is right. Any
+// service with the same siteverify API can be used by filling in the fields.
+type CaptchaVerifier struct {
+	SiteKey string
+	Secret  string
+
+	// The service's script, which makes the elements with WidgetClass into widgets that
+	// put their answer in the form field ResponseField
+	ScriptURL     string
+	WidgetClass   string
+	ResponseField string
+
+	// Where the answers are checked, and the client used for that
+	VerifyURL string
+	Client    *http.Client
+}
+
+// NewCaptchaVerifier returns a CaptchaVerifier for the named service, which is
+// "hcaptcha" or "turnstile".
+func NewCaptchaVerifier(service, siteKey, secret string) (*CaptchaVerifier, error) {
+	v := &CaptchaVerifier{SiteKey: siteKey, Secret: secret, Client: &http.Client{Timeout: 10 * time.Second}}
+	switch service {
+	case "hcaptcha":
+		v.ScriptURL = "https://js.hcaptcha.com/1/api.js"
+		v.WidgetClass = "h-captcha"
+		v.ResponseField = "h-captcha-response"
+		v.VerifyURL = "https://api.hcaptcha.com/siteverify"
+	case "turnstile":
+		v.ScriptURL = "https://challenges.cloudflare.com/turnstile/v0/api.js"
+		v.WidgetClass = "cf-turnstile"
+		v.ResponseField = "cf-turnstile-response"
+		v.VerifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+	default:
+		return nil, errors.New("Unknown captcha service " + service + ", please use hcaptcha or turnstile")
+	}
+	return v, nil
+}
+
+func (v *CaptchaVerifier) Describe() (ChallengeDescription, error) {
+	return ChallengeDescription{Type: "captcha", Script: v.ScriptURL, Class: v.WidgetClass, SiteKey: v.SiteKey}, nil
+}
+
+// Verify sends the answer in the form to the service, with the address of the client.
+func (v *CaptchaVerifier) Verify(r *http.Request) error {
+	response := r.PostFormValue(v.ResponseField)
+	if response == "" {
+		return errors.New("No captcha was solved")
+	}
+
+	form := url.Values{"secret": {v.Secret}, "response": {response}, "sitekey": {v.SiteKey}}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		form.Set("remoteip", host)
+	}
+	resp, err := v.Client.PostForm(v.VerifyURL, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if resp.StatusCode != 200 {
+		return errors.New("The captcha service answered with status " + resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if !result.Success {
+		return errors.New("The captcha was not solved: " + strings.Join(result.ErrorCodes, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package authbyemail
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// solveProofOfWork does what the login page's script does for a proof of work
+func solveProofOfWork(t *testing.T, c Challenge) (string, string) {
+	description, err := c.Describe()
+	if err != nil || description.Type != "pow" {
+		t.Fatalf("Could not get a proof of work challenge, %#v %v", description, err)
+	}
+	for nonce := 0; ; nonce++ {
+		if leadingZeroBits(sha256.Sum256([]byte(description.Challenge+":"+strconv.Itoa(nonce)))) >= description.Bits {
+			return description.Challenge, strconv.Itoa(nonce)
+		}
+	}
+}
+
+// answer returns a posted login form with the given fields
+func answer(fields url.Values) *http.Request {
+	fields.Set("email", "test@example.com")
+	req := httptest.NewRequest("POST", "http://example.com/auth/login", strings.NewReader(fields.Encode()))
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = "192.0.2.1:1234"
+	return req
+}
+
+func TestProofOfWork(t *testing.T) {
+	pow := NewProofOfWork(12)
+
+	t.Run("Correct answer", func(t *testing.T) {
+		challenge, nonce := solveProofOfWork(t, pow)
+		if err := pow.Verify(answer(url.Values{"challenge": {challenge}, "nonce": {nonce}})); err != nil {
+			t.Errorf("Solved challenge not accepted, %v", err)
+		}
+		if err := pow.Verify(answer(url.Values{"challenge": {challenge}, "nonce": {nonce}})); err == nil {
+			t.Error("Solved challenge accepted twice")
+		}
+	})
+
+	t.Run("Wrong answers", func(t *testing.T) {
+		challenge, nonce := solveProofOfWork(t, pow)
+		expired := "1." + newRandom()
+		expired += "." + CRYPTO.computeHmac([]byte("pow/"+expired))
+		easy, easyNonce := solveProofOfWork(t, NewProofOfWork(1))
+		for _, fields := range []url.Values{
+			{},
+			{"challenge": {challenge}},
+			{"challenge": {challenge}, "nonce": {nonce + "1"}},
+			{"challenge": {"9999999999.abc.def"}, "nonce": {nonce}},
+			{"challenge": {strings.Replace(challenge, ".", "1.", 1)}, "nonce": {nonce}},
+			{"challenge": {expired}, "nonce": {"0"}},
+		} {
+			if err := pow.Verify(answer(fields)); err == nil {
+				t.Errorf("Wrong answer accepted, %v", fields)
+			}
+		}
+
+		// The number of bits is checked by the server, not taken from the browser
+		if err := pow.Verify(answer(url.Values{"challenge": {easy}, "nonce": {easyNonce}})); err == nil && leadingZeroBits(sha256.Sum256([]byte(easy+":"+easyNonce))) < pow.Bits {
+			t.Error("Answer to an easier challenge accepted")
+		}
+	})
+}
+
+func TestCaptchaVerifier(t *testing.T) {
+	var received url.Values
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		received = r.PostForm
+		if r.PostForm.Get("secret") == "secret" && r.PostForm.Get("response") == "right" {
+			w.Write([]byte(`{"success": true}`))
+		} else {
+			w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-response"]}`))
+		}
+	}))
+	defer stub.Close()
+
+	v, err := NewCaptchaVerifier("hcaptcha", "sitekey", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.VerifyURL = stub.URL
+
+	if description, _ := v.Describe(); description.Type != "captcha" || description.Class != "h-captcha" || description.SiteKey != "sitekey" {
+		t.Errorf("Wrong description of the captcha, %#v", description)
+	}
+	if err := v.Verify(answer(url.Values{"h-captcha-response": {"right"}})); err != nil {
+		t.Errorf("Right answer not accepted, %v", err)
+	}
+	if received.Get("remoteip") != "192.0.2.1" || received.Get("sitekey") != "sitekey" {
+		t.Errorf("The service was not told who answered, got %v", received)
+	}
+	if err := v.Verify(answer(url.Values{"h-captcha-response": {"wrong"}})); err == nil || !strings.Contains(err.Error(), "invalid-input-response") {
+		t.Errorf("Wrong answer accepted, %v", err)
+	}
+
+	received = nil
+	if err := v.Verify(answer(url.Values{})); err == nil || received != nil {
+		t.Errorf("Missing answer accepted or sent to the service, %v", err)
+	}
+
+	// If the service cannot be reached, nobody gets in
+	v.VerifyURL = "http://127.0.0.1:1/siteverify"
+	v.Client.Timeout = time.Second
+	if err := v.Verify(answer(url.Values{"h-captcha-response": {"right"}})); err == nil {
+		t.Error("Answer accepted without the service")
+	}
+
+	if _, err := NewCaptchaVerifier("recaptcha", "sitekey", "secret"); err == nil {
+		t.Error("Unknown captcha service accepted")
+	}
+}
@@ -6,14 +6,56 @@ import (
 )
 
 // checkAuthentication checks if a given (sanitised) url can be accessed without
-// a valid cookie, and if not, if a valid cookie is present. If neither is true,
-// false is returned.
-func (h AuthByEmailHandler) checkAuthentication(url string, r *http.Request) bool {
+// a valid cookie, and if not, if a valid cookie or personal access token is present.
+// If neither is true, false is returned. Otherwise, it also returns the user who sent
+// the request, if any, and whether they did so with a validated cookie, so that the
+// rest of the request does not need to look them up again. For unprotected urls, the
+// user is only looked up if the identity headers need them.
+func (h AuthByEmailHandler) checkAuthentication(url string, r *http.Request) (UserID, bool, bool) {
 	if h.isUnprotectedPath(url) {
+		if !h.config.IdentityHeaders {
+			return "", false, true
+		}
+		user, fromCookie, _ := h.requestUser(url, r)
+		return user, fromCookie, true
+	}
+
+	return h.requestUser(url, r)
+}
+
+// checkAuthorization checks if the logged-in user may access the given (sanitised) url,
+// given the group rules in the Caddyfile. If the url matches one or more rules, the user
+// must be a member of at least one of their groups. It should only be called after
+// checkAuthentication has succeeded, with the user it returned.
+func (h AuthByEmailHandler) checkAuthorization(url string, user UserID) bool {
+	if h.isUnprotectedPath(url) {
+		return true
+	}
+
+	var required []string
+	for _, rule := range h.config.GroupRules {
+		for _, p := range rule.Paths {
+			if pathMatches(url, p) {
+				required = append(required, rule.Group)
+				break
+			}
+		}
+	}
+	if len(required) == 0 {
 		return true
 	}
 
-	return h.isCookieValid(r)
+	if user == "" {
+		return false
+	}
+	for _, group := range h.database.GetUserGroups(user) {
+		for _, r := range required {
+			if group == r {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // isCookieValid checks if the request comes with a validated cookie
@@ -24,7 +66,86 @@ func (h AuthByEmailHandler) isCookieValid(r *http.Request) bool {
 	}
 
 	token := h.database.GetCookieToken(cookie)
-	return token != nil && token.IsValidated
+	if token == nil || !token.IsValidated {
+		return false
+	}
+
+	h.database.TouchCookieToken(cookie)
+	return true
+}
+
+// requestUser returns the user who sent the request for the given (sanitised) url, as
+// identified by a session token, a validated cookie or a personal access token that
+// allows the url, whether it was by the cookie, and whether there is one. It looks up
+// the cookie or token once, so it should be called once per request.
+func (h AuthByEmailHandler) requestUser(url string, r *http.Request) (UserID, bool, bool) {
+	if user, ok := h.sessionTokenUser(r); ok {
+		return user, false, true
+	}
+	if cookie := GetCookie(r); cookie != "" {
+		if token := h.database.GetCookieToken(cookie); token != nil && token.IsValidated {
+			h.database.TouchCookieToken(cookie)
+			return token.UserID, true, true
+		}
+	}
+
+	if !h.config.AccessTokens {
+		return "", false, false
+	}
+	bearer := bearerAccessToken(r)
+	if bearer == "" {
+		return "", false, false
+	}
+	accessToken := h.database.GetAccessToken(bearer)
+	if accessToken == nil || !accessToken.Allows(url) {
+		return "", false, false
+	}
+
+	// The tokens of users whose access has ended are kept, in case it is renewed
+	if !h.database.IsKnownUser(accessToken.UserID) {
+		return "", false, false
+	}
+
+	h.database.TouchAccessToken(accessToken.ID)
+	return accessToken.UserID, false, true
+}
+
+// isAdmin checks whether the given user is one of the configured admins, given with
+// admin or in one of the admin routes
+func (h AuthByEmailHandler) isAdmin(user UserID) bool {
+	if h.isGlobalAdmin(user) {
+		return true
+	}
+	for _, route := range h.config.AdminRoutes {
+		for _, adminEmail := range route.Admins {
+			if CRYPTO.UserIDfromEmail(adminEmail) == user {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isGlobalAdmin checks whether the given user is one of the admins given with admin,
+// who may manage all users
+func (h AuthByEmailHandler) isGlobalAdmin(user UserID) bool {
+	for _, adminEmail := range h.config.Admins {
+		if CRYPTO.UserIDfromEmail(adminEmail) == user {
+			return true
+		}
+	}
+	return false
+}
+
+// isAdminOf checks whether the given admin is responsible for the given user, and may
+// so decide about their access: as the admin routes say, or by domain without them.
+func (h AuthByEmailHandler) isAdminOf(admin UserID, email *EmailAddr) bool {
+	for _, adminEmail := range h.config.adminsForUser(email) {
+		if CRYPTO.UserIDfromEmail(adminEmail) == admin {
+			return true
+		}
+	}
+	return false
 }
 
 // isUnprotectedPath checks whether the given sanitised url is configured to be
@@ -32,20 +153,26 @@ func (h AuthByEmailHandler) isCookieValid(r *http.Request) bool {
 // character of an 'unprotected' path.
 func (h AuthByEmailHandler) isUnprotectedPath(url string) bool {
 	for _, p := range h.config.UnprotectedPaths {
-		if p[len(p)-1] == '*' {
-			if strings.HasPrefix(url, p[:(len(p)-1)]) {
-				return true
-			}
-		} else {
-			if p == url {
-				return true
-			}
+		if pathMatches(url, p) {
+			return true
 		}
 	}
 
 	return false
 }
 
+// pathMatches checks whether the given sanitised url matches a path from the
+// Caddyfile, which may have the wildcard '*' as its last character.
+func pathMatches(url string, p string) bool {
+	if p == "" {
+		return url == ""
+	}
+	if p[len(p)-1] == '*' {
+		return strings.HasPrefix(url, p[:(len(p)-1)])
+	}
+	return p == url
+}
+
 // GetCookie returns our cookie from this request, if applicable.
 func GetCookie(r *http.Request) string {
 	// Check the cookie. First we have to find our cookie. Each cookie header is of the form
@@ -1,18 +1,20 @@
 package authbyemail
 
 import (
+	"errors"
 	"fmt"
-	"github.com/caddyserver/caddy"
-	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 )
 
-// The Config type contains parsed configuration information from the Caddyfile.
+// The Config type contains parsed configuration information, for example from the Caddyfile.
 type Config struct {
 	Admins           []*EmailAddr
-	WhitelistDomains []string
+	AdminRoutes      []AdminRoute
+	WhitelistDomains *AddressList
+	BlockDomains     *AddressList
 	FilesystemRoot   string
 	Database         string
 	UnprotectedPaths []string
@@ -21,151 +23,510 @@ type Config struct {
 	SiteName         string
 	SiteURL          string
 	MailerFrom       *EmailAddr
+	QRLogin          bool
+	APITokens        map[string]string
+	GroupRules       []GroupRule
+	IdentityHeaders  bool
+	CookieDomain     string
+
+	AccessTokens           bool
+	MaxAccessTokenValidity time.Duration
+
+	OIDCClients []OIDCClient
+
+	SessionTokens        bool
+	SessionTokenValidity time.Duration
+
+	// Limits on login attempts per client address, per e-mail address and per admin asked
+	// for approval, and the time before another e-mail is sent to the same address.
+	LoginRateLimitIP    RateLimit
+	LoginRateLimitEmail RateLimit
+	LoginRateLimitAdmin RateLimit
+	ResendCooldown      time.Duration
+	PersistRateLimits   bool
+
+	// A challenge the login form must answer, such as a proof of work or a captcha. It
+	// is nil if there is none.
+	Challenge Challenge
+}
+
+// An AdminRoute sends the approval requests of users whose address matches Users to
+// all of the given Admins. The route for the pattern "*" has no Users; it is used for
+// users that no other route matches. New users are only let in once Approvals of the
+// admins approved them through the links in their e-mail; 0 counts as 1.
+type AdminRoute struct {
+	Users     *AddressList
+	Admins    []*EmailAddr
+	Approvals int
+}
+
+// A GroupRule restricts the given paths to members of a group. The paths are
+// sanitised like UnprotectedPaths, and may likewise end in the wildcard '*'.
+type GroupRule struct {
+	Group string
+	Paths []string
 }
 
-// newConfig returns a Config with default values. Mandatory parameters may
+// NewConfig returns a Config with default values. Mandatory parameters may
 // not be initialized, but for optional parameters, we provide sane defaults.
-func newConfig() *Config {
+func NewConfig() *Config {
 	return &Config{
-		CookieValidity: time.Duration(30*24) * time.Hour,
-		Redirect:       "/",
+		CookieValidity:         time.Duration(30*24) * time.Hour,
+		Redirect:               "/",
+		MaxAccessTokenValidity: time.Duration(365*24) * time.Hour,
+		SessionTokenValidity:   5 * time.Minute,
+		LoginRateLimitIP:       RateLimit{Count: 30, Period: time.Hour},
+		LoginRateLimitEmail:    RateLimit{Count: 5, Period: time.Hour},
+		LoginRateLimitAdmin:    RateLimit{Count: 20, Period: time.Hour},
+		ResendCooldown:         time.Minute,
 	}
 }
 
-// NewConfigFromCaddy parses the caddyfile, and populates a new Config with
-// values found there. It returns an error if these values are erroneous, or
-// if mandatory parameters were not given.
-func NewConfigFromCaddy(c *caddy.Controller) (*Config, error) {
-	config := newConfig()
+// ParseDirective processes one line of configuration, such as `admin a@example.com`
+// in a Caddyfile, given as its name and arguments. It returns an error if the
+// directive is unknown or its arguments are erroneous.
+func (c *Config) ParseDirective(name string, args []string) error {
+	switch name {
+	case "siteurl":
+		if len(args) != 1 {
+			return errors.New("Please give one (1) URL after 'siteurl'")
+		}
+		c.SiteURL = strings.TrimSuffix(args[0], "/")
 
-	// Initialise options we can find out by ourselves
-	config.FilesystemRoot = httpserver.GetConfig(c).Root
-	config.SiteURL = httpserver.GetConfig(c).Addr.String()
+	case "root":
+		if len(args) != 1 {
+			return errors.New("Please give one (1) directory after 'root'")
+		}
+		c.FilesystemRoot = args[0]
 
-	// Check that mandatory parameters were found
-	if config.FilesystemRoot == "" {
-		return nil, c.Err("Error finding out the filesystem root from Caddy")
-	}
-	if config.SiteURL == "" {
-		return nil, c.Err("Error finding out the site URL from Caddy")
-	}
+	case "admin":
+		if len(args) == 0 {
+			return errors.New("No admin e-mail addresses given after `admin` keyword. Please give at least one")
+		}
+		c.Admins = make([]*EmailAddr, len(args))
+		for i, str := range args {
+			email, err := NewEmailAddrFromString(str)
+			if err != nil {
+				return errors.New("Could not parse e-mail address " + str)
+			}
+			c.Admins[i] = email
+		}
 
-	// Process options from the Caddyfile
-	c.Next() // Skip "authbyemail" literal
+	case "adminroute":
+		if len(args) < 2 {
+			return errors.New("Please give a domain pattern (or *) and at least one admin after 'adminroute'")
+		}
+		var route AdminRoute
+		if args[0] != "*" {
+			users, err := NewAddressList(args[:1])
+			if err != nil {
+				return err
+			}
+			route.Users = users
+		}
+		admins := args[1:]
+		if admins[0] == "approvals" {
+			if len(admins) < 2 {
+				return errors.New("Please give the number of admins who must approve after 'approvals'")
+			}
+			approvals, err := strconv.Atoi(admins[1])
+			if err != nil || approvals < 1 {
+				return errors.New("Could not parse number of approvals " + admins[1])
+			}
+			route.Approvals, admins = approvals, admins[2:]
+		}
+		for _, str := range admins {
+			email, err := NewEmailAddrFromString(str)
+			if err != nil {
+				return errors.New("Could not parse e-mail address " + str)
+			}
+			route.Admins = append(route.Admins, email)
+		}
+		if len(route.Admins) == 0 || len(route.Admins) < route.Approvals {
+			return errors.New("Please give at least as many admins as approvals are needed after 'adminroute'")
+		}
+		c.AdminRoutes = append(c.AdminRoutes, route)
 
-	if len(c.RemainingArgs()) > 1 {
-		return nil, c.Err("Unexpected `" + c.Val() + "` after `authbyemail` keyword. Open a block {} instead.")
-	}
+	case "whitelistdomains":
+		if len(args) == 0 {
+			return errors.New("No domain names given after `whitelistdomains` keyword. Please give at least one")
+		}
+		if c.WhitelistDomains == nil {
+			c.WhitelistDomains, _ = NewAddressList(nil)
+		}
+		if err := c.WhitelistDomains.Add(args); err != nil {
+			return err
+		}
+
+	case "blockdomains":
+		if len(args) == 0 {
+			return errors.New("No domain names given after `blockdomains` keyword. Please give at least one")
+		}
+		if c.BlockDomains == nil {
+			c.BlockDomains, _ = NewAddressList(nil)
+		}
+		if err := c.BlockDomains.Add(args); err != nil {
+			return err
+		}
 
-	for c.NextBlock() {
-		parameter := c.Val()
-		args := c.RemainingArgs()
+	case "sitename":
+		if len(args) == 0 {
+			return errors.New("No name given after `sitename` keyword. Please give one")
+		}
+		c.SiteName = strings.Join(args, " ")
 
-		switch parameter {
+	case "database":
+		if len(args) != 1 {
+			return errors.New("Please give one (1) database filename after 'database'")
+		}
+		c.Database = args[0]
 
-		case "admin":
-			if len(args) == 0 {
-				return nil, c.Err("No admin e-mail addresses given after `admin` keyword. Please give at least one")
-			}
-			config.Admins = make([]*EmailAddr, len(args))
-			for i, str := range args {
-				email, err := NewEmailAddrFromString(str)
-				if err != nil {
-					return nil, c.Err("Could not parse e-mail address " + str)
-				}
-				config.Admins[i] = email
-			}
+	case "unprotected":
+		if len(args) == 0 {
+			return errors.New("No paths given after `unprotected` keyword. Please give at least one")
+		}
+		c.UnprotectedPaths = args
 
-		case "whitelistdomains":
-			if len(args) == 0 {
-				return nil, c.Err("No domain names given after `whitelistdomains` keyword. Please give at least one")
-			}
-			config.WhitelistDomains = args
+	case "redirect":
+		if len(args) != 1 {
+			return errors.New("Please give one (1) redirect location after 'redirect'")
+		}
+		c.Redirect = args[0]
 
-		case "sitename":
-			if len(args) == 0 {
-				return nil, c.Err("No name given after `sitename` keyword. Please give one")
-			}
-			config.SiteName = strings.Join(args, " ")
+	case "cookievalidity":
+		if len(args) != 1 {
+			return errors.New("Please give one (1) amount of seconds after 'cookievalidity'")
+		}
+		if validity, err := strconv.ParseUint(args[0], 10, 32); err != nil {
+			return fmt.Errorf("Unable to convert you argument to cookievalidity (%v) to an integer; %v", args[0], err)
+		} else if int(validity) <= 0 {
+			return errors.New("Your argument to cookievalidity was not positive when converted to a machine-sized integer")
+		} else {
+			c.CookieValidity = time.Duration(validity) * time.Second
+		}
 
-		case "database":
-			if len(args) != 1 {
-				return nil, c.Err("Please give one (1) database filename after 'database'")
+	case "mailerfrom":
+		if len(args) != 1 {
+			return errors.New("Please give one (1) e-mail address after 'mailerfrom'")
+		}
+		email, err := NewEmailAddrFromString(args[0])
+		if err != nil {
+			return errors.New("Could not parse e-mail address " + args[0])
+		}
+		c.MailerFrom = email
+
+	case "qrlogin":
+		if len(args) != 0 {
+			return errors.New("Unexpected arguments after 'qrlogin'")
+		}
+		c.QRLogin = true
+
+	case "apitoken":
+		if len(args) != 2 {
+			return errors.New("Please give a name and a token after 'apitoken'")
+		}
+		if len(args[1]) < minAPITokenLength {
+			return fmt.Errorf("The API token named %v is too short, please use at least %v characters", args[0], minAPITokenLength)
+		}
+		if c.APITokens == nil {
+			c.APITokens = make(map[string]string)
+		}
+		c.APITokens[args[0]] = args[1]
+
+	case "cookiedomain":
+		if len(args) != 1 {
+			return errors.New("Please give one (1) domain after 'cookiedomain'")
+		}
+		c.CookieDomain = strings.TrimPrefix(strings.ToLower(args[0]), ".")
+
+	case "identityheaders":
+		if len(args) != 0 {
+			return errors.New("Unexpected arguments after 'identityheaders'")
+		}
+		c.IdentityHeaders = true
+
+	case "accesstokens":
+		if len(args) > 1 {
+			return errors.New("Please give at most one (1) amount of days after 'accesstokens'")
+		}
+		if len(args) == 1 {
+			if days, err := strconv.ParseUint(args[0], 10, 16); err != nil || days == 0 {
+				return fmt.Errorf("Your argument to accesstokens (%v) is not a positive number of days", args[0])
+			} else {
+				c.MaxAccessTokenValidity = time.Duration(days*24) * time.Hour
 			}
-			config.Database = args[0]
+		}
+		c.AccessTokens = true
 
-		case "unprotected":
-			if len(args) == 0 {
-				return nil, c.Err("No paths given after `unprotected` keyword. Please give at least one")
+	case "sessiontokens":
+		if len(args) > 1 {
+			return errors.New("Please give at most one (1) amount of seconds after 'sessiontokens'")
+		}
+		if len(args) == 1 {
+			if seconds, err := strconv.ParseUint(args[0], 10, 32); err != nil || seconds == 0 {
+				return fmt.Errorf("Your argument to sessiontokens (%v) is not a positive number of seconds", args[0])
+			} else {
+				c.SessionTokenValidity = time.Duration(seconds) * time.Second
 			}
-			config.UnprotectedPaths = args
+		}
+		c.SessionTokens = true
 
-		case "redirect":
+	case "ratelimit":
+		if len(args) == 0 {
+			return errors.New("Please give a rule like `ratelimit ip|email|admin <count> <seconds>`, `ratelimit cooldown <seconds>` or `ratelimit persist`")
+		}
+		switch args[0] {
+		case "ip", "email", "admin":
+			var limit RateLimit
+			if len(args) == 2 && args[1] == "off" {
+				// The zero RateLimit is disabled
+			} else if len(args) != 3 {
+				return fmt.Errorf("Please give a number of attempts and seconds after 'ratelimit %v', or 'off'", args[0])
+			} else {
+				count, err := strconv.ParseUint(args[1], 10, 16)
+				if err != nil || count == 0 {
+					return fmt.Errorf("Your number of attempts for ratelimit %v (%v) is not a positive number", args[0], args[1])
+				}
+				seconds, err := strconv.ParseUint(args[2], 10, 32)
+				if err != nil || seconds == 0 || time.Duration(seconds)*time.Second > rateLimitMaxPeriod {
+					return fmt.Errorf("Your number of seconds for ratelimit %v (%v) is not a positive number of at most %v", args[0], args[2], int(rateLimitMaxPeriod.Seconds()))
+				}
+				limit = RateLimit{Count: int(count), Period: time.Duration(seconds) * time.Second}
+			}
+			switch args[0] {
+			case "ip":
+				c.LoginRateLimitIP = limit
+			case "email":
+				c.LoginRateLimitEmail = limit
+			case "admin":
+				c.LoginRateLimitAdmin = limit
+			}
+		case "cooldown":
+			if len(args) != 2 {
+				return errors.New("Please give one (1) amount of seconds after 'ratelimit cooldown'")
+			}
+			seconds, err := strconv.ParseUint(args[1], 10, 32)
+			if err != nil || time.Duration(seconds)*time.Second > rateLimitMaxPeriod {
+				return fmt.Errorf("Your number of seconds for ratelimit cooldown (%v) is not a number of at most %v", args[1], int(rateLimitMaxPeriod.Seconds()))
+			}
+			c.ResendCooldown = time.Duration(seconds) * time.Second
+		case "persist":
 			if len(args) != 1 {
-				return nil, c.Err("Please give one (1) redirect location after 'redirect'")
+				return errors.New("Unexpected arguments after 'ratelimit persist'")
 			}
-			config.Redirect = args[0]
+			c.PersistRateLimits = true
+		default:
+			return errors.New("Unknown rate limit " + args[0] + ", please use ip, email, admin, cooldown or persist")
+		}
 
-		case "cookievalidity":
-			if len(args) != 1 {
-				return nil, c.Err("Please give one (1) amount of seconds after 'cookievalidity'")
+	case "challenge":
+		if len(args) == 0 {
+			return errors.New("Please give a challenge like `challenge pow [bits]` or `challenge hcaptcha|turnstile <sitekey> <secret> [verifyurl]`")
+		}
+		switch args[0] {
+		case "pow":
+			if len(args) > 2 {
+				return errors.New("Please give at most one (1) number of bits after 'challenge pow'")
 			}
-			if validity, err := strconv.ParseUint(args[0], 10, 32); err != nil {
-				return nil, c.Err(fmt.Sprintf("Unable to convert you argument to cookievalidity (%v) to an integer; %v", args[0], err))
-			} else if int(validity) <= 0 {
-				return nil, c.Err("Your argument to cookievalidity was not positive when converted to a machine-sized integer")
-			} else {
-				config.CookieValidity = time.Duration(validity) * time.Second
+			bits := defaultProofOfWorkBits
+			if len(args) == 2 {
+				if n, err := strconv.ParseUint(args[1], 10, 8); err != nil || n == 0 || n > 32 {
+					return fmt.Errorf("Your number of bits for challenge pow (%v) is not a number from 1 to 32", args[1])
+				} else {
+					bits = int(n)
+				}
 			}
-
-		case "mailerfrom":
-			if len(args) != 1 {
-				return nil, c.Err("Please give one (1) e-mail address after 'mailerfrom'")
+			c.Challenge = NewProofOfWork(bits)
+		case "hcaptcha", "turnstile":
+			if len(args) != 3 && len(args) != 4 {
+				return fmt.Errorf("Please give a site key, a secret and optionally a verification URL after 'challenge %v'", args[0])
 			}
-			email, err := NewEmailAddrFromString(args[0])
-			if err != nil {
-				return nil, c.Err("Could not parse e-mail address " + args[0])
+			verifier, _ := NewCaptchaVerifier(args[0], args[1], args[2])
+			if len(args) == 4 {
+				if parsed, err := url.Parse(args[3]); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+					return errors.New("Could not parse verification URL " + args[3])
+				}
+				verifier.VerifyURL = args[3]
 			}
-			config.MailerFrom = email
-
+			c.Challenge = verifier
 		default:
-			return nil, c.Err("Unknown parameter in `authbyemail` block: " + parameter)
+			return errors.New("Unknown challenge " + args[0] + ", please use pow, hcaptcha or turnstile")
+		}
+
+	case "oidcclient":
+		if len(args) < 3 {
+			return errors.New("Please give a client ID, a secret (or - for none) and at least one redirect URI after 'oidcclient'")
 		}
+		if c.oidcClient(args[0]) != nil {
+			return errors.New("The OIDC client " + args[0] + " was given more than once")
+		}
+		client := OIDCClient{ID: args[0], Secret: args[1], RedirectURIs: args[2:]}
+		if client.Secret == "-" {
+			client.Secret = ""
+		} else if len(client.Secret) < minAPITokenLength {
+			return fmt.Errorf("The secret of OIDC client %v is too short, please use at least %v characters", args[0], minAPITokenLength)
+		}
+		for _, uri := range client.RedirectURIs {
+			if parsed, err := url.Parse(uri); err != nil || parsed.Scheme == "" || parsed.Host == "" || parsed.Fragment != "" {
+				return errors.New("Could not parse redirect URI " + uri + " of OIDC client " + args[0])
+			}
+		}
+		c.OIDCClients = append(c.OIDCClients, client)
+
+	case "require":
+		if len(args) < 3 || args[0] != "group" {
+			return errors.New("Please give a rule like `require group <name> <paths...>`")
+		}
+		if !IsValidGroupName(args[1]) {
+			return errors.New("Invalid group name " + args[1])
+		}
+		rule := GroupRule{Group: args[1]}
+		for _, path := range args[2:] {
+			rule.Paths = append(rule.Paths, strings.TrimLeft(strings.ToLower(path), "/"))
+		}
+		c.GroupRules = append(c.GroupRules, rule)
+
+	default:
+		return errors.New("Unknown parameter in `authbyemail` block: " + name)
 	}
 
-	// Check that mandatory parameters were given
-	if config.SiteName == "" {
-		return nil, c.Err("No SiteName was given in the Caddyfile.")
+	return nil
+}
+
+// Validate checks that the mandatory parameters were given.
+func (c *Config) Validate() error {
+	if c.SiteName == "" {
+		return errors.New("No SiteName was given in the configuration.")
 	}
-	if config.MailerFrom == nil {
-		return nil, c.Err("No MailerFrom was given in the Caddyfile.")
+	if c.MailerFrom == nil {
+		return errors.New("No MailerFrom was given in the configuration.")
 	}
-
-	return config, nil
+	if c.SiteURL == "" {
+		return errors.New("No SiteURL was given in the configuration.")
+	}
+	return nil
 }
 
-// The helper function adminEmailFromUserEmail returns the admin belonging
-// to the user's domain. If there is only one admin, that one is always given.
-// Else, if there is no admin for this user, nil is returned
+// The helper function adminEmailFromUserEmail returns the first admin responsible
+// for the user (see adminsForUser), or nil if there is none
 func (c *Config) adminEmailFromUserEmail(e *EmailAddr) *EmailAddr {
+	if admins := c.adminsForUser(e); len(admins) > 0 {
+		return admins[0]
+	}
+	return nil
+}
+
+// The helper function adminsForUser returns the admins who are asked to approve
+// the user. With AdminRoutes, these are the admins of every route matching the
+// user, or else those of the "*" route. Without, it is the admin given by
+// domainAdmin, if there is one
+func (c *Config) adminsForUser(e *EmailAddr) []*EmailAddr {
+	if len(c.AdminRoutes) == 0 {
+		if admin := c.domainAdmin(e); admin != nil {
+			return []*EmailAddr{admin}
+		}
+		return nil
+	}
+
+	// Admins may be given by several routes, but are only asked once
+	var admins, fallback []*EmailAddr
+	add := func(list []*EmailAddr, route AdminRoute) []*EmailAddr {
+		for _, admin := range route.Admins {
+			found := false
+			for _, other := range list {
+				found = found || other.String() == admin.String()
+			}
+			if !found {
+				list = append(list, admin)
+			}
+		}
+		return list
+	}
+	for _, route := range c.AdminRoutes {
+		if route.Users == nil {
+			fallback = add(fallback, route)
+		} else if route.Users.Matches(e) {
+			admins = add(admins, route)
+		}
+	}
+	if len(admins) == 0 {
+		return fallback
+	}
+	return admins
+}
+
+// The helper function approvalsForUser returns how many admins must approve the
+// user before they are let in: the most asked by any route matching the user, or
+// else by the "*" route. It is always at least 1
+func (c *Config) approvalsForUser(e *EmailAddr) int {
+	approvals, fallback, matched := 1, 1, false
+	for _, route := range c.AdminRoutes {
+		if route.Users == nil {
+			if route.Approvals > fallback {
+				fallback = route.Approvals
+			}
+		} else if route.Users.Matches(e) {
+			matched = true
+			if route.Approvals > approvals {
+				approvals = route.Approvals
+			}
+		}
+	}
+	if !matched {
+		return fallback
+	}
+	return approvals
+}
+
+// The helper function domainAdmin returns the admin belonging to the user's
+// domain, or else to the closest parent domain (so that the admin of example.com
+// also handles users of sales.example.com). If there is only one admin, that one
+// is always given. Else, if there is no admin for this user, nil is returned
+func (c *Config) domainAdmin(e *EmailAddr) *EmailAddr {
 	if len(c.Admins) == 1 {
 		return c.Admins[0]
 	}
-	for _, ad := range c.Admins {
-		if ad.Domain == e.Domain {
-			return ad
+	for domain := e.Domain; domain != ""; {
+		for _, ad := range c.Admins {
+			if ad.Domain == domain {
+				return ad
+			}
 		}
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
 	}
 	return nil
 }
 
-// The helper function IsDomainWhitelisted checks whether the given domain
-// is whitelisted by checking all members of WhitelistDomains
-func (c *Config) IsDomainWhitelisted(domain string) bool {
-	for _, whitelisted_domain := range c.WhitelistDomains {
-		if whitelisted_domain == domain {
-			return true
+// The helper function oidcClient returns the OIDC client with the given ID, or nil
+// if there is none.
+func (c *Config) oidcClient(id string) *OIDCClient {
+	for i := range c.OIDCClients {
+		if c.OIDCClients[i].ID == id {
+			return &c.OIDCClients[i]
 		}
 	}
-	return false
+	return nil
+}
+
+// The helper function IsDomainWhitelisted checks whether the given domain
+// matches one of the domain patterns in WhitelistDomains
+func (c *Config) IsDomainWhitelisted(domain string) bool {
+	return c.WhitelistDomains.MatchesDomain(domain)
+}
+
+// The helper function IsWhitelisted checks whether the given address may log in
+// without being approved by an admin
+func (c *Config) IsWhitelisted(e *EmailAddr) bool {
+	return c.WhitelistDomains.Matches(e) && !c.IsBlocked(e)
+}
+
+// The helper function IsBlocked checks whether the given address matches
+// BlockDomains. Addresses that are whitelisted by themselves (rather than by
+// their domain) are never blocked.
+func (c *Config) IsBlocked(e *EmailAddr) bool {
+	return c.BlockDomains.Matches(e) && !c.WhitelistDomains.MatchesAddress(e)
 }
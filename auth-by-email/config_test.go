@@ -0,0 +1,184 @@
+package authbyemail
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfig(t *testing.T) {
+	t.Run("Correct directives", func(t *testing.T) {
+		c := NewConfig()
+		for _, directive := range []struct {
+			name string
+			args []string
+		}{
+			{"sitename", []string{"My", "Cool", "Site"}},
+			{"siteurl", []string{"https://example.com/"}},
+			{"admin", []string{"sysadmin@example.com"}},
+			{"mailerfrom", []string{"sysadmin@example.com"}},
+			{"cookievalidity", []string{"3600"}},
+			{"require", []string{"group", "finance", "/Reports/*"}},
+			{"qrlogin", nil},
+			{"accesstokens", []string{"90"}},
+			{"oidcclient", []string{"wiki", "-", "https://wiki.example.com/callback"}},
+			{"sessiontokens", []string{"60"}},
+			{"ratelimit", []string{"ip", "100", "3600"}},
+			{"ratelimit", []string{"admin", "off"}},
+			{"ratelimit", []string{"cooldown", "120"}},
+			{"ratelimit", []string{"persist"}},
+			{"challenge", []string{"pow", "20"}},
+			{"challenge", []string{"turnstile", "sitekey", "secret", "http://localhost:8080/siteverify"}},
+			{"adminroute", []string{"*.example.org", "sysadmin@example.com", "liaison@example.org"}},
+			{"adminroute", []string{"*", "sysadmin@example.com"}},
+			{"adminroute", []string{"bank.example.org", "approvals", "2", "sysadmin@example.com", "liaison@example.org"}},
+			{"whitelistdomains", []string{"example.com", "*.example.org"}},
+			{"whitelistdomains", []string{"friend@gmail.com"}},
+			{"blockdomains", []string{"mailinator.com", "/.*\\+spam@.*/"}},
+		} {
+			if err := c.ParseDirective(directive.name, directive.args); err != nil {
+				t.Errorf("Could not parse directive %v %v, %v", directive.name, directive.args, err)
+			}
+		}
+
+		if err := c.Validate(); err != nil {
+			t.Errorf("Complete configuration did not validate, %v", err)
+		}
+		if c.SiteName != "My Cool Site" || c.SiteURL != "https://example.com" || c.CookieValidity != time.Hour || !c.QRLogin {
+			t.Errorf("Directives not parsed correctly, got %#v", c)
+		}
+		if !c.AccessTokens || c.MaxAccessTokenValidity != 90*24*time.Hour {
+			t.Errorf("Access tokens not enabled correctly, got %#v", c)
+		}
+		if !c.SessionTokens || c.SessionTokenValidity != time.Minute {
+			t.Errorf("Session tokens not enabled correctly, got %#v", c)
+		}
+		if c.LoginRateLimitIP != (RateLimit{100, time.Hour}) || c.LoginRateLimitAdmin.Count != 0 || c.LoginRateLimitEmail.Count != 5 || c.ResendCooldown != 2*time.Minute || !c.PersistRateLimits {
+			t.Errorf("Rate limits not parsed correctly, got %#v", c)
+		}
+		if len(c.WhitelistDomains.Patterns()) != 3 || len(c.BlockDomains.Patterns()) != 2 {
+			t.Errorf("Domain lists not parsed correctly, got %v and %v", c.WhitelistDomains.Patterns(), c.BlockDomains.Patterns())
+		}
+		if len(c.GroupRules) != 1 || c.GroupRules[0].Paths[0] != "reports/*" {
+			t.Errorf("Group rule not parsed correctly, got %#v", c.GroupRules)
+		}
+		if client := c.oidcClient("wiki"); client == nil || client.Secret != "" || !client.allowsRedirect("https://wiki.example.com/callback") {
+			t.Errorf("OIDC client not parsed correctly, got %#v", c.OIDCClients)
+		}
+	})
+
+	t.Run("Erroneous directives", func(t *testing.T) {
+		c := NewConfig()
+		for _, directive := range []struct {
+			name string
+			args []string
+		}{
+			{"banana", nil},
+			{"admin", nil},
+			{"admin", []string{"nobody"}},
+			{"cookievalidity", []string{"-5"}},
+			{"qrlogin", []string{"yes"}},
+			{"apitoken", []string{"hr", "short"}},
+			{"require", []string{"user", "finance", "/reports/*"}},
+			{"accesstokens", []string{"0"}},
+			{"accesstokens", []string{"30", "days"}},
+			{"oidcclient", []string{"wiki", "-"}},
+			{"sessiontokens", []string{"soon"}},
+			{"ratelimit", nil},
+			{"ratelimit", []string{"ip", "100"}},
+			{"ratelimit", []string{"ip", "0", "3600"}},
+			{"ratelimit", []string{"email", "5", "172800"}},
+			{"ratelimit", []string{"everyone", "5", "3600"}},
+			{"challenge", nil},
+			{"challenge", []string{"pow", "64"}},
+			{"challenge", []string{"hcaptcha", "sitekey"}},
+			{"challenge", []string{"recaptcha", "sitekey", "secret"}},
+			{"oidcclient", []string{"wiki", "short", "https://wiki.example.com/callback"}},
+			{"whitelistdomains", nil},
+			{"adminroute", []string{"*.example.org"}},
+			{"adminroute", []string{"*.example.org", "nobody"}},
+			{"adminroute", []string{"/(unclosed/", "sysadmin@example.com"}},
+			{"adminroute", []string{"*.example.org", "approvals"}},
+			{"adminroute", []string{"*.example.org", "approvals", "0", "sysadmin@example.com"}},
+			{"adminroute", []string{"*.example.org", "approvals", "2", "sysadmin@example.com"}},
+			{"blockdomains", []string{"/(unclosed/"}},
+			{"blockdomains", []string{"file:/does/not/exist"}},
+			{"blockdomains", []string{"ex*ample.com"}},
+			{"oidcclient", []string{"wiki", "-", "/callback"}},
+		} {
+			if err := c.ParseDirective(directive.name, directive.args); err == nil {
+				t.Errorf("Parsed erroneous directive %v %v", directive.name, directive.args)
+			}
+		}
+	})
+
+	t.Run("Admin for a user", func(t *testing.T) {
+		c := NewConfig()
+		c.ParseDirective("admin", []string{"root@example.com", "root@sales.example.com", "root@example.org"})
+		for user, expected := range map[string]string{
+			"user@example.com":            "root@example.com",
+			"user@sales.example.com":      "root@sales.example.com",
+			"user@east.sales.example.com": "root@sales.example.com",
+			"user@hr.example.com":         "root@example.com",
+			"user@example.org":            "root@example.org",
+			"user@example.net":            "",
+			"user@notexample.com":         "",
+		} {
+			email, _ := NewEmailAddrFromString(user)
+			if admin := c.adminEmailFromUserEmail(email); (admin == nil && expected != "") || (admin != nil && admin.String() != expected) {
+				t.Errorf("Expected admin %q for %v, got %v", expected, user, admin)
+			}
+		}
+	})
+
+	t.Run("Admins for a user (routes)", func(t *testing.T) {
+		c := NewConfig()
+		c.ParseDirective("admin", []string{"root@example.com"})
+		c.ParseDirective("adminroute", []string{"*.example.com", "root@example.com", "sales@example.com"})
+		c.ParseDirective("adminroute", []string{".partner.org", "liaison@example.com", "root@example.com"})
+		c.ParseDirective("adminroute", []string{"*", "helpdesk@example.com"})
+		for user, expected := range map[string]string{
+			"user@sales.example.com":  "root@example.com sales@example.com",
+			"user@partner.org":        "liaison@example.com root@example.com",
+			"user@east.partner.org":   "liaison@example.com root@example.com",
+			"user@example.com":        "helpdesk@example.com",
+			"user@somewhere.else.net": "helpdesk@example.com",
+		} {
+			email, _ := NewEmailAddrFromString(user)
+			var admins []string
+			for _, admin := range c.adminsForUser(email) {
+				admins = append(admins, admin.String())
+			}
+			if strings.Join(admins, " ") != expected {
+				t.Errorf("Expected admins %q for %v, got %v", expected, user, admins)
+			}
+		}
+
+		// Users need the most approvals asked by any of their routes
+		c.ParseDirective("adminroute", []string{"*.sales.example.com", "approvals", "2", "root@example.com", "sales@example.com"})
+		for user, expected := range map[string]int{
+			"user@east.sales.example.com": 2,
+			"user@sales.example.com":      1,
+			"user@somewhere.else.net":     1,
+		} {
+			email, _ := NewEmailAddrFromString(user)
+			if approvals := c.approvalsForUser(email); approvals != expected {
+				t.Errorf("Expected %v approvals for %v, got %v", expected, user, approvals)
+			}
+		}
+
+		// Without a fallback, users matching no route have no admin
+		c.AdminRoutes = c.AdminRoutes[:2]
+		if email, _ := NewEmailAddrFromString("user@somewhere.else.net"); c.adminsForUser(email) != nil || c.adminEmailFromUserEmail(email) != nil {
+			t.Error("Found an admin for a user without a route")
+		}
+	})
+
+	t.Run("Missing mandatory parameters", func(t *testing.T) {
+		c := NewConfig()
+		c.ParseDirective("sitename", []string{"Site"})
+		if err := c.Validate(); err == nil {
+			t.Error("Configuration without mailerfrom and siteurl validated")
+		}
+	})
+}
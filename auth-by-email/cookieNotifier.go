@@ -0,0 +1,71 @@
+package authbyemail
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A cookieNotifier lets goroutines wait for changes to cookie tokens, such as a
+// browser on the wait page that waits for its cookie to be validated elsewhere.
+// Any change to any cookie wakes up all waiters, who then check their own cookie.
+type cookieNotifier struct {
+	mutex   sync.Mutex
+	changed chan struct{}
+}
+
+func newCookieNotifier() *cookieNotifier {
+	return &cookieNotifier{changed: make(chan struct{})}
+}
+
+// wait returns a channel that is closed upon the next call to notify.
+func (n *cookieNotifier) wait() <-chan struct{} {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.changed
+}
+
+// notify wakes up everyone currently waiting for a change.
+func (n *cookieNotifier) notify() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+// awaitCookieToken implements Database.AwaitCookieToken given a function to look up
+// the cookie. Besides being woken up by the notifier, it looks the cookie up every
+// pollInterval (if positive) to notice changes made by other processes.
+func awaitCookieToken(ctx context.Context, n *cookieNotifier, pollInterval time.Duration, get func() *CookieToken) *CookieToken {
+	for {
+		// Start waiting before looking up the cookie, so we can not miss a change in between
+		changed := n.wait()
+
+		token := get()
+		if token == nil || token.IsValidated {
+			return token
+		}
+
+		var poll <-chan time.Time
+		var timer *time.Timer
+		if pollInterval > 0 {
+			timer = time.NewTimer(pollInterval)
+			poll = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-changed:
+		case <-poll:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+		if ctx.Err() != nil {
+			return token
+		}
+	}
+}
@@ -3,6 +3,8 @@ package authbyemail
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
@@ -11,12 +13,22 @@ import (
 	"errors"
 	"hash"
 	"io"
+	"math/big"
 	"os"
+	"sync"
 )
 
 type Crypto struct {
-	hmac   hash.Hash
-	cipher cipher.AEAD
+	hmac      hash.Hash
+	hmacMutex sync.Mutex
+	cipher    cipher.AEAD
+
+	// sessionKey signs the session tokens that stand in for cookies in the database
+	sessionKey []byte
+
+	// signingKey signs the ID tokens we issue as an OpenID Connect provider
+	signingKey   *ecdsa.PrivateKey
+	signingKeyID string
 }
 
 var CRYPTO *Crypto
@@ -53,9 +65,14 @@ func InitializeCrypto() {
 		panic(err)
 	}
 
+	signingKey := signingKeyFromSeed(keyDerivation(mainKey, []byte("signingKey")))
+
 	CRYPTO = &Crypto{
-		hmac:   hmac.New(sha256.New, keyDerivation(mainKey, []byte("hmacKey"))),
-		cipher: cipher,
+		hmac:         hmac.New(sha256.New, keyDerivation(mainKey, []byte("hmacKey"))),
+		cipher:       cipher,
+		sessionKey:   keyDerivation(mainKey, []byte("sessionKey")),
+		signingKey:   signingKey,
+		signingKeyID: signingKeyID(&signingKey.PublicKey),
 	}
 }
 
@@ -95,7 +112,11 @@ func (c *Crypto) decrypt(input string) (string, error) {
 }
 
 // computeHmac uses a sha256-based hmac function to calculate the hmac of the input.
+// The hmac function keeps state, so concurrent requests have to take turns.
 func (c *Crypto) computeHmac(input []byte) string {
+	c.hmacMutex.Lock()
+	defer c.hmacMutex.Unlock()
+
 	c.hmac.Reset()
 	c.hmac.Write(input)
 	return base64.RawURLEncoding.EncodeToString(c.hmac.Sum(nil))
@@ -109,3 +130,27 @@ func keyDerivation(mainKey, seed []byte) []byte {
 	hash.Write(mainKey)
 	return hash.Sum(nil)
 }
+
+// signingKeyFromSeed derives a P-256 key from a seed, rather than generating a random one,
+// so that all processes that share AUTH_BY_EMAIL_KEY sign with the same key, and tokens
+// remain valid across restarts.
+func signingKeyFromSeed(seed []byte) *ecdsa.PrivateKey {
+	curve := elliptic.P256()
+
+	// The private key is a number from 1 to N-1
+	d := new(big.Int).SetBytes(seed)
+	d.Mod(d, new(big.Int).Sub(curve.Params().N, big.NewInt(1)))
+	d.Add(d, big.NewInt(1))
+
+	key := &ecdsa.PrivateKey{D: d}
+	key.PublicKey.Curve = curve
+	key.PublicKey.X, key.PublicKey.Y = curve.ScalarBaseMult(d.Bytes())
+	return key
+}
+
+// signingKeyID gives a short identifier of a public key, with which clients can pick
+// the right key to check a signature.
+func signingKeyID(key *ecdsa.PublicKey) string {
+	hash := sha256.Sum256(elliptic.Marshal(key.Curve, key.X, key.Y))
+	return base64.RawURLEncoding.EncodeToString(hash[:12])
+}
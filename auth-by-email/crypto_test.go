@@ -1,7 +1,9 @@
 package authbyemail
 
 import (
+	"encoding/base64"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -28,3 +30,25 @@ func TestHash(t *testing.T) {
 		t.Errorf("Hash failed: expected `%v`, output `%v`", "HUq-zHOjVj2mQ24pUWPrJXEXHvN2eYebibOM8EbJjjE", result)
 	}
 }
+
+func TestSignJWT(t *testing.T) {
+	// The signing key is derived from the main key, so all processes sign alike
+	if key := signingKeyFromSeed(keyDerivation([]byte("main"), []byte("signingKey"))); !key.Equal(signingKeyFromSeed(keyDerivation([]byte("main"), []byte("signingKey")))) {
+		t.Error("Signing keys derived from the same main key differ")
+	}
+
+	token, err := CRYPTO.signJWT(oidcClaims{Subject: "test", ExpiresAt: 1234})
+	if err != nil {
+		t.Fatalf("Could not sign a token, %v", err)
+	}
+	var claims oidcClaims
+	if err := CRYPTO.verifyJWT(token, &claims); err != nil || claims.Subject != "test" || claims.ExpiresAt != 1234 {
+		t.Errorf("Could not verify a signed token, got %#v (%v)", claims, err)
+	}
+
+	parts := strings.Split(token, ".")
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"admin","exp":1234}`)) + "." + parts[2]
+	if err := CRYPTO.verifyJWT(tampered, &claims); err == nil {
+		t.Error("Verified a token with a changed payload")
+	}
+}
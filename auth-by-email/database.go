@@ -1,8 +1,11 @@
 package authbyemail
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
+	"math/big"
+	"strings"
 	"time"
 )
 
@@ -20,27 +23,170 @@ type Database interface {
 	IsKnownUser(user UserID) bool
 
 	// NewCookieToken makes a fresh cookie token for the given user
-	// and saves it to the database.
+	// and saves it to the database. If the UserID is empty, an anonymous
+	// (unvalidated) cookie is made, which a user can claim later on.
 	NewCookieToken(cookieToken CookieToken) (string, error)
 
 	// ValidateCookieToken sets the Validated property of this cookie to true.
 	// If there is no such cookie, an error is returned.
 	ValidateCookieToken(cookieText string) error
 
+	// ClaimCookieToken assigns an anonymous cookie to the given user and validates it.
+	// If there is no such cookie, or it is not anonymous, an error is returned.
+	ClaimCookieToken(cookieText string, user UserID) error
+
 	// DeleteCookieToken removes a given cookie. If none exists, an error is returned.
 	DeleteCookieToken(cookieText string) error
 
+	// TouchCookieToken records that the given cookie was just used. To limit the
+	// number of writes, this may be ignored if it was already used very recently.
+	TouchCookieToken(cookieText string)
+
+	// GetSessions returns the cookies of the given user that have not expired.
+	GetSessions(user UserID) []Session
+
+	// CountUsers returns the number of users in the database.
+	CountUsers() int
+
+	// CountSessions returns the number of validated cookies that have not expired.
+	CountSessions() int
+
+	// AwaitCookieToken blocks until the given cookie is validated, deleted or expired,
+	// or until ctx is done. It returns the cookie information at that point, which is
+	// nil if the cookie no longer exists.
+	AwaitCookieToken(ctx context.Context, cookieText string) *CookieToken
+
+	// CookieVersion returns a number that changes whenever a cookie is validated, claimed
+	// or removed, also by other processes using the same database, so that caches of
+	// cookies know when to forget them.
+	CookieVersion() int64
+
 	// NewLinkToken makes a fresh link token for the given user
 	// and saves it to the database
 	NewLinkToken(linkToken LinkToken, validityPeriod time.Duration) (string, error)
 
-	// AddUser adds the given user to the database
+	// AddUser adds the given user to the database, and removes their pending request
+	// if they had one. A user whose access has ended is added anew, without an expiry.
 	AddUser(user UserID)
 
+	// SetUserEmail stores the e-mail address of an existing user, encrypted, so that
+	// it can be shown to admins.
+	SetUserEmail(email *EmailAddr) error
+
+	// GetUserEmail returns the e-mail address of the given user, or nil if it is not known.
+	GetUserEmail(user UserID) *EmailAddr
+
+	// GetUsers returns all users, including those whose access has ended.
+	GetUsers() []User
+
+	// SetUserExpiry sets when the given user loses access. Afterwards, IsKnownUser returns
+	// false for them and their cookies stop working, but they are kept in the database so
+	// that their access can be renewed. The zero time removes the expiry.
+	SetUserExpiry(user UserID, expiresAt time.Time) error
+
+	// GetUserExpiry returns when the given user loses access, or the zero time if never.
+	GetUserExpiry(user UserID) time.Time
+
+	// GetExpiringUsers returns the users whose access ends before the given time but has
+	// not ended yet, and who were not reminded of it since their expiry was set.
+	GetExpiringUsers(before time.Time) []User
+
+	// SetExpiryReminded records that the given user was reminded that their access ends.
+	SetExpiryReminded(user UserID) error
+
+	// SetUserGroups replaces the groups the given user is a member of.
+	SetUserGroups(user UserID, groups []string) error
+
+	// GetUserGroups returns the groups the given user is a member of, sorted by name.
+	GetUserGroups(user UserID) []string
+
 	// DelUser removes a user from the database
 	DelUser(user UserID) error
+
+	// AddPendingRequest records that the user with the given e-mail address asked for
+	// access. It returns true if this is their first request, and false if an earlier
+	// request was pending, in which case that one is updated instead.
+	AddPendingRequest(email *EmailAddr) (bool, error)
+
+	// GetPendingRequests returns all pending requests, oldest first.
+	GetPendingRequests() []PendingRequest
+
+	// DelPendingRequest removes the pending request of the given user, if there is one.
+	DelPendingRequest(user UserID)
+
+	// AddApprovalDecision records how an admin decided about the given user, replacing
+	// that admin's earlier decision about them.
+	AddApprovalDecision(user UserID, decision ApprovalDecision) error
+
+	// GetApprovalDecisions returns the latest decision of each admin about the given
+	// user, oldest first.
+	GetApprovalDecisions(user UserID) []ApprovalDecision
+
+	// DelApprovalDecisions forgets all decisions about the given user, so that they do
+	// not count towards a later request. Deleting a user does so as well.
+	DelApprovalDecisions(user UserID) error
+
+	// NewAPIToken makes a fresh token for the API, replacing any earlier token with the
+	// same name. Only a hash of the token is stored.
+	NewAPIToken(name string) (string, error)
+
+	// CheckAPIToken returns the name of the given API token, and whether it is valid.
+	CheckAPIToken(token string) (string, bool)
+
+	// DelAPIToken removes the API token with the given name.
+	DelAPIToken(name string) error
+
+	// NewAccessToken makes a fresh personal access token for the user, name and scopes of
+	// the given token, and saves it to the database. Only a hash of the token is stored.
+	// If there is no such user, an error is returned.
+	NewAccessToken(accessToken AccessToken, validityPeriod time.Duration) (string, error)
+
+	// GetAccessToken checks if the given string is a personal access token that has not
+	// expired, and returns its information if so.
+	GetAccessToken(token string) *AccessToken
+
+	// TouchAccessToken records that the access token with the given ID was just used.
+	// Like TouchCookieToken, this may be ignored if it was already used very recently.
+	TouchAccessToken(id string)
+
+	// GetAccessTokens returns the personal access tokens of the given user that have not
+	// expired, oldest first.
+	GetAccessTokens(user UserID) []AccessToken
+
+	// DelAccessToken removes the access token with the given ID, if it belongs to the given
+	// user. If there is no such token, an error is returned.
+	DelAccessToken(user UserID, id string) error
+
+	// NewLoginCode makes a fresh one-time code for the given cookie and saves it to
+	// the database, replacing any earlier code for that cookie. If there is no such
+	// cookie, an error is returned.
+	NewLoginCode(cookieText string, validityPeriod time.Duration) (string, error)
+
+	// ValidateLoginCode checks the given code against the one made for this cookie.
+	// Each call uses up one attempt; if the code is correct, the cookie is validated
+	// and the code is removed. If it is incorrect, expired or out of attempts, an
+	// error is returned.
+	ValidateLoginCode(cookieText string, code string) error
+
+	// UpdateRateLimit reads the state of the rate limit stored under the given key (which
+	// is zero if there is none), and stores the state returned by update instead, as one
+	// transaction, so that processes sharing the database can share rate limits.
+	UpdateRateLimit(key string, update func(RateLimitState) RateLimitState) error
+
+	// Close releases the database. It can not be used afterwards.
+	Close() error
 }
 
+// cookieTouchInterval is how precisely the last use of a cookie is recorded.
+const cookieTouchInterval = time.Minute
+
+// The number of digits in a one-time login code, and the number of times a user
+// may try to enter it before the code is discarded.
+const (
+	loginCodeDigits   = 6
+	loginCodeAttempts = 5
+)
+
 // newRandom generates 16 cryptographically random bytes and returns them as a
 // string of hexadecimal digits.
 func newRandom() string {
@@ -51,3 +197,34 @@ func newRandom() string {
 	}
 	return hex.EncodeToString(b)
 }
+
+// newLoginCode generates a cryptographically random code of loginCodeDigits
+// decimal digits, suitable for typing over from an e-mail.
+func newLoginCode() string {
+	var b strings.Builder
+	for i := 0; i < loginCodeDigits; i++ {
+		digit, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			panic("Can not generate random numbers for the login codes")
+		}
+		b.WriteString(digit.String())
+	}
+	return b.String()
+}
+
+// hashLoginCode computes the value under which a login code is stored. The code
+// is bound to its cookie, so that it can not be used to validate any other cookie.
+func hashLoginCode(cookieText string, code string) string {
+	return CRYPTO.computeHmac([]byte("loginCode/" + cookieText + "/" + code))
+}
+
+// hashAccessToken computes the value under which a personal access token is stored.
+func hashAccessToken(token string) string {
+	return CRYPTO.computeHmac([]byte("accessToken/" + token))
+}
+
+// hashAPIToken computes the value under which an API token is stored, so that the
+// tokens can not be read back from the database.
+func hashAPIToken(token string) string {
+	return CRYPTO.computeHmac([]byte("apiToken/" + token))
+}
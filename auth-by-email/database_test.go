@@ -1,9 +1,12 @@
 package authbyemail
 
 import (
+	"context"
+	"database/sql"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -13,12 +16,56 @@ func TestDatabase(t *testing.T) {
 	t.Run("Disk backed db", func(t *testing.T) { databaseTests(t, sql) })
 	testTeardown(sql)
 
+	sql = testSetup()
+	t.Run("Cached disk backed db", func(t *testing.T) { databaseTests(t, NewCachedDatabase(sql, 2, time.Minute)) })
+	testTeardown(sql)
+
 	t.Run("Map based db", func(t *testing.T) { databaseTests(t, NewMapBasedDatabase()) })
 }
 
+// TestDatabaseUpgrade checks that a database made by an older version can still be used.
+func TestDatabaseUpgrade(t *testing.T) {
+	testTeardown(testSetup()) // Registers the database driver
+
+	db, err := sql.Open("sqlite3_custom", "/tmp/abe_test_db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+            create table Users (userID text not null primary key);
+            create table Cookies (cookieToken text not null primary key, userID text not null, validUntil datetime, isValidated bool, browser text);
+            insert into Users(userID) values('test');
+            insert into Cookies(cookieToken, userID, validUntil, isValidated, browser) values('old', 'test', ?, 1, 'cde');`,
+		time.Now().Add(time.Hour))
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewConfig()
+	c.Database = "/tmp/abe_test_db"
+	upgraded := NewDiskBackedDatabase(c, log.New(ioutil.Discard, "(AuthByEmail) ", log.LstdFlags))
+	defer func() { testTeardown(upgraded) }()
+
+	if ct := upgraded.GetCookieToken("old"); ct == nil || !ct.IsValidated {
+		t.Errorf("Cookie from the old database is not valid after upgrading, got %#v", ct)
+	}
+	if sessions := upgraded.GetSessions(UserID("test")); len(sessions) != 1 || !sessions[0].CreatedAt.IsZero() {
+		t.Errorf("Expected one session without a creation time, got %#v", sessions)
+	}
+	if users := upgraded.GetUsers(); len(users) != 1 || users[0].EncryptedEmail != "" || upgraded.GetUserEmail(UserID("test")) != nil {
+		t.Errorf("Expected one user without an e-mail address, got %#v", users)
+	}
+
+	// Opening it a second time should not try to upgrade it again
+	upgraded.db.Close()
+	upgraded = NewDiskBackedDatabase(c, log.New(ioutil.Discard, "(AuthByEmail) ", log.LstdFlags))
+	databaseTests(t, upgraded)
+}
+
 func testSetup() *DiskBackedDatabase {
 	os.Remove("/tmp/abe_test_db")
-	c := newConfig()
+	c := NewConfig()
 	c.Database = "/tmp/abe_test_db"
 	return NewDiskBackedDatabase(c, log.New(ioutil.Discard, "(AuthByEmail) ", log.LstdFlags))
 }
@@ -143,6 +190,475 @@ func databaseTests(t *testing.T, db Database) {
 		}
 	})
 
+	t.Run("Sessions", func(t *testing.T) {
+		db.AddUser(userID)
+		db.AddUser(UserID("other"))
+
+		c1, _ := db.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: "cde"})
+		c2, _ := db.NewCookieToken(CookieToken{UserID: userID, IsValidated: false, BrowserContext: "pqr"})
+		db.NewCookieToken(CookieToken{UserID: UserID("other"), IsValidated: true, BrowserContext: "xyz"})
+		db.TouchCookieToken(c1)
+
+		sessions := db.GetSessions(userID)
+		if len(sessions) != 2 {
+			t.Fatalf("Expected 2 sessions, got %#v", sessions)
+		}
+		for _, session := range sessions {
+			if session.UserID != userID || (session.Cookie != c1 && session.Cookie != c2) {
+				t.Errorf("Got session that does not belong to the user, %#v", session)
+			}
+			if session.CreatedAt.IsZero() || session.LastUsed.IsZero() || !session.ValidUntil.After(time.Now()) {
+				t.Errorf("Session does not have proper timestamps, %#v", session)
+			}
+		}
+
+		db.DelUser(userID)
+		db.DelUser(UserID("other"))
+		if sessions := db.GetSessions(userID); len(sessions) != 0 {
+			t.Errorf("Got sessions for a deleted user, %#v", sessions)
+		}
+	})
+
+	t.Run("Cookie version", func(t *testing.T) {
+		db.AddUser(userID)
+		c, _ := db.NewCookieToken(CookieToken{UserID: userID, IsValidated: false, BrowserContext: "cde"})
+
+		version := db.CookieVersion()
+		db.ValidateCookieToken(c)
+		if db.CookieVersion() == version {
+			t.Error("Cookie version did not change after validating a cookie")
+		}
+
+		version = db.CookieVersion()
+		db.DelUser(userID)
+		if db.CookieVersion() == version {
+			t.Error("Cookie version did not change after deleting a user")
+		}
+	})
+
+	t.Run("Rate limits", func(t *testing.T) {
+		now := time.Now()
+		db.UpdateRateLimit("test", func(state RateLimitState) RateLimitState {
+			if state.Tokens != 0 || !state.Updated.IsZero() {
+				t.Errorf("Expected a new rate limit to be zero, got %#v", state)
+			}
+			return RateLimitState{Tokens: 1.5, Updated: now}
+		})
+		db.UpdateRateLimit("test", func(state RateLimitState) RateLimitState {
+			if state.Tokens != 1.5 || !state.Updated.Equal(now) {
+				t.Errorf("Rate limit not stored correctly, got %#v", state)
+			}
+			return state
+		})
+	})
+
+	t.Run("Anonymous cookie token", func(t *testing.T) {
+		db.AddUser(userID)
+
+		if _, err := db.NewCookieToken(CookieToken{UserID: "", IsValidated: true, BrowserContext: "cde"}); err == nil {
+			t.Error("Was able to add a validated anonymous cookie")
+		}
+
+		proper := CookieToken{UserID: "", IsValidated: false, BrowserContext: "cde"}
+		c, err := db.NewCookieToken(proper)
+		ct := db.GetCookieToken(c)
+		if err != nil || ct == nil || *ct != proper {
+			t.Errorf("Anonymous cookie token in database does not match what was inserted, got %#v, expected %#v, error %v", ct, proper, err)
+		}
+
+		if err = db.ClaimCookieToken(c, UserID("jkl")); err == nil {
+			t.Error("Was able to claim a cookie for a non-existent user")
+		}
+
+		proper = CookieToken{UserID: userID, IsValidated: true, BrowserContext: "cde"}
+		err = db.ClaimCookieToken(c, userID)
+		ct = db.GetCookieToken(c)
+		if err != nil || ct == nil || *ct != proper {
+			t.Errorf("Claimed cookie token in database does not match, got %#v, expected %#v, error %v", ct, proper, err)
+		}
+
+		if err = db.ClaimCookieToken(c, userID); err == nil {
+			t.Error("Was able to claim a cookie twice")
+		}
+		if err = db.ClaimCookieToken("does not exist", userID); err == nil {
+			t.Error("Was able to claim a non-existent cookie")
+		}
+
+		db.DelUser(userID)
+	})
+
+	t.Run("Pending requests", func(t *testing.T) {
+		email, _ := NewEmailAddrFromString("pending@example.com")
+		pendingID := CRYPTO.UserIDfromEmail(email)
+
+		if first, err := db.AddPendingRequest(email); !first || err != nil {
+			t.Errorf("First request for access not recognised as such, error %v", err)
+		}
+		if first, err := db.AddPendingRequest(email); first || err != nil {
+			t.Errorf("Repeated request for access recognised as a first one, error %v", err)
+		}
+
+		requests := db.GetPendingRequests()
+		if len(requests) != 1 || requests[0].UserID != pendingID || requests[0].Count != 2 {
+			t.Fatalf("Pending requests not stored correctly, got %#v", requests)
+		}
+		if e, err := requests[0].Email(); err != nil || e.String() != email.String() {
+			t.Errorf("Could not recover e-mail address of pending request, got %v, error %v", e, err)
+		}
+
+		db.DelPendingRequest(pendingID)
+		if requests := db.GetPendingRequests(); len(requests) != 0 {
+			t.Errorf("Pending request not deleted, got %#v", requests)
+		}
+
+		// Approving the user removes their request
+		db.AddPendingRequest(email)
+		db.AddUser(pendingID)
+		if requests := db.GetPendingRequests(); len(requests) != 0 {
+			t.Errorf("Pending request not deleted after approval, got %#v", requests)
+		}
+
+		db.DelUser(pendingID)
+	})
+
+	t.Run("Approval decisions", func(t *testing.T) {
+		email, _ := NewEmailAddrFromString("decided@example.com")
+		decidedID := CRYPTO.UserIDfromEmail(email)
+		earlier := time.Now().Add(-time.Hour)
+
+		if decisions := db.GetApprovalDecisions(decidedID); len(decisions) != 0 {
+			t.Errorf("Decisions found before any were made, got %#v", decisions)
+		}
+		db.AddApprovalDecision(decidedID, ApprovalDecision{Admin: "alice@example.com", Approved: true, DecidedAt: earlier})
+		db.AddApprovalDecision(decidedID, ApprovalDecision{Admin: "bob@example.com", Approved: true, DecidedAt: earlier.Add(time.Minute)})
+		db.AddApprovalDecision(decidedID, ApprovalDecision{Admin: "alice@example.com", Approved: false, DecidedAt: earlier.Add(2 * time.Minute)})
+
+		decisions := db.GetApprovalDecisions(decidedID)
+		if len(decisions) != 2 || decisions[0].Admin != "bob@example.com" || decisions[1].Admin != "alice@example.com" || decisions[1].Approved {
+			t.Errorf("Decisions not stored correctly, got %#v", decisions)
+		}
+		if decisions[0].DecidedAt.Unix() != earlier.Add(time.Minute).Unix() {
+			t.Errorf("Time of decision not stored correctly, got %v", decisions[0].DecidedAt)
+		}
+
+		db.DelApprovalDecisions(decidedID)
+		if decisions := db.GetApprovalDecisions(decidedID); len(decisions) != 0 {
+			t.Errorf("Decisions found after they were deleted, got %#v", decisions)
+		}
+
+		// Deleting the user forgets the decisions about them as well
+		db.AddUser(decidedID)
+		db.AddApprovalDecision(decidedID, ApprovalDecision{Admin: "alice@example.com", Approved: true, DecidedAt: earlier})
+		db.DelUser(decidedID)
+		if decisions := db.GetApprovalDecisions(decidedID); len(decisions) != 0 {
+			t.Errorf("Decisions found after the user was deleted, got %#v", decisions)
+		}
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		email, _ := NewEmailAddrFromString("contractor@example.com")
+		expiringID := CRYPTO.UserIDfromEmail(email)
+		if err := db.SetUserExpiry(expiringID, time.Now().Add(time.Hour)); err == nil {
+			t.Error("Was able to set the expiry of a non-existent user")
+		}
+
+		db.AddUser(expiringID)
+		db.SetUserEmail(email)
+		cookie, _ := db.NewCookieToken(CookieToken{UserID: expiringID, IsValidated: true})
+		expiresAt := time.Now().Add(24 * time.Hour)
+		if err := db.SetUserExpiry(expiringID, expiresAt); err != nil || db.GetUserExpiry(expiringID).Unix() != expiresAt.Unix() {
+			t.Errorf("Expiry not set, got %v, %v", db.GetUserExpiry(expiringID), err)
+		}
+		if !db.IsKnownUser(expiringID) || db.GetCookieToken(cookie) == nil {
+			t.Error("User lost access before their expiry")
+		}
+
+		// Users are reminded once
+		if users := db.GetExpiringUsers(time.Now().Add(time.Hour)); len(users) != 0 {
+			t.Errorf("Users expiring later found, got %#v", users)
+		}
+		if users := db.GetExpiringUsers(time.Now().Add(48 * time.Hour)); len(users) != 1 || users[0].UserID != expiringID || users[0].ExpiresAt.Unix() != expiresAt.Unix() {
+			t.Errorf("Expiring user not found, got %#v", users)
+		}
+		db.SetExpiryReminded(expiringID)
+		if users := db.GetExpiringUsers(time.Now().Add(48 * time.Hour)); len(users) != 0 {
+			t.Errorf("Reminded user found again, got %#v", users)
+		}
+
+		// After the expiry, the user is unknown and their cookies stop working, but they
+		// are kept so that their access can be renewed
+		db.SetUserExpiry(expiringID, time.Now().Add(-time.Second))
+		if db.IsKnownUser(expiringID) || db.GetCookieToken(cookie) != nil {
+			t.Error("User kept access after their expiry")
+		}
+		if _, err := db.NewLinkToken(LinkToken{UserID: expiringID}, time.Hour); err == nil {
+			t.Error("Made a link token for a user whose access ended")
+		}
+		if users := db.GetExpiringUsers(time.Now().Add(48 * time.Hour)); len(users) != 0 {
+			t.Errorf("User whose access ended is still expiring, got %#v", users)
+		}
+		if err := db.SetUserExpiry(expiringID, time.Time{}); err != nil || !db.IsKnownUser(expiringID) || db.GetCookieToken(cookie) == nil {
+			t.Errorf("Access not renewed, %v", err)
+		}
+
+		// Adding a user whose access ended gives it back, without an expiry
+		db.SetUserExpiry(expiringID, time.Now().Add(-time.Second))
+		db.AddUser(expiringID)
+		if !db.IsKnownUser(expiringID) || !db.GetUserExpiry(expiringID).IsZero() {
+			t.Error("User not added again after their access ended")
+		}
+
+		db.SetUserExpiry(expiringID, time.Now().Add(-time.Second))
+		if err := db.DelUser(expiringID); err != nil {
+			t.Errorf("Could not delete a user whose access ended, %v", err)
+		}
+	})
+
+	t.Run("E-mail addresses", func(t *testing.T) {
+		email, _ := NewEmailAddrFromString("stored@example.com")
+		storedID := CRYPTO.UserIDfromEmail(email)
+
+		if err := db.SetUserEmail(email); err == nil {
+			t.Error("Was able to set the e-mail address of a non-existent user")
+		}
+
+		db.AddUser(storedID)
+		if e := db.GetUserEmail(storedID); e != nil {
+			t.Errorf("User has an e-mail address before it was set, got %v", e)
+		}
+		if err := db.SetUserEmail(email); err != nil {
+			t.Errorf("Could not set e-mail address, error %v", err)
+		}
+		if e := db.GetUserEmail(storedID); e == nil || e.String() != email.String() {
+			t.Errorf("E-mail address not stored correctly, got %v", e)
+		}
+
+		found := false
+		for _, user := range db.GetUsers() {
+			if user.UserID == storedID {
+				e, err := user.Email()
+				found = err == nil && e.String() == email.String()
+			}
+		}
+		if !found {
+			t.Error("User and their e-mail address not listed")
+		}
+
+		db.DelUser(storedID)
+		if e := db.GetUserEmail(storedID); e != nil {
+			t.Errorf("E-mail address not deleted along with the user, got %v", e)
+		}
+	})
+
+	t.Run("Groups", func(t *testing.T) {
+		if err := db.SetUserGroups(userID, []string{"finance"}); err == nil {
+			t.Error("Was able to set the groups of a non-existent user")
+		}
+
+		db.AddUser(userID)
+		if err := db.SetUserGroups(userID, []string{"hr", "finance"}); err != nil {
+			t.Errorf("Could not set groups, error %v", err)
+		}
+		if groups := db.GetUserGroups(userID); len(groups) != 2 || groups[0] != "finance" || groups[1] != "hr" {
+			t.Errorf("Groups not stored correctly, got %#v", groups)
+		}
+
+		// Setting the groups replaces them
+		db.SetUserGroups(userID, []string{"hr"})
+		if groups := db.GetUserGroups(userID); len(groups) != 1 || groups[0] != "hr" {
+			t.Errorf("Groups not replaced correctly, got %#v", groups)
+		}
+
+		// Deleting the user forgets their groups
+		db.DelUser(userID)
+		db.AddUser(userID)
+		if groups := db.GetUserGroups(userID); len(groups) != 0 {
+			t.Errorf("Groups not deleted along with the user, got %#v", groups)
+		}
+		db.DelUser(userID)
+	})
+
+	t.Run("API tokens", func(t *testing.T) {
+		token, err := db.NewAPIToken("hr")
+		if err != nil || token == "" {
+			t.Fatalf("Could not make an API token, error %v", err)
+		}
+		if name, ok := db.CheckAPIToken(token); !ok || name != "hr" {
+			t.Errorf("API token not recognised, got %q", name)
+		}
+		if _, ok := db.CheckAPIToken("does not exist"); ok {
+			t.Error("Non-existent API token recognised")
+		}
+
+		// Making a new token with the same name replaces the old one
+		newToken, _ := db.NewAPIToken("hr")
+		if _, ok := db.CheckAPIToken(token); ok {
+			t.Error("Replaced API token still recognised")
+		}
+
+		if err = db.DelAPIToken("hr"); err != nil {
+			t.Errorf("Could not delete API token, error %v", err)
+		}
+		if _, ok := db.CheckAPIToken(newToken); ok {
+			t.Error("Deleted API token still recognised")
+		}
+		if err = db.DelAPIToken("hr"); err == nil {
+			t.Error("Was able to delete a non-existent API token")
+		}
+	})
+
+	t.Run("Access tokens", func(t *testing.T) {
+		db.AddUser(userID)
+
+		if _, err := db.NewAccessToken(AccessToken{UserID: UserID("nobody"), Name: "ci"}, time.Hour); err == nil {
+			t.Error("Was able to make an access token for a non-existent user")
+		}
+
+		token, err := db.NewAccessToken(AccessToken{UserID: userID, Name: "ci", Scopes: []string{"api/*", "status"}}, time.Hour)
+		if err != nil || !strings.HasPrefix(token, accessTokenPrefix) {
+			t.Fatalf("Could not make an access token, got %q, error %v", token, err)
+		}
+		at := db.GetAccessToken(token)
+		if at == nil || at.UserID != userID || at.Name != "ci" || len(at.Scopes) != 2 || !at.LastUsed.IsZero() {
+			t.Fatalf("Access token not stored correctly, got %#v", at)
+		}
+		if db.GetAccessToken("abe_doesnotexist") != nil {
+			t.Error("Non-existent access token recognised")
+		}
+
+		db.TouchAccessToken(at.ID)
+		if tokens := db.GetAccessTokens(userID); len(tokens) != 1 || tokens[0].ID != at.ID || tokens[0].LastUsed.IsZero() {
+			t.Errorf("Expected the one access token, used just now, got %#v", tokens)
+		}
+
+		expired, _ := db.NewAccessToken(AccessToken{UserID: userID, Name: "old"}, -time.Hour)
+		if db.GetAccessToken(expired) != nil || len(db.GetAccessTokens(userID)) != 1 {
+			t.Error("Expired access token recognised")
+		}
+
+		if err = db.DelAccessToken(UserID("other"), at.ID); err == nil {
+			t.Error("Was able to delete the access token of another user")
+		}
+		if err = db.DelAccessToken(userID, at.ID); err != nil {
+			t.Errorf("Could not delete access token, error %v", err)
+		}
+		if db.GetAccessToken(token) != nil {
+			t.Error("Deleted access token still recognised")
+		}
+
+		// Deleting the user deletes their tokens
+		token, _ = db.NewAccessToken(AccessToken{UserID: userID, Name: "ci"}, time.Hour)
+		db.DelUser(userID)
+		if db.GetAccessToken(token) != nil {
+			t.Error("Access token exists after deletion of user")
+		}
+	})
+
+	t.Run("Login code", func(t *testing.T) {
+		db.AddUser(userID)
+
+		c, _ := db.NewCookieToken(CookieToken{UserID: userID, IsValidated: false, BrowserContext: "cde"})
+		code, err := db.NewLoginCode(c, time.Hour)
+		if err != nil || len(code) != loginCodeDigits {
+			t.Errorf("Could not make a login code, got %q, error %v", code, err)
+		}
+
+		if err = db.ValidateLoginCode(c, "wrong"); err == nil {
+			t.Error("Was able to validate a cookie with an incorrect login code")
+		}
+		if ct := db.GetCookieToken(c); ct == nil || ct.IsValidated {
+			t.Errorf("Cookie token changed after incorrect login code, got %#v", ct)
+		}
+
+		if err = db.ValidateLoginCode(c, code); err != nil {
+			t.Errorf("Could not validate a cookie with its login code, error %v", err)
+		}
+		if ct := db.GetCookieToken(c); ct == nil || !ct.IsValidated {
+			t.Errorf("Cookie token not validated after correct login code, got %#v", ct)
+		}
+
+		if err = db.ValidateLoginCode(c, code); err == nil {
+			t.Error("Was able to use a login code twice")
+		}
+
+		db.DelUser(userID)
+	})
+
+	t.Run("Login code (erroneously)", func(t *testing.T) {
+		if _, err := db.NewLoginCode("does not exist", time.Hour); err == nil {
+			t.Error("Was able to make a login code for a non-existent cookie")
+		}
+
+		db.AddUser(userID)
+		c, _ := db.NewCookieToken(CookieToken{UserID: userID, IsValidated: false, BrowserContext: "cde"})
+
+		// Run out of attempts, after which even the correct code should fail
+		code, _ := db.NewLoginCode(c, time.Hour)
+		for i := 0; i < loginCodeAttempts; i++ {
+			db.ValidateLoginCode(c, "wrong")
+		}
+		if err := db.ValidateLoginCode(c, code); err == nil {
+			t.Error("Was able to use a login code after running out of attempts")
+		}
+
+		// Let a code expire
+		code, _ = db.NewLoginCode(c, 0)
+		time.Sleep(time.Millisecond)
+		if err := db.ValidateLoginCode(c, code); err == nil {
+			t.Error("Was able to use an expired login code")
+		}
+
+		// A code for one cookie should not work for another
+		other, _ := db.NewCookieToken(CookieToken{UserID: userID, IsValidated: false, BrowserContext: "pqr"})
+		code, _ = db.NewLoginCode(c, time.Hour)
+		if err := db.ValidateLoginCode(other, code); err == nil {
+			t.Error("Was able to use a login code for a different cookie")
+		}
+
+		if ct := db.GetCookieToken(c); ct == nil || ct.IsValidated {
+			t.Errorf("Cookie token validated by erroneous login codes, got %#v", ct)
+		}
+
+		db.DelUser(userID)
+	})
+
+	t.Run("Await cookie token", func(t *testing.T) {
+		db.AddUser(userID)
+		c, _ := db.NewCookieToken(CookieToken{UserID: userID, IsValidated: false, BrowserContext: "cde"})
+
+		// Nothing happens to the cookie, so we should time out
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		if ct := db.AwaitCookieToken(ctx, c); ct == nil || ct.IsValidated {
+			t.Errorf("Awaiting an unchanged cookie should time out with it unvalidated, got %#v", ct)
+		}
+		cancel()
+
+		// The cookie is validated while we wait
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			db.ValidateCookieToken(c)
+		}()
+		ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+		if ct := db.AwaitCookieToken(ctx, c); ct == nil || !ct.IsValidated || ctx.Err() != nil {
+			t.Errorf("Awaiting a cookie that is validated should return it, got %#v (context error %v)", ct, ctx.Err())
+		}
+		cancel()
+
+		// The cookie is deleted while we wait
+		c, _ = db.NewCookieToken(CookieToken{UserID: userID, IsValidated: false, BrowserContext: "cde"})
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			db.DeleteCookieToken(c)
+		}()
+		ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+		if ct := db.AwaitCookieToken(ctx, c); ct != nil || ctx.Err() != nil {
+			t.Errorf("Awaiting a cookie that is deleted should return nil, got %#v (context error %v)", ct, ctx.Err())
+		}
+		cancel()
+
+		db.DelUser(userID)
+	})
+
 	t.Run("Delete user", func(t *testing.T) {
 		db.AddUser(userID)
 		l, _ := db.NewLinkToken(LinkToken{UserID: userID, CorrespondingCookie: "abc"}, time.Hour)
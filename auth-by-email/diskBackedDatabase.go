@@ -1,11 +1,14 @@
 package authbyemail
 
 import (
+	"context"
+	"crypto/subtle"
 	"database/sql"
 	"errors"
 	sqlite "github.com/mattn/go-sqlite3"
 	"log"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
@@ -15,11 +18,16 @@ import (
 // (MapBasedDatabase) is used when no path to a database file is given and is intended for
 // debugging or trial usage.
 type DiskBackedDatabase struct {
-	db     *sql.DB
-	logger *log.Logger
-	config *Config
+	db       *sql.DB
+	logger   *log.Logger
+	config   *Config
+	notifier *cookieNotifier
 }
 
+// Changes to cookies made by this process wake up waiting browsers immediately, but
+// changes made by others (e.g. the usermod tool) are only noticed by polling.
+const awaitCookiePollInterval = time.Second
+
 var databaseRegistration sync.Once
 
 // NewDiskBackedDatabase opens or creates the database file, and sets up the database
@@ -83,12 +91,41 @@ func NewDiskBackedDatabase(config *Config, logger *log.Logger) *DiskBackedDataba
 		}
 	}
 
-	return &DiskBackedDatabase{db, logger, config}
+	// Create the tables that were added later on, so that older databases can still be used
+	sqlStmt := `
+            create table if not exists LoginCodes (cookieToken text not null primary key, codeHash text not null, validUntil datetime, attemptsLeft integer);
+            create table if not exists PendingRequests (userID text not null primary key, email text not null, firstRequest integer, lastRequest integer, count integer);
+            create table if not exists APITokens (name text not null primary key, tokenHash text not null unique, createdAt integer);
+            create table if not exists Groups (userID text not null, groupName text not null, primary key (userID, groupName));
+            create table if not exists AccessTokens (id text not null primary key, tokenHash text not null unique, userID text not null, name text, scopes text, createdAt integer, lastUsed integer, expiresAt integer);
+            create table if not exists Versions (name text not null primary key, version integer not null);
+            create table if not exists RateLimits (name text not null primary key, tokens real not null, updated integer not null);
+            create table if not exists ApprovalDecisions (userID text not null, admin text not null, approved bool, decidedAt integer, primary key (userID, admin));`
+	if _, err = db.Exec(sqlStmt); err != nil {
+		logger.Panicf("Could not upgrade tables, %v", err)
+	}
+
+	// Likewise, add the columns that were added later on. Timestamps in these columns are
+	// stored as Unix time, which makes them easy to compare.
+	for _, column := range []struct{ table, name, definition string }{
+		{"Cookies", "createdAt", "integer"},
+		{"Cookies", "lastUsed", "integer"},
+		{"Users", "email", "text"},
+		{"Users", "expiresAt", "integer"},
+		{"Users", "expiryReminded", "bool"},
+	} {
+		if err = addColumnIfMissing(db, column.table, column.name, column.definition); err != nil {
+			logger.Panicf("Could not upgrade table %v, %v", column.table, err)
+		}
+	}
+
+	return &DiskBackedDatabase{db, logger, config, newCookieNotifier()}
 }
 
 // GetCookieContents returns a given cookie if it exists and has not expired, nil otherwise.
 func (d *DiskBackedDatabase) GetCookieToken(cookieText string) *CookieToken {
-	result, err := d.db.Query(`select userID, isValidated, browser from Cookies where cookieToken = ? and timeNotInPast(validUntil);`, cookieText)
+	result, err := d.db.Query(`select userID, isValidated, browser from Cookies where cookieToken = ? and timeNotInPast(validUntil)
+            and userID not in (select userID from Users where expiresAt <= ?);`, cookieText, time.Now().Unix())
 	if err != nil {
 		d.logger.Printf("Could not execute sql statement for CheckCookieToken, %v", err)
 		return nil
@@ -129,9 +166,9 @@ func (d *DiskBackedDatabase) GetLinkToken(linkText string) *LinkToken {
 	return &link.LinkToken
 }
 
-// IsKnownUser checks whether the UserID is valid
+// IsKnownUser checks whether the UserID is valid, and their access has not ended
 func (d *DiskBackedDatabase) IsKnownUser(user UserID) bool {
-	result, err := d.db.Query(`select * from Users where userID = ?;`, string(user))
+	result, err := d.db.Query(`select userID from Users where userID = ? and (expiresAt is null or expiresAt > ?);`, string(user), time.Now().Unix())
 	if err != nil {
 		d.logger.Printf("Could not execute sql statement for IsKnownUser, %v", err)
 		return false
@@ -143,7 +180,11 @@ func (d *DiskBackedDatabase) IsKnownUser(user UserID) bool {
 
 // NewCookieToken makes a fresh cookie token for the given user
 func (d *DiskBackedDatabase) NewCookieToken(cookieToken CookieToken) (string, error) {
-	if !d.IsKnownUser(cookieToken.UserID) {
+	if cookieToken.UserID == "" {
+		if cookieToken.IsValidated {
+			return "", errors.New("Tried to add a validated anonymous cookie token")
+		}
+	} else if !d.IsKnownUser(cookieToken.UserID) {
 		d.printDebugInfo()
 		return "", errors.New("Tried to add a cookie token for non-existent user")
 	}
@@ -152,12 +193,14 @@ func (d *DiskBackedDatabase) NewCookieToken(cookieToken CookieToken) (string, er
 
 	newToken := newRandom()
 
-	_, err := d.db.Exec(`insert into Cookies(cookieToken, userID, validUntil, isValidated, browser) values(?, ?, ?, ?, ?);`,
+	_, err := d.db.Exec(`insert into Cookies(cookieToken, userID, validUntil, isValidated, browser, createdAt, lastUsed) values(?, ?, ?, ?, ?, ?, ?);`,
 		newToken,
 		string(cookieToken.UserID),
 		time.Now().Add(d.config.CookieValidity),
 		cookieToken.IsValidated,
-		cookieToken.BrowserContext)
+		cookieToken.BrowserContext,
+		time.Now().Unix(),
+		time.Now().Unix())
 
 	if err != nil {
 		return "", err
@@ -179,11 +222,38 @@ func (d *DiskBackedDatabase) ValidateCookieToken(cookieToken string) error {
 		return errors.New("ValidateCookietoken: No such cookie found in database")
 	}
 
+	d.cookiesChanged()
+	return nil
+}
+
+// ClaimCookieToken assigns an anonymous cookie to a user and validates it
+func (d *DiskBackedDatabase) ClaimCookieToken(cookieToken string, user UserID) error {
+	if !d.IsKnownUser(user) {
+		return errors.New("Tried to claim a cookie token for non-existent user")
+	}
+
+	result, err := d.db.Exec(`update Cookies set userID = ?, isValidated = ? where cookieToken = ? and userID = '' and not isValidated and timeNotInPast(validUntil);`,
+		string(user),
+		true,
+		cookieToken)
+
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		return errors.New("ClaimCookieToken: No such anonymous cookie found in database")
+	}
+
+	d.cookiesChanged()
 	return nil
 }
 
 // DeleteCookieToken validates a cookie matching the given token
 func (d *DiskBackedDatabase) DeleteCookieToken(cookieToken string) error {
+	if _, err := d.db.Exec(`delete from LoginCodes where cookieToken = ?;`, cookieToken); err != nil {
+		return err
+	}
+
 	result, err := d.db.Exec(`delete from Cookies where cookieToken = ?;`, cookieToken)
 
 	if err != nil {
@@ -193,9 +263,97 @@ func (d *DiskBackedDatabase) DeleteCookieToken(cookieToken string) error {
 		return errors.New("DeleteCookietoken: No such cookie found in database")
 	}
 
+	d.cookiesChanged()
 	return nil
 }
 
+// cookiesChanged wakes up the browsers waiting for a cookie in this process, and counts
+// the change in the database, for the caches of all processes.
+func (d *DiskBackedDatabase) cookiesChanged() {
+	if _, err := d.db.Exec(`insert or ignore into Versions (name, version) values ('cookies', 0);
+            update Versions set version = version + 1 where name = 'cookies';`); err != nil {
+		d.logger.Printf("Could not count a change to the cookies, %v", err)
+	}
+	d.notifier.notify()
+}
+
+// CookieVersion returns the number of changes to the cookies counted by cookiesChanged
+func (d *DiskBackedDatabase) CookieVersion() int64 {
+	var version int64
+	err := d.db.QueryRow(`select version from Versions where name = 'cookies';`).Scan(&version)
+	if err != nil && err != sql.ErrNoRows {
+		d.logger.Printf("Could not execute sql statement for CookieVersion, %v", err)
+	}
+	return version
+}
+
+// TouchCookieToken records that a cookie was used, at most once per cookieTouchInterval
+func (d *DiskBackedDatabase) TouchCookieToken(cookieText string) {
+	now := time.Now()
+	_, err := d.db.Exec(`update Cookies set lastUsed = ? where cookieToken = ? and ifnull(lastUsed, 0) < ?;`,
+		now.Unix(),
+		cookieText,
+		now.Add(-cookieTouchInterval).Unix())
+
+	if err != nil {
+		d.logger.Printf("Could not execute sql statement for TouchCookieToken, %v", err)
+	}
+}
+
+// GetSessions returns all cookies of the given user that have not expired
+func (d *DiskBackedDatabase) GetSessions(user UserID) []Session {
+	result, err := d.db.Query(`select cookieToken, isValidated, browser, validUntil, ifnull(createdAt, 0), ifnull(lastUsed, 0) from Cookies where userID = ? and timeNotInPast(validUntil) order by createdAt;`, string(user))
+	if err != nil {
+		d.logger.Printf("Could not execute sql statement for GetSessions, %v", err)
+		return nil
+	}
+	defer result.Close()
+
+	var sessions []Session
+	for result.Next() {
+		var createdAt, lastUsed int64
+		session := Session{CookieToken: CookieToken{UserID: user}}
+		if err = result.Scan(&session.Cookie, &session.IsValidated, &session.BrowserContext, &session.ValidUntil, &createdAt, &lastUsed); err != nil {
+			d.logger.Print("Error getting record,", err)
+			continue
+		}
+		if createdAt != 0 {
+			session.CreatedAt = time.Unix(createdAt, 0)
+		}
+		if lastUsed != 0 {
+			session.LastUsed = time.Unix(lastUsed, 0)
+		}
+		sessions = append(sessions, session)
+	}
+
+	return sessions
+}
+
+// CountUsers returns the number of users
+func (d *DiskBackedDatabase) CountUsers() int {
+	var count int
+	if err := d.db.QueryRow(`select count(*) from Users;`).Scan(&count); err != nil {
+		d.logger.Printf("Could not execute sql statement for CountUsers, %v", err)
+	}
+	return count
+}
+
+// CountSessions returns the number of validated cookies that have not expired
+func (d *DiskBackedDatabase) CountSessions() int {
+	var count int
+	if err := d.db.QueryRow(`select count(*) from Cookies where isValidated and timeNotInPast(validUntil);`).Scan(&count); err != nil {
+		d.logger.Printf("Could not execute sql statement for CountSessions, %v", err)
+	}
+	return count
+}
+
+// AwaitCookieToken waits until a cookie is validated or deleted
+func (d *DiskBackedDatabase) AwaitCookieToken(ctx context.Context, cookieText string) *CookieToken {
+	return awaitCookieToken(ctx, d.notifier, awaitCookiePollInterval, func() *CookieToken {
+		return d.GetCookieToken(cookieText)
+	})
+}
+
 // NewLinkToken makes a fresh link token for the given user
 func (d *DiskBackedDatabase) NewLinkToken(linkToken LinkToken, validityPeriod time.Duration) (string, error) {
 	if !d.IsKnownUser(linkToken.UserID) {
@@ -218,14 +376,17 @@ func (d *DiskBackedDatabase) AddUser(user UserID) {
 		return
 	}
 
-	d.db.Exec(`insert into Users(userID) values(?);`, string(user))
+	// A user whose access ended is still there, and gets it back
+	d.db.Exec(`update Users set expiresAt = null, expiryReminded = 0 where userID = ?;`, string(user))
+	d.db.Exec(`insert or ignore into Users(userID) values(?);`, string(user))
+	d.DelPendingRequest(user)
 }
 
 // DelUser removes a user from the database. Tokens corresponding to a non-existent user
 // are invalid; if you re-add a user, tokens that were valid before deletion will become
 // valid once more.
 func (d *DiskBackedDatabase) DelUser(user UserID) error {
-	if !d.IsKnownUser(user) {
+	if !d.hasUser(user) {
 		d.printDebugInfo()
 		return errors.New("Tried to delete a non-existent user")
 	}
@@ -233,17 +394,515 @@ func (d *DiskBackedDatabase) DelUser(user UserID) error {
 	if _, err := d.db.Exec(`delete from Users where userID = ?;`, string(user)); err != nil {
 		return err
 	}
+	if _, err := d.db.Exec(`delete from LoginCodes where cookieToken in (select cookieToken from Cookies where userID = ?);`, string(user)); err != nil {
+		return err
+	}
 	if _, err := d.db.Exec(`delete from Cookies where userID = ?;`, string(user)); err != nil {
 		return err
 	}
+	if _, err := d.db.Exec(`delete from Groups where userID = ?;`, string(user)); err != nil {
+		return err
+	}
+	if _, err := d.db.Exec(`delete from AccessTokens where userID = ?;`, string(user)); err != nil {
+		return err
+	}
+	if err := d.DelApprovalDecisions(user); err != nil {
+		return err
+	}
+
+	d.cookiesChanged()
+	return nil
+}
+
+// SetUserEmail stores the encrypted e-mail address of an existing user
+func (d *DiskBackedDatabase) SetUserEmail(email *EmailAddr) error {
+	result, err := d.db.Exec(`update Users set email = ? where userID = ?;`,
+		CRYPTO.encrypt(email.String()),
+		string(CRYPTO.UserIDfromEmail(email)))
+
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return errors.New("Tried to set the e-mail address of a non-existent user")
+	}
+	return nil
+}
+
+// GetUserEmail returns the e-mail address of the given user, if it is known
+func (d *DiskBackedDatabase) GetUserEmail(user UserID) *EmailAddr {
+	var encryptedEmail sql.NullString
+	if err := d.db.QueryRow(`select email from Users where userID = ?;`, string(user)).Scan(&encryptedEmail); err != nil {
+		if err != sql.ErrNoRows {
+			d.logger.Printf("Could not execute sql statement for GetUserEmail, %v", err)
+		}
+		return nil
+	}
+
+	u := User{UserID: user, EncryptedEmail: encryptedEmail.String}
+	email, err := u.Email()
+	if err != nil {
+		return nil
+	}
+	return email
+}
+
+// GetUsers returns all users
+func (d *DiskBackedDatabase) GetUsers() []User {
+	return d.queryUsers(`select userID, email, ifnull(expiresAt, 0) from Users;`)
+}
+
+// queryUsers returns the users found by a query for their ID, e-mail and expiry.
+func (d *DiskBackedDatabase) queryUsers(query string, args ...interface{}) []User {
+	result, err := d.db.Query(query, args...)
+	if err != nil {
+		d.logger.Printf("Could not execute sql statement for users, %v", err)
+		return nil
+	}
+	defer result.Close()
 
+	var users []User
+	for result.Next() {
+		var userID string
+		var encryptedEmail sql.NullString
+		var expiresAt int64
+		if err = result.Scan(&userID, &encryptedEmail, &expiresAt); err != nil {
+			d.logger.Print("Error getting record,", err)
+			continue
+		}
+		user := User{UserID: UserID(userID), EncryptedEmail: encryptedEmail.String}
+		if expiresAt != 0 {
+			user.ExpiresAt = time.Unix(expiresAt, 0)
+		}
+		users = append(users, user)
+	}
+
+	return users
+}
+
+// hasUser checks whether the user is in the database, even if their access has ended
+func (d *DiskBackedDatabase) hasUser(user UserID) bool {
+	var count int
+	if err := d.db.QueryRow(`select count(*) from Users where userID = ?;`, string(user)).Scan(&count); err != nil {
+		d.logger.Printf("Could not execute sql statement for hasUser, %v", err)
+	}
+	return count > 0
+}
+
+// SetUserExpiry sets when a user loses access, or removes the expiry given the zero time
+func (d *DiskBackedDatabase) SetUserExpiry(user UserID, expiresAt time.Time) error {
+	var unix interface{}
+	if !expiresAt.IsZero() {
+		unix = expiresAt.Unix()
+	}
+	result, err := d.db.Exec(`update Users set expiresAt = ?, expiryReminded = 0 where userID = ?;`, unix, string(user))
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return errors.New("Tried to set the expiry of a non-existent user")
+	}
+	d.cookiesChanged()
 	return nil
 }
 
+// GetUserExpiry returns when a user loses access, or the zero time if never
+func (d *DiskBackedDatabase) GetUserExpiry(user UserID) time.Time {
+	var expiresAt sql.NullInt64
+	if err := d.db.QueryRow(`select expiresAt from Users where userID = ?;`, string(user)).Scan(&expiresAt); err != nil {
+		if err != sql.ErrNoRows {
+			d.logger.Printf("Could not execute sql statement for GetUserExpiry, %v", err)
+		}
+		return time.Time{}
+	}
+	if !expiresAt.Valid {
+		return time.Time{}
+	}
+	return time.Unix(expiresAt.Int64, 0)
+}
+
+// GetExpiringUsers returns the users whose access ends before the given time, and who
+// were not reminded yet
+func (d *DiskBackedDatabase) GetExpiringUsers(before time.Time) []User {
+	return d.queryUsers(`select userID, email, expiresAt from Users where expiresAt > ? and expiresAt <= ? and not ifnull(expiryReminded, 0);`,
+		time.Now().Unix(), before.Unix())
+}
+
+// SetExpiryReminded records that a user was reminded that their access ends
+func (d *DiskBackedDatabase) SetExpiryReminded(user UserID) error {
+	_, err := d.db.Exec(`update Users set expiryReminded = 1 where userID = ?;`, string(user))
+	return err
+}
+
+// SetUserGroups replaces the groups of the given user
+func (d *DiskBackedDatabase) SetUserGroups(user UserID, groups []string) error {
+	if !d.IsKnownUser(user) {
+		return errors.New("Tried to set the groups of a non-existent user")
+	}
+
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`delete from Groups where userID = ?;`, string(user)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, group := range groups {
+		if _, err = tx.Exec(`insert or ignore into Groups(userID, groupName) values(?, ?);`, string(user), group); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetUserGroups returns the groups of the given user
+func (d *DiskBackedDatabase) GetUserGroups(user UserID) []string {
+	result, err := d.db.Query(`select groupName from Groups where userID = ? order by groupName;`, string(user))
+	if err != nil {
+		d.logger.Printf("Could not execute sql statement for GetUserGroups, %v", err)
+		return nil
+	}
+	defer result.Close()
+
+	var groups []string
+	for result.Next() {
+		var group string
+		if err = result.Scan(&group); err != nil {
+			d.logger.Print("Error getting record,", err)
+			continue
+		}
+		groups = append(groups, group)
+	}
+
+	return groups
+}
+
+// AddPendingRequest records or updates a request for access
+func (d *DiskBackedDatabase) AddPendingRequest(email *EmailAddr) (bool, error) {
+	user := CRYPTO.UserIDfromEmail(email)
+	now := time.Now().Unix()
+
+	result, err := d.db.Exec(`insert or ignore into PendingRequests(userID, email, firstRequest, lastRequest, count) values(?, ?, ?, ?, ?);`,
+		string(user),
+		CRYPTO.encrypt(email.String()),
+		now,
+		now,
+		1)
+
+	if err != nil {
+		return false, err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 1 {
+		return true, nil
+	}
+
+	// The user asked before, so only update the existing request
+	_, err = d.db.Exec(`update PendingRequests set lastRequest = ?, count = count + 1 where userID = ?;`, now, string(user))
+	return false, err
+}
+
+// GetPendingRequests returns all pending requests, oldest first
+func (d *DiskBackedDatabase) GetPendingRequests() []PendingRequest {
+	result, err := d.db.Query(`select userID, email, firstRequest, lastRequest, count from PendingRequests order by firstRequest;`)
+	if err != nil {
+		d.logger.Printf("Could not execute sql statement for GetPendingRequests, %v", err)
+		return nil
+	}
+	defer result.Close()
+
+	var requests []PendingRequest
+	for result.Next() {
+		var userID string
+		var firstRequest, lastRequest int64
+		var request PendingRequest
+		if err = result.Scan(&userID, &request.EncryptedEmail, &firstRequest, &lastRequest, &request.Count); err != nil {
+			d.logger.Print("Error getting record,", err)
+			continue
+		}
+		request.UserID = UserID(userID)
+		request.FirstRequest = time.Unix(firstRequest, 0)
+		request.LastRequest = time.Unix(lastRequest, 0)
+		requests = append(requests, request)
+	}
+
+	return requests
+}
+
+// DelPendingRequest removes a pending request
+func (d *DiskBackedDatabase) DelPendingRequest(user UserID) {
+	if _, err := d.db.Exec(`delete from PendingRequests where userID = ?;`, string(user)); err != nil {
+		d.logger.Printf("Could not execute sql statement for DelPendingRequest, %v", err)
+	}
+}
+
+// AddApprovalDecision records an admin's decision about a user
+func (d *DiskBackedDatabase) AddApprovalDecision(user UserID, decision ApprovalDecision) error {
+	_, err := d.db.Exec(`insert or replace into ApprovalDecisions(userID, admin, approved, decidedAt) values(?, ?, ?, ?);`,
+		string(user),
+		decision.Admin,
+		decision.Approved,
+		decision.DecidedAt.Unix())
+	return err
+}
+
+// GetApprovalDecisions returns the decisions about a user, oldest first
+func (d *DiskBackedDatabase) GetApprovalDecisions(user UserID) []ApprovalDecision {
+	result, err := d.db.Query(`select admin, approved, decidedAt from ApprovalDecisions where userID = ? order by decidedAt, admin;`, string(user))
+	if err != nil {
+		d.logger.Printf("Could not execute sql statement for GetApprovalDecisions, %v", err)
+		return nil
+	}
+	defer result.Close()
+
+	var decisions []ApprovalDecision
+	for result.Next() {
+		var decision ApprovalDecision
+		var decidedAt int64
+		if err = result.Scan(&decision.Admin, &decision.Approved, &decidedAt); err != nil {
+			d.logger.Print("Error getting record,", err)
+			continue
+		}
+		decision.DecidedAt = time.Unix(decidedAt, 0)
+		decisions = append(decisions, decision)
+	}
+
+	return decisions
+}
+
+// DelApprovalDecisions removes the decisions about a user
+func (d *DiskBackedDatabase) DelApprovalDecisions(user UserID) error {
+	_, err := d.db.Exec(`delete from ApprovalDecisions where userID = ?;`, string(user))
+	return err
+}
+
+// NewAPIToken makes a fresh API token with the given name, replacing any earlier
+// token of that name. Only a hash of the token is stored.
+func (d *DiskBackedDatabase) NewAPIToken(name string) (string, error) {
+	token := newRandom()
+	_, err := d.db.Exec(`insert or replace into APITokens(name, tokenHash, createdAt) values(?, ?, ?);`,
+		name,
+		hashAPIToken(token),
+		time.Now().Unix())
+
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// CheckAPIToken returns the name of the given API token, and whether it exists
+func (d *DiskBackedDatabase) CheckAPIToken(token string) (string, bool) {
+	var name string
+	err := d.db.QueryRow(`select name from APITokens where tokenHash = ?;`, hashAPIToken(token)).Scan(&name)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			d.logger.Printf("Could not execute sql statement for CheckAPIToken, %v", err)
+		}
+		return "", false
+	}
+	return name, true
+}
+
+// DelAPIToken removes the API token with the given name
+func (d *DiskBackedDatabase) DelAPIToken(name string) error {
+	result, err := d.db.Exec(`delete from APITokens where name = ?;`, name)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return errors.New("Tried to delete a non-existent API token")
+	}
+	return nil
+}
+
+// NewAccessToken makes a fresh personal access token for an existing user
+func (d *DiskBackedDatabase) NewAccessToken(accessToken AccessToken, validityPeriod time.Duration) (string, error) {
+	if !d.IsKnownUser(accessToken.UserID) {
+		return "", errors.New("Tried to make an access token for a non-existent user")
+	}
+
+	token := newAccessToken()
+	now := time.Now()
+	_, err := d.db.Exec(`insert into AccessTokens(id, tokenHash, userID, name, scopes, createdAt, lastUsed, expiresAt) values(?, ?, ?, ?, ?, ?, 0, ?);`,
+		newRandom(),
+		hashAccessToken(token),
+		string(accessToken.UserID),
+		accessToken.Name,
+		strings.Join(accessToken.Scopes, " "),
+		now.Unix(),
+		now.Add(validityPeriod).Unix())
+
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// GetAccessToken returns the information of a personal access token that has not expired
+func (d *DiskBackedDatabase) GetAccessToken(token string) *AccessToken {
+	result, err := d.db.Query(`select id, userID, name, scopes, createdAt, lastUsed, expiresAt from AccessTokens where tokenHash = ? and expiresAt > ?;`,
+		hashAccessToken(token),
+		time.Now().Unix())
+	if err != nil {
+		d.logger.Printf("Could not execute sql statement for GetAccessToken, %v", err)
+		return nil
+	}
+	defer result.Close()
+
+	if tokens := scanAccessTokens(result, d.logger); len(tokens) == 1 {
+		return &tokens[0]
+	}
+	return nil
+}
+
+// TouchAccessToken records when an access token was last used
+func (d *DiskBackedDatabase) TouchAccessToken(id string) {
+	now := time.Now()
+	_, err := d.db.Exec(`update AccessTokens set lastUsed = ? where id = ? and lastUsed < ?;`,
+		now.Unix(),
+		id,
+		now.Add(-cookieTouchInterval).Unix())
+
+	if err != nil {
+		d.logger.Printf("Could not execute sql statement for TouchAccessToken, %v", err)
+	}
+}
+
+// GetAccessTokens returns all access tokens of the given user that have not expired
+func (d *DiskBackedDatabase) GetAccessTokens(user UserID) []AccessToken {
+	result, err := d.db.Query(`select id, userID, name, scopes, createdAt, lastUsed, expiresAt from AccessTokens where userID = ? and expiresAt > ? order by createdAt;`,
+		string(user),
+		time.Now().Unix())
+	if err != nil {
+		d.logger.Printf("Could not execute sql statement for GetAccessTokens, %v", err)
+		return nil
+	}
+	defer result.Close()
+
+	return scanAccessTokens(result, d.logger)
+}
+
+// DelAccessToken removes an access token of the given user
+func (d *DiskBackedDatabase) DelAccessToken(user UserID, id string) error {
+	result, err := d.db.Exec(`delete from AccessTokens where userID = ? and id = ?;`, string(user), id)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return errors.New("Tried to delete a non-existent access token")
+	}
+	return nil
+}
+
+// scanAccessTokens reads the access tokens from the result of a query.
+func scanAccessTokens(result *sql.Rows, logger *log.Logger) []AccessToken {
+	var tokens []AccessToken
+	for result.Next() {
+		var userID, scopes string
+		var createdAt, lastUsed, expiresAt int64
+		var token AccessToken
+		if err := result.Scan(&token.ID, &userID, &token.Name, &scopes, &createdAt, &lastUsed, &expiresAt); err != nil {
+			logger.Print("Error getting record,", err)
+			continue
+		}
+		token.UserID = UserID(userID)
+		token.Scopes = strings.Fields(scopes)
+		token.CreatedAt = time.Unix(createdAt, 0)
+		if lastUsed != 0 {
+			token.LastUsed = time.Unix(lastUsed, 0)
+		}
+		token.ExpiresAt = time.Unix(expiresAt, 0)
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+// NewLoginCode makes a fresh one-time code for the given cookie
+func (d *DiskBackedDatabase) NewLoginCode(cookieText string, validityPeriod time.Duration) (string, error) {
+	if d.GetCookieToken(cookieText) == nil {
+		return "", errors.New("Tried to add a login code for a non-existent cookie token")
+	}
+
+	code := newLoginCode()
+
+	_, err := d.db.Exec(`insert or replace into LoginCodes(cookieToken, codeHash, validUntil, attemptsLeft) values(?, ?, ?, ?);`,
+		cookieText,
+		hashLoginCode(cookieText, code),
+		time.Now().Add(validityPeriod),
+		loginCodeAttempts)
+
+	if err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// ValidateLoginCode validates the cookie belonging to the code, if the code is correct
+func (d *DiskBackedDatabase) ValidateLoginCode(cookieText string, code string) error {
+	// Use up an attempt first, so that concurrent guesses can not exceed the limit
+	result, err := d.db.Exec(`update LoginCodes set attemptsLeft = attemptsLeft - 1 where cookieToken = ? and attemptsLeft > 0 and timeNotInPast(validUntil);`, cookieText)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		d.db.Exec(`delete from LoginCodes where cookieToken = ?;`, cookieText)
+		return errors.New("ValidateLoginCode: No such login code found in database")
+	}
+
+	var codeHash string
+	if err := d.db.QueryRow(`select codeHash from LoginCodes where cookieToken = ?;`, cookieText).Scan(&codeHash); err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(codeHash), []byte(hashLoginCode(cookieText, code))) != 1 {
+		d.db.Exec(`delete from LoginCodes where cookieToken = ? and attemptsLeft <= 0;`, cookieText)
+		return errors.New("ValidateLoginCode: Incorrect login code")
+	}
+
+	if _, err := d.db.Exec(`delete from LoginCodes where cookieToken = ?;`, cookieText); err != nil {
+		return err
+	}
+
+	return d.ValidateCookieToken(cookieText)
+}
+
+// UpdateRateLimit updates the state of a rate limit in a transaction. The time of the
+// last update is stored in nanoseconds, since tokens may come back every few seconds.
+func (d *DiskBackedDatabase) UpdateRateLimit(key string, update func(RateLimitState) RateLimitState) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var state RateLimitState
+	var updated int64
+	err = tx.QueryRow(`select tokens, updated from RateLimits where name = ?;`, key).Scan(&state.Tokens, &updated)
+	if err == nil {
+		state.Updated = time.Unix(0, updated)
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
+	state = update(state)
+	if _, err := tx.Exec(`insert or replace into RateLimits (name, tokens, updated) values (?, ?, ?);`, key, state.Tokens, state.Updated.UnixNano()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Close closes the database file
+func (d *DiskBackedDatabase) Close() error {
+	return d.db.Close()
+}
+
 func (d *DiskBackedDatabase) printDebugInfo() {
 	d.logger.Println("Dumping database")
 
-	result, err := d.db.Query(`select * from Users;`)
+	result, err := d.db.Query(`select userID from Users;`)
 	if err != nil {
 		d.logger.Println("Can not get Users!", err)
 		return
@@ -257,7 +916,7 @@ func (d *DiskBackedDatabase) printDebugInfo() {
 		d.logger.Printf("USERS uid %v", userID)
 	}
 
-	result, err = d.db.Query(`select * from Cookies;`)
+	result, err = d.db.Query(`select cookieToken, userID, validUntil, isValidated, browser from Cookies;`)
 	if err != nil {
 		d.logger.Println("Can not get Cookies!", err)
 		return
@@ -287,4 +946,40 @@ func (d *DiskBackedDatabase) deleteExpiredCookies() {
 	} else {
 		d.logger.Printf("Purged %v expired cookies from the database", rowsAffected)
 	}
+
+	if _, err := d.db.Exec("delete from LoginCodes where not timeNotInPast(validUntil) or cookieToken not in (select cookieToken from Cookies);"); err != nil {
+		d.logger.Printf("Error deleting expired login codes: %v", err)
+	}
+
+	if _, err := d.db.Exec("delete from AccessTokens where expiresAt <= ?;", time.Now().Unix()); err != nil {
+		d.logger.Printf("Error deleting expired access tokens: %v", err)
+	}
+
+	if _, err := d.db.Exec("delete from RateLimits where updated < ?;", time.Now().Add(-rateLimitMaxPeriod).UnixNano()); err != nil {
+		d.logger.Printf("Error deleting old rate limits: %v", err)
+	}
+}
+
+// addColumnIfMissing adds a column to a table that was made by an older version of this
+// package. If the column already exists, nothing happens.
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	result, err := db.Query(`select name from pragma_table_info(?);`, table)
+	if err != nil {
+		return err
+	}
+	defer result.Close()
+
+	for result.Next() {
+		var name string
+		if err = result.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	result.Close()
+
+	_, err = db.Exec(`alter table ` + table + ` add column ` + column + ` ` + definition + `;`)
+	return err
 }
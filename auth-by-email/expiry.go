@@ -0,0 +1,140 @@
+package authbyemail
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// How long before their access ends users are reminded, how often we look for users to
+// remind, and how long after their access ended users can still ask for a renewal.
+const (
+	expiryReminderPeriod = 7 * 24 * time.Hour
+	expiryCheckInterval  = time.Hour
+	renewalGracePeriod   = 30 * 24 * time.Hour
+)
+
+// ParseExpiry parses the date on which the access of a user ends. A date like 2006-01-02
+// means their access ends at the start of that day, local time; a time in RFC 3339 format
+// is taken as is. The empty string means that their access does not end, and gives the
+// zero time.
+func ParseExpiry(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.New("Not a date like 2006-01-02, or a time like 2006-01-02T15:04:05Z")
+	}
+	return t, nil
+}
+
+// formatExpiry formats the date on which the access of a user ends as ParseExpiry reads
+// it, for date fields in forms.
+func formatExpiry(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Local().Format("2006-01-02")
+}
+
+// accessEnded returns when the access of a user ended, and whether it did. Approving
+// such a user lets their access go on for ever, unless they are given a new end.
+func (h AuthByEmailHandler) accessEnded(user UserID) (time.Time, bool) {
+	expiresAt := h.database.GetUserExpiry(user)
+	return expiresAt, !expiresAt.IsZero() && !expiresAt.After(time.Now())
+}
+
+// A renewal lets a user whose access ends soon ask the admins to extend it. Like an
+// invitation it is encrypted into the link, and it is only good for the expiry it was
+// sent about: once an admin changed that, the link no longer asks for anything.
+type renewal struct {
+	Email      string    `json:"email"`
+	ExpiresAt  time.Time `json:"expiresAt"`
+	ValidUntil time.Time `json:"validUntil"`
+}
+
+// Renewals are marked, so that nothing else that is encrypted can pass for one.
+const renewalPrefix = "renew/"
+
+func (r renewal) serialize() string {
+	return CRYPTO.sealJSON(renewalPrefix, r)
+}
+
+// parseRenewal decrypts the token of a renewal link, and checks that it has not expired.
+func parseRenewal(token string) (*renewal, error) {
+	var r renewal
+	if err := CRYPTO.openJSON(renewalPrefix, token, &r); err != nil {
+		return nil, errors.New("Not a renewal")
+	}
+	if time.Now().After(r.ValidUntil) {
+		return nil, errors.New("The renewal link has expired")
+	}
+	return &r, nil
+}
+
+// expiryCheck keeps when we last looked for users to remind, shared by all copies of the
+// handler.
+type expiryCheck struct {
+	mutex   sync.Mutex
+	checked time.Time
+}
+
+// due returns whether it is time to look for users to remind again, and if so, notes
+// that we are doing so now.
+func (c *expiryCheck) due() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if time.Since(c.checked) < expiryCheckInterval {
+		return false
+	}
+	c.checked = time.Now()
+	return true
+}
+
+// remindExpiringUsers sends the expiry reminders in the background, at most once every
+// expiryCheckInterval. It is called for every request, so that no separate process is
+// needed for the reminders.
+func (h AuthByEmailHandler) remindExpiringUsers() {
+	if h.expiryCheck == nil || !h.expiryCheck.due() {
+		return
+	}
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				h.logger.Printf("Recovered from a panic sending expiry reminders! %v", r)
+			}
+		}()
+		h.sendExpiryReminders()
+	}()
+}
+
+// sendExpiryReminders mails every user whose access ends within expiryReminderPeriod a
+// link to ask for a renewal, once. Users are marked as reminded before they are mailed,
+// so that handlers sharing the database do not remind them twice.
+func (h AuthByEmailHandler) sendExpiryReminders() {
+	for _, user := range h.database.GetExpiringUsers(time.Now().Add(expiryReminderPeriod)) {
+		if err := h.database.SetExpiryReminded(user.UserID); err != nil {
+			h.logger.Printf("Database error marking user %v as reminded, %v", user.UserID, err)
+			continue
+		}
+		email, err := user.Email()
+		if err != nil {
+			h.logger.Printf("Access of user %v ends on %v, but they can not be reminded, %v", user.UserID, formatExpiry(user.ExpiresAt), err)
+			continue
+		}
+
+		token := renewal{
+			Email:      email.String(),
+			ExpiresAt:  user.ExpiresAt,
+			ValidUntil: user.ExpiresAt.Add(renewalGracePeriod),
+		}.serialize()
+		if err := h.mailer.SendExpiryReminder(email, token, user.ExpiresAt); err != nil {
+			h.logger.Printf("Error mailing user %v an expiry reminder, %v", email.String(), err)
+		}
+	}
+}
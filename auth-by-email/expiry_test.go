@@ -0,0 +1,71 @@
+package authbyemail
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseExpiry(t *testing.T) {
+	if expiresAt, err := ParseExpiry(""); err != nil || !expiresAt.IsZero() {
+		t.Errorf("Empty expiry should be the zero time, got %v %v", expiresAt, err)
+	}
+	if expiresAt, err := ParseExpiry("2030-06-01"); err != nil || !expiresAt.Equal(time.Date(2030, 6, 1, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("Date should be the start of that day, got %v %v", expiresAt, err)
+	}
+	if expiresAt, err := ParseExpiry("2030-06-01T12:00:00Z"); err != nil || !expiresAt.Equal(time.Date(2030, 6, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("RFC 3339 time not parsed, got %v %v", expiresAt, err)
+	}
+	for _, bad := range []string{"soon", "2030-13-01", "01-06-2030"} {
+		if _, err := ParseExpiry(bad); err == nil {
+			t.Errorf("Bad expiry %q accepted", bad)
+		}
+	}
+	if formatted := formatExpiry(time.Date(2030, 6, 1, 0, 0, 0, 0, time.Local)); formatted != "2030-06-01" {
+		t.Errorf("Expiry formatted as %q", formatted)
+	}
+}
+
+func TestSendExpiryReminders(t *testing.T) {
+	h := NewTestHandler()
+
+	soon, _ := NewEmailAddrFromString("soon@example.com")
+	later, _ := NewEmailAddrFromString("later@example.com")
+	h.addUser(soon)
+	h.addUser(later)
+	h.database.SetUserExpiry(CRYPTO.UserIDfromEmail(soon), time.Now().Add(3*24*time.Hour))
+	h.database.SetUserExpiry(CRYPTO.UserIDfromEmail(later), time.Now().Add(30*24*time.Hour))
+
+	// A user whose address is not known yet can not be reminded, but should not stop the others
+	h.database.AddUser("unknown-address")
+	h.database.SetUserExpiry("unknown-address", time.Now().Add(24*time.Hour))
+
+	h.sendExpiryReminders()
+	if h.mailer.(*MockMailer).mail != "expiry" {
+		t.Fatal("No reminder sent to a user whose access ends within a week")
+	}
+	renewal, err := parseRenewal(h.mailer.(*MockMailer).code)
+	if err != nil || renewal.Email != soon.String() || !renewal.ExpiresAt.Equal(h.database.GetUserExpiry(CRYPTO.UserIDfromEmail(soon))) {
+		t.Errorf("Reminder does not hold a renewal for the user, got %#v %v", renewal, err)
+	}
+
+	// Users are reminded once
+	h.mailer.(*MockMailer).mail = ""
+	h.sendExpiryReminders()
+	if h.mailer.(*MockMailer).mail != "" {
+		t.Error("User reminded twice")
+	}
+}
+
+func TestExpiryCheck(t *testing.T) {
+	var c expiryCheck
+	if !c.due() {
+		t.Error("First check not due")
+	}
+	if c.due() {
+		t.Error("Check due again right away")
+	}
+	c.checked = time.Now().Add(-expiryCheckInterval)
+	if !c.due() {
+		t.Error("Check not due after the interval")
+	}
+}
@@ -18,6 +18,7 @@ require (
 	golang.org/x/text v0.3.8 // indirect
 	google.golang.org/protobuf v1.25.0 // indirect
 	gopkg.in/square/go-jose.v2 v2.5.1 // indirect
+	rsc.io/qr v0.2.0
 )
 
 replace github.com/mholt/certmagic => github.com/caddyserver/certmagic v0.8.0
@@ -0,0 +1,40 @@
+package authbyemail
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// IsValidGroupName checks whether a group name consists of lowercase letters,
+// digits, dashes and underscores only, so that it can be used in the Caddyfile,
+// in lists separated by commas, and in headers.
+func IsValidGroupName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseGroups parses a list of group names separated by commas and/or spaces,
+// like "finance, hr". The result is sorted and contains no duplicates.
+func ParseGroups(text string) ([]string, error) {
+	seen := make(map[string]bool)
+	groups := []string{}
+	for _, group := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+		if !IsValidGroupName(group) {
+			return nil, fmt.Errorf("Invalid group name `%v`", group)
+		}
+		if !seen[group] {
+			seen[group] = true
+			groups = append(groups, group)
+		}
+	}
+	sort.Strings(groups)
+	return groups, nil
+}
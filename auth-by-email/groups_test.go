@@ -0,0 +1,26 @@
+package authbyemail
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseGroups(t *testing.T) {
+	for text, expected := range map[string][]string{
+		"":                {},
+		"finance":         {"finance"},
+		"hr, Finance,,hr": {"finance", "hr"},
+		" team-1 team_2 ": {"team-1", "team_2"},
+	} {
+		groups, err := ParseGroups(text)
+		if err != nil || !reflect.DeepEqual(groups, expected) {
+			t.Errorf("Parsing %q gave %#v, error %v; wanted %#v", text, groups, err, expected)
+		}
+	}
+
+	for _, text := range []string{"finance;hr", "ünicode", "a/b"} {
+		if groups, err := ParseGroups(text); err == nil {
+			t.Errorf("Parsing %q should fail, but gave %#v", text, groups)
+		}
+	}
+}
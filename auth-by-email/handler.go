@@ -1,7 +1,6 @@
 package authbyemail
 
 import (
-	"github.com/caddyserver/caddy/caddyhttp/httpserver"
 	"log"
 	"net/http"
 	"os"
@@ -9,12 +8,28 @@ import (
 	"strings"
 )
 
+// A Handler serves HTTP requests like Caddy v1 handlers do. It returns the status code
+// of the response if it did not write one itself, or 0 if it did, and any error that
+// occurred. Caddy's own handlers are Handlers, and NewMiddleware adapts them to net/http.
+type Handler interface {
+	ServeHTTP(http.ResponseWriter, *http.Request) (int, error)
+}
+
 type AuthByEmailHandler struct {
-	Next     httpserver.Handler
+	Next     Handler
 	config   *Config
 	database Database
 	mailer   Mailer
 	logger   *log.Logger
+
+	// The authorization codes handed out to OIDC clients, shared by all copies of the handler
+	oidcCodes *oidcCodes
+
+	// Where the states of the rate limits on logging in are kept
+	rateLimits rateLimitStore
+
+	// When we last looked for users whose access ends soon, shared by all copies of the handler
+	expiryCheck *expiryCheck
 }
 
 // NewHandler initialises the package's various parts and returns the new Handler.
@@ -25,7 +40,7 @@ type AuthByEmailHandler struct {
 // if the database can not be initialised (for example because a location for the file
 // was given, but can not be written to), or if the mailer can not be initialised
 // (for example because the SendInBlue API key is not present in the environment).
-func NewHandler(next httpserver.Handler, config *Config) AuthByEmailHandler {
+func NewHandler(next Handler, config *Config) AuthByEmailHandler {
 	InitializeCrypto()
 
 	logger := log.New(os.Stderr, "(AuthByEmail) ", log.LstdFlags)
@@ -36,7 +51,12 @@ func NewHandler(next httpserver.Handler, config *Config) AuthByEmailHandler {
 	if config.Database == "" {
 		database = NewMapBasedDatabase()
 	} else {
-		database = NewDiskBackedDatabase(config, logger)
+		database = NewCachedDatabase(NewDiskBackedDatabase(config, logger), cookieCacheSize, cookieCacheTTL)
+	}
+
+	var rateLimits rateLimitStore = newMemoryRateLimits()
+	if config.PersistRateLimits {
+		rateLimits = database
 	}
 
 	return AuthByEmailHandler{
@@ -45,9 +65,19 @@ func NewHandler(next httpserver.Handler, config *Config) AuthByEmailHandler {
 		database: database,
 		mailer:   NewRealMailer(config, logger),
 		logger:   logger,
+
+		oidcCodes:   newOIDCCodes(),
+		rateLimits:  rateLimits,
+		expiryCheck: &expiryCheck{},
 	}
 }
 
+// Close releases the database of the handler. This is only needed if the program keeps
+// running without it, e.g. when Caddy reloads its configuration.
+func (h AuthByEmailHandler) Close() error {
+	return h.database.Close()
+}
+
 // ServeHTTP serves a response in response to an HTTP request.
 // The AuthByEmail handler will check whether the user is sufficiently authorized
 // before passing the request on to the "next" handler, and if not, will instead serve
@@ -61,6 +91,9 @@ func NewHandler(next httpserver.Handler, config *Config) AuthByEmailHandler {
 // send email to an admin asking for access.
 //
 // auth/wait - will wait after "login" in case the user approves the cookie elsewhere.
+// A POST request with a code= field logs in using the one-time code from the e-mail.
+//
+// auth/wait/events - streams an event to the wait page once its cookie is approved elsewhere.
 //
 // auth/logout - will log out a logged in user by removing their cookie from the database.
 //
@@ -71,8 +104,37 @@ func NewHandler(next httpserver.Handler, config *Config) AuthByEmailHandler {
 // whether to accept or refuse membership to that user. A POST request to the same endpoint
 // executes that decision.
 //
+// auth/invite - can be GETted with a token from an invitation, which adds the invited user
+// and logs them in the first time it is used.
+//
+// auth/renew - can be GETted with a token from an expiry reminder, which asks the admins
+// to extend the access of the user.
+//
 // auth/delete - can be GETed, in which case it will ask for confirmation. A POST request
 // to the same endpoint deletes the logged-in user from the database.
+//
+// auth/sessions - lists the logged-in user's sessions. A POST request to the same endpoint
+// revokes one session, or all but the current one.
+//
+// auth/admin - shows the admin dashboard to logged-in admins. A POST request to the same
+// endpoint approves, revokes, invites, logs out or sends a login link to a user.
+//
+// auth/qr - if enabled, shows a QR code with which a logged-in phone can log in this browser.
+//
+// auth/qr/confirm - can be GETted by a logged-in user with a request from a QR code, and asks
+// whether to log in the screen that showed it. A POST request executes that decision.
+//
+// auth/verify - answers 200 (with identity headers) or 401 depending on the cookie, so that
+// other reverse proxies can ask us whether to let a request through.
+//
+// auth/tokens - if enabled, lists the personal access tokens of the logged-in user. A POST
+// request to the same endpoint makes or revokes one.
+//
+// auth/oidc/... - if OIDC clients are configured, lets other websites log in their users
+// with us, as an OpenID Connect provider. See serveOIDC for the endpoints.
+//
+// auth/api/v1/... - a JSON API for provisioning users, for which an API token is needed.
+// See serveAPI for the endpoints.
 func (h AuthByEmailHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
 	// Caddy swallows all panics we allow to bubble up, so we have to handle them here.
 	defer func() {
@@ -81,6 +143,18 @@ func (h AuthByEmailHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) (i
 		}
 	}()
 
+	h.remindExpiringUsers()
+
+	// Caddy v1 fills in the scheme, which decides whether our cookies are only sent over
+	// https; other servers leave it empty.
+	if r.URL.Scheme == "" {
+		if r.TLS != nil {
+			r.URL.Scheme = "https"
+		} else {
+			r.URL.Scheme = "http"
+		}
+	}
+
 	sanitizedUrl := strings.ToLower(r.URL.Path)
 	for strings.HasPrefix(sanitizedUrl, "/") {
 		sanitizedUrl = sanitizedUrl[1:]
@@ -101,31 +175,90 @@ func (h AuthByEmailHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) (i
 		case "wait":
 			return h.serveWait(w, r)
 
+		case "wait/events":
+			return h.serveWaitEvents(w, r)
+
 		case "welcome":
 			return h.serveWelcome(w, r)
 
 		case "approve":
 			return h.serveApprove(w, r)
 
+		case "invite":
+			return h.serveInvite(w, r)
+
+		case "renew":
+			return h.serveRenew(w, r)
+
 		case "logout":
 			return h.serveLogout(w, r)
 
 		case "delete":
 			return h.serveDelete(w, r)
 
+		case "sessions":
+			return h.serveSessions(w, r)
+
+		case "admin":
+			return h.serveAdmin(w, r)
+
+		case "qr":
+			return h.serveQR(w, r)
+
+		case "qr/confirm":
+			return h.serveQRConfirm(w, r)
+
+		case "verify":
+			return h.serveVerify(w, r)
+
+		case "tokens":
+			return h.serveTokens(w, r)
+
+		case "challenge":
+			return h.serveChallenge(w)
+
+		case "challenge.js":
+			return h.serveChallengeScript(w)
+
 		default:
+			if strings.HasPrefix(sanitizedUrl[5:], "api/v1/") {
+				return h.serveAPI(w, r, sanitizedUrl[12:])
+			}
+			if strings.HasPrefix(sanitizedUrl[5:], "oidc/") {
+				return h.serveOIDC(w, r, sanitizedUrl[10:])
+			}
 			return h.serveNotFound(w)
 		}
 	}
 
 	// Otherwise, this is a request for the underlying website, and we should see if it has a
 	// proper cookie set. If not, we send the log-in form.
-	if !h.checkAuthentication(sanitizedUrl, r) {
+	// The user is looked up once, and passed on to the checks below.
+	user, fromCookie, ok := h.checkAuthentication(sanitizedUrl, r)
+	if !ok {
 		return h.serveStaticPage(w, r, 403, TplLogin)
 	}
 
+	// Logged-in users may still lack the group membership needed for this path.
+	if !h.checkAuthorization(sanitizedUrl, user) {
+		h.logger.Printf("This request was refused because of a group rule: %v", sanitizedUrl)
+		return h.serveStaticPage(w, r, 403, TplNoAccess)
+	}
+
+	// Spare the database on the next requests, if session tokens are enabled
+	if fromCookie && !h.isUnprotectedPath(sanitizedUrl) {
+		h.refreshSessionToken(w, r, user)
+	}
+
 	// The default action is to have the next handler serve the request
-	// (i.e., the handler that actually serves a web page).
+	// (i.e., the handler that actually serves a web page), telling it who the user is.
+	h.setIdentityHeaders(r, user)
+
+	// Our access tokens are of no use to the next handler, and should not leak to it
+	if h.config.AccessTokens && bearerAccessToken(r) != "" {
+		r.Header.Del("Authorization")
+	}
+
 	h.logger.Printf("This request was forwarded to the next handler: %v", sanitizedUrl)
 	return h.Next.ServeHTTP(w, r)
 }
@@ -8,6 +8,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestServeHTTP(t *testing.T) {
@@ -60,9 +61,53 @@ func TestServeHTTP(t *testing.T) {
 	h.database.DelUser(userID)
 }
 
+func TestServeHTTPGroups(t *testing.T) {
+	h := NewTestHandler()
+	h.config.UnprotectedPaths = []string{"reports/public"}
+	h.config.GroupRules = []GroupRule{
+		{Group: "finance", Paths: []string{"reports/*"}},
+		{Group: "board", Paths: []string{"reports/board/*", "minutes"}},
+	}
+
+	userID := UserID("test")
+	h.database.AddUser(userID)
+	h.database.SetUserGroups(userID, []string{"finance"})
+	cookie, _ := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: ""})
+
+	for path, desiredStatus := range map[string]int{
+		"/":                   200,
+		"/reports/q1":         200,
+		"/Reports/Q1":         200,
+		"/reports/board/q1":   200, // Matches both rules, and either group suffices
+		"/minutes":            403,
+		"/reports/public":     200,
+		"/minutes/but/longer": 200,
+	} {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.Header.Add("Cookie", "authByEmailToken="+cookie)
+		w := httptest.NewRecorder()
+		statusCode, _ := h.ServeHTTP(w, req)
+		if statusCode != 0 || w.Result().StatusCode != desiredStatus {
+			t.Errorf("Request of %v should be %v but was %v", path, desiredStatus, w.Result().StatusCode)
+		}
+	}
+
+	// Without the group, the reports are off limits, but the rest of the site is not
+	h.database.SetUserGroups(userID, nil)
+	for path, desiredStatus := range map[string]int{"/": 200, "/reports/q1": 403, "/reports/public": 200} {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.Header.Add("Cookie", "authByEmailToken="+cookie)
+		w := httptest.NewRecorder()
+		statusCode, _ := h.ServeHTTP(w, req)
+		if statusCode != 0 || w.Result().StatusCode != desiredStatus {
+			t.Errorf("Request of %v without groups should be %v but was %v", path, desiredStatus, w.Result().StatusCode)
+		}
+	}
+}
+
 func NewTestHandler() *AuthByEmailHandler {
 	// Set up a handler
-	config := newConfig()
+	config := NewConfig()
 	config.Admins = nil
 	config.FilesystemRoot = "."
 	config.Database = "/tmp/testingdb"
@@ -78,6 +123,9 @@ func NewTestHandler() *AuthByEmailHandler {
 		database: NewMapBasedDatabase(),
 		mailer:   &MockMailer{},
 		logger:   log.New(&strings.Builder{}, "", log.LstdFlags),
+
+		oidcCodes:  newOIDCCodes(),
+		rateLimits: newMemoryRateLimits(),
 	}
 }
 
@@ -91,16 +139,32 @@ func (mn MockNext) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error
 }
 
 type MockMailer struct {
-	mail string
+	mail   string
+	code   string
+	admins []*EmailAddr
 }
 
-func (m *MockMailer) SendLoginLink(email *EmailAddr, token string) error {
+func (m *MockMailer) SendLoginLink(email *EmailAddr, token string, code string) error {
 	m.mail = "login"
+	m.code = code
 	return nil
 }
 
-func (m *MockMailer) SendAdminLoginRequest(email *EmailAddr) error {
+func (m *MockMailer) SendAdminLoginRequest(email *EmailAddr, admins []*EmailAddr) error {
 	m.mail = "admin"
+	m.admins = admins
+	return nil
+}
+
+func (m *MockMailer) SendInvitation(email *EmailAddr, token string, inviter string, message string, validUntil time.Time) error {
+	m.mail = "invite"
+	m.code = token
+	return nil
+}
+
+func (m *MockMailer) SendExpiryReminder(email *EmailAddr, token string, expiresAt time.Time) error {
+	m.mail = "expiry"
+	m.code = token
 	return nil
 }
 
@@ -0,0 +1,44 @@
+package authbyemail
+
+import (
+	"net/http"
+	"strings"
+)
+
+// These headers tell the next handler who is logged in, if the Caddyfile asks for it.
+// Whether or not it does, copies sent by the client are removed, so that the
+// applications behind us can always trust them.
+var identityHeaders = []string{"X-Auth-User-Id", "X-Auth-Email", "X-Auth-Groups"}
+
+// setIdentityHeaders removes any identity headers from the request, and adds our own
+// describing the logged-in user if configured; user is empty if no one is logged in.
+// The user ID is the pseudonymous UserID; the e-mail address is only given if it is
+// stored, and groups are separated by commas.
+func (h AuthByEmailHandler) setIdentityHeaders(r *http.Request, user UserID) {
+	for name := range r.Header {
+		// Some applications treat underscores like dashes, so remove those variants too
+		normalized := http.CanonicalHeaderKey(strings.ReplaceAll(name, "_", "-"))
+		for _, header := range identityHeaders {
+			if normalized == header {
+				delete(r.Header, name)
+			}
+		}
+	}
+
+	if !h.config.IdentityHeaders || user == "" {
+		return
+	}
+
+	h.addIdentityHeaders(r.Header, user)
+}
+
+// addIdentityHeaders adds the headers describing the given user to a request or response.
+func (h AuthByEmailHandler) addIdentityHeaders(header http.Header, user UserID) {
+	header.Set("X-Auth-User-Id", string(user))
+	if email := h.database.GetUserEmail(user); email != nil {
+		header.Set("X-Auth-Email", email.String())
+	}
+	if groups := h.database.GetUserGroups(user); len(groups) > 0 {
+		header.Set("X-Auth-Groups", strings.Join(groups, ","))
+	}
+}
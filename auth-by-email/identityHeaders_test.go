@@ -0,0 +1,79 @@
+package authbyemail
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// HeaderNext serves the identity headers it receives, so that we can check them.
+type HeaderNext struct{}
+
+func (hn HeaderNext) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	for _, header := range []string{"X-Auth-User-Id", "X-Auth-Email", "X-Auth-Groups", "X_Auth_User_Id"} {
+		fmt.Fprintf(w, "%v=%v;", header, strings.Join(r.Header[header], ","))
+	}
+	return 0, nil
+}
+
+func TestServeHTTPIdentityHeaders(t *testing.T) {
+	h := NewTestHandler()
+	h.Next = HeaderNext{}
+
+	userID := UserID("test")
+	h.database.AddUser(userID)
+	h.database.SetUserGroups(userID, []string{"finance", "hr"})
+	cookie, _ := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: ""})
+
+	test := func(t *testing.T, path, cookie, desiredBody string) {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		req.Header.Add("Cookie", "authByEmailToken="+cookie)
+		req.Header["X-Auth-User-Id"] = []string{"spoofed"}
+		req.Header["X-Auth-Email"] = []string{"spoofed@example.com"}
+		req.Header["X_Auth_User_Id"] = []string{"spoofed"}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if body := w.Body.String(); body != desiredBody {
+			t.Errorf("Request of %v gave headers %q, wanted %q", path, body, desiredBody)
+		}
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		h.config.IdentityHeaders = false
+		test(t, "/", cookie, "X-Auth-User-Id=;X-Auth-Email=;X-Auth-Groups=;X_Auth_User_Id=;")
+	})
+
+	t.Run("Enabled", func(t *testing.T) {
+		h.config.IdentityHeaders = true
+		test(t, "/", cookie, "X-Auth-User-Id=test;X-Auth-Email=;X-Auth-Groups=finance,hr;X_Auth_User_Id=;")
+	})
+
+	t.Run("Enabled (known e-mail address)", func(t *testing.T) {
+		h.config.IdentityHeaders = true
+		email, _ := NewEmailAddrFromString("user@example.com")
+		h.addUser(email)
+		cookie, _ := h.database.NewCookieToken(CookieToken{UserID: CRYPTO.UserIDfromEmail(email), IsValidated: true, BrowserContext: ""})
+		test(t, "/", cookie, "X-Auth-User-Id="+string(CRYPTO.UserIDfromEmail(email))+";X-Auth-Email=user@example.com;X-Auth-Groups=;X_Auth_User_Id=;")
+	})
+
+	t.Run("Enabled (unprotected path, logged out)", func(t *testing.T) {
+		h.config.IdentityHeaders = true
+		test(t, "/testpath", "", "X-Auth-User-Id=;X-Auth-Email=;X-Auth-Groups=;X_Auth_User_Id=;")
+	})
+
+	t.Run("Enabled (one lookup per request)", func(t *testing.T) {
+		h.config.IdentityHeaders = true
+		h.config.GroupRules = []GroupRule{{Group: "hr", Paths: []string{"*"}}}
+		inner := &countingDatabase{Database: h.database}
+		h.database = inner
+		defer func() { h.config.GroupRules, h.database = nil, inner.Database }()
+
+		// Authentication, the group rules and the headers all need the user
+		test(t, "/", cookie, "X-Auth-User-Id=test;X-Auth-Email=;X-Auth-Groups=finance,hr;X_Auth_User_Id=;")
+		if inner.lookups != 1 {
+			t.Errorf("Expected 1 cookie lookup for the request, got %v", inner.lookups)
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package authbyemail
+
+import (
+	"errors"
+	"time"
+)
+
+// How long invitations are valid by default and at most, and how long their personal
+// message may be.
+const (
+	defaultInvitationValidity = 7 * 24 * time.Hour
+	maxInvitationValidity     = 90 * 24 * time.Hour
+	maxInvitationMessage      = 2000
+)
+
+// An invitation lets someone use the site without asking for access first. Like the
+// link tokens of the DiskBackedDatabase, it is encrypted into the link rather than
+// stored, so invitations can be made for users who are not in the database yet.
+type invitation struct {
+	Email      string    `json:"email"`
+	Inviter    string    `json:"inviter"`
+	IssuedAt   time.Time `json:"issuedAt"`
+	ValidUntil time.Time `json:"validUntil"`
+}
+
+// Invitations are marked, so that nothing else that is encrypted can pass for one.
+const invitationPrefix = "invite/"
+
+func (i invitation) serialize() string {
+	return CRYPTO.sealJSON(invitationPrefix, i)
+}
+
+// parseInvitation decrypts the token of an invitation link, and checks that it has not
+// expired.
+func parseInvitation(token string) (*invitation, error) {
+	var i invitation
+	if err := CRYPTO.openJSON(invitationPrefix, token, &i); err != nil {
+		return nil, errors.New("Not an invitation")
+	}
+	if time.Now().After(i.ValidUntil) {
+		return nil, errors.New("The invitation has expired")
+	}
+	return &i, nil
+}
+
+// Invite mails the given address a link that adds them as a user when they follow it,
+// and logs them in. The inviter is recorded as having approved the user, like the admins
+// of ApprovalDecisions; they can withdraw the invitation by rejecting the user. The link
+// only works while that decision stands, so it can be used once: the decisions about a
+// user are forgotten once they are added or deleted, and a new invitation by the same
+// inviter replaces it. Users who
+// must be approved by several admins can not be invited, since one inviter is not enough.
+// The personal message is optional, and a validity of 0 means the default of a week.
+func (h AuthByEmailHandler) Invite(email *EmailAddr, inviter string, message string, validity time.Duration) error {
+	if h.config.approvalsForUser(email) > 1 {
+		return errors.New("Users who must be approved by several admins can not be invited")
+	}
+	if validity == 0 {
+		validity = defaultInvitationValidity
+	}
+	if validity < 0 || validity > maxInvitationValidity {
+		return errors.New("Invitations can be valid for at most 90 days")
+	}
+	if len(message) > maxInvitationMessage {
+		return errors.New("The message of an invitation can be at most 2000 characters")
+	}
+
+	// Decisions are stored by the second, so the invitation is as well
+	now := time.Unix(time.Now().Unix(), 0)
+	token := invitation{
+		Email:      email.String(),
+		Inviter:    inviter,
+		IssuedAt:   now,
+		ValidUntil: now.Add(validity),
+	}.serialize()
+
+	decision := ApprovalDecision{Admin: inviter, Approved: true, DecidedAt: now}
+	if err := h.database.AddApprovalDecision(CRYPTO.UserIDfromEmail(email), decision); err != nil {
+		h.logger.Printf("Database error trying to record the invitation of %v, %v", email.String(), err)
+		return err
+	}
+	if err := h.mailer.SendInvitation(email, token, inviter, message, now.Add(validity)); err != nil {
+		h.logger.Printf("Error mailing user %v an invitation, %v", email.String(), err)
+		return err
+	}
+	return nil
+}
+
+// isOutstanding returns whether the invitation can still be accepted, given the decisions
+// about the user: the approval of the inviter recorded with it must still stand, and no
+// admin may have rejected the user since.
+func (i invitation) isOutstanding(decisions []ApprovalDecision) bool {
+	outstanding := false
+	for _, decision := range decisions {
+		if !decision.Approved && decision.DecidedAt.After(i.IssuedAt) {
+			return false
+		}
+		if decision.Approved && decision.Admin == i.Inviter && decision.DecidedAt.Equal(i.IssuedAt) {
+			outstanding = true
+		}
+	}
+	return outstanding
+}
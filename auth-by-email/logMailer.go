@@ -2,6 +2,7 @@ package authbyemail
 
 import (
 	"log"
+	"time"
 )
 
 // The LogMailer is a dummy mailer that does not send mail. but instead prints messages
@@ -10,16 +11,30 @@ type LogMailer struct {
 	logger *log.Logger
 }
 
-func (m *LogMailer) SendLoginLink(email *EmailAddr, token string) error {
-	m.logger.Printf("(LogMailer) Hi user %v, here is your login token /auth/welcome?token=%v", email.String(), token)
+func (m *LogMailer) SendLoginLink(email *EmailAddr, token string, code string) error {
+	m.logger.Printf("(LogMailer) Hi user %v, here is your login token /auth/welcome?token=%v (code %v)", email.String(), token, code)
 	return nil
 }
 
-func (m *LogMailer) SendAdminLoginRequest(email *EmailAddr) error {
+func (m *LogMailer) SendAdminLoginRequest(email *EmailAddr, admins []*EmailAddr) error {
 	encryptedEmail := m.encryptEmail(email)
-	m.logger.Printf("(LogMailer) Hi admin, please approve or revoke user %v:\n"+
-		"/auth/approve?email=%v",
-		email.String(), encryptedEmail)
+	for _, admin := range admins {
+		m.logger.Printf("(LogMailer) Hi admin %v, please approve or revoke user %v:\n"+
+			"/auth/approve?email=%v&admin=%v",
+			admin.String(), email.String(), encryptedEmail, approvalVote{User: email.String(), Admin: admin.String()}.serialize())
+	}
+	return nil
+}
+
+func (m *LogMailer) SendInvitation(email *EmailAddr, token string, inviter string, message string, validUntil time.Time) error {
+	m.logger.Printf("(LogMailer) Hi %v, %q invites you, until %v: /auth/invite?token=%v\n%v",
+		email.String(), inviter, validUntil.Format("2006-01-02 15:04"), token, message)
+	return nil
+}
+
+func (m *LogMailer) SendExpiryReminder(email *EmailAddr, token string, expiresAt time.Time) error {
+	m.logger.Printf("(LogMailer) Hi user %v, your access ends on %v, ask for a renewal: /auth/renew?token=%v",
+		email.String(), expiresAt.Format("2006-01-02 15:04"), token)
 	return nil
 }
 
@@ -1,11 +1,23 @@
 package authbyemail
 
+import "time"
+
 type Mailer interface {
-	// SendLoginLink sends a user an email with a login link using the given token
-	SendLoginLink(email *EmailAddr, token string) error
+	// SendLoginLink sends a user an email with a login link using the given token.
+	// If a one-time code is given, it is included as an alternative to the link.
+	SendLoginLink(email *EmailAddr, token string, code string) error
+
+	// SendAdminLoginRequest sends each of the given admins an email with an approval link
+	// for the given user. The link tells which admin it was sent to.
+	SendAdminLoginRequest(email *EmailAddr, admins []*EmailAddr) error
+
+	// SendInvitation sends someone an email with an invitation link using the given token.
+	// The inviter and their personal message are shown if they are given.
+	SendInvitation(email *EmailAddr, token string, inviter string, message string, validUntil time.Time) error
 
-	// SendAdminLoginRequest sends a user an email with an approval link for the given user
-	SendAdminLoginRequest(email *EmailAddr) error
+	// SendExpiryReminder reminds a user that their access ends at the given time, with a
+	// link to ask for a renewal using the given token.
+	SendExpiryReminder(email *EmailAddr, token string, expiresAt time.Time) error
 
 	// DecryptEmail decrypts an e-mail address that was given in an admin approval link
 	DecryptEmail(encryptedEmail string) (*EmailAddr, error)
@@ -1,7 +1,10 @@
 package authbyemail
 
 import (
+	"context"
+	"crypto/subtle"
 	"errors"
+	"sort"
 	"sync"
 	"time"
 )
@@ -12,10 +15,24 @@ import (
 //
 // See DiskBasedDatabase for function-level documentation.
 type MapBasedDatabase struct {
-	writeMutex   sync.Mutex
+	mutex        sync.RWMutex
 	users        map[UserID]bool
 	linkTokens   map[string]*linkTokenInternal
 	cookieTokens map[string]*cookieTokenInternal
+	loginCodes   map[string]*loginCodeInternal
+	pending      map[UserID]*PendingRequest
+	decisions    map[UserID][]ApprovalDecision
+	apiTokens    map[string]string
+	groups       map[UserID][]string
+	emails       map[UserID]string
+	expiries     map[UserID]time.Time
+	reminded     map[UserID]bool
+	accessTokens map[string]*AccessToken
+	rateLimits   *memoryRateLimits
+	notifier     *cookieNotifier
+
+	// Counts the changes to cookies, under mutex like the maps
+	cookieVersion int64
 }
 
 func NewMapBasedDatabase() *MapBasedDatabase {
@@ -23,67 +40,202 @@ func NewMapBasedDatabase() *MapBasedDatabase {
 		users:        make(map[UserID]bool),
 		linkTokens:   make(map[string]*linkTokenInternal),
 		cookieTokens: make(map[string]*cookieTokenInternal),
+		loginCodes:   make(map[string]*loginCodeInternal),
+		pending:      make(map[UserID]*PendingRequest),
+		decisions:    make(map[UserID][]ApprovalDecision),
+		apiTokens:    make(map[string]string),
+		groups:       make(map[UserID][]string),
+		emails:       make(map[UserID]string),
+		expiries:     make(map[UserID]time.Time),
+		reminded:     make(map[UserID]bool),
+		accessTokens: make(map[string]*AccessToken),
+		rateLimits:   newMemoryRateLimits(),
+		notifier:     newCookieNotifier(),
 	}
 }
 
+// GetCookieToken returns a copy of the cookie information, so that it does not change
+// when the cookie is validated by another goroutine.
 func (m *MapBasedDatabase) GetCookieToken(cookieText string) *CookieToken {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
 	c, ok := m.cookieTokens[cookieText]
-	if ok && c.ValidUntil.After(time.Now()) {
-		return &c.CookieToken
+	if ok && c.ValidUntil.After(time.Now()) && !m.expired(c.UserID) {
+		token := c.CookieToken
+		return &token
 	}
 	return nil
 }
 
 func (m *MapBasedDatabase) GetLinkToken(linkText string) *LinkToken {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
 	l, ok := m.linkTokens[linkText]
-	if ok && l.ValidUntil.After(time.Now()) {
-		return &l.LinkToken
+	if ok && l.ValidUntil.After(time.Now()) && !m.expired(l.UserID) {
+		token := l.LinkToken
+		return &token
 	}
 	return nil
 }
 
-// IsKnownUser checks whether the UserID is valid
+// IsKnownUser checks whether the UserID is valid, and their access has not ended
 func (m *MapBasedDatabase) IsKnownUser(user UserID) bool {
-	return m.users[user]
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.users[user] && !m.expired(user)
+}
+
+// expired checks whether the access of the user has ended. The mutex must be held.
+func (m *MapBasedDatabase) expired(user UserID) bool {
+	expiresAt, ok := m.expiries[user]
+	return ok && !time.Now().Before(expiresAt)
 }
 
 // NewCookieToken makes a fresh cookie token for the given user
 // and saves it to the database
 func (m *MapBasedDatabase) NewCookieToken(cookieToken CookieToken) (string, error) {
-	if !m.IsKnownUser(cookieToken.UserID) {
+	if cookieToken.UserID == "" {
+		if cookieToken.IsValidated {
+			return "", errors.New("Tried to add a validated anonymous cookie token")
+		}
+	} else if !m.IsKnownUser(cookieToken.UserID) {
 		return "", errors.New("Tried to add a cookie token for non-existent user")
 	}
 
 	newToken := newRandom()
 
-	m.writeMutex.Lock()
-	defer m.writeMutex.Unlock()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
 	m.cookieTokens[newToken] = &cookieTokenInternal{
 		CookieToken: cookieToken,
 		ValidUntil:  time.Now().Add(30 * 24 * time.Hour),
+		CreatedAt:   time.Now(),
+		LastUsed:    time.Now(),
 	}
 	return newToken, nil
 }
 
 // ValidateCookieToken validates a cookie matching the given token
 func (m *MapBasedDatabase) ValidateCookieToken(cookieText string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	if _, ok := m.cookieTokens[cookieText]; !ok {
 		return errors.New("Tried to validate a non-existent cookie token")
 	}
 	m.cookieTokens[cookieText].IsValidated = true
+	m.cookieVersion++
+	m.notifier.notify()
+	return nil
+}
+
+// ClaimCookieToken assigns an anonymous cookie to a user and validates it
+func (m *MapBasedDatabase) ClaimCookieToken(cookieText string, user UserID) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.users[user] {
+		return errors.New("Tried to claim a cookie token for non-existent user")
+	}
+	c, ok := m.cookieTokens[cookieText]
+	if !ok || !c.ValidUntil.After(time.Now()) || c.UserID != "" || c.IsValidated {
+		return errors.New("Tried to claim a non-existent or non-anonymous cookie token")
+	}
+	c.UserID = user
+	c.IsValidated = true
+	m.cookieVersion++
+	m.notifier.notify()
 	return nil
 }
 
 // DeleteCookieToken validates a cookie matching the given token
 func (m *MapBasedDatabase) DeleteCookieToken(cookieText string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
 	if _, ok := m.cookieTokens[cookieText]; !ok {
 		return errors.New("Tried to delete a non-existent cookie token")
 	}
 	delete(m.cookieTokens, cookieText)
+	delete(m.loginCodes, cookieText)
+	m.cookieVersion++
+	m.notifier.notify()
 	return nil
 }
 
+// CookieVersion returns the number of changes to the cookies
+func (m *MapBasedDatabase) CookieVersion() int64 {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.cookieVersion
+}
+
+// TouchCookieToken records that a cookie was used
+func (m *MapBasedDatabase) TouchCookieToken(cookieText string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if c, ok := m.cookieTokens[cookieText]; ok {
+		c.LastUsed = time.Now()
+	}
+}
+
+// GetSessions returns all cookies of the given user that have not expired
+func (m *MapBasedDatabase) GetSessions(user UserID) []Session {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var sessions []Session
+	for key, c := range m.cookieTokens {
+		if c.UserID == user && c.ValidUntil.After(time.Now()) {
+			sessions = append(sessions, Session{
+				CookieToken: c.CookieToken,
+				Cookie:      key,
+				CreatedAt:   c.CreatedAt,
+				LastUsed:    c.LastUsed,
+				ValidUntil:  c.ValidUntil,
+			})
+		}
+	}
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].CreatedAt.Before(sessions[j].CreatedAt) })
+	return sessions
+}
+
+// CountUsers returns the number of users
+func (m *MapBasedDatabase) CountUsers() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return len(m.users)
+}
+
+// CountSessions returns the number of validated cookies that have not expired
+func (m *MapBasedDatabase) CountSessions() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	count := 0
+	for _, c := range m.cookieTokens {
+		if c.IsValidated && c.ValidUntil.After(time.Now()) {
+			count++
+		}
+	}
+	return count
+}
+
+// AwaitCookieToken waits until a cookie is validated or deleted
+func (m *MapBasedDatabase) AwaitCookieToken(ctx context.Context, cookieText string) *CookieToken {
+	return awaitCookieToken(ctx, m.notifier, 0, func() *CookieToken {
+		return m.GetCookieToken(cookieText)
+	})
+}
+
 // NewLinkToken makes a fresh link token for the given user
 // and saves it to the database
 func (m *MapBasedDatabase) NewLinkToken(linkToken LinkToken, validityPeriod time.Duration) (string, error) {
@@ -93,8 +245,8 @@ func (m *MapBasedDatabase) NewLinkToken(linkToken LinkToken, validityPeriod time
 
 	newToken := newRandom()
 
-	m.writeMutex.Lock()
-	defer m.writeMutex.Unlock()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
 	m.linkTokens[newToken] = &linkTokenInternal{
 		LinkToken:  linkToken,
@@ -105,24 +257,30 @@ func (m *MapBasedDatabase) NewLinkToken(linkToken LinkToken, validityPeriod time
 
 // AddUser adds the given user to the database
 func (m *MapBasedDatabase) AddUser(user UserID) {
-	m.writeMutex.Lock()
-	defer m.writeMutex.Unlock()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
 
+	if m.expired(user) {
+		delete(m.expiries, user)
+		delete(m.reminded, user)
+	}
 	m.users[user] = true
+	delete(m.pending, user)
 }
 
 // DelUser removes a user from the database and invalidates all corresponding tokens
 func (m *MapBasedDatabase) DelUser(user UserID) error {
-	if !m.IsKnownUser(user) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.users[user] {
 		return errors.New("Tried to delete a non-existent user")
 	}
 
-	m.writeMutex.Lock()
-	defer m.writeMutex.Unlock()
-
 	for key, token := range m.cookieTokens {
 		if token.UserID == user {
 			delete(m.cookieTokens, key)
+			delete(m.loginCodes, key)
 		}
 	}
 
@@ -132,6 +290,389 @@ func (m *MapBasedDatabase) DelUser(user UserID) error {
 		}
 	}
 
+	for key, token := range m.accessTokens {
+		if token.UserID == user {
+			delete(m.accessTokens, key)
+		}
+	}
+
 	delete(m.users, user)
+	delete(m.groups, user)
+	delete(m.decisions, user)
+	delete(m.emails, user)
+	delete(m.expiries, user)
+	delete(m.reminded, user)
+	m.cookieVersion++
+	m.notifier.notify()
+	return nil
+}
+
+// SetUserEmail stores the encrypted e-mail address of an existing user
+func (m *MapBasedDatabase) SetUserEmail(email *EmailAddr) error {
+	user := CRYPTO.UserIDfromEmail(email)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.users[user] {
+		return errors.New("Tried to set the e-mail address of a non-existent user")
+	}
+	m.emails[user] = CRYPTO.encrypt(email.String())
+	return nil
+}
+
+// GetUserEmail returns the e-mail address of the given user, if it is known
+func (m *MapBasedDatabase) GetUserEmail(user UserID) *EmailAddr {
+	m.mutex.RLock()
+	u := User{UserID: user, EncryptedEmail: m.emails[user]}
+	m.mutex.RUnlock()
+
+	email, err := u.Email()
+	if err != nil {
+		return nil
+	}
+	return email
+}
+
+// GetUsers returns all users
+func (m *MapBasedDatabase) GetUsers() []User {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var users []User
+	for user := range m.users {
+		users = append(users, User{UserID: user, EncryptedEmail: m.emails[user], ExpiresAt: m.expiries[user]})
+	}
+	return users
+}
+
+// SetUserExpiry sets when a user loses access, or removes the expiry given the zero time
+func (m *MapBasedDatabase) SetUserExpiry(user UserID, expiresAt time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.users[user] {
+		return errors.New("Tried to set the expiry of a non-existent user")
+	}
+
+	if expiresAt.IsZero() {
+		delete(m.expiries, user)
+	} else {
+		m.expiries[user] = time.Unix(expiresAt.Unix(), 0)
+	}
+	delete(m.reminded, user)
+	m.cookieVersion++
+	m.notifier.notify()
+	return nil
+}
+
+// GetUserExpiry returns when a user loses access, or the zero time if never
+func (m *MapBasedDatabase) GetUserExpiry(user UserID) time.Time {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.expiries[user]
+}
+
+// GetExpiringUsers returns the users whose access ends before the given time, and who
+// were not reminded yet
+func (m *MapBasedDatabase) GetExpiringUsers(before time.Time) []User {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var users []User
+	for user, expiresAt := range m.expiries {
+		if !m.expired(user) && !expiresAt.After(before) && !m.reminded[user] {
+			users = append(users, User{UserID: user, EncryptedEmail: m.emails[user], ExpiresAt: expiresAt})
+		}
+	}
+	return users
+}
+
+// SetExpiryReminded records that a user was reminded that their access ends
+func (m *MapBasedDatabase) SetExpiryReminded(user UserID) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.reminded[user] = true
+	return nil
+}
+
+// SetUserGroups replaces the groups of the given user
+func (m *MapBasedDatabase) SetUserGroups(user UserID, groups []string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.users[user] {
+		return errors.New("Tried to set the groups of a non-existent user")
+	}
+
+	sorted := append([]string(nil), groups...)
+	sort.Strings(sorted)
+	m.groups[user] = sorted
+	return nil
+}
+
+// GetUserGroups returns the groups of the given user
+func (m *MapBasedDatabase) GetUserGroups(user UserID) []string {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return append([]string(nil), m.groups[user]...)
+}
+
+// AddPendingRequest records or updates a request for access
+func (m *MapBasedDatabase) AddPendingRequest(email *EmailAddr) (bool, error) {
+	user := CRYPTO.UserIDfromEmail(email)
+	now := time.Now()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if p, ok := m.pending[user]; ok {
+		p.LastRequest = now
+		p.Count++
+		return false, nil
+	}
+
+	m.pending[user] = &PendingRequest{
+		UserID:         user,
+		EncryptedEmail: CRYPTO.encrypt(email.String()),
+		FirstRequest:   now,
+		LastRequest:    now,
+		Count:          1,
+	}
+	return true, nil
+}
+
+// GetPendingRequests returns all pending requests, oldest first
+func (m *MapBasedDatabase) GetPendingRequests() []PendingRequest {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var requests []PendingRequest
+	for _, p := range m.pending {
+		requests = append(requests, *p)
+	}
+
+	sort.Slice(requests, func(i, j int) bool { return requests[i].FirstRequest.Before(requests[j].FirstRequest) })
+	return requests
+}
+
+// DelPendingRequest removes a pending request
+func (m *MapBasedDatabase) DelPendingRequest(user UserID) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.pending, user)
+}
+
+// AddApprovalDecision records an admin's decision about a user
+func (m *MapBasedDatabase) AddApprovalDecision(user UserID, decision ApprovalDecision) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var decisions []ApprovalDecision
+	for _, d := range m.decisions[user] {
+		if d.Admin != decision.Admin {
+			decisions = append(decisions, d)
+		}
+	}
+	decision.DecidedAt = time.Unix(decision.DecidedAt.Unix(), 0)
+	m.decisions[user] = append(decisions, decision)
+	return nil
+}
+
+// GetApprovalDecisions returns the decisions about a user, oldest first
+func (m *MapBasedDatabase) GetApprovalDecisions(user UserID) []ApprovalDecision {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	decisions := append([]ApprovalDecision(nil), m.decisions[user]...)
+	sort.SliceStable(decisions, func(i, j int) bool { return decisions[i].DecidedAt.Before(decisions[j].DecidedAt) })
+	return decisions
+}
+
+// DelApprovalDecisions removes the decisions about a user
+func (m *MapBasedDatabase) DelApprovalDecisions(user UserID) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.decisions, user)
+	return nil
+}
+
+// NewAPIToken makes a fresh API token with the given name
+func (m *MapBasedDatabase) NewAPIToken(name string) (string, error) {
+	token := newRandom()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.apiTokens[name] = hashAPIToken(token)
+	return token, nil
+}
+
+// CheckAPIToken returns the name of the given API token, and whether it exists
+func (m *MapBasedDatabase) CheckAPIToken(token string) (string, bool) {
+	hash := hashAPIToken(token)
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for name, h := range m.apiTokens {
+		if h == hash {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// DelAPIToken removes the API token with the given name
+func (m *MapBasedDatabase) DelAPIToken(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if _, ok := m.apiTokens[name]; !ok {
+		return errors.New("Tried to delete a non-existent API token")
+	}
+	delete(m.apiTokens, name)
+	return nil
+}
+
+// NewAccessToken makes a fresh personal access token for an existing user
+func (m *MapBasedDatabase) NewAccessToken(accessToken AccessToken, validityPeriod time.Duration) (string, error) {
+	token := newAccessToken()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.users[accessToken.UserID] {
+		return "", errors.New("Tried to make an access token for a non-existent user")
+	}
+
+	now := time.Now()
+	m.accessTokens[hashAccessToken(token)] = &AccessToken{
+		ID:        newRandom(),
+		UserID:    accessToken.UserID,
+		Name:      accessToken.Name,
+		Scopes:    append([]string(nil), accessToken.Scopes...),
+		CreatedAt: now,
+		ExpiresAt: now.Add(validityPeriod),
+	}
+	return token, nil
+}
+
+// GetAccessToken returns a copy of the information of an access token that has not expired
+func (m *MapBasedDatabase) GetAccessToken(token string) *AccessToken {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if a, ok := m.accessTokens[hashAccessToken(token)]; ok && a.ExpiresAt.After(time.Now()) {
+		accessToken := *a
+		return &accessToken
+	}
+	return nil
+}
+
+// TouchAccessToken records when an access token was last used
+func (m *MapBasedDatabase) TouchAccessToken(id string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, a := range m.accessTokens {
+		if a.ID == id {
+			a.LastUsed = time.Now()
+		}
+	}
+}
+
+// GetAccessTokens returns all access tokens of the given user that have not expired
+func (m *MapBasedDatabase) GetAccessTokens(user UserID) []AccessToken {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var tokens []AccessToken
+	for _, a := range m.accessTokens {
+		if a.UserID == user && a.ExpiresAt.After(time.Now()) {
+			tokens = append(tokens, *a)
+		}
+	}
+
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].CreatedAt.Before(tokens[j].CreatedAt) })
+	return tokens
+}
+
+// DelAccessToken removes an access token of the given user
+func (m *MapBasedDatabase) DelAccessToken(user UserID, id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for key, a := range m.accessTokens {
+		if a.UserID == user && a.ID == id {
+			delete(m.accessTokens, key)
+			return nil
+		}
+	}
+	return errors.New("Tried to delete a non-existent access token")
+}
+
+// NewLoginCode makes a fresh one-time code for the given cookie
+func (m *MapBasedDatabase) NewLoginCode(cookieText string, validityPeriod time.Duration) (string, error) {
+	if m.GetCookieToken(cookieText) == nil {
+		return "", errors.New("Tried to add a login code for a non-existent cookie token")
+	}
+
+	code := newLoginCode()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.loginCodes[cookieText] = &loginCodeInternal{
+		CodeHash:     hashLoginCode(cookieText, code),
+		AttemptsLeft: loginCodeAttempts,
+		ValidUntil:   time.Now().Add(validityPeriod),
+	}
+	return code, nil
+}
+
+// ValidateLoginCode validates the cookie belonging to the code, if the code is correct
+func (m *MapBasedDatabase) ValidateLoginCode(cookieText string, code string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	l, ok := m.loginCodes[cookieText]
+	if !ok || !l.ValidUntil.After(time.Now()) {
+		delete(m.loginCodes, cookieText)
+		return errors.New("Tried to use a non-existent or expired login code")
+	}
+
+	l.AttemptsLeft--
+	if subtle.ConstantTimeCompare([]byte(l.CodeHash), []byte(hashLoginCode(cookieText, code))) != 1 {
+		if l.AttemptsLeft <= 0 {
+			delete(m.loginCodes, cookieText)
+		}
+		return errors.New("Tried to use an incorrect login code")
+	}
+
+	delete(m.loginCodes, cookieText)
+
+	c, ok := m.cookieTokens[cookieText]
+	if !ok {
+		return errors.New("Tried to validate a non-existent cookie token")
+	}
+	c.IsValidated = true
+	m.cookieVersion++
+	m.notifier.notify()
+	return nil
+}
+
+// UpdateRateLimit updates the state of a rate limit, which has its own mutex
+func (m *MapBasedDatabase) UpdateRateLimit(key string, update func(RateLimitState) RateLimitState) error {
+	return m.rateLimits.UpdateRateLimit(key, update)
+}
+
+// Close does nothing, since the maps are simply forgotten
+func (m *MapBasedDatabase) Close() error {
 	return nil
 }
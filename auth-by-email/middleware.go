@@ -0,0 +1,46 @@
+package authbyemail
+
+import (
+	"net/http"
+)
+
+// NewMiddleware initialises the package's various parts like NewHandler does, and
+// returns standard net/http middleware. Wrap each handler that should be protected:
+//
+//	protect := authbyemail.NewMiddleware(config)
+//	http.ListenAndServe(":8080", protect(mux))
+//
+// Requests under /auth/ are served by the middleware itself. All wrapped handlers share
+// one database, so the same middleware can protect several handlers.
+func NewMiddleware(config *Config) func(http.Handler) http.Handler {
+	h := NewHandler(nil, config)
+
+	return func(next http.Handler) http.Handler {
+		wrapped := h
+		wrapped.Next = nextHandler{next}
+		return middlewareHandler{wrapped}
+	}
+}
+
+// middlewareHandler turns our Handler into a net/http handler.
+type middlewareHandler struct {
+	h AuthByEmailHandler
+}
+
+func (m middlewareHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Like Caddy, write a plain error page if no response was written yet
+	if status, _ := m.h.ServeHTTP(w, r); status != 0 {
+		http.Error(w, http.StatusText(status), status)
+	}
+}
+
+// nextHandler turns a net/http handler into a Handler, which always writes its
+// own response.
+type nextHandler struct {
+	next http.Handler
+}
+
+func (n nextHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	n.next.ServeHTTP(w, r)
+	return 0, nil
+}
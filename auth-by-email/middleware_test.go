@@ -0,0 +1,47 @@
+package authbyemail
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	os.Setenv("SENDINBLUE_API_KEY", "not used") // The mailer is not used in this test
+
+	config := NewConfig()
+	config.UnprotectedPaths = []string{"public"}
+	config.SiteName = "Test"
+	config.SiteURL = "http://example.com"
+	config.MailerFrom, _ = NewEmailAddrFromString("admin@example.com")
+
+	protect := NewMiddleware(config)
+	handler := protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Page")
+	}))
+
+	test := func(t *testing.T, desiredStatus int, path string, desiredBody string) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com"+path, nil))
+		if w.Result().StatusCode != desiredStatus {
+			t.Errorf("Request of %v should be %v but was %v", path, desiredStatus, w.Result().StatusCode)
+		}
+		if desiredBody != "" && w.Body.String() != desiredBody {
+			t.Errorf("Request of %v should serve %q but served %q", path, desiredBody, w.Body.String())
+		}
+	}
+
+	t.Run("Protected path", func(t *testing.T) {
+		test(t, 403, "/", PAGEDATA_LOGIN)
+	})
+
+	t.Run("Unprotected path", func(t *testing.T) {
+		test(t, 200, "/public", "Page")
+	})
+
+	t.Run("Our own endpoints", func(t *testing.T) {
+		test(t, 404, "/auth/etc", "")
+	})
+}
@@ -0,0 +1,220 @@
+package authbyemail
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long an authorization code may take to be exchanged for tokens, and how long the
+// tokens we issue for it are valid.
+var (
+	oidcCodeValidity  = time.Minute
+	oidcTokenValidity = time.Hour
+)
+
+// An OIDCClient is a website that lets its users log in with us, as an OpenID Connect
+// provider. It is registered with the `oidcclient` directive.
+type OIDCClient struct {
+	ID string
+
+	// The secret with which the client authenticates itself. It is empty for public
+	// clients (such as apps running in a browser), which have to use PKCE instead.
+	Secret string
+
+	// The addresses to which users may be sent back with an authorization code
+	RedirectURIs []string
+}
+
+// allowsRedirect checks whether the given address was registered for this client.
+// Only exact matches count.
+func (c *OIDCClient) allowsRedirect(uri string) bool {
+	for _, allowed := range c.RedirectURIs {
+		if allowed == uri {
+			return true
+		}
+	}
+	return false
+}
+
+// An oidcCode records what a client asked for when it sent a user to us, until it
+// exchanges the authorization code it got for tokens.
+type oidcCode struct {
+	ClientID      string
+	RedirectURI   string
+	UserID        UserID
+	Scopes        []string
+	Nonce         string
+	CodeChallenge string
+	ExpiresAt     time.Time
+}
+
+// oidcCodes keeps the authorization codes that were not used yet. They are only valid
+// for oidcCodeValidity, so they are kept in memory rather than in the database.
+type oidcCodes struct {
+	mutex sync.Mutex
+	codes map[string]*oidcCode
+}
+
+func newOIDCCodes() *oidcCodes {
+	return &oidcCodes{codes: make(map[string]*oidcCode)}
+}
+
+// add stores the given code under a fresh random string, which is returned, and
+// forgets expired codes.
+func (c *oidcCodes) add(code *oidcCode) string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	for key, other := range c.codes {
+		if now.After(other.ExpiresAt) {
+			delete(c.codes, key)
+		}
+	}
+
+	key := newRandom()
+	c.codes[key] = code
+	return key
+}
+
+// take returns the code stored under the given string and removes it, so that every
+// code can be used only once. It returns nil if there is no such code, or if it expired.
+func (c *oidcCodes) take(key string) *oidcCode {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	code, ok := c.codes[key]
+	if !ok {
+		return nil
+	}
+	delete(c.codes, key)
+	if time.Now().After(code.ExpiresAt) {
+		return nil
+	}
+	return code
+}
+
+// oidcClaims are the contents of the ID tokens and access tokens we issue.
+type oidcClaims struct {
+	Issuer        string   `json:"iss"`
+	Subject       UserID   `json:"sub"`
+	Audience      string   `json:"aud"`
+	ExpiresAt     int64    `json:"exp"`
+	IssuedAt      int64    `json:"iat"`
+	Nonce         string   `json:"nonce,omitempty"`
+	Scope         string   `json:"scope,omitempty"`
+	Email         string   `json:"email,omitempty"`
+	EmailVerified bool     `json:"email_verified,omitempty"`
+	Groups        []string `json:"groups,omitempty"`
+}
+
+// A jsonWebKey describes our public signing key, as published at the JWKS endpoint.
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// jwtHeader is the header of the JSON Web Tokens we sign.
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// publicJWK returns the public part of our signing key.
+func (c *Crypto) publicJWK() jsonWebKey {
+	return jsonWebKey{
+		KeyType:   "EC",
+		Curve:     "P-256",
+		X:         base64.RawURLEncoding.EncodeToString(c.signingKey.X.FillBytes(make([]byte, 32))),
+		Y:         base64.RawURLEncoding.EncodeToString(c.signingKey.Y.FillBytes(make([]byte, 32))),
+		Use:       "sig",
+		Algorithm: "ES256",
+		KeyID:     c.signingKeyID,
+	}
+}
+
+// signJWT makes a JSON Web Token with the given claims, signed with ES256.
+func (c *Crypto) signJWT(claims interface{}) (string, error) {
+	header, err := json.Marshal(jwtHeader{Algorithm: "ES256", Type: "JWT", KeyID: c.signingKeyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, c.signingKey, hash[:])
+	if err != nil {
+		return "", err
+	}
+
+	// The signature is r and s, each as 32 big-endian bytes
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// verifyJWT checks that the given JSON Web Token was signed by signJWT, and if so,
+// reads its claims. It does not check the claims themselves, such as when it expires.
+func (c *Crypto) verifyJWT(token string, claims interface{}) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return errors.New("verifyJWT: token does not have three parts")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return err
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return err
+	}
+	if header.Algorithm != "ES256" || header.KeyID != c.signingKeyID {
+		return errors.New("verifyJWT: token is not signed with our key")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	if len(signature) != 64 {
+		return errors.New("verifyJWT: signature has the wrong length")
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	if !ecdsa.Verify(&c.signingKey.PublicKey, hash[:], r, s) {
+		return errors.New("verifyJWT: signature is not valid")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, claims)
+}
+
+// pkceChallenge computes the S256 code challenge belonging to a PKCE code verifier.
+func pkceChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
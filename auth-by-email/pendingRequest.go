@@ -0,0 +1,38 @@
+package authbyemail
+
+import "time"
+
+// A PendingRequest records that a user who has not been approved asked for access.
+// Repeated requests by the same user are counted rather than stored separately.
+type PendingRequest struct {
+	UserID UserID
+
+	// The user's e-mail address, encrypted, so that admins can see who asked.
+	EncryptedEmail string
+
+	// When the user first and last asked for access, and how many times in total.
+	FirstRequest time.Time
+	LastRequest  time.Time
+	Count        int
+}
+
+// Email decrypts the e-mail address of the user who made the request.
+func (p *PendingRequest) Email() (*EmailAddr, error) {
+	res, err := CRYPTO.decrypt(p.EncryptedEmail)
+	if err != nil {
+		return nil, err
+	}
+	return NewEmailAddrFromString(res)
+}
+
+// An ApprovalDecision records how an admin last decided about a user's access, so that
+// the other admins responsible for the user can see it.
+type ApprovalDecision struct {
+	// The e-mail address of the admin, or a description like "API token hr" if the
+	// decision was made otherwise. It is empty if the admin is not known, for example
+	// when they used an approval link from before decisions were recorded.
+	Admin string
+
+	Approved  bool
+	DecidedAt time.Time
+}
@@ -0,0 +1,160 @@
+package authbyemail
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A RateLimit allows Count events per Period, in bursts of at most Count. It is
+// disabled if Count is zero.
+type RateLimit struct {
+	Count  int
+	Period time.Duration
+}
+
+// The longest period a rate limit can have. States that were not updated for this long
+// are the same as new ones, and can be forgotten.
+const rateLimitMaxPeriod = 24 * time.Hour
+
+// A RateLimitState is the state of one token bucket: the number of events it still
+// allows (which grows again over time) as of when it was last updated.
+type RateLimitState struct {
+	Tokens  float64
+	Updated time.Time
+}
+
+// take uses up one event, if the limit allows it at the given time. It returns the new
+// state, whether the event was allowed, and if not, how long it takes until it is.
+func (l RateLimit) take(state RateLimitState, now time.Time) (RateLimitState, bool, time.Duration) {
+	perSecond := float64(l.Count) / l.Period.Seconds()
+	if state.Updated.IsZero() {
+		state.Tokens = float64(l.Count)
+	} else {
+		state.Tokens = math.Min(float64(l.Count), state.Tokens+now.Sub(state.Updated).Seconds()*perSecond)
+	}
+	state.Updated = now
+
+	if state.Tokens < 1 {
+		return state, false, time.Duration((1 - state.Tokens) / perSecond * float64(time.Second))
+	}
+	state.Tokens--
+	return state, true, 0
+}
+
+// give returns an event that was taken, but not used after all.
+func (l RateLimit) give(state RateLimitState) RateLimitState {
+	state.Tokens = math.Min(float64(l.Count), state.Tokens+1)
+	return state
+}
+
+// A rateLimitStore keeps the states of rate limits. It is implemented by the databases,
+// for limits shared by several processes, and by memoryRateLimits.
+type rateLimitStore interface {
+	// UpdateRateLimit reads the state stored under the given key (which is zero if there
+	// is none), and stores the state returned by update instead, as one transaction.
+	UpdateRateLimit(key string, update func(RateLimitState) RateLimitState) error
+}
+
+// memoryRateLimits keeps the states of rate limits in memory.
+type memoryRateLimits struct {
+	mutex   sync.Mutex
+	states  map[string]RateLimitState
+	cleaned time.Time
+}
+
+func newMemoryRateLimits() *memoryRateLimits {
+	return &memoryRateLimits{states: make(map[string]RateLimitState), cleaned: time.Now()}
+}
+
+// UpdateRateLimit updates the state under the given key, and every hour forgets the
+// states that were not updated for rateLimitMaxPeriod.
+func (m *memoryRateLimits) UpdateRateLimit(key string, update func(RateLimitState) RateLimitState) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if time.Since(m.cleaned) > time.Hour {
+		for k, state := range m.states {
+			if time.Since(state.Updated) > rateLimitMaxPeriod {
+				delete(m.states, k)
+			}
+		}
+		m.cleaned = time.Now()
+	}
+
+	m.states[key] = update(m.states[key])
+	return nil
+}
+
+// takeRateLimit uses up one event of the given limit for the given key. It returns
+// whether that was allowed, and if not, how long it takes until it is.
+func (h AuthByEmailHandler) takeRateLimit(key string, limit RateLimit) (bool, time.Duration) {
+	if limit.Count == 0 {
+		return true, 0
+	}
+
+	var allowed bool
+	var retryAfter time.Duration
+	err := h.rateLimits.UpdateRateLimit(key, func(state RateLimitState) RateLimitState {
+		state, allowed, retryAfter = limit.take(state, time.Now())
+		return state
+	})
+	if err != nil {
+		// Rather send too many e-mails than none at all
+		h.logger.Printf("Could not update rate limit, %v", err)
+		return true, 0
+	}
+	return allowed, retryAfter
+}
+
+// giveRateLimit returns an event of the given limit for the given key, which was taken
+// with takeRateLimit but refused by a later limit.
+func (h AuthByEmailHandler) giveRateLimit(key string, limit RateLimit) {
+	if limit.Count == 0 {
+		return
+	}
+
+	err := h.rateLimits.UpdateRateLimit(key, func(state RateLimitState) RateLimitState {
+		return limit.give(state)
+	})
+	if err != nil {
+		h.logger.Printf("Could not update rate limit, %v", err)
+	}
+}
+
+// serveRateLimited serves the given page with a 429 status, telling the browser how
+// long to wait before trying again.
+func (h AuthByEmailHandler) serveRateLimited(w http.ResponseWriter, tid TemplateID, retryAfter time.Duration) (int, error) {
+	h.logger.Println("Serving a 429")
+	minutes := int(math.Ceil(retryAfter.Minutes()))
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(429)
+
+	data := struct{ Wait string }{"1 minute"}
+	if minutes > 1 {
+		data.Wait = strconv.Itoa(minutes) + " minutes"
+	}
+	outputTemplate(h.config, w, tid, &data)
+	return 0, nil
+}
+
+// clientAddress returns the address of the client that sent the request, for rate
+// limits. IPv6 clients usually have a whole /64 network, which is counted as one.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if ip.To4() == nil {
+		return ip.Mask(net.CIDRMask(64, 128)).String()
+	}
+	return ip.String()
+}
@@ -0,0 +1,51 @@
+package authbyemail
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	limit := RateLimit{Count: 2, Period: time.Minute}
+	now := time.Now()
+
+	var state RateLimitState
+	var allowed bool
+	var retryAfter time.Duration
+	for i, expected := range []bool{true, true, false} {
+		state, allowed, retryAfter = limit.take(state, now)
+		if allowed != expected {
+			t.Errorf("Event %v should be allowed: %v, got %v", i+1, expected, allowed)
+		}
+	}
+	if retryAfter != 30*time.Second {
+		t.Errorf("Expected to retry after 30 seconds, got %v", retryAfter)
+	}
+
+	// One event comes back every 30 seconds, but no more than Count
+	if state, allowed, _ = limit.take(state, now.Add(30*time.Second)); !allowed {
+		t.Error("Event not allowed after waiting")
+	}
+	if state, _, _ = limit.take(state, now.Add(time.Hour)); state.Tokens != 1 {
+		t.Errorf("Expected the bucket to be full (minus one) after an hour, got %v", state.Tokens)
+	}
+
+	// An event that is given back can be taken again, but the bucket does not overflow
+	if state = limit.give(limit.give(state)); state.Tokens != 2 {
+		t.Errorf("Expected the bucket to be full after giving back, got %v", state.Tokens)
+	}
+}
+
+func TestClientAddress(t *testing.T) {
+	for remoteAddr, expected := range map[string]string{
+		"192.0.2.1:1234":              "192.0.2.1",
+		"[2001:db8:1:2:3:4:5:6]:1234": "2001:db8:1:2::",
+		"unknown":                     "unknown",
+	} {
+		r := &http.Request{RemoteAddr: remoteAddr}
+		if address := clientAddress(r); address != expected {
+			t.Errorf("Expected client address %v for %v, got %v", expected, remoteAddr, address)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"html/template"
 	"log"
 	"strings"
+	"time"
 )
 
 type RealMailer struct {
@@ -30,9 +31,9 @@ type EmailMessage struct {
 	Body    string
 }
 
-// SendLoginLink sends a login link with the given token to a user. The admin
-// is given as the reply-to address.
-func (m *RealMailer) SendLoginLink(email *EmailAddr, token string) error {
+// SendLoginLink sends a login link with the given token to a user, along with
+// the one-time code if there is one. The admin is given as the reply-to address.
+func (m *RealMailer) SendLoginLink(email *EmailAddr, token string, code string) error {
 	admin := m.config.adminEmailFromUserEmail(email)
 	if admin == nil {
 		return fmt.Errorf("Need to mail login link but can not find admin for %v", email.String())
@@ -42,10 +43,12 @@ func (m *RealMailer) SendLoginLink(email *EmailAddr, token string) error {
 		User     string
 		SiteName string
 		Link     template.URL
+		Code     string
 	}{
 		User:     email.String(),
 		SiteName: m.config.SiteName,
 		Link:     template.URL(m.config.SiteURL + "/auth/welcome?token=" + token),
+		Code:     code,
 	}
 
 	var b strings.Builder
@@ -60,32 +63,103 @@ func (m *RealMailer) SendLoginLink(email *EmailAddr, token string) error {
 }
 
 // SendAdminLoginRequest sends an approve/reject link for the given user to
-// their admin.
-func (m *RealMailer) SendAdminLoginRequest(email *EmailAddr) error {
-	admin := m.config.adminEmailFromUserEmail(email)
-	if admin == nil {
+// each of the given admins. If mailing an admin fails, the others are still
+// mailed, and the first error is returned.
+func (m *RealMailer) SendAdminLoginRequest(email *EmailAddr, admins []*EmailAddr) error {
+	if len(admins) == 0 {
 		return fmt.Errorf("Need to mail admin approval link but can not find admin for %v", email.String())
 	}
 
+	var firstErr error
+	for _, admin := range admins {
+		data := struct {
+			Admin    string
+			User     string
+			SiteName string
+			Link     template.URL
+		}{
+			Admin:    admin.String(),
+			User:     email.String(),
+			SiteName: m.config.SiteName,
+			Link:     template.URL(m.config.SiteURL + "/auth/approve?email=" + m.encryptEmail(email) + "&admin=" + approvalVote{User: email.String(), Admin: admin.String()}.serialize()),
+		}
+
+		var b strings.Builder
+		outputTemplate(m.config, &b, TplMailApprove, &data)
+
+		err := m.impl.SendMail(&EmailMessage{
+			ReplyTo: m.config.MailerFrom,
+			To:      admin,
+			Subject: "[" + m.config.SiteName + "] Please approve new user " + email.String(),
+			Body:    b.String(),
+		})
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// SendInvitation sends an invitation link with the given token to someone who is not
+// a user yet. If the inviter is an e-mail address (rather than, say, an API token), it
+// is named in the e-mail and given as the reply-to address.
+func (m *RealMailer) SendInvitation(email *EmailAddr, token string, inviter string, message string, validUntil time.Time) error {
+	replyTo := m.config.MailerFrom
+	if inviterEmail, err := NewEmailAddrFromString(inviter); err == nil {
+		replyTo = inviterEmail
+	} else {
+		inviter = ""
+	}
+
 	data := struct {
-		Admin    string
-		User     string
-		SiteName string
-		Link     template.URL
+		User       string
+		Inviter    string
+		Message    string
+		SiteName   string
+		Link       template.URL
+		ValidUntil time.Time
 	}{
-		Admin:    admin.String(),
-		User:     email.String(),
-		SiteName: m.config.SiteName,
-		Link:     template.URL(m.config.SiteURL + "/auth/approve?email=" + m.encryptEmail(email)),
+		User:       email.String(),
+		Inviter:    inviter,
+		Message:    message,
+		SiteName:   m.config.SiteName,
+		Link:       template.URL(m.config.SiteURL + "/auth/invite?token=" + token),
+		ValidUntil: validUntil,
 	}
 
 	var b strings.Builder
-	outputTemplate(m.config, &b, TplMailApprove, &data)
+	outputTemplate(m.config, &b, TplMailInvite, &data)
+
+	return m.impl.SendMail(&EmailMessage{
+		ReplyTo: replyTo,
+		To:      email,
+		Subject: "[" + m.config.SiteName + "] You have been invited",
+		Body:    b.String(),
+	})
+}
+
+// SendExpiryReminder tells a user when their access ends, with a link to ask the admins
+// for a renewal.
+func (m *RealMailer) SendExpiryReminder(email *EmailAddr, token string, expiresAt time.Time) error {
+	data := struct {
+		User      string
+		SiteName  string
+		Link      template.URL
+		ExpiresAt time.Time
+	}{
+		User:      email.String(),
+		SiteName:  m.config.SiteName,
+		Link:      template.URL(m.config.SiteURL + "/auth/renew?token=" + token),
+		ExpiresAt: expiresAt,
+	}
+
+	var b strings.Builder
+	outputTemplate(m.config, &b, TplMailExpiry, &data)
 
 	return m.impl.SendMail(&EmailMessage{
 		ReplyTo: m.config.MailerFrom,
-		To:      admin,
-		Subject: "[" + m.config.SiteName + "] Please approve new user " + email.String(),
+		To:      email,
+		Subject: "[" + m.config.SiteName + "] Your access ends soon",
 		Body:    b.String(),
 	})
 }
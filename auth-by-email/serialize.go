@@ -1,5 +1,11 @@
 package authbyemail
 
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
 // Serialize takes an object, serializes it and encrypts the result.
 func (c *Crypto) serialize(token linkTokenInternal) string {
 	return c.encrypt(string(token.MarshalBinary()))
@@ -17,3 +23,20 @@ func (c *Crypto) deserialize(ciphertext string, returner *linkTokenInternal) err
 
 	return returner.UnmarshalBinary([]byte(serialized))
 }
+
+// sealJSON encodes an object as JSON and encrypts it, marked with the given prefix so
+// that tokens of one kind can not pass for another.
+func (c *Crypto) sealJSON(prefix string, object interface{}) string {
+	data, _ := json.Marshal(object)
+	return c.encrypt(prefix + string(data))
+}
+
+// openJSON decrypts a token made by sealJSON with the same prefix, and fills the object
+// pointed to by `returner` with its contents.
+func (c *Crypto) openJSON(prefix string, token string, returner interface{}) error {
+	plaintext, err := c.decrypt(token)
+	if err != nil || !strings.HasPrefix(plaintext, prefix) {
+		return errors.New("Not a token of the right kind")
+	}
+	return json.Unmarshal([]byte(plaintext[len(prefix):]), returner)
+}
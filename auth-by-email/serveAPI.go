@@ -0,0 +1,323 @@
+package authbyemail
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// API tokens given in the Caddyfile must be at least this long, so that they can not
+// be guessed. Tokens made by the database are always long enough.
+const minAPITokenLength = 32
+
+// Users as shown by the API
+type apiUser struct {
+	Email     string     `json:"email"`
+	UserID    UserID     `json:"userID"`
+	Exists    bool       `json:"exists"`
+	Groups    []string   `json:"groups"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+// Sessions as shown by the API. The ID is the same as on the sessions page.
+type apiSession struct {
+	ID         string    `json:"id"`
+	Browser    string    `json:"browser"`
+	Validated  bool      `json:"validated"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastUsed   time.Time `json:"lastUsed"`
+	ValidUntil time.Time `json:"validUntil"`
+}
+
+// Pending requests as shown by the API
+type apiPendingRequest struct {
+	Email        string    `json:"email"`
+	UserID       UserID    `json:"userID"`
+	FirstRequest time.Time `json:"firstRequest"`
+	LastRequest  time.Time `json:"lastRequest"`
+	Count        int       `json:"count"`
+}
+
+// serveAPI serves the JSON API under auth/api/v1/, which lets other systems provision
+// users without going through e-mail. The path is given relative to auth/api/v1/.
+// Requests must carry a header `Authorization: Bearer <token>` with an API token that
+// was given in the Caddyfile or made with usermod. The endpoints are
+//
+// GET users - lists all users. Users whose address is not known yet have an empty email, and
+// users whose access has ended do not exist.
+// GET users/{email} - tells whether the user exists.
+// PUT users/{email} - adds the user, like `usermod -mode add`. An optional body like
+// {"groups": ["finance"], "expiresAt": "2030-01-01"} sets their groups and when their access
+// ends, like `usermod -groups` and `-expires`. An empty expiresAt means it does not end.
+// DELETE users/{email} - deletes the user and all their tokens, like `usermod -mode delete`.
+// POST users/{email}/invalidate - logs the user out everywhere, like `usermod -mode invalidate`.
+// Neither is allowed for the admins given in the configuration.
+// POST users/{email}/invite - mails an invitation to someone who is not a user yet, like
+// `usermod -mode invite`. An optional body like {"message": "Welcome!", "days": 14} gives a
+// personal message and how long the invitation is valid.
+// GET users/{email}/sessions - lists the sessions of the user.
+// GET pending - lists the requests waiting for approval.
+// POST pending/{email}/approve - approves the request, and sends the user a login link. If
+// several admins must approve the user, this counts as one of them, and gives 202 Accepted
+// until enough have.
+// POST pending/{email}/reject - rejects the request.
+func (h AuthByEmailHandler) serveAPI(w http.ResponseWriter, r *http.Request, path string) (int, error) {
+	name, ok := h.checkAPIToken(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="auth-by-email"`)
+		return h.serveAPIError(w, 401, "Missing or invalid API token")
+	}
+	h.logger.Printf("API request by token `%v`: %v %v", name, r.Method, path)
+
+	parts := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	if len(parts) == 1 && (parts[0] == "users" || parts[0] == "pending") {
+		if r.Method != "GET" {
+			return h.serveAPIError(w, 405, "Method not allowed")
+		}
+		if parts[0] == "users" {
+			return h.serveAPIUsers(w)
+		}
+		return h.serveAPIPendingRequests(w)
+	}
+
+	if len(parts) < 2 || len(parts) > 3 || (parts[0] != "users" && parts[0] != "pending") {
+		return h.serveAPIError(w, 404, "No such endpoint")
+	}
+
+	email, err := NewEmailAddrFromString(parts[1])
+	if err != nil {
+		return h.serveAPIError(w, 400, "Could not parse e-mail address")
+	}
+	userID := CRYPTO.UserIDfromEmail(email)
+
+	// Find the endpoint, e.g. "POST users/{email}/invalidate"
+	parts[1] = "{email}"
+	switch r.Method + " " + strings.Join(parts, "/") {
+	case "GET users/{email}":
+		// Nothing to do but show the user below
+
+	case "PUT users/{email}":
+		var body struct {
+			Groups    *[]string `json:"groups"`
+			ExpiresAt *string   `json:"expiresAt"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				return h.serveAPIError(w, 400, "Could not parse request body")
+			}
+		}
+		var groups []string
+		if body.Groups != nil {
+			if groups, err = ParseGroups(strings.Join(*body.Groups, ",")); err != nil {
+				return h.serveAPIError(w, 400, err.Error())
+			}
+		}
+		var expiresAt time.Time
+		if body.ExpiresAt != nil {
+			if expiresAt, err = ParseExpiry(*body.ExpiresAt); err != nil {
+				return h.serveAPIError(w, 400, err.Error())
+			}
+		}
+
+		h.addUser(email)
+		if body.Groups != nil {
+			if err := h.database.SetUserGroups(userID, groups); err != nil {
+				return h.serveAPIError(w, 500, "Could not set groups")
+			}
+		}
+		if body.ExpiresAt != nil {
+			if err := h.database.SetUserExpiry(userID, expiresAt); err != nil {
+				return h.serveAPIError(w, 500, "Could not set expiry")
+			}
+		}
+
+	case "DELETE users/{email}":
+		// Like on the dashboard, admins can not be removed, since the configuration adds them
+		if h.isAdmin(userID) {
+			return h.serveAPIError(w, 409, "Admins can not be deleted")
+		}
+		if err := h.database.DelUser(userID); err != nil {
+			return h.serveAPIError(w, 404, "No such user")
+		}
+
+	case "POST users/{email}/invalidate":
+		// Deleting the user removes all their tokens, after which they are added back
+		if h.isAdmin(userID) {
+			return h.serveAPIError(w, 409, "Admins can not be invalidated")
+		}
+		groups := h.database.GetUserGroups(userID)
+		expiresAt := h.database.GetUserExpiry(userID)
+		if err := h.database.DelUser(userID); err != nil {
+			return h.serveAPIError(w, 404, "No such user")
+		}
+		h.addUser(email)
+		h.database.SetUserGroups(userID, groups)
+		if !expiresAt.IsZero() {
+			h.database.SetUserExpiry(userID, expiresAt)
+		}
+
+	case "POST users/{email}/invite":
+		var body struct {
+			Message string `json:"message"`
+			Days    int    `json:"days"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				return h.serveAPIError(w, 400, "Could not parse request body")
+			}
+		}
+		validity := time.Duration(body.Days) * 24 * time.Hour
+		if validity < 0 || validity > maxInvitationValidity || len(body.Message) > maxInvitationMessage {
+			return h.serveAPIError(w, 400, "Invitations can be valid for at most 90 days, with a message of at most 2000 characters")
+		}
+		if h.database.IsKnownUser(userID) {
+			return h.serveAPIError(w, 409, "Already a user")
+		}
+		if h.config.approvalsForUser(email) > 1 {
+			return h.serveAPIError(w, 409, "Must be approved by several admins")
+		}
+		if err := h.Invite(email, "API token "+name, body.Message, validity); err != nil {
+			return h.serveAPIError(w, 500, "Could not invite user")
+		}
+
+	case "GET users/{email}/sessions":
+		sessions := []apiSession{}
+		for _, session := range h.database.GetSessions(userID) {
+			sessions = append(sessions, apiSession{
+				ID:         sessionID(session.Cookie),
+				Browser:    session.BrowserContext,
+				Validated:  session.IsValidated,
+				CreatedAt:  session.CreatedAt,
+				LastUsed:   session.LastUsed,
+				ValidUntil: session.ValidUntil,
+			})
+		}
+		return h.serveJSON(w, 200, sessions)
+
+	case "POST pending/{email}/approve":
+		if !h.hasPendingRequest(userID) {
+			return h.serveAPIError(w, 404, "No such pending request")
+		}
+		approved, err := h.voteToApprove(email, "API token "+name)
+		if err != nil {
+			return h.serveAPIError(w, 500, "Could not approve user")
+		}
+		if !approved {
+			return h.serveJSON(w, 202, apiUser{Email: email.String(), UserID: userID, Groups: []string{}})
+		}
+
+	case "POST pending/{email}/reject":
+		if !h.hasPendingRequest(userID) {
+			return h.serveAPIError(w, 404, "No such pending request")
+		}
+		h.database.DelPendingRequest(userID)
+		h.recordDecision(userID, "API token "+name, false)
+
+	default:
+		return h.serveAPIError(w, 404, "No such endpoint")
+	}
+
+	return h.serveJSON(w, 200, apiUser{
+		Email:     email.String(),
+		UserID:    userID,
+		Exists:    h.database.IsKnownUser(userID),
+		Groups:    append([]string{}, h.database.GetUserGroups(userID)...),
+		ExpiresAt: apiExpiry(h.database.GetUserExpiry(userID)),
+	})
+}
+
+// apiExpiry gives when the access of a user ends, or nil if it does not, so that it is
+// left out of the JSON.
+func apiExpiry(expiresAt time.Time) *time.Time {
+	if expiresAt.IsZero() {
+		return nil
+	}
+	return &expiresAt
+}
+
+// serveAPIUsers lists all users, including those whose access has ended.
+func (h AuthByEmailHandler) serveAPIUsers(w http.ResponseWriter) (int, error) {
+	users := []apiUser{}
+	for _, user := range h.listUsers() {
+		users = append(users, apiUser{
+			Email:     user.Email,
+			UserID:    user.UserID,
+			Exists:    user.ExpiresAt.IsZero() || user.ExpiresAt.After(time.Now()),
+			Groups:    append([]string{}, user.Groups...),
+			ExpiresAt: apiExpiry(user.ExpiresAt),
+		})
+	}
+	return h.serveJSON(w, 200, users)
+}
+
+// serveAPIPendingRequests lists the requests waiting for approval.
+func (h AuthByEmailHandler) serveAPIPendingRequests(w http.ResponseWriter) (int, error) {
+	requests := []apiPendingRequest{}
+	for _, request := range h.database.GetPendingRequests() {
+		email, err := request.Email()
+		if err != nil {
+			h.logger.Printf("Could not decrypt the e-mail address of a pending request, %v", err)
+			continue
+		}
+		requests = append(requests, apiPendingRequest{
+			Email:        email.String(),
+			UserID:       request.UserID,
+			FirstRequest: request.FirstRequest,
+			LastRequest:  request.LastRequest,
+			Count:        request.Count,
+		})
+	}
+	return h.serveJSON(w, 200, requests)
+}
+
+// hasPendingRequest checks whether the given user is waiting for approval
+func (h AuthByEmailHandler) hasPendingRequest(user UserID) bool {
+	for _, request := range h.database.GetPendingRequests() {
+		if request.UserID == user {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAPIToken checks the bearer token of the request against the tokens in the
+// Caddyfile and in the database, and returns its name if it is valid.
+func (h AuthByEmailHandler) checkAPIToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(header[7:])
+	if token == "" {
+		return "", false
+	}
+
+	for name, configToken := range h.config.APITokens {
+		if subtle.ConstantTimeCompare([]byte(configToken), []byte(token)) == 1 {
+			return name, true
+		}
+	}
+	return h.database.CheckAPIToken(token)
+}
+
+// serveJSON writes the given data as a JSON response.
+func (h AuthByEmailHandler) serveJSON(w http.ResponseWriter, status int, data interface{}) (int, error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		h.logger.Printf("Could not write JSON response, %v", err)
+	}
+	return 0, nil
+}
+
+// serveAPIError writes an error as a JSON response, like {"error": "No such user"}.
+func (h AuthByEmailHandler) serveAPIError(w http.ResponseWriter, status int, message string) (int, error) {
+	h.logger.Printf("Serving a %v from the API: %v", status, message)
+	h.serveJSON(w, status, struct {
+		Error string `json:"error"`
+	}{message})
+	return 0, errors.New(message)
+}
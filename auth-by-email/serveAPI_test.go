@@ -0,0 +1,231 @@
+package authbyemail
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeHTTPAPI(t *testing.T) {
+	h := NewTestHandler()
+	h.config.APITokens = map[string]string{"hr": "0123456789abcdef0123456789abcdef"}
+	dbToken, _ := h.database.NewAPIToken("provisioning")
+
+	email, _ := NewEmailAddrFromString("user@example.com")
+	userID := CRYPTO.UserIDfromEmail(email)
+
+	test := func(t *testing.T, desiredStatus int, method, path, token string, result interface{}) {
+		req := httptest.NewRequest(method, "http://example.com/auth/api/v1/"+path, nil)
+		if token != "" {
+			req.Header.Add("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		statusCode, _ := h.ServeHTTP(w, req)
+		if statusCode != 0 || w.Result().StatusCode != desiredStatus {
+			t.Errorf("Status code of %v %v should be %v but was %v. %#v", method, path, desiredStatus, w.Result().StatusCode, w.Result())
+		}
+		if w.Result().Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Response of %v %v is not JSON", method, path)
+		}
+		if result != nil {
+			if err := json.NewDecoder(w.Result().Body).Decode(result); err != nil {
+				t.Errorf("Could not decode response of %v %v, %v", method, path, err)
+			}
+		}
+	}
+
+	t.Run("Correct request (add user)", func(t *testing.T) {
+		var user apiUser
+		test(t, 200, "PUT", "users/"+email.String(), h.config.APITokens["hr"], &user)
+		if !user.Exists || user.UserID != userID || !h.database.IsKnownUser(userID) {
+			t.Errorf("User not added through the API, got %#v", user)
+		}
+	})
+
+	t.Run("Correct request (set groups)", func(t *testing.T) {
+		req := httptest.NewRequest("PUT", "http://example.com/auth/api/v1/users/"+email.String(), strings.NewReader(`{"groups": ["hr", "finance"]}`))
+		req.Header.Add("Authorization", "Bearer "+dbToken)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		var user apiUser
+		json.NewDecoder(w.Result().Body).Decode(&user)
+		if w.Result().StatusCode != 200 || len(user.Groups) != 2 || user.Groups[0] != "finance" {
+			t.Errorf("Groups not set through the API, got %v %#v", w.Result().StatusCode, user)
+		}
+	})
+
+	t.Run("Correct request (set expiry)", func(t *testing.T) {
+		put := func(body string) (int, apiUser) {
+			req := httptest.NewRequest("PUT", "http://example.com/auth/api/v1/users/"+email.String(), strings.NewReader(body))
+			req.Header.Add("Authorization", "Bearer "+dbToken)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			var user apiUser
+			json.NewDecoder(w.Result().Body).Decode(&user)
+			return w.Result().StatusCode, user
+		}
+
+		if status, user := put(`{"expiresAt": "2100-01-01T00:00:00Z"}`); status != 200 || user.ExpiresAt == nil || user.ExpiresAt.Year() != 2100 {
+			t.Errorf("Expiry not set through the API, got %v %#v", status, user)
+		}
+		if status, user := put(`{"expiresAt": ""}`); status != 200 || user.ExpiresAt != nil {
+			t.Errorf("Expiry not removed through the API, got %v %#v", status, user)
+		}
+		put(`{"expiresAt": "2100-01-01T00:00:00Z"}`)
+		if status, user := put(`{"groups": ["hr", "finance"]}`); status != 200 || user.ExpiresAt == nil {
+			t.Errorf("Expiry removed without being given, got %v %#v", status, user)
+		}
+		if status, _ := put(`{"expiresAt": "soon"}`); status != 400 {
+			t.Errorf("Bad expiry accepted, got %v", status)
+		}
+	})
+
+	t.Run("Correct request (database token)", func(t *testing.T) {
+		var user apiUser
+		test(t, 200, "GET", "users/"+email.String(), dbToken, &user)
+		if !user.Exists || user.Email != email.String() {
+			t.Errorf("User not found through the API, got %#v", user)
+		}
+	})
+
+	t.Run("Correct request (sessions)", func(t *testing.T) {
+		cookie, _ := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: "user browser"})
+		var sessions []apiSession
+		test(t, 200, "GET", "users/"+email.String()+"/sessions", dbToken, &sessions)
+		if len(sessions) != 1 || sessions[0].ID != sessionID(cookie) || sessions[0].Browser != "user browser" {
+			t.Errorf("Sessions not listed correctly through the API, got %#v", sessions)
+		}
+	})
+
+	t.Run("Correct request (invalidate)", func(t *testing.T) {
+		test(t, 200, "POST", "users/"+email.String()+"/invalidate", dbToken, nil)
+		if len(h.database.GetSessions(userID)) != 0 || !h.database.IsKnownUser(userID) {
+			t.Error("User not invalidated through the API")
+		}
+		if len(h.database.GetUserGroups(userID)) != 2 {
+			t.Error("Groups lost when invalidating through the API")
+		}
+		if h.database.GetUserExpiry(userID).Year() != 2100 {
+			t.Error("Expiry lost when invalidating through the API")
+		}
+	})
+
+	t.Run("Correct request (delete user)", func(t *testing.T) {
+		test(t, 200, "DELETE", "users/"+email.String(), dbToken, nil)
+		if h.database.IsKnownUser(userID) {
+			t.Error("User not deleted through the API")
+		}
+		test(t, 404, "DELETE", "users/"+email.String(), dbToken, nil)
+	})
+
+	t.Run("Malformed request (delete admin)", func(t *testing.T) {
+		h.config.Admins = []*EmailAddr{h.config.MailerFrom}
+		defer func() { h.config.Admins = nil }()
+		adminID := CRYPTO.UserIDfromEmail(h.config.MailerFrom)
+		h.database.AddUser(adminID)
+
+		test(t, 409, "DELETE", "users/"+h.config.MailerFrom.String(), dbToken, nil)
+		test(t, 409, "POST", "users/"+h.config.MailerFrom.String()+"/invalidate", dbToken, nil)
+		if !h.database.IsKnownUser(adminID) {
+			t.Error("Admin deleted through the API")
+		}
+	})
+
+	t.Run("Correct request (invite)", func(t *testing.T) {
+		guest, _ := NewEmailAddrFromString("guest@example.com")
+		h.mailer.(*MockMailer).mail = ""
+		req := httptest.NewRequest("POST", "http://example.com/auth/api/v1/users/"+guest.String()+"/invite", strings.NewReader(`{"message": "Welcome!", "days": 14}`))
+		req.Header.Add("Authorization", "Bearer "+dbToken)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		var user apiUser
+		json.NewDecoder(w.Result().Body).Decode(&user)
+		if w.Result().StatusCode != 200 || user.Exists || h.mailer.(*MockMailer).mail != "invite" {
+			t.Errorf("Invitation not sent through the API, got %v %#v", w.Result().StatusCode, user)
+		}
+
+		h.addUser(guest)
+		test(t, 409, "POST", "users/"+guest.String()+"/invite", dbToken, nil)
+
+		users, _ := NewAddressList([]string{"quorum.example.com"})
+		h.config.AdminRoutes = []AdminRoute{{Users: users, Admins: []*EmailAddr{h.config.MailerFrom}, Approvals: 2}}
+		defer func() { h.config.AdminRoutes = nil }()
+		test(t, 409, "POST", "users/newcomer@quorum.example.com/invite", dbToken, nil)
+	})
+
+	t.Run("Correct request (pending requests)", func(t *testing.T) {
+		h.database.AddPendingRequest(email)
+		var requests []apiPendingRequest
+		test(t, 200, "GET", "pending", dbToken, &requests)
+		if len(requests) != 1 || requests[0].Email != email.String() || requests[0].Count != 1 {
+			t.Errorf("Pending requests not listed correctly through the API, got %#v", requests)
+		}
+
+		h.mailer.(*MockMailer).mail = ""
+		test(t, 200, "POST", "pending/"+email.String()+"/approve", dbToken, nil)
+		if !h.database.IsKnownUser(userID) || h.mailer.(*MockMailer).mail != "login" {
+			t.Error("Pending request not approved through the API")
+		}
+		test(t, 404, "POST", "pending/"+email.String()+"/approve", dbToken, nil)
+
+		// If several admins must approve the user, the token is one of them
+		users, _ := NewAddressList([]string{"quorum.example.com"})
+		h.config.AdminRoutes = []AdminRoute{{Users: users, Admins: []*EmailAddr{h.config.MailerFrom}, Approvals: 2}}
+		defer func() { h.config.AdminRoutes = nil }()
+		voter, _ := NewEmailAddrFromString("voter@quorum.example.com")
+		h.database.AddPendingRequest(voter)
+		test(t, 202, "POST", "pending/"+voter.String()+"/approve", dbToken, nil)
+		if h.database.IsKnownUser(CRYPTO.UserIDfromEmail(voter)) {
+			t.Error("User added through the API after one of two approvals")
+		}
+		h.database.AddApprovalDecision(CRYPTO.UserIDfromEmail(voter), ApprovalDecision{Admin: "admin@example.com", Approved: true, DecidedAt: time.Now()})
+		test(t, 200, "POST", "pending/"+voter.String()+"/approve", dbToken, nil)
+		if !h.database.IsKnownUser(CRYPTO.UserIDfromEmail(voter)) {
+			t.Error("User not added through the API after two approvals")
+		}
+
+		other, _ := NewEmailAddrFromString("other@example.com")
+		h.database.AddPendingRequest(other)
+		test(t, 200, "POST", "pending/"+other.String()+"/reject", dbToken, nil)
+		if len(h.database.GetPendingRequests()) != 0 || h.database.IsKnownUser(CRYPTO.UserIDfromEmail(other)) {
+			t.Error("Pending request not rejected through the API")
+		}
+	})
+
+	t.Run("Malformed request (no token)", func(t *testing.T) {
+		test(t, 401, "GET", "pending", "", nil)
+	})
+
+	t.Run("Malformed request (bad token)", func(t *testing.T) {
+		test(t, 401, "GET", "pending", "0123456789abcdef", nil)
+	})
+
+	t.Run("Malformed request (revoked token)", func(t *testing.T) {
+		token, _ := h.database.NewAPIToken("revoked")
+		h.database.DelAPIToken("revoked")
+		test(t, 401, "GET", "pending", token, nil)
+	})
+
+	t.Run("Malformed request (bad endpoint)", func(t *testing.T) {
+		test(t, 404, "GET", "groups", dbToken, nil)
+		test(t, 404, "POST", "users/"+email.String(), dbToken, nil)
+		test(t, 405, "POST", "pending", dbToken, nil)
+	})
+
+	t.Run("Malformed request (bad email)", func(t *testing.T) {
+		test(t, 400, "GET", "users/nobody", dbToken, nil)
+	})
+
+	t.Run("Malformed request (bearer token on the site)", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Add("Authorization", "Bearer "+dbToken)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Result().StatusCode != http.StatusForbidden {
+			t.Errorf("API token gave access to the site, status %v", w.Result().StatusCode)
+		}
+	})
+}
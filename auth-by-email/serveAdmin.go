@@ -0,0 +1,319 @@
+package authbyemail
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serveAdmin shows the admin dashboard to logged-in admins. A GET request shows some
+// statistics, the requests waiting for approval, a form and all users; a POST request with
+// an email= and an action= field looks up, approves or revokes that user, rejects their
+// request, logs them out everywhere, revokes one of their access tokens (given by token=),
+// sends them a login link, or invites them (with an optional message= and days=). Approving
+// a user with an expires= date, or the setexpiry action, sets when their access ends. Users
+// can also be looked up by their user ID, as found in the X-Auth-User-ID header.
+//
+// Only the admins of a user, as the admin routes say, can approve, reject or invite them.
+// Admins given with admin can manage all users otherwise; those only given in admin
+// routes can only manage the users they approve.
+//
+// All forms carry a token bound to the admin's cookie, so that other websites can not
+// make an admin's browser submit them.
+func (h AuthByEmailHandler) serveAdmin(w http.ResponseWriter, r *http.Request) (int, error) {
+	cookie := GetCookie(r)
+	token := h.database.GetCookieToken(cookie)
+	if !h.isCookieValid(r) || token == nil || !h.isAdmin(token.UserID) {
+		return h.serveNotAuthenticated(w)
+	}
+
+	type sessionData struct {
+		Browser                         string
+		CreatedAt, LastUsed, ValidUntil time.Time
+		IsValidated                     bool
+	}
+	type userData struct {
+		Email               string
+		UserID              UserID
+		Groups              []string
+		Exists, SafeAddress bool
+		Sessions            []sessionData
+		Approvals           int
+		ApprovalsNeeded     int
+		ExpiresAt           time.Time
+		AccessTokens        []AccessToken
+	}
+	type pendingData struct {
+		Email                     string
+		FirstRequest, LastRequest time.Time
+		Count                     int
+	}
+	data := struct {
+		CSRFToken       string
+		Users, Sessions int
+		Pending         []pendingData
+		Message         string
+		User            *userData
+		UserList        []listedUser
+	}{
+		CSRFToken: csrfToken(cookie),
+	}
+
+	// serveDashboard adds the overview to the data, and serves the page
+	serveDashboard := func() (int, error) {
+		data.Users = h.database.CountUsers()
+		data.Sessions = h.database.CountSessions()
+		data.UserList = h.listUsers()
+
+		for _, request := range h.database.GetPendingRequests() {
+			email, err := request.Email()
+			if err != nil {
+				h.logger.Printf("Could not decrypt the e-mail address of a pending request, %v", err)
+				continue
+			}
+			data.Pending = append(data.Pending, pendingData{
+				Email:        email.String(),
+				FirstRequest: request.FirstRequest,
+				LastRequest:  request.LastRequest,
+				Count:        request.Count,
+			})
+		}
+
+		return h.serveTemplate(w, TplAdmin, &data)
+	}
+
+	if r.Method == "POST" {
+		r.ParseForm()
+		if len(r.PostForm["csrf"]) == 0 || subtle.ConstantTimeCompare([]byte(r.PostForm["csrf"][0]), []byte(data.CSRFToken)) != 1 {
+			h.logger.Printf("Admin action attempted without a proper CSRF token")
+			return h.serveBadRequest(w)
+		}
+		if len(r.PostForm["action"]) == 0 || len(r.PostForm["email"]) == 0 {
+			return h.serveBadRequest(w)
+		}
+
+		// Anything without an @ is taken to be a user ID, which can only be looked up
+		input := strings.TrimSpace(r.PostForm["email"][0])
+		if r.PostForm["action"][0] == "lookup" && !strings.Contains(input, "@") {
+			if email := h.database.GetUserEmail(UserID(input)); email != nil {
+				input = email.String()
+			} else {
+				data.Message = "There is no user with ID " + input + ", or their e-mail address is not known yet."
+				return serveDashboard()
+			}
+		}
+
+		email, err := NewEmailAddrFromString(input)
+		if err != nil {
+			return h.serveBadRequest(w)
+		}
+		userID := CRYPTO.UserIDfromEmail(email)
+
+		// Decisions are recorded under the admin's address. Admins who logged in before
+		// e-mail addresses were stored are known by their ID instead.
+		adminName := string(token.UserID)
+		if adminEmail := h.database.GetUserEmail(token.UserID); adminEmail != nil {
+			adminName = adminEmail.String()
+		}
+
+		// Only the admins responsible for a user decide about their access; besides them,
+		// the admins given with admin may manage every user
+		switch action := r.PostForm["action"][0]; {
+		case (action == "approve" || action == "reject" || action == "invite") && !h.isAdminOf(token.UserID, email):
+			data.Message = "You are not an admin of " + email.String() + ", so you can not decide about their access."
+			return serveDashboard()
+		case action != "lookup" && !h.isGlobalAdmin(token.UserID) && !h.isAdminOf(token.UserID, email):
+			data.Message = "You are not an admin of " + email.String() + "."
+			return serveDashboard()
+		}
+
+		switch r.PostForm["action"][0] {
+		case "lookup":
+			// Nothing to do but show the user below
+
+		case "approve":
+			// An expiry is optional here; an empty field leaves it as it is, except for users
+			// whose access ended, who must be given a new end
+			expiresAt, err := ParseExpiry(strings.TrimSpace(r.PostForm.Get("expires")))
+			if err != nil || (!expiresAt.IsZero() && !expiresAt.After(time.Now())) {
+				return h.serveBadRequest(w)
+			}
+			if endedAt, ended := h.accessEnded(userID); ended && expiresAt.IsZero() {
+				data.Message = "The access of " + email.String() + " ended on " + formatExpiry(endedAt) + ". Please give a new end to approve them."
+				break
+			}
+			// If several admins must approve the user, this is one of their votes
+			approved, err := h.voteToApprove(email, adminName)
+			if err != nil {
+				return 500, err
+			}
+			if !approved {
+				data.Message = "Your approval of " + email.String() + " has been recorded. " +
+					strconv.Itoa(countApprovals(h.database.GetApprovalDecisions(userID))) + " of the " +
+					strconv.Itoa(h.config.approvalsForUser(email)) + " approvals needed have been given."
+				break
+			}
+			data.Message = email.String() + " has been approved, and has been sent a log-in e-mail."
+			if !expiresAt.IsZero() {
+				if err := h.database.SetUserExpiry(userID, expiresAt); err != nil {
+					return 500, err
+				}
+				data.Message += " Their access ends on " + formatExpiry(expiresAt) + "."
+			}
+
+		case "setexpiry":
+			// An empty field means their access does not end
+			expiresAt, err := ParseExpiry(strings.TrimSpace(r.PostForm.Get("expires")))
+			if err != nil || (!expiresAt.IsZero() && !expiresAt.After(time.Now())) {
+				return h.serveBadRequest(w)
+			}
+			if !h.database.IsKnownUser(userID) {
+				return h.serveBadRequest(w)
+			}
+			if err := h.database.SetUserExpiry(userID, expiresAt); err != nil {
+				return 500, err
+			}
+			if expiresAt.IsZero() {
+				data.Message = "The access of " + email.String() + " no longer ends."
+			} else {
+				data.Message = "The access of " + email.String() + " ends on " + formatExpiry(expiresAt) + "."
+			}
+
+		case "invite":
+			// The validity is given in days, and is optional
+			var validity time.Duration
+			if days := r.PostForm.Get("days"); days != "" {
+				n, err := strconv.Atoi(days)
+				if err != nil || n < 1 {
+					return h.serveBadRequest(w)
+				}
+				validity = time.Duration(n) * 24 * time.Hour
+			}
+			if h.database.IsKnownUser(userID) {
+				data.Message = email.String() + " is already a user."
+			} else if err := h.Invite(email, adminName, strings.TrimSpace(r.PostForm.Get("message")), validity); err != nil {
+				data.Message = email.String() + " could not be invited: " + err.Error()
+			} else {
+				data.Message = email.String() + " has been sent an invitation."
+			}
+
+		case "revoke":
+			if h.isAdmin(userID) {
+				return h.serveBadRequest(w)
+			}
+			h.database.DelPendingRequest(userID)
+			if err := h.database.DelUser(userID); err != nil {
+				data.Message = email.String() + " could not be deleted: " + err.Error()
+			} else {
+				h.recordDecision(userID, adminName, false)
+				data.Message = email.String() + " has been deleted."
+			}
+
+		case "reject":
+			h.database.DelPendingRequest(userID)
+			h.recordDecision(userID, adminName, false)
+			data.Message = "The request of " + email.String() + " has been rejected."
+
+		case "logout":
+			if err := h.logoutUser(userID); err != nil {
+				return 500, err
+			}
+			data.Message = email.String() + " has been logged out everywhere."
+
+		case "revoketoken":
+			if err := h.database.DelAccessToken(userID, r.PostForm.Get("token")); err != nil {
+				return h.serveBadRequest(w)
+			}
+			data.Message = "An access token of " + email.String() + " has been revoked."
+
+		case "sendlink":
+			if !h.database.IsKnownUser(userID) {
+				return h.serveBadRequest(w)
+			}
+			if err := h.sendLoginLink(email); err != nil {
+				return 500, err
+			}
+			data.Message = email.String() + " has been sent a log-in e-mail."
+
+		default:
+			return h.serveBadRequest(w)
+		}
+
+		// Show the user that was acted upon
+		data.User = &userData{
+			Email:        email.String(),
+			UserID:       userID,
+			Groups:       h.database.GetUserGroups(userID),
+			Exists:       h.database.IsKnownUser(userID),
+			SafeAddress:  email.LocalPartIsASCII(),
+			AccessTokens: h.database.GetAccessTokens(userID),
+
+			Approvals:       countApprovals(h.database.GetApprovalDecisions(userID)),
+			ApprovalsNeeded: h.config.approvalsForUser(email),
+			ExpiresAt:       h.database.GetUserExpiry(userID),
+		}
+		for _, session := range h.database.GetSessions(userID) {
+			data.User.Sessions = append(data.User.Sessions, sessionData{
+				Browser:     session.BrowserContext,
+				CreatedAt:   session.CreatedAt,
+				LastUsed:    session.LastUsed,
+				ValidUntil:  session.ValidUntil,
+				IsValidated: session.IsValidated,
+			})
+		}
+	}
+
+	return serveDashboard()
+}
+
+// A listedUser is a user as shown in listings for admins.
+type listedUser struct {
+	Email     string
+	UserID    UserID
+	Groups    []string
+	ExpiresAt time.Time
+}
+
+// listUsers lists all users, sorted by e-mail address. Users whose address is not
+// known yet are listed last, by user ID.
+func (h AuthByEmailHandler) listUsers() []listedUser {
+	var users []listedUser
+	for _, user := range h.database.GetUsers() {
+		listed := listedUser{UserID: user.UserID, Groups: h.database.GetUserGroups(user.UserID), ExpiresAt: user.ExpiresAt}
+		if email, err := user.Email(); err == nil {
+			listed.Email = email.String()
+		}
+		users = append(users, listed)
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		if (users[i].Email == "") != (users[j].Email == "") {
+			return users[j].Email == ""
+		}
+		if users[i].Email != users[j].Email {
+			return users[i].Email < users[j].Email
+		}
+		return users[i].UserID < users[j].UserID
+	})
+	return users
+}
+
+// logoutUser deletes all cookies of the given user, logging them out everywhere.
+func (h AuthByEmailHandler) logoutUser(user UserID) error {
+	for _, session := range h.database.GetSessions(user) {
+		if err := h.database.DeleteCookieToken(session.Cookie); err != nil {
+			h.logger.Printf("Database error trying to delete a cookie, %v\n", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// csrfToken computes the token that forms for a logged-in user must carry, which is
+// bound to their cookie.
+func csrfToken(cookie string) string {
+	return CRYPTO.computeHmac([]byte("csrf/" + cookie))
+}
@@ -0,0 +1,323 @@
+package authbyemail
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeHTTPAdmin(t *testing.T) {
+	h := NewTestHandler()
+	h.config.Admins = []*EmailAddr{h.config.MailerFrom}
+	adminID := CRYPTO.UserIDfromEmail(h.config.MailerFrom)
+	h.database.AddUser(adminID)
+	cookieAdmin, _ := h.database.NewCookieToken(CookieToken{UserID: adminID, IsValidated: true, BrowserContext: "admin"})
+
+	email, _ := NewEmailAddrFromString("user@example.com")
+	userID := CRYPTO.UserIDfromEmail(email)
+
+	test := func(t *testing.T, desiredStatus int, req *http.Request) *http.Response {
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		statusCode, _ := h.ServeHTTP(w, req)
+		if statusCode != 0 || w.Result().StatusCode != desiredStatus {
+			t.Errorf("Status code should be %v but was %v. %#v", desiredStatus, w.Result().StatusCode, w.Result())
+		}
+		return w.Result()
+	}
+
+	post := func(cookie string, values url.Values) *http.Request {
+		req := httptest.NewRequest("POST", "http://example.com/auth/admin", strings.NewReader(values.Encode()))
+		req.Header.Add("Cookie", "authByEmailToken="+cookie)
+		return req
+	}
+
+	t.Run("Correct request (dashboard)", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://example.com/auth/admin", nil)
+		req.Header.Add("Cookie", "authByEmailToken="+cookieAdmin)
+		rsp := test(t, 200, req)
+		if body, _ := ioutil.ReadAll(rsp.Body); !strings.Contains(string(body), "There are 1 users, with 1 active sessions") {
+			t.Errorf("Dashboard does not show the right statistics: %v", string(body))
+		}
+	})
+
+	t.Run("Correct request (approve)", func(t *testing.T) {
+		h.mailer.(*MockMailer).mail = ""
+		test(t, 200, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"approve"}, "email": {email.String()}}))
+		if !h.database.IsKnownUser(userID) {
+			t.Error("User not added after approval")
+		}
+		if h.mailer.(*MockMailer).mail != "login" {
+			t.Error("No login mail sent after approval")
+		}
+		if decisions := h.database.GetApprovalDecisions(userID); len(decisions) != 0 {
+			t.Errorf("Decisions kept after the user was added, got %#v", decisions)
+		}
+	})
+
+	t.Run("Correct request (user list and reverse lookup)", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://example.com/auth/admin", nil)
+		req.Header.Add("Cookie", "authByEmailToken="+cookieAdmin)
+		rsp := test(t, 200, req)
+		if body, _ := ioutil.ReadAll(rsp.Body); !strings.Contains(string(body), email.String()) || !strings.Contains(string(body), "unknown until they log in again") {
+			t.Errorf("Dashboard does not list the users: %v", string(body))
+		}
+
+		rsp = test(t, 200, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"lookup"}, "email": {string(userID)}}))
+		if body, _ := ioutil.ReadAll(rsp.Body); !strings.Contains(string(body), "<h2>"+email.String()+"</h2>") {
+			t.Errorf("Reverse lookup did not find the user: %v", string(body))
+		}
+
+		rsp = test(t, 200, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"lookup"}, "email": {"nonexistent"}}))
+		if body, _ := ioutil.ReadAll(rsp.Body); !strings.Contains(string(body), "There is no user with ID nonexistent") {
+			t.Errorf("Reverse lookup of a non-existent user ID gave: %v", string(body))
+		}
+	})
+
+	t.Run("Correct request (lookup)", func(t *testing.T) {
+		h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: "user browser"})
+		rsp := test(t, 200, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"lookup"}, "email": {email.String()}}))
+		if body, _ := ioutil.ReadAll(rsp.Body); !strings.Contains(string(body), "user browser") {
+			t.Errorf("Dashboard does not show the user's sessions: %v", string(body))
+		}
+	})
+
+	t.Run("Correct request (send link)", func(t *testing.T) {
+		h.mailer.(*MockMailer).mail = ""
+		test(t, 200, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"sendlink"}, "email": {email.String()}}))
+		if h.mailer.(*MockMailer).mail != "login" {
+			t.Error("No login mail sent")
+		}
+	})
+
+	t.Run("Correct request (set expiry)", func(t *testing.T) {
+		date := time.Now().AddDate(0, 1, 0).Format("2006-01-02")
+		rsp := test(t, 200, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"setexpiry"}, "email": {email.String()}, "expires": {date}}))
+		if expiresAt, _ := ParseExpiry(date); !h.database.GetUserExpiry(userID).Equal(expiresAt) {
+			t.Errorf("Expiry not set, got %v", h.database.GetUserExpiry(userID))
+		}
+		if body, _ := ioutil.ReadAll(rsp.Body); !strings.Contains(string(body), "Their access ends on "+date) {
+			t.Errorf("User section does not show the expiry: %v", string(body))
+		}
+
+		test(t, 200, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"setexpiry"}, "email": {email.String()}, "expires": {""}}))
+		if !h.database.GetUserExpiry(userID).IsZero() {
+			t.Error("Expiry not removed")
+		}
+
+		test(t, 400, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"setexpiry"}, "email": {email.String()}, "expires": {"2000-01-01"}}))
+		test(t, 400, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"setexpiry"}, "email": {"stranger@example.com"}, "expires": {date}}))
+	})
+
+	t.Run("Correct request (approve with expiry)", func(t *testing.T) {
+		temp, _ := NewEmailAddrFromString("temp@example.com")
+		date := time.Now().AddDate(0, 0, 14).Format("2006-01-02")
+		test(t, 200, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"approve"}, "email": {temp.String()}, "expires": {date}}))
+		if expiresAt, _ := ParseExpiry(date); !h.database.IsKnownUser(CRYPTO.UserIDfromEmail(temp)) || !h.database.GetUserExpiry(CRYPTO.UserIDfromEmail(temp)).Equal(expiresAt) {
+			t.Error("User not added with an expiry")
+		}
+		h.database.DelUser(CRYPTO.UserIDfromEmail(temp))
+	})
+
+	t.Run("Correct request (approve a user whose access ended)", func(t *testing.T) {
+		ended, _ := NewEmailAddrFromString("ended@example.com")
+		endedID := CRYPTO.UserIDfromEmail(ended)
+		h.addUser(ended)
+		h.database.SetUserExpiry(endedID, time.Now().Add(-time.Hour))
+
+		// Without a new end, they are not approved
+		rsp := test(t, 200, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"approve"}, "email": {ended.String()}, "expires": {""}}))
+		if body, _ := ioutil.ReadAll(rsp.Body); h.database.IsKnownUser(endedID) || !strings.Contains(string(body), "Please give a new end") {
+			t.Errorf("User approved without a new end: %v", string(body))
+		}
+
+		date := time.Now().AddDate(0, 0, 14).Format("2006-01-02")
+		test(t, 200, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"approve"}, "email": {ended.String()}, "expires": {date}}))
+		if expiresAt, _ := ParseExpiry(date); !h.database.IsKnownUser(endedID) || !h.database.GetUserExpiry(endedID).Equal(expiresAt) {
+			t.Error("User not approved with the new end")
+		}
+		h.database.DelUser(endedID)
+	})
+
+	t.Run("Correct request (invite)", func(t *testing.T) {
+		h.mailer.(*MockMailer).mail = ""
+		guest, _ := NewEmailAddrFromString("guest@example.com")
+		test(t, 200, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"invite"}, "email": {guest.String()}, "message": {"Welcome!"}, "days": {"14"}}))
+		if h.mailer.(*MockMailer).mail != "invite" {
+			t.Error("No invitation sent")
+		}
+		if h.database.IsKnownUser(CRYPTO.UserIDfromEmail(guest)) {
+			t.Error("Invited user added before accepting the invitation")
+		}
+		test(t, 400, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"invite"}, "email": {guest.String()}, "days": {"soon"}}))
+	})
+
+	t.Run("Correct request (logout)", func(t *testing.T) {
+		test(t, 200, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"logout"}, "email": {email.String()}}))
+		if sessions := h.database.GetSessions(userID); len(sessions) != 0 {
+			t.Errorf("User still has sessions after being logged out: %#v", sessions)
+		}
+		if !h.database.IsKnownUser(userID) {
+			t.Error("User deleted after being logged out")
+		}
+	})
+
+	t.Run("Correct request (revoke access token)", func(t *testing.T) {
+		token, _ := h.database.NewAccessToken(AccessToken{UserID: userID, Name: "nightly backup"}, time.Hour)
+		at := h.database.GetAccessToken(token)
+
+		rsp := test(t, 200, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"lookup"}, "email": {email.String()}}))
+		if body, _ := ioutil.ReadAll(rsp.Body); !strings.Contains(string(body), "nightly backup") || strings.Contains(string(body), token) {
+			t.Errorf("User section does not list the access token by name only: %v", string(body))
+		}
+
+		test(t, 200, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"revoketoken"}, "email": {email.String()}, "token": {at.ID}}))
+		if h.database.GetAccessToken(token) != nil {
+			t.Error("Access token still exists after being revoked")
+		}
+		test(t, 400, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"revoketoken"}, "email": {email.String()}, "token": {at.ID}}))
+	})
+
+	t.Run("Correct request (revoke)", func(t *testing.T) {
+		test(t, 200, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"revoke"}, "email": {email.String()}}))
+		if h.database.IsKnownUser(userID) {
+			t.Error("User still exists after being revoked")
+		}
+	})
+
+	t.Run("Correct request (pending requests)", func(t *testing.T) {
+		pending, _ := NewEmailAddrFromString("pending@example.com")
+		h.database.AddPendingRequest(pending)
+
+		req := httptest.NewRequest("GET", "http://example.com/auth/admin", nil)
+		req.Header.Add("Cookie", "authByEmailToken="+cookieAdmin)
+		rsp := test(t, 200, req)
+		if body, _ := ioutil.ReadAll(rsp.Body); !strings.Contains(string(body), pending.String()) {
+			t.Errorf("Dashboard does not list the pending request: %v", string(body))
+		}
+
+		test(t, 200, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"reject"}, "email": {pending.String()}}))
+		if requests := h.database.GetPendingRequests(); len(requests) != 0 {
+			t.Errorf("Pending request still exists after being rejected, got %#v", requests)
+		}
+		if h.database.IsKnownUser(CRYPTO.UserIDfromEmail(pending)) {
+			t.Error("User added after their request was rejected")
+		}
+	})
+
+	t.Run("Correct request (lookup of a user who must be approved by several admins)", func(t *testing.T) {
+		users, _ := NewAddressList([]string{"quorum.example.com"})
+		h.config.AdminRoutes = []AdminRoute{{Users: users, Admins: h.config.Admins, Approvals: 2}}
+		defer func() { h.config.AdminRoutes = nil }()
+
+		newcomer, _ := NewEmailAddrFromString("newcomer@quorum.example.com")
+		h.database.AddApprovalDecision(CRYPTO.UserIDfromEmail(newcomer), ApprovalDecision{Admin: "other@example.com", Approved: true, DecidedAt: time.Now()})
+		rsp := test(t, 200, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"lookup"}, "email": {newcomer.String()}}))
+		if body, _ := ioutil.ReadAll(rsp.Body); !strings.Contains(string(body), "1 of the 2 approvals needed") || !strings.Contains(string(body), "<h2>Users</h2>") {
+			t.Errorf("Dashboard does not show the approvals so far: %v", string(body))
+		}
+	})
+
+	t.Run("Correct request (approve a user who must be approved by several admins)", func(t *testing.T) {
+		users, _ := NewAddressList([]string{"quorum.example.com"})
+		h.config.AdminRoutes = []AdminRoute{{Users: users, Admins: h.config.Admins, Approvals: 2}}
+		defer func() { h.config.AdminRoutes = nil }()
+
+		// Approving twice is still a single vote
+		voter, _ := NewEmailAddrFromString("voter@quorum.example.com")
+		for i := 0; i < 2; i++ {
+			rsp := test(t, 200, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"approve"}, "email": {voter.String()}}))
+			if body, _ := ioutil.ReadAll(rsp.Body); !strings.Contains(string(body), "1 of the 2 approvals needed") {
+				t.Errorf("Dashboard does not show that the approval was recorded: %v", string(body))
+			}
+		}
+		if h.database.IsKnownUser(CRYPTO.UserIDfromEmail(voter)) {
+			t.Error("User added after one of two approvals")
+		}
+
+		h.database.AddApprovalDecision(CRYPTO.UserIDfromEmail(voter), ApprovalDecision{Admin: "other@example.com", Approved: true, DecidedAt: time.Now()})
+		test(t, 200, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"approve"}, "email": {voter.String()}}))
+		if !h.database.IsKnownUser(CRYPTO.UserIDfromEmail(voter)) {
+			t.Error("User not added after two approvals")
+		}
+	})
+
+	t.Run("Correct request (admins of routes)", func(t *testing.T) {
+		h.config.ParseDirective("adminroute", []string{"partner.org", "liaison@example.com"})
+		h.config.ParseDirective("adminroute", []string{"*", h.config.MailerFrom.String()})
+		defer func() { h.config.AdminRoutes = nil }()
+		liaison, _ := NewEmailAddrFromString("liaison@example.com")
+		h.addUser(liaison)
+		cookieLiaison, _ := h.database.NewCookieToken(CookieToken{UserID: CRYPTO.UserIDfromEmail(liaison), IsValidated: true, BrowserContext: "liaison"})
+
+		// An admin only given in a route can use the dashboard for the users they approve
+		partner, _ := NewEmailAddrFromString("partner@partner.org")
+		test(t, 200, post(cookieLiaison, url.Values{"csrf": {csrfToken(cookieLiaison)}, "action": {"approve"}, "email": {partner.String()}}))
+		if !h.database.IsKnownUser(CRYPTO.UserIDfromEmail(partner)) {
+			t.Error("User not approved by the admin of their route")
+		}
+
+		// But not for others
+		rsp := test(t, 200, post(cookieLiaison, url.Values{"csrf": {csrfToken(cookieLiaison)}, "action": {"logout"}, "email": {email.String()}}))
+		if body, _ := ioutil.ReadAll(rsp.Body); !strings.Contains(string(body), "You are not an admin of "+email.String()) {
+			t.Errorf("Admin of a route managed a user of another route: %v", string(body))
+		}
+
+		// Nor can the global admin approve users of a route they are not in
+		other, _ := NewEmailAddrFromString("other@partner.org")
+		test(t, 200, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"approve"}, "email": {other.String()}}))
+		if h.database.IsKnownUser(CRYPTO.UserIDfromEmail(other)) || len(h.database.GetApprovalDecisions(CRYPTO.UserIDfromEmail(other))) != 0 {
+			t.Error("User approved by an admin who is not in their route")
+		}
+
+		// They can still manage them otherwise
+		test(t, 200, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"logout"}, "email": {partner.String()}}))
+
+		h.database.DelUser(CRYPTO.UserIDfromEmail(partner))
+		h.database.DelUser(CRYPTO.UserIDfromEmail(liaison))
+	})
+
+	t.Run("Malformed request (revoke admin)", func(t *testing.T) {
+		test(t, 400, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"revoke"}, "email": {h.config.MailerFrom.String()}}))
+		if !h.database.IsKnownUser(adminID) {
+			t.Error("Admin deleted themselves")
+		}
+	})
+
+	t.Run("Malformed request (send link to unknown user)", func(t *testing.T) {
+		test(t, 400, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"sendlink"}, "email": {email.String()}}))
+	})
+
+	t.Run("Malformed request (bad CSRF token)", func(t *testing.T) {
+		test(t, 400, post(cookieAdmin, url.Values{"csrf": {"problem"}, "action": {"approve"}, "email": {email.String()}}))
+		test(t, 400, post(cookieAdmin, url.Values{"action": {"approve"}, "email": {email.String()}}))
+		if h.database.IsKnownUser(userID) {
+			t.Error("User added without a proper CSRF token")
+		}
+	})
+
+	t.Run("Malformed request (bad data)", func(t *testing.T) {
+		test(t, 400, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"problem"}, "email": {email.String()}}))
+		test(t, 400, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}, "action": {"approve"}, "email": {"problem"}}))
+		test(t, 400, post(cookieAdmin, url.Values{"csrf": {csrfToken(cookieAdmin)}}))
+	})
+
+	t.Run("Malformed request (not an admin)", func(t *testing.T) {
+		test(t, 403, httptest.NewRequest("GET", "http://example.com/auth/admin", nil))
+
+		h.database.AddUser(userID)
+		cookieUser, _ := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: "user"})
+		req := httptest.NewRequest("GET", "http://example.com/auth/admin", nil)
+		req.Header.Add("Cookie", "authByEmailToken="+cookieUser)
+		test(t, 403, req)
+
+		test(t, 403, post(cookieUser, url.Values{"csrf": {csrfToken(cookieUser)}, "action": {"revoke"}, "email": {h.config.MailerFrom.String()}}))
+		if !h.database.IsKnownUser(adminID) {
+			t.Error("Admin deleted by a regular user")
+		}
+	})
+}
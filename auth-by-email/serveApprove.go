@@ -1,7 +1,11 @@
 package authbyemail
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 )
 
@@ -38,15 +42,40 @@ func (h AuthByEmailHandler) serveApproveByAskingConfirmation(w http.ResponseWrit
 		return h.serveBadRequest(w)
 	}
 
-	// Collect data for the approval template
+	// The link tells which admin it was sent to, so that their decision can be recorded
+	if _, err := h.approvingAdmin(r.Form, email); err != nil {
+		h.logger.Printf("Approve-confirm attempted for %v without a valid admin, %v", email.String(), err)
+		return h.serveBadRequest(w)
+	}
+
+	// Collect data for the approval template, including what other admins decided
+	userID := CRYPTO.UserIDfromEmail(email)
+	decisions := h.database.GetApprovalDecisions(userID)
 	data := struct {
-		User, EncEmail      string
-		Exists, SafeAddress bool
+		User, EncEmail, EncAdmin, Groups string
+		Exists, SafeAddress              bool
+		Decisions                        []ApprovalDecision
+		Approvals, ApprovalsNeeded       int
+		ExpiresAt                        time.Time
+		Expires                          string
 	}{
 		User:        email.String(),
 		EncEmail:    r.Form["email"][0],
-		Exists:      h.database.IsKnownUser(CRYPTO.UserIDfromEmail(email)),
+		EncAdmin:    r.Form.Get("admin"),
+		Groups:      strings.Join(h.database.GetUserGroups(userID), ", "),
+		Exists:      h.database.IsKnownUser(userID),
 		SafeAddress: email.LocalPartIsASCII(),
+		Decisions:   decisions,
+
+		Approvals:       countApprovals(decisions),
+		ApprovalsNeeded: h.config.approvalsForUser(email),
+	}
+
+	// The expiry field is filled in with the current expiry, unless that has passed, since
+	// approving the user would end their access again right away
+	data.ExpiresAt = h.database.GetUserExpiry(userID)
+	if data.ExpiresAt.After(time.Now()) {
+		data.Expires = formatExpiry(data.ExpiresAt)
 	}
 
 	return h.serveTemplate(w, TplApprove, &data)
@@ -68,33 +97,191 @@ func (h AuthByEmailHandler) serveApproveByExecutingAction(w http.ResponseWriter,
 		return h.serveBadRequest(w)
 	}
 
+	admin, err := h.approvingAdmin(r.PostForm, email)
+	if err != nil {
+		h.logger.Printf("Approve-execute attempted for %v without a valid admin, %v", email.String(), err)
+		return h.serveBadRequest(w)
+	}
+
 	userID := CRYPTO.UserIDfromEmail(email)
 
 	switch r.PostForm["action"][0] {
 	case "approve":
-		// Add user to the database
-		h.database.AddUser(userID)
-		// Send user a login link
-		token, err := h.database.NewLinkToken(LinkToken{UserID: userID, CorrespondingCookie: ""}, 48*time.Hour)
-		if err != nil {
-			h.logger.Printf("Database error trying to approve a user from an admin link, %v", err)
-			return 500, err
+		// The groups field is optional, so that custom templates without it still work
+		var groups []string
+		if len(r.PostForm["groups"]) > 0 {
+			if groups, err = ParseGroups(r.PostForm["groups"][0]); err != nil {
+				h.logger.Printf("Approve-execute attempted with bad groups, %v", err)
+				return h.serveBadRequest(w)
+			}
+		}
+
+		// So is the expiry field; when it is there but empty, the user's access does not end,
+		// unless it ended before (see below)
+		expires, setExpiry := r.PostForm["expires"]
+		var expiresAt time.Time
+		if setExpiry {
+			if expiresAt, err = ParseExpiry(strings.TrimSpace(expires[0])); err != nil || (!expiresAt.IsZero() && !expiresAt.After(time.Now())) {
+				h.logger.Printf("Approve-execute attempted with a bad expiry %q", expires[0])
+				return h.serveBadRequest(w)
+			}
 		}
 
-		err = h.mailer.SendLoginLink(email, token)
+		// A user whose access ended, and who asks for a renewal, must be given a new end,
+		// so that their access does not go on for ever by accident
+		if endedAt, ended := h.accessEnded(userID); ended && expiresAt.IsZero() {
+			h.logger.Printf("Approve-execute attempted without a new expiry for %v, whose access ended on %v", email.String(), formatExpiry(endedAt))
+			return h.serveBadRequest(w)
+		}
+
+		// Add user to the database and send them a login link, once enough admins
+		// approved them; until then, the vote is just recorded
+		approved, err := h.voteToApprove(email, admin)
 		if err != nil {
-			h.logger.Printf("Error mailing user %v a login link, %v", email.String(), err)
 			return 500, err
 		}
+		if !approved {
+			return h.serveStaticPage(w, r, 200, TplAckVote)
+		}
+
+		if groups != nil {
+			if err := h.database.SetUserGroups(userID, groups); err != nil {
+				h.logger.Printf("Database error trying to set the groups of %v, %v", email.String(), err)
+				return 500, err
+			}
+		}
+
+		if setExpiry {
+			if err := h.database.SetUserExpiry(userID, expiresAt); err != nil {
+				h.logger.Printf("Database error trying to set the expiry of %v, %v", email.String(), err)
+				return 500, err
+			}
+		}
 
 		return h.serveStaticPage(w, r, 200, TplAckApprove)
 
 	case "revoke":
-		// Delete user and invalidate all links and cookies
+		// Delete user and invalidate all links and cookies, or reject their request. This
+		// vetoes the approvals of other admins.
+		h.database.DelPendingRequest(userID)
 		h.database.DelUser(userID)
+		h.recordDecision(userID, admin, false)
 		return h.serveStaticPage(w, r, 200, TplAckRemove)
 
 	default:
 		return h.serveBadRequest(w)
 	}
 }
+
+// An approvalVote tells to which admin an approval link was sent, and about which user.
+// It is encrypted into the admin= field of the link, so that an admin can only decide
+// in their own name, and only about the user the link was sent for.
+type approvalVote struct {
+	User  string `json:"user"`
+	Admin string `json:"admin"`
+}
+
+// Approval votes are marked, so that nothing else that is encrypted can pass for one.
+const approvalVotePrefix = "approve/"
+
+func (v approvalVote) serialize() string {
+	return CRYPTO.sealJSON(approvalVotePrefix, v)
+}
+
+// approvingAdmin returns the e-mail address of the admin to whom the approval link for
+// a user was sent, from its admin= field. The admin must still be one of the admins of
+// the user, since each of them has a say only once.
+func (h AuthByEmailHandler) approvingAdmin(form url.Values, email *EmailAddr) (string, error) {
+	var vote approvalVote
+	if err := CRYPTO.openJSON(approvalVotePrefix, form.Get("admin"), &vote); err != nil {
+		return "", errors.New("Not an approval link of an admin")
+	}
+	if vote.User != email.String() {
+		return "", fmt.Errorf("The approval link was sent for %v", vote.User)
+	}
+	for _, admin := range h.config.adminsForUser(email) {
+		if admin.String() == vote.Admin {
+			return vote.Admin, nil
+		}
+	}
+	return "", fmt.Errorf("%v is not an admin of this user", vote.Admin)
+}
+
+// recordDecision records how an admin decided about a user, so that the other admins
+// responsible for them can see it. Not being able to record it is no reason to fail.
+func (h AuthByEmailHandler) recordDecision(user UserID, admin string, approved bool) {
+	decision := ApprovalDecision{Admin: admin, Approved: approved, DecidedAt: time.Now()}
+	if err := h.database.AddApprovalDecision(user, decision); err != nil {
+		h.logger.Printf("Database error trying to record a decision about user %v, %v", user, err)
+	}
+}
+
+// countApprovals counts the admins who approved a user since one last rejected them,
+// given their decisions oldest first. Each admin counts once, since a new decision of
+// an admin replaces their earlier one.
+func countApprovals(decisions []ApprovalDecision) int {
+	approvals := 0
+	for _, decision := range decisions {
+		if decision.Approved {
+			approvals++
+		} else {
+			approvals = 0
+		}
+	}
+	return approvals
+}
+
+// voteToApprove records that an admin approved a user, and approves the user once enough
+// admins did so. Users who are known already, and may have asked for a renewal, are
+// approved at once. It returns whether the user was approved. Callers check that the
+// admin is one of the admins of the user (see isAdminOf).
+func (h AuthByEmailHandler) voteToApprove(email *EmailAddr, admin string) (bool, error) {
+	userID := CRYPTO.UserIDfromEmail(email)
+	h.recordDecision(userID, admin, true)
+	if !h.database.IsKnownUser(userID) {
+		if approvals := countApprovals(h.database.GetApprovalDecisions(userID)); approvals < h.config.approvalsForUser(email) {
+			h.logger.Printf("Admin %q approved %v, %v approvals so far", admin, email.String(), approvals)
+			return false, nil
+		}
+	}
+	return true, h.approveUser(email)
+}
+
+// approveUser adds a user to the database, and sends them a login link. Users who are
+// known already may have asked for a renewal, which is granted as well. The decisions
+// of the admins are forgotten, so that they do not count towards a later request.
+func (h AuthByEmailHandler) approveUser(email *EmailAddr) error {
+	userID := CRYPTO.UserIDfromEmail(email)
+	h.addUser(email)
+	h.database.DelPendingRequest(userID)
+	if err := h.database.DelApprovalDecisions(userID); err != nil {
+		h.logger.Printf("Database error trying to forget the decisions about %v, %v", email.String(), err)
+	}
+	return h.sendLoginLink(email)
+}
+
+// addUser adds a user to the database, along with their (encrypted) e-mail address.
+func (h AuthByEmailHandler) addUser(email *EmailAddr) {
+	h.database.AddUser(CRYPTO.UserIDfromEmail(email))
+	if err := h.database.SetUserEmail(email); err != nil {
+		h.logger.Printf("Database error trying to store the e-mail address of %v, %v", email.String(), err)
+	}
+}
+
+// sendLoginLink sends an existing user a login link that is valid for two days. Since
+// the user did not ask for it themselves, it is not tied to any browser.
+func (h AuthByEmailHandler) sendLoginLink(email *EmailAddr) error {
+	token, err := h.database.NewLinkToken(LinkToken{UserID: CRYPTO.UserIDfromEmail(email), CorrespondingCookie: ""}, 48*time.Hour)
+	if err != nil {
+		h.logger.Printf("Database error trying to make a login link for %v, %v", email.String(), err)
+		return err
+	}
+
+	err = h.mailer.SendLoginLink(email, token, "")
+	if err != nil {
+		h.logger.Printf("Error mailing user %v a login link, %v", email.String(), err)
+		return err
+	}
+
+	return nil
+}
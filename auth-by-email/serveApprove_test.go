@@ -5,13 +5,31 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestServeHTTPApprove(t *testing.T) {
 	h := NewTestHandler()
 	h.database.AddUser(CRYPTO.UserIDfromEmail(h.config.MailerFrom))
+	h.config.ParseDirective("adminroute", []string{"*", "alice@example.com", "bob@example.com"})
+	h.config.ParseDirective("adminroute", []string{"example.net", "approvals", "2", "alice@example.com", "bob@example.com"})
+
+	// link returns the fields of the approval link mailed to an admin about a user, and
+	// the other given fields and values
+	link := func(user, admin string, fields ...string) url.Values {
+		vote := approvalVote{User: user, Admin: admin}
+		if email, err := NewEmailAddrFromString(user); err == nil {
+			vote.User = email.String()
+		}
+		values := url.Values{"email": {CRYPTO.encrypt(user)}, "admin": {vote.serialize()}}
+		for i := 0; i+1 < len(fields); i += 2 {
+			values.Set(fields[i], fields[i+1])
+		}
+		return values
+	}
 
 	// Standard GET request
 	test := func(t *testing.T, desiredStatus int, req *http.Request) {
@@ -24,13 +42,13 @@ func TestServeHTTPApprove(t *testing.T) {
 
 	t.Run("Ask for confirmation", func(t *testing.T) {
 		t.Run("Correct request", func(t *testing.T) {
-			test(t, 200, httptest.NewRequest("GET", "http://example.com/auth/approve?"+url.Values{"email": {CRYPTO.encrypt("test@example.com")}, "submit": {"Get"}}.Encode(), nil))
+			test(t, 200, httptest.NewRequest("GET", "http://example.com/auth/approve?"+link("test@example.com", "alice@example.com").Encode(), nil))
 		})
 		t.Run("Malformed request (no data)", func(t *testing.T) {
 			test(t, 400, httptest.NewRequest("GET", "http://example.com/auth/approve", nil))
 		})
 		t.Run("Malformed request (bad email)", func(t *testing.T) {
-			test(t, 400, httptest.NewRequest("GET", "http://example.com/auth/approve?"+url.Values{"email": {CRYPTO.encrypt("problem")}, "submit": {"Get"}}.Encode(), nil))
+			test(t, 400, httptest.NewRequest("GET", "http://example.com/auth/approve?"+link("problem", "alice@example.com").Encode(), nil))
 		})
 		t.Run("Malformed request (bad encryption)", func(t *testing.T) {
 			test(t, 400, httptest.NewRequest("GET", "http://example.com/auth/approve?"+url.Values{"email": {"problem"}, "submit": {"Get"}}.Encode(), nil))
@@ -53,7 +71,7 @@ func TestServeHTTPApprove(t *testing.T) {
 	t.Run("Confirmation form correctly identifies existing users", func(t *testing.T) {
 		t.Run("New user should not exist", func(t *testing.T) {
 			testString(t, "This user does not exist in the database.",
-				httptest.NewRequest("GET", "http://example.com/auth/approve?"+url.Values{"email": {CRYPTO.encrypt("test@example.com")}, "submit": {"Get"}}.Encode(), nil))
+				httptest.NewRequest("GET", "http://example.com/auth/approve?"+link("test@example.com", "alice@example.com").Encode(), nil))
 		})
 
 		// Add the user and try again
@@ -63,7 +81,7 @@ func TestServeHTTPApprove(t *testing.T) {
 
 		t.Run("Existing user should exist", func(t *testing.T) {
 			testString(t, "This user is currently approved. Approving them again will resend the log-in link.",
-				httptest.NewRequest("GET", "http://example.com/auth/approve?"+url.Values{"email": {CRYPTO.encrypt("test@example.com")}, "submit": {"Get"}}.Encode(), nil))
+				httptest.NewRequest("GET", "http://example.com/auth/approve?"+link("test@example.com", "alice@example.com").Encode(), nil))
 		})
 		h.database.DelUser(userID)
 	})
@@ -71,12 +89,12 @@ func TestServeHTTPApprove(t *testing.T) {
 	t.Run("Confirmation form correctly handles non-ASCII addresses", func(t *testing.T) {
 		t.Run("Non-ASCII domain should be punycoded", func(t *testing.T) {
 			testString(t, "xn--example-tfb.com",
-				httptest.NewRequest("GET", "http://example.com/auth/approve?"+url.Values{"email": {CRYPTO.encrypt("test@exaımple.com")}, "submit": {"Get"}}.Encode(), nil))
+				httptest.NewRequest("GET", "http://example.com/auth/approve?"+link("test@exaımple.com", "alice@example.com").Encode(), nil))
 		})
 
 		t.Run("Non-ASCII local part should give a warning", func(t *testing.T) {
 			testString(t, "This e-mail address contains non-ascii characters.",
-				httptest.NewRequest("GET", "http://example.com/auth/approve?"+url.Values{"email": {CRYPTO.encrypt("teıst@example.com")}, "submit": {"Get"}}.Encode(), nil))
+				httptest.NewRequest("GET", "http://example.com/auth/approve?"+link("teıst@example.com", "alice@example.com").Encode(), nil))
 		})
 	})
 
@@ -95,7 +113,7 @@ func TestServeHTTPApprove(t *testing.T) {
 		t.Run("Correct request (approval)", func(t *testing.T) {
 			h.mailer.(*MockMailer).mail = ""
 			test(t, 200, httptest.NewRequest("POST", "http://example.com/auth/approve",
-				strings.NewReader(url.Values{"email": {CRYPTO.encrypt("test@example.com")}, "action": {"approve"}, "submit": {"Get"}}.Encode())))
+				strings.NewReader(link("test@example.com", "alice@example.com", "action", "approve").Encode())))
 			if h.mailer.(*MockMailer).mail != "login" {
 				t.Error("No login mail sent after admin approval")
 			}
@@ -104,9 +122,45 @@ func TestServeHTTPApprove(t *testing.T) {
 			}
 		})
 
+		t.Run("Correct request (approval with groups)", func(t *testing.T) {
+			test(t, 200, httptest.NewRequest("POST", "http://example.com/auth/approve",
+				strings.NewReader(link("test@example.com", "alice@example.com", "action", "approve", "groups", "hr, finance").Encode())))
+			email, _ := NewEmailAddrFromString("test@example.com")
+			if groups := h.database.GetUserGroups(CRYPTO.UserIDfromEmail(email)); !reflect.DeepEqual(groups, []string{"finance", "hr"}) {
+				t.Errorf("Groups not set after admin approval, got %#v", groups)
+			}
+			testString(t, "finance, hr",
+				httptest.NewRequest("GET", "http://example.com/auth/approve?"+link("test@example.com", "alice@example.com").Encode(), nil))
+		})
+
+		t.Run("Correct request (approval with expiry)", func(t *testing.T) {
+			email, _ := NewEmailAddrFromString("test@example.com")
+			userID := CRYPTO.UserIDfromEmail(email)
+			date := time.Now().AddDate(0, 1, 0).Format("2006-01-02")
+			test(t, 200, httptest.NewRequest("POST", "http://example.com/auth/approve",
+				strings.NewReader(link("test@example.com", "alice@example.com", "action", "approve", "expires", date).Encode())))
+			if expiresAt, _ := ParseExpiry(date); !h.database.GetUserExpiry(userID).Equal(expiresAt) {
+				t.Errorf("Expiry not set after admin approval, got %v", h.database.GetUserExpiry(userID))
+			}
+			testString(t, `value="`+date+`"`,
+				httptest.NewRequest("GET", "http://example.com/auth/approve?"+link("test@example.com", "alice@example.com").Encode(), nil))
+
+			// Without the field, the expiry is left alone; an empty field removes it
+			test(t, 200, httptest.NewRequest("POST", "http://example.com/auth/approve",
+				strings.NewReader(link("test@example.com", "alice@example.com", "action", "approve").Encode())))
+			if h.database.GetUserExpiry(userID).IsZero() {
+				t.Error("Expiry removed by an approval without the expires field")
+			}
+			test(t, 200, httptest.NewRequest("POST", "http://example.com/auth/approve",
+				strings.NewReader(link("test@example.com", "alice@example.com", "action", "approve", "expires", "").Encode())))
+			if !h.database.GetUserExpiry(userID).IsZero() {
+				t.Error("Expiry not removed after admin approval with an empty expires field")
+			}
+		})
+
 		t.Run("Correct request (revocation)", func(t *testing.T) {
 			test(t, 200, httptest.NewRequest("POST", "http://example.com/auth/approve",
-				strings.NewReader(url.Values{"email": {CRYPTO.encrypt("test@example.com")}, "action": {"revoke"}, "submit": {"Get"}}.Encode())))
+				strings.NewReader(link("test@example.com", "alice@example.com", "action", "revoke").Encode())))
 			if email, _ := NewEmailAddrFromString("test@example.com"); h.database.IsKnownUser(CRYPTO.UserIDfromEmail(email)) {
 				t.Error("User not deleted after admin approval")
 			}
@@ -119,7 +173,7 @@ func TestServeHTTPApprove(t *testing.T) {
 
 		t.Run("Malformed request (bad email)", func(t *testing.T) {
 			test(t, 400, httptest.NewRequest("POST", "http://example.com/auth/approve",
-				strings.NewReader(url.Values{"email": {CRYPTO.encrypt("problem")}, "action": {"revoke"}, "submit": {"Get"}}.Encode())))
+				strings.NewReader(link("problem", "alice@example.com", "action", "revoke").Encode())))
 
 		})
 
@@ -129,9 +183,131 @@ func TestServeHTTPApprove(t *testing.T) {
 
 		})
 
+		t.Run("Malformed request (bad groups)", func(t *testing.T) {
+			test(t, 400, httptest.NewRequest("POST", "http://example.com/auth/approve",
+				strings.NewReader(link("test@example.com", "alice@example.com", "action", "approve", "groups", "finance/hr").Encode())))
+		})
+
+		t.Run("Malformed request (bad expiry)", func(t *testing.T) {
+			test(t, 400, httptest.NewRequest("POST", "http://example.com/auth/approve",
+				strings.NewReader(link("test@example.com", "alice@example.com", "action", "approve", "expires", "soon").Encode())))
+			test(t, 400, httptest.NewRequest("POST", "http://example.com/auth/approve",
+				strings.NewReader(link("test@example.com", "alice@example.com", "action", "approve", "expires", "2000-01-01").Encode())))
+		})
+
+		t.Run("Correct request (decisions of admins)", func(t *testing.T) {
+			test(t, 200, httptest.NewRequest("POST", "http://example.com/auth/approve",
+				strings.NewReader(link("decided@example.net", "alice@example.com", "action", "approve").Encode())))
+			testString(t, "alice@example.com approved this user",
+				httptest.NewRequest("GET", "http://example.com/auth/approve?"+link("decided@example.net", "bob@example.com").Encode(), nil))
+
+			// An admin who changes their mind replaces their decision
+			test(t, 200, httptest.NewRequest("POST", "http://example.com/auth/approve",
+				strings.NewReader(link("decided@example.net", "alice@example.com", "action", "revoke").Encode())))
+			testString(t, "alice@example.com rejected this user",
+				httptest.NewRequest("GET", "http://example.com/auth/approve?"+link("decided@example.net", "alice@example.com").Encode(), nil))
+
+			email, _ := NewEmailAddrFromString("decided@example.net")
+			userID := CRYPTO.UserIDfromEmail(email)
+			for _, decision := range h.database.GetApprovalDecisions(userID) {
+				if decision.Admin == "alice@example.com" && decision.Approved {
+					t.Errorf("Earlier decision of the admin was kept, got %#v", decision)
+				}
+			}
+
+			// Once the user is added, the decisions no longer count towards a later request
+			test(t, 200, httptest.NewRequest("POST", "http://example.com/auth/approve",
+				strings.NewReader(link("decided@example.net", "alice@example.com", "action", "approve").Encode())))
+			test(t, 200, httptest.NewRequest("POST", "http://example.com/auth/approve",
+				strings.NewReader(link("decided@example.net", "bob@example.com", "action", "approve").Encode())))
+			if decisions := h.database.GetApprovalDecisions(userID); !h.database.IsKnownUser(userID) || len(decisions) != 0 {
+				t.Errorf("Decisions kept after the user was added, got %#v", decisions)
+			}
+			h.database.DelUser(userID)
+			test(t, 200, httptest.NewRequest("POST", "http://example.com/auth/approve",
+				strings.NewReader(link("decided@example.net", "alice@example.com", "action", "approve").Encode())))
+			if h.database.IsKnownUser(userID) {
+				t.Error("User added again by one approval, after earlier ones")
+			}
+		})
+
+		t.Run("Correct request (several approvals needed)", func(t *testing.T) {
+			routes := h.config.AdminRoutes
+			h.config.ParseDirective("adminroute", []string{"example.org", "approvals", "2", "alice@example.com", "bob@example.com", "carol@example.com"})
+			defer func() { h.config.AdminRoutes = routes }()
+			vote := func(user, admin, action string) *http.Request {
+				req := httptest.NewRequest("POST", "http://example.com/auth/approve",
+					strings.NewReader(link(user, admin, "action", action).Encode()))
+				req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+				return req
+			}
+
+			// One approval is not enough, and a rejection vetoes it
+			email, _ := NewEmailAddrFromString("quorum@example.org")
+			userID := CRYPTO.UserIDfromEmail(email)
+			testString(t, "Your approval has been recorded", vote(email.String(), "alice@example.com", "approve"))
+			if h.database.IsKnownUser(userID) {
+				t.Error("User added after one of two approvals")
+			}
+			testString(t, "1 of the 2 approvals needed have been given",
+				httptest.NewRequest("GET", "http://example.com/auth/approve?"+link(email.String(), "alice@example.com").Encode(), nil))
+			test(t, 200, vote(email.String(), "bob@example.com", "revoke"))
+			if approvals := countApprovals(h.database.GetApprovalDecisions(userID)); h.database.IsKnownUser(userID) || approvals != 0 {
+				t.Errorf("Rejection did not veto the approval, got %v approvals", approvals)
+			}
+
+			// The second approval adds the user
+			email, _ = NewEmailAddrFromString("quorum2@example.org")
+			userID = CRYPTO.UserIDfromEmail(email)
+			h.database.AddApprovalDecision(userID, ApprovalDecision{Admin: "alice@example.com", Approved: true, DecidedAt: time.Now().Add(-time.Minute)})
+			h.mailer.(*MockMailer).mail = ""
+			testString(t, "User has been added", vote(email.String(), "carol@example.com", "approve"))
+			if !h.database.IsKnownUser(userID) || h.mailer.(*MockMailer).mail != "login" {
+				t.Error("User not added after two approvals")
+			}
+		})
+
+		t.Run("Malformed request (bad admin)", func(t *testing.T) {
+			post := func(form url.Values) *http.Request {
+				return httptest.NewRequest("POST", "http://example.com/auth/approve", strings.NewReader(form.Encode()))
+			}
+			form := link("test@example.com", "alice@example.com", "action", "approve")
+			form.Set("admin", "problem")
+			test(t, 400, post(form))
+			form.Del("admin")
+			test(t, 400, post(form))
+
+			// Admins of other users, and former admins, have no say
+			test(t, 400, post(link("test@example.com", "carol@example.com", "action", "approve")))
+			test(t, 400, post(link("test@example.com", "mallory@example.com", "action", "approve")))
+		})
+
+		t.Run("Malformed request (voting twice)", func(t *testing.T) {
+			post := func(form url.Values) *http.Request {
+				return httptest.NewRequest("POST", "http://example.com/auth/approve", strings.NewReader(form.Encode()))
+			}
+
+			email, _ := NewEmailAddrFromString("twice@example.net")
+			userID := CRYPTO.UserIDfromEmail(email)
+			test(t, 200, post(link(email.String(), "alice@example.com", "action", "approve")))
+			test(t, 200, post(link(email.String(), "alice@example.com", "action", "approve")))
+
+			// Nor can an admin pass off their link about another user, or the encrypted
+			// address of another admin, as a vote of someone else
+			form := link(email.String(), "alice@example.com", "action", "approve")
+			form.Set("admin", link("test@example.com", "bob@example.com").Get("admin"))
+			test(t, 400, post(form))
+			form.Set("admin", CRYPTO.encrypt("bob@example.com"))
+			test(t, 400, post(form))
+
+			if approvals := countApprovals(h.database.GetApprovalDecisions(userID)); h.database.IsKnownUser(userID) || approvals != 1 {
+				t.Errorf("User added after one admin voted twice, got %v approvals", approvals)
+			}
+		})
+
 		t.Run("Malformed request (bad action)", func(t *testing.T) {
 			test(t, 400, httptest.NewRequest("POST", "http://example.com/auth/approve",
-				strings.NewReader(url.Values{"email": {CRYPTO.encrypt("test@example.com")}, "action": {"banana"}, "submit": {"Get"}}.Encode())))
+				strings.NewReader(link("test@example.com", "alice@example.com", "action", "banana").Encode())))
 		})
 	})
 }
@@ -0,0 +1,200 @@
+package authbyemail
+
+import (
+	"io"
+	"net/http"
+)
+
+// serveChallenge tells the script on the login page what to ask of the browser before
+// the login form may be posted, as JSON.
+func (h AuthByEmailHandler) serveChallenge(w http.ResponseWriter) (int, error) {
+	if h.config.Challenge == nil {
+		return h.serveNotFound(w)
+	}
+
+	description, err := h.config.Challenge.Describe()
+	if err != nil {
+		h.logger.Printf("Could not make a login challenge, %v", err)
+		return 500, err
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return h.serveJSON(w, 200, description)
+}
+
+// serveChallengeScript serves the script that the login page includes to answer the
+// challenge. Without a challenge, it does nothing.
+func (h AuthByEmailHandler) serveChallengeScript(w http.ResponseWriter) (int, error) {
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if h.config.Challenge == nil {
+		io.WriteString(w, "// No challenge is configured\n")
+	} else {
+		io.WriteString(w, CHALLENGE_SCRIPT)
+	}
+	return 0, nil
+}
+
+// This script finds the forms on the page that post to /auth/login, and fetches the
+// challenge from /auth/challenge. It either shows the widget of a captcha service in
+// them, or solves a proof of work in the background and puts it in the hidden fields
+// `challenge` and `nonce`. A form that is submitted before the proof of work is done is
+// posted when it is.
+const CHALLENGE_SCRIPT = `(function () {
+	"use strict";
+	var forms = Array.prototype.filter.call(document.getElementsByTagName("form"), function (form) {
+		return /\/auth\/login$/.test(form.getAttribute("action") || "");
+	});
+	if (forms.length === 0) {
+		return;
+	}
+
+	var K = [
+		0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5, 0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+		0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3, 0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+		0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc, 0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+		0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7, 0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+		0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13, 0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+		0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3, 0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+		0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5, 0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+		0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208, 0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2
+	];
+
+	// SHA-256 of an ASCII string, as eight 32-bit words. WebCrypto is not used, because it
+	// is asynchronous (which is slow for many small hashes) and needs HTTPS.
+	function sha256(s) {
+		var n = s.length, blocks = ((n + 8) >> 6) * 16 + 16, m = [], w = [], i, j;
+		for (i = 0; i < blocks; i++) {
+			m[i] = 0;
+		}
+		for (i = 0; i < n; i++) {
+			m[i >> 2] |= s.charCodeAt(i) << (24 - (i % 4) * 8);
+		}
+		m[n >> 2] |= 0x80 << (24 - (n % 4) * 8);
+		m[blocks - 1] = n * 8;
+
+		var h = [0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a, 0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19];
+		for (i = 0; i < blocks; i += 16) {
+			var a = h[0], b = h[1], c = h[2], d = h[3], e = h[4], f = h[5], g = h[6], k = h[7];
+			for (j = 0; j < 64; j++) {
+				if (j < 16) {
+					w[j] = m[i + j];
+				} else {
+					var x = w[j - 15], y = w[j - 2];
+					w[j] = (((x >>> 7) | (x << 25)) ^ ((x >>> 18) | (x << 14)) ^ (x >>> 3)) +
+						(((y >>> 17) | (y << 15)) ^ ((y >>> 19) | (y << 13)) ^ (y >>> 10)) + w[j - 7] + w[j - 16] | 0;
+				}
+				var t1 = k + (((e >>> 6) | (e << 26)) ^ ((e >>> 11) | (e << 21)) ^ ((e >>> 25) | (e << 7))) +
+					((e & f) ^ (~e & g)) + K[j] + w[j] | 0;
+				var t2 = (((a >>> 2) | (a << 30)) ^ ((a >>> 13) | (a << 19)) ^ ((a >>> 22) | (a << 10))) +
+					((a & b) ^ (a & c) ^ (b & c)) | 0;
+				k = g; g = f; f = e; e = d + t1 | 0; d = c; c = b; b = a; a = t1 + t2 | 0;
+			}
+			h[0] = h[0] + a | 0; h[1] = h[1] + b | 0; h[2] = h[2] + c | 0; h[3] = h[3] + d | 0;
+			h[4] = h[4] + e | 0; h[5] = h[5] + f | 0; h[6] = h[6] + g | 0; h[7] = h[7] + k | 0;
+		}
+		return h;
+	}
+
+	function leadingZeroBits(h) {
+		for (var i = 0; i < h.length; i++) {
+			if (h[i] !== 0) {
+				return i * 32 + Math.clz32(h[i]);
+			}
+		}
+		return h.length * 32;
+	}
+
+	function setField(form, name, value) {
+		var input = form.querySelector("input[name='" + name + "']");
+		if (!input) {
+			input = document.createElement("input");
+			input.type = "hidden";
+			input.name = name;
+			form.appendChild(input);
+		}
+		input.value = value;
+	}
+
+	var solved = false, waiting = [];
+	forms.forEach(function (form) {
+		form.addEventListener("submit", function (event) {
+			if (!solved) {
+				event.preventDefault();
+				if (waiting.indexOf(form) < 0) {
+					waiting.push(form);
+				}
+			}
+		});
+	});
+
+	// Finds a nonce in small steps, so that the page stays responsive
+	function solve(challenge, bits, run) {
+		var nonce = 0;
+		(function step() {
+			if (run !== runs) {
+				return;
+			}
+			for (var end = nonce + 5000; nonce < end; nonce++) {
+				if (leadingZeroBits(sha256(challenge + ":" + nonce)) >= bits) {
+					forms.forEach(function (form) {
+						setField(form, "challenge", challenge);
+						setField(form, "nonce", String(nonce));
+					});
+					solved = true;
+					waiting.splice(0).forEach(function (form) { form.submit(); });
+					return;
+				}
+			}
+			setTimeout(step, 0);
+		})();
+	}
+
+	function showCaptcha(challenge) {
+		solved = true;
+		if (document.querySelector("script[src='" + challenge.script + "']")) {
+			return;
+		}
+		forms.forEach(function (form) {
+			var widget = document.createElement("div");
+			widget.className = challenge["class"];
+			widget.setAttribute("data-sitekey", challenge.sitekey);
+			var submit = form.querySelector("[type='submit']");
+			if (submit) {
+				submit.parentNode.insertBefore(widget, submit);
+			} else {
+				form.appendChild(widget);
+			}
+		});
+		var script = document.createElement("script");
+		script.src = challenge.script;
+		script.async = true;
+		document.head.appendChild(script);
+	}
+
+	// A proof of work can only be used once, so a page that is shown again (for example
+	// with the back button) gets a new one
+	var runs = 0;
+	function start() {
+		var run = ++runs;
+		solved = false;
+		fetch("/auth/challenge", {cache: "no-store"}).then(function (response) {
+			return response.json();
+		}).then(function (challenge) {
+			if (challenge.type === "pow") {
+				solve(challenge.challenge, challenge.bits, run);
+			} else if (challenge.type === "captcha") {
+				showCaptcha(challenge);
+			}
+		}).catch(function () {
+			// Let the server tell the user what went wrong
+			solved = true;
+		});
+	}
+	window.addEventListener("pageshow", function (event) {
+		if (event.persisted) {
+			start();
+		}
+	});
+	start();
+})();
+`
@@ -0,0 +1,51 @@
+package authbyemail
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeHTTPChallenge(t *testing.T) {
+	h := NewTestHandler()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("No challenge", func(t *testing.T) {
+		if w := get("/auth/challenge"); w.Code != 404 {
+			t.Errorf("Expected a 404 without a challenge, got %v", w.Code)
+		}
+		if w := get("/auth/challenge.js"); w.Code != 200 || strings.Contains(w.Body.String(), "fetch") {
+			t.Errorf("Expected an empty script without a challenge, got %v %v", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Correct request", func(t *testing.T) {
+		h.config.Challenge = NewProofOfWork(10)
+		defer func() { h.config.Challenge = nil }()
+
+		w := get("/auth/challenge")
+		var description ChallengeDescription
+		if err := json.NewDecoder(w.Body).Decode(&description); err != nil || w.Code != 200 {
+			t.Fatalf("Could not get the challenge, %v %v", w.Code, err)
+		}
+		if description.Type != "pow" || description.Bits != 10 || description.Challenge == "" {
+			t.Errorf("Wrong challenge, %#v", description)
+		}
+		if w := get("/auth/challenge.js"); w.Code != 200 || !strings.Contains(w.Body.String(), "/auth/challenge") {
+			t.Errorf("Expected the challenge script, got %v", w.Code)
+		}
+	})
+
+	t.Run("Login page includes the script", func(t *testing.T) {
+		if w := get("/page"); w.Code != 403 || !strings.Contains(w.Body.String(), `src="/auth/challenge.js"`) {
+			t.Errorf("Login page does not include the challenge script, got %v", w.Code)
+		}
+	})
+}
@@ -24,11 +24,9 @@ func (h AuthByEmailHandler) serveDelete(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Check if the user is not an admin
-	for _, adminEmail := range h.config.Admins {
-		if CRYPTO.UserIDfromEmail(adminEmail) == token.UserID {
-			h.logger.Printf("Can not delete admin %v", adminEmail)
-			return h.serveBadRequest(w)
-		}
+	if h.isAdmin(token.UserID) {
+		h.logger.Printf("Can not delete admin %v", token.UserID)
+		return h.serveBadRequest(w)
 	}
 
 	err := h.database.DelUser(token.UserID)
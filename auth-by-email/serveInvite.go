@@ -0,0 +1,55 @@
+package authbyemail
+
+import (
+	"net/http"
+)
+
+// serveInvite is called when someone follows the link in an invitation. The first time,
+// they are added as a user and logged in. Afterwards, the link only leads to the site,
+// so that a forwarded invitation does not let others in, and once they are deleted it
+// no longer works at all.
+func (h AuthByEmailHandler) serveInvite(w http.ResponseWriter, r *http.Request) (int, error) {
+	r.ParseForm()
+	if len(r.Form["token"]) == 0 {
+		return h.serveBadRequest(w)
+	}
+
+	invitation, err := parseInvitation(r.Form["token"][0])
+	if err != nil {
+		h.logger.Printf("Invitation not accepted, %v", err)
+		return h.serveNotAuthenticated(w)
+	}
+	email, err := NewEmailAddrFromString(invitation.Email)
+	if err != nil {
+		return h.serveBadRequest(w)
+	}
+	userID := CRYPTO.UserIDfromEmail(email)
+
+	if h.database.IsKnownUser(userID) {
+		return h.serveRedirect(w, h.config.Redirect)
+	}
+
+	// The admins may since have been asked to approve such users together
+	if approvals := h.config.approvalsForUser(email); approvals > 1 {
+		h.logger.Printf("Invitation of %v not accepted, %v admins must approve them", email.String(), approvals)
+		return h.serveNotAuthenticated(w)
+	}
+
+	// An admin who rejects the user after the invitation was sent withdraws it, and a user
+	// who was deleted after accepting it can not use it to come back
+	if !invitation.isOutstanding(h.database.GetApprovalDecisions(userID)) {
+		h.logger.Printf("Invitation of %v by %q was withdrawn or used already", email.String(), invitation.Inviter)
+		return h.serveNotAuthenticated(w)
+	}
+
+	h.logger.Printf("%v accepted the invitation of %q", email.String(), invitation.Inviter)
+	h.addUser(email)
+	h.database.DelPendingRequest(userID)
+	if err := h.database.DelApprovalDecisions(userID); err != nil {
+		h.logger.Printf("Database error trying to forget the decisions about %v, %v", email.String(), err)
+	}
+	if err := h.makeAndSendNewCookie(w, r, userID); err != nil {
+		return 500, err
+	}
+	return h.serveRedirectAfterLogin(w, r)
+}
@@ -0,0 +1,124 @@
+package authbyemail
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestServeHTTPInvite(t *testing.T) {
+	h := NewTestHandler()
+
+	test := func(t *testing.T, desiredStatus int, token string) *http.Response {
+		w := httptest.NewRecorder()
+		statusCode, _ := h.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/auth/invite?"+url.Values{"token": {token}}.Encode(), nil))
+		if statusCode != 0 || w.Result().StatusCode != desiredStatus {
+			t.Errorf("Status code should be %v but was %v. %#v", desiredStatus, w.Result().StatusCode, w.Result())
+		}
+		return w.Result()
+	}
+
+	// invite invites the given address, and returns the token from the e-mail
+	invite := func(t *testing.T, address string) (*EmailAddr, string) {
+		email, _ := NewEmailAddrFromString(address)
+		h.mailer.(*MockMailer).mail = ""
+		if err := h.Invite(email, "admin@example.com", "Welcome!", 0); err != nil || h.mailer.(*MockMailer).mail != "invite" {
+			t.Fatalf("No invitation sent, %v", err)
+		}
+		return email, h.mailer.(*MockMailer).code
+	}
+
+	t.Run("Correct request (first click)", func(t *testing.T) {
+		email, token := invite(t, "guest@example.com")
+		userID := CRYPTO.UserIDfromEmail(email)
+		if h.database.IsKnownUser(userID) {
+			t.Error("User added before accepting the invitation")
+		}
+		if decisions := h.database.GetApprovalDecisions(userID); len(decisions) != 1 || decisions[0].Admin != "admin@example.com" || !decisions[0].Approved {
+			t.Errorf("Invitation not recorded as approval, got %#v", decisions)
+		}
+
+		rsp := test(t, 303, token)
+		if cookie := GetResponseCookie(rsp); cookie == nil {
+			t.Error("No cookie after accepting the invitation")
+		} else if ct := h.database.GetCookieToken(cookie.Value); ct == nil || !ct.IsValidated || ct.UserID != userID {
+			t.Error("Not logged in after accepting the invitation")
+		}
+		if !h.database.IsKnownUser(userID) || h.database.GetUserEmail(userID) == nil {
+			t.Error("User not added after accepting the invitation")
+		}
+
+		// Afterwards, the link only leads to the site
+		if rsp := test(t, 303, token); GetResponseCookie(rsp) != nil {
+			t.Error("Invitation logged in a second time")
+		}
+
+		// A user who is deleted can not come back with the same link
+		h.database.DelUser(userID)
+		test(t, 403, token)
+		if h.database.IsKnownUser(userID) {
+			t.Error("Deleted user added again by an invitation they used before")
+		}
+	})
+
+	t.Run("Replaced invitation", func(t *testing.T) {
+		email, token := invite(t, "reinvited@example.com")
+		userID := CRYPTO.UserIDfromEmail(email)
+		h.database.AddApprovalDecision(userID, ApprovalDecision{Admin: "admin@example.com", Approved: true, DecidedAt: time.Now().Add(time.Minute)})
+		test(t, 403, token)
+		if h.database.IsKnownUser(userID) {
+			t.Error("User added by an invitation that was replaced")
+		}
+	})
+
+	t.Run("Withdrawn invitation", func(t *testing.T) {
+		email, token := invite(t, "uninvited@example.com")
+		userID := CRYPTO.UserIDfromEmail(email)
+		h.database.AddApprovalDecision(userID, ApprovalDecision{Admin: "other@example.com", Approved: false, DecidedAt: time.Now().Add(time.Minute)})
+		test(t, 403, token)
+		if h.database.IsKnownUser(userID) {
+			t.Error("User added by a withdrawn invitation")
+		}
+	})
+
+	t.Run("Malformed request (expired invitation)", func(t *testing.T) {
+		test(t, 403, invitation{Email: "late@example.com", IssuedAt: time.Now().Add(-time.Hour), ValidUntil: time.Now().Add(-time.Minute)}.serialize())
+	})
+
+	t.Run("Malformed request (not an invitation)", func(t *testing.T) {
+		test(t, 403, CRYPTO.encrypt(`{"email": "forged@example.com"}`))
+		test(t, 403, "problem")
+	})
+
+	t.Run("Malformed request (no token)", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/auth/invite", nil))
+		if w.Result().StatusCode != 400 {
+			t.Errorf("Status code should be 400 but was %v", w.Result().StatusCode)
+		}
+	})
+
+	t.Run("Invitation of a user who must be approved by several admins", func(t *testing.T) {
+		email, token := invite(t, "quorum@example.org")
+		h.config.ParseDirective("adminroute", []string{"example.org", "approvals", "2", "alice@example.org", "bob@example.org"})
+		defer func() { h.config.AdminRoutes = nil }()
+
+		// Neither can they be invited, nor can they accept an earlier invitation
+		if err := h.Invite(email, "admin@example.com", "", 0); err == nil {
+			t.Error("Invitation sent to a user who must be approved by several admins")
+		}
+		test(t, 403, token)
+		if h.database.IsKnownUser(CRYPTO.UserIDfromEmail(email)) {
+			t.Error("User added by one inviter, while several admins must approve them")
+		}
+	})
+
+	t.Run("Invitation valid for too long", func(t *testing.T) {
+		email, _ := NewEmailAddrFromString("forever@example.com")
+		if err := h.Invite(email, "", "", 365*24*time.Hour); err == nil {
+			t.Error("Invitation valid for a year was sent")
+		}
+	})
+}
@@ -21,17 +21,59 @@ func (h AuthByEmailHandler) serveLogin(w http.ResponseWriter, r *http.Request) (
 		return h.serveBadRequest(w)
 	}
 
+	// Bots that cannot answer the challenge do not get to use up the rate limits below
+	if h.config.Challenge != nil {
+		if err := h.config.Challenge.Verify(r); err != nil {
+			h.logger.Printf("Login challenge failed for %v, %v", email.String(), err)
+			return h.serveStaticPage(w, r, 403, TplChallengeFailed)
+		}
+	}
+
+	// Blocked addresses get no e-mail at all, and do not use up the rate limits below
+	if h.config.IsBlocked(email) {
+		h.logger.Printf("Refusing to send a login link to blocked address %v", email.String())
+		return h.serveStaticPage(w, r, 403, TplBlocked)
+	}
+
 	userID := CRYPTO.UserIDfromEmail(email)
 
-	// If the user is new but from a whitelisted domain, they should be added before being sent a link
-	if h.config.IsDomainWhitelisted(email.Domain) && !h.database.IsKnownUser(userID) {
+	// Limit how often anyone can make us send e-mail, first per client, then per address.
+	// Known and unknown addresses are limited alike, so that the limits do not tell them apart.
+	if allowed, retryAfter := h.takeRateLimit("ip/"+CRYPTO.computeHmac([]byte(clientAddress(r))), h.config.LoginRateLimitIP); !allowed {
+		h.logger.Printf("Too many login attempts from %v", clientAddress(r))
+		return h.serveRateLimited(w, TplTooManyRequests, retryAfter)
+	}
+	cooldown := RateLimit{Count: 1, Period: h.config.ResendCooldown}
+	if cooldown.Period == 0 {
+		cooldown.Count = 0
+	}
+	if allowed, retryAfter := h.takeRateLimit("cooldown/"+string(userID), cooldown); !allowed {
+		return h.serveRateLimited(w, TplAlreadySent, retryAfter)
+	}
+	if allowed, retryAfter := h.takeRateLimit("email/"+string(userID), h.config.LoginRateLimitEmail); !allowed {
+		// No e-mail is sent, so the address is not in its cooldown either
+		h.giveRateLimit("cooldown/"+string(userID), cooldown)
+		h.logger.Printf("Too many login attempts for %v", email.String())
+		return h.serveRateLimited(w, TplAlreadySent, retryAfter)
+	}
+
+	// If the user is new but from a whitelisted domain, they should be added before being sent a link.
+	// Users whose access ended are not new, and must ask the admins for a renewal like others.
+	if h.config.IsWhitelisted(email) && !h.database.IsKnownUser(userID) && h.database.GetUserExpiry(userID).IsZero() {
 		// If the user is not known, but should be automatically approved, we add them to the database
 		// and then send the e-mail.
-		h.database.AddUser(userID)
+		h.addUser(email)
 	}
 
 	// Send the appropriate email
 	if h.database.IsKnownUser(userID) {
+		// Users added before e-mail addresses were stored get theirs stored now
+		if h.database.GetUserEmail(userID) == nil {
+			if err := h.database.SetUserEmail(email); err != nil {
+				h.logger.Printf("Database error trying to store the e-mail address of an existing user, %v\n", err)
+			}
+		}
+
 		// If the user is known, we support a kiosk login by giving this browser an invalid
 		// cookie that can later be validated.
 		cookie, err := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: false, BrowserContext: GetBrowserContext(r)})
@@ -46,7 +88,15 @@ func (h AuthByEmailHandler) serveLogin(w http.ResponseWriter, r *http.Request) (
 			return 500, err
 		}
 
-		err = h.mailer.SendLoginLink(email, token)
+		// The one-time code lets the user log in this browser by typing it over from
+		// the e-mail, which is easier than clicking the link on another device.
+		code, err := h.database.NewLoginCode(cookie, time.Hour)
+		if err != nil {
+			h.logger.Printf("Database error trying to make a login code for an existing user, %v\n", err)
+			return 500, err
+		}
+
+		err = h.mailer.SendLoginLink(email, token, code)
 		if err != nil {
 			h.logger.Printf("Error mailing user %v a login link, %v", email.String(), err)
 			return 500, err
@@ -56,6 +106,7 @@ func (h AuthByEmailHandler) serveLogin(w http.ResponseWriter, r *http.Request) (
 		http.SetCookie(w, &http.Cookie{
 			Name:     "authByEmailToken",
 			Path:     "/",
+			Domain:   h.config.CookieDomain,
 			Value:    cookie,
 			MaxAge:   int(h.config.CookieValidity.Seconds()), // seconds
 			Secure:   r.URL.Scheme == "https",
@@ -64,9 +115,7 @@ func (h AuthByEmailHandler) serveLogin(w http.ResponseWriter, r *http.Request) (
 	} else {
 		// For unknown users, make an admin request. Given the timescale, setting an unvalidated
 		// cookie is not necessary (kiosk login is not supported).
-		err := h.mailer.SendAdminLoginRequest(email)
-		if err != nil {
-			h.logger.Printf("Error mailing user %v's admin an approval link, %v", email.String(), err)
+		if err := h.requestApproval(email); err != nil {
 			return 500, err
 		}
 
@@ -75,6 +124,7 @@ func (h AuthByEmailHandler) serveLogin(w http.ResponseWriter, r *http.Request) (
 		http.SetCookie(w, &http.Cookie{
 			Name:     "authByEmailToken",
 			Path:     "/",
+			Domain:   h.config.CookieDomain,
 			Value:    newRandom(),
 			MaxAge:   int(h.config.CookieValidity.Seconds()), // seconds
 			Secure:   r.URL.Scheme == "https",
@@ -84,3 +134,39 @@ func (h AuthByEmailHandler) serveLogin(w http.ResponseWriter, r *http.Request) (
 
 	return h.serveRedirect(w, "/auth/wait")
 }
+
+// requestApproval queues a request of the given user for the admins. The request is queued,
+// and the admins are only mailed the first time, so that impatient users do not flood them.
+func (h AuthByEmailHandler) requestApproval(email *EmailAddr) error {
+	first, err := h.database.AddPendingRequest(email)
+	if err != nil {
+		h.logger.Printf("Database error trying to queue a request for user %v, %v", email.String(), err)
+		return err
+	}
+	if !first {
+		return nil
+	}
+
+	// All responsible admins are asked. They can always find the request on their
+	// dashboard, but are not mailed more often than their limit allows
+	admins := h.config.adminsForUser(email)
+	var mailed []*EmailAddr
+	for _, admin := range admins {
+		if allowed, _ := h.takeRateLimit("admin/"+string(CRYPTO.UserIDfromEmail(admin)), h.config.LoginRateLimitAdmin); allowed {
+			mailed = append(mailed, admin)
+		} else {
+			h.logger.Printf("Too many approval requests for %v, not mailing them about %v", admin.String(), email.String())
+		}
+	}
+
+	// Without any admin, the mailer reports the error
+	if len(mailed) > 0 || len(admins) == 0 {
+		if err := h.mailer.SendAdminLoginRequest(email, mailed); err != nil {
+			// Forget the request, so that the next attempt mails the admins again
+			h.database.DelPendingRequest(CRYPTO.UserIDfromEmail(email))
+			h.logger.Printf("Error mailing user %v's admin an approval link, %v", email.String(), err)
+			return err
+		}
+	}
+	return nil
+}
@@ -5,12 +5,14 @@ import (
 	"net/url"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestServeHTTPLogin(t *testing.T) {
 	h := NewTestHandler()
 	h.database.AddUser(CRYPTO.UserIDfromEmail(h.config.MailerFrom))
-	h.config.WhitelistDomains = []string{"example.it"}
+	h.config.WhitelistDomains, _ = NewAddressList([]string{"example.it"})
+	h.config.ResendCooldown = 0 // See TestServeHTTPLoginRateLimits
 
 	t.Run("Correct request (new user)", func(t *testing.T) {
 		req := httptest.NewRequest("POST", "http://example.com/auth/login",
@@ -30,6 +32,24 @@ func TestServeHTTPLogin(t *testing.T) {
 
 	})
 
+	t.Run("Correct request (new user, repeated)", func(t *testing.T) {
+		h.mailer.(*MockMailer).mail = ""
+		req := httptest.NewRequest("POST", "http://example.com/auth/login",
+			strings.NewReader(url.Values{"email": {"test@example.com"}, "submit": {"Get"}}.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		statusCode, _ := h.ServeHTTP(w, req)
+		if statusCode != 0 || w.Result().StatusCode != 303 {
+			t.Errorf("Repeated request of auth/login with new addr should be See Other but was %v. %#v", w.Result().StatusCode, w.Result())
+		}
+		if h.mailer.(*MockMailer).mail != "" {
+			t.Error("Signup mail sent again when trying to log in with the same new address")
+		}
+		if requests := h.database.GetPendingRequests(); len(requests) != 1 || requests[0].Count != 2 {
+			t.Errorf("Repeated request not counted, got %#v", requests)
+		}
+	})
+
 	t.Run("Correct request (new user, whitelisted domain)", func(t *testing.T) {
 		req := httptest.NewRequest("POST", "http://example.com/auth/login",
 			strings.NewReader(url.Values{"email": {"test@example.it"}, "submit": {"Get"}}.Encode()))
@@ -50,6 +70,29 @@ func TestServeHTTPLogin(t *testing.T) {
 		}
 	})
 
+	t.Run("Correct request (whitelisted user whose access ended)", func(t *testing.T) {
+		h.config.Admins = []*EmailAddr{h.config.MailerFrom}
+		defer func() { h.config.Admins = nil }()
+		email, _ := NewEmailAddrFromString("former@example.it")
+		userID := CRYPTO.UserIDfromEmail(email)
+		h.addUser(email)
+		endedAt := time.Unix(time.Now().Add(-time.Hour).Unix(), 0)
+		h.database.SetUserExpiry(userID, endedAt)
+
+		h.mailer.(*MockMailer).mail = ""
+		req := httptest.NewRequest("POST", "http://example.com/auth/login",
+			strings.NewReader(url.Values{"email": {email.String()}}.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Result().StatusCode != 303 || h.mailer.(*MockMailer).mail != "admin" {
+			t.Errorf("Admins not asked to renew a whitelisted user whose access ended, got %v and mail %q", w.Result().StatusCode, h.mailer.(*MockMailer).mail)
+		}
+		if h.database.IsKnownUser(userID) || !h.database.GetUserExpiry(userID).Equal(endedAt) {
+			t.Errorf("Access of a whitelisted user renewed without an admin, expiry now %v", h.database.GetUserExpiry(userID))
+		}
+	})
+
 	t.Run("Correct request (known user)", func(t *testing.T) {
 		req := httptest.NewRequest("POST", "http://example.com/auth/login",
 			strings.NewReader(url.Values{"email": {h.config.MailerFrom.String()}, "submit": {"Get"}}.Encode()))
@@ -62,9 +105,15 @@ func TestServeHTTPLogin(t *testing.T) {
 		if h.mailer.(*MockMailer).mail != "login" {
 			t.Error("No login mail sent when trying to log in with known address")
 		}
+		if len(h.mailer.(*MockMailer).code) != loginCodeDigits {
+			t.Errorf("Login mail contained no proper one-time code, but %q", h.mailer.(*MockMailer).code)
+		}
 		if GetResponseCookie(w.Result()) == nil {
 			t.Error("Request of auth/login with known addr should get a cookie but got nothing")
 		}
+		if email := h.database.GetUserEmail(CRYPTO.UserIDfromEmail(h.config.MailerFrom)); email == nil || email.String() != h.config.MailerFrom.String() {
+			t.Errorf("E-mail address of existing user not stored when logging in, got %v", email)
+		}
 
 	})
 
@@ -99,3 +148,208 @@ func TestServeHTTPLogin(t *testing.T) {
 		}
 	})
 }
+
+func TestServeHTTPLoginRateLimits(t *testing.T) {
+	h := NewTestHandler()
+	admin, _ := NewEmailAddrFromString("admin@example.com")
+	h.config.Admins = []*EmailAddr{admin}
+	h.database.AddUser(CRYPTO.UserIDfromEmail(h.config.MailerFrom))
+
+	login := func(email, remoteAddr string) *httptest.ResponseRecorder {
+		h.mailer.(*MockMailer).mail = ""
+		req := httptest.NewRequest("POST", "http://example.com/auth/login",
+			strings.NewReader(url.Values{"email": {email}, "submit": {"Get"}}.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Cooldown", func(t *testing.T) {
+		if w := login("admin@example.com", "192.0.2.1:1234"); w.Code != 303 || h.mailer.(*MockMailer).mail != "login" {
+			t.Fatalf("First login should send a mail, got %v", w.Code)
+		}
+		w := login("admin@example.com", "192.0.2.2:1234")
+		if w.Code != 429 || h.mailer.(*MockMailer).mail != "" || w.Header().Get("Retry-After") != "60" {
+			t.Errorf("Second login within the cooldown should not send a mail, got %v (Retry-After %v)", w.Code, w.Header().Get("Retry-After"))
+		}
+		if !strings.Contains(w.Body.String(), "already sent") || !strings.Contains(w.Body.String(), "1 minute") {
+			t.Errorf("Expected the already sent page, got %v", w.Body.String())
+		}
+	})
+
+	t.Run("Limit per address", func(t *testing.T) {
+		h.config.ResendCooldown = 0
+		h.config.LoginRateLimitEmail = RateLimit{Count: 2, Period: time.Hour}
+		defer func() { h.config.LoginRateLimitEmail = NewConfig().LoginRateLimitEmail }()
+
+		for i, expected := range []int{303, 303, 429} {
+			if w := login("user@example.com", "192.0.2.3:1234"); w.Code != expected {
+				t.Errorf("Login %v for the same address should give %v, got %v", i+1, expected, w.Code)
+			}
+		}
+	})
+
+	t.Run("Limit per address (no cooldown when refused)", func(t *testing.T) {
+		h.config.LoginRateLimitEmail = RateLimit{Count: 1, Period: time.Hour}
+		defer func() { h.config.LoginRateLimitEmail, h.config.ResendCooldown = NewConfig().LoginRateLimitEmail, 0 }()
+
+		login("cooldown@example.com", "192.0.2.5:1234")
+		h.config.ResendCooldown = time.Hour
+		if w := login("cooldown@example.com", "192.0.2.5:1234"); w.Code != 429 {
+			t.Errorf("Second login for the same address should be refused, got %v", w.Code)
+		}
+
+		// The refused login sent no e-mail, so it did not start a cooldown
+		h.config.LoginRateLimitEmail = RateLimit{}
+		if w := login("cooldown@example.com", "192.0.2.5:1234"); w.Code != 303 {
+			t.Errorf("Login after the limit per address should not be in a cooldown, got %v", w.Code)
+		}
+	})
+
+	t.Run("Limit per client", func(t *testing.T) {
+		h.config.LoginRateLimitIP = RateLimit{Count: 2, Period: time.Hour}
+		defer func() { h.config.LoginRateLimitIP = NewConfig().LoginRateLimitIP }()
+
+		login("a@example.com", "[2001:db8::1]:1234")
+		login("b@example.com", "[2001:db8::2]:1234")
+		w := login("c@example.com", "[2001:db8::3]:1234")
+		if w.Code != 429 || !strings.Contains(w.Body.String(), "Too many") {
+			t.Errorf("Third login from the same network should be refused, got %v", w.Code)
+		}
+		if w := login("c@example.com", "[2001:db8:1::1]:1234"); w.Code != 303 {
+			t.Errorf("Login from another network should be allowed, got %v", w.Code)
+		}
+	})
+
+	t.Run("Limit per admin", func(t *testing.T) {
+		h.config.LoginRateLimitAdmin = RateLimit{Count: 1, Period: time.Hour}
+		defer func() { h.config.LoginRateLimitAdmin = NewConfig().LoginRateLimitAdmin }()
+
+		login("d@example.com", "192.0.2.4:1234")
+		if h.mailer.(*MockMailer).mail != "admin" {
+			t.Error("First approval request should be mailed to the admin")
+		}
+		if w := login("e@example.com", "192.0.2.4:1234"); w.Code != 303 || h.mailer.(*MockMailer).mail != "" {
+			t.Errorf("Second approval request should only be queued, got %v and mail %q", w.Code, h.mailer.(*MockMailer).mail)
+		}
+		if e, _ := NewEmailAddrFromString("e@example.com"); !h.hasPendingRequest(CRYPTO.UserIDfromEmail(e)) {
+			t.Error("Second approval request was not queued")
+		}
+	})
+}
+
+func TestServeHTTPLoginChallenge(t *testing.T) {
+	h := NewTestHandler()
+	h.config.Challenge = NewProofOfWork(8)
+	h.database.AddUser(CRYPTO.UserIDfromEmail(h.config.MailerFrom))
+
+	login := func(form url.Values) *httptest.ResponseRecorder {
+		h.mailer.(*MockMailer).mail = ""
+		req := httptest.NewRequest("POST", "http://example.com/auth/login", strings.NewReader(form.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Correct request", func(t *testing.T) {
+		challenge, nonce := solveProofOfWork(t, h.config.Challenge)
+		w := login(url.Values{"email": {h.config.MailerFrom.String()}, "challenge": {challenge}, "nonce": {nonce}})
+		if w.Code != 303 || h.mailer.(*MockMailer).mail != "login" {
+			t.Errorf("Login with a solved challenge should send a mail, got %v", w.Code)
+		}
+	})
+
+	t.Run("Malformed request (no answer)", func(t *testing.T) {
+		w := login(url.Values{"email": {h.config.MailerFrom.String()}})
+		if w.Code != 403 || h.mailer.(*MockMailer).mail != "" || !strings.Contains(w.Body.String(), "robot") {
+			t.Errorf("Login without solving the challenge should be refused, got %v", w.Code)
+		}
+	})
+}
+
+func TestServeHTTPLoginAddressLists(t *testing.T) {
+	h := NewTestHandler()
+	h.config.ResendCooldown = 0
+	h.config.WhitelistDomains, _ = NewAddressList([]string{"*.example.com", "friend@mailinator.com"})
+	h.config.BlockDomains, _ = NewAddressList([]string{"mailinator.com", "spam.example.com"})
+
+	login := func(email string) *httptest.ResponseRecorder {
+		h.mailer.(*MockMailer).mail = ""
+		req := httptest.NewRequest("POST", "http://example.com/auth/login",
+			strings.NewReader(url.Values{"email": {email}, "submit": {"Get"}}.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Correct request (subdomain whitelisted)", func(t *testing.T) {
+		if w := login("user@sales.example.com"); w.Code != 303 || h.mailer.(*MockMailer).mail != "login" {
+			t.Errorf("Address on a whitelisted subdomain should get a login link, got %v", w.Code)
+		}
+	})
+
+	t.Run("Correct request (address whitelisted on a blocked domain)", func(t *testing.T) {
+		if w := login("friend@mailinator.com"); w.Code != 303 || h.mailer.(*MockMailer).mail != "login" {
+			t.Errorf("Whitelisted address should get a login link, got %v", w.Code)
+		}
+	})
+
+	t.Run("Blocked", func(t *testing.T) {
+		for _, email := range []string{"other@mailinator.com", "user@spam.example.com"} {
+			w := login(email)
+			if w.Code != 403 || h.mailer.(*MockMailer).mail != "" || !strings.Contains(w.Body.String(), "cannot be sent") {
+				t.Errorf("Blocked address %v should not get any mail, got %v", email, w.Code)
+			}
+			addr, _ := NewEmailAddrFromString(email)
+			if h.database.IsKnownUser(CRYPTO.UserIDfromEmail(addr)) {
+				t.Errorf("Blocked address %v was added as a user", email)
+			}
+		}
+		if len(h.database.GetPendingRequests()) != 0 {
+			t.Error("Blocked address was queued for approval")
+		}
+	})
+}
+
+func TestServeHTTPLoginAdminRoutes(t *testing.T) {
+	h := NewTestHandler()
+	h.config.ParseDirective("adminroute", []string{"partner.org", "root@example.com", "liaison@example.com"})
+	h.config.ParseDirective("adminroute", []string{"*", "root@example.com"})
+	h.config.LoginRateLimitAdmin = RateLimit{Count: 1, Period: time.Hour}
+
+	login := func(email string) {
+		h.mailer.(*MockMailer).mail = ""
+		h.mailer.(*MockMailer).admins = nil
+		req := httptest.NewRequest("POST", "http://example.com/auth/login",
+			strings.NewReader(url.Values{"email": {email}, "submit": {"Get"}}.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	mailed := func() string {
+		var admins []string
+		for _, admin := range h.mailer.(*MockMailer).admins {
+			admins = append(admins, admin.String())
+		}
+		return strings.Join(admins, " ")
+	}
+
+	login("user@partner.org")
+	if h.mailer.(*MockMailer).mail != "admin" || mailed() != "root@example.com liaison@example.com" {
+		t.Errorf("Expected both admins of the partner to be mailed, got %q", mailed())
+	}
+
+	// Admins that reached their limit are left out
+	login("other@partner.org")
+	if h.mailer.(*MockMailer).mail != "" {
+		t.Errorf("Expected no admins to be mailed once they reached their limit, got %q", mailed())
+	}
+	h.config.LoginRateLimitAdmin = RateLimit{}
+	login("user@elsewhere.net")
+	if mailed() != "root@example.com" {
+		t.Errorf("Expected the fallback admin to be mailed, got %q", mailed())
+	}
+}
@@ -12,6 +12,9 @@ func (h AuthByEmailHandler) serveLogout(w http.ResponseWriter, r *http.Request)
 		// to begin with
 		h.database.DeleteCookieToken(GetCookie(r))
 	}
+	if h.config.SessionTokens {
+		h.clearSessionToken(w)
+	}
 
 	// Show a login page
 	return h.serveStaticPage(w, r, 200, TplLogin)
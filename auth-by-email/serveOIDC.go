@@ -0,0 +1,292 @@
+package authbyemail
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The cookie in which the authorization request of an OIDC client is kept while the
+// user logs in by e-mail.
+const oidcReturnCookie = "authByEmailOIDC"
+
+// serveOIDC lets other websites use us to log in their users, as an OpenID Connect
+// provider. Only the authorization code flow is supported, with PKCE for clients that
+// have no secret. The issuer is SiteURL/auth/oidc, and it has the endpoints:
+//
+// auth/oidc/.well-known/openid-configuration - describes the provider to clients.
+//
+// auth/oidc/authorize - where clients send their users. If the user is logged in, they
+// are sent back with an authorization code; if not, the login page is shown first.
+//
+// auth/oidc/token - can be POSTed to by the client to exchange a code for tokens.
+//
+// auth/oidc/jwks - the public key with which the ID tokens are signed.
+//
+// auth/oidc/userinfo - tells a client with an access token who the user is.
+func (h AuthByEmailHandler) serveOIDC(w http.ResponseWriter, r *http.Request, path string) (int, error) {
+	if len(h.config.OIDCClients) == 0 {
+		return h.serveNotFound(w)
+	}
+
+	switch path {
+	case ".well-known/openid-configuration":
+		return h.serveOIDCDiscovery(w)
+	case "authorize":
+		return h.serveOIDCAuthorize(w, r)
+	case "token":
+		return h.serveOIDCToken(w, r)
+	case "jwks":
+		return h.serveJSON(w, 200, struct {
+			Keys []jsonWebKey `json:"keys"`
+		}{[]jsonWebKey{CRYPTO.publicJWK()}})
+	case "userinfo":
+		return h.serveOIDCUserinfo(w, r)
+	default:
+		return h.serveNotFound(w)
+	}
+}
+
+// oidcIssuer is the identifier of this website as an OpenID Connect provider.
+func (h AuthByEmailHandler) oidcIssuer() string {
+	return h.config.SiteURL + "/auth/oidc"
+}
+
+func (h AuthByEmailHandler) serveOIDCDiscovery(w http.ResponseWriter) (int, error) {
+	issuer := h.oidcIssuer()
+	return h.serveJSON(w, 200, map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"userinfo_endpoint":                     issuer + "/userinfo",
+		"jwks_uri":                              issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"ES256"},
+		"scopes_supported":                      []string{"openid", "email", "groups"},
+		"claims_supported":                      []string{"sub", "email", "email_verified", "groups"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+// serveOIDCAuthorize checks the request of a client, and sends the user back to it with
+// an authorization code. Users who are not logged in get the login page, and the request
+// is kept in a cookie, so that they return here once they have logged in.
+func (h AuthByEmailHandler) serveOIDCAuthorize(w http.ResponseWriter, r *http.Request) (int, error) {
+	r.ParseForm()
+
+	// Without a known client and redirect URI, we can not tell the client what went wrong
+	client := h.config.oidcClient(r.Form.Get("client_id"))
+	redirectURI := r.Form.Get("redirect_uri")
+	if client == nil || !client.allowsRedirect(redirectURI) {
+		h.logger.Printf("OIDC authorization requested for unknown client or redirect URI %v", redirectURI)
+		return h.serveBadRequest(w)
+	}
+
+	redirect := func(values url.Values) (int, error) {
+		if state := r.Form.Get("state"); state != "" {
+			values.Set("state", state)
+		}
+		location, _ := url.Parse(redirectURI)
+		query := location.Query()
+		for key := range values {
+			query.Set(key, values.Get(key))
+		}
+		location.RawQuery = query.Encode()
+		return h.serveRedirect(w, location.String())
+	}
+
+	scopes := strings.Fields(r.Form.Get("scope"))
+	challenge := r.Form.Get("code_challenge")
+	switch {
+	case r.Form.Get("response_type") != "code":
+		return redirect(url.Values{"error": {"unsupported_response_type"}})
+	case !hasScope(scopes, "openid"):
+		return redirect(url.Values{"error": {"invalid_scope"}})
+	case challenge == "" && client.Secret == "":
+		return redirect(url.Values{"error": {"invalid_request"}, "error_description": {"PKCE is required for public clients"}})
+	case challenge != "" && r.Form.Get("code_challenge_method") != "S256":
+		return redirect(url.Values{"error": {"invalid_request"}, "error_description": {"Only the S256 code challenge method is supported"}})
+	}
+
+	token := h.database.GetCookieToken(GetCookie(r))
+	if !h.isCookieValid(r) || token == nil {
+		if r.Form.Get("prompt") == "none" {
+			return redirect(url.Values{"error": {"login_required"}})
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcReturnCookie,
+			Path:     "/auth/",
+			Value:    r.Form.Encode(),
+			MaxAge:   3600, // seconds
+			Secure:   r.URL.Scheme == "https",
+			HttpOnly: true,
+		})
+		return h.serveStaticPage(w, r, 200, TplLogin)
+	}
+
+	code := h.oidcCodes.add(&oidcCode{
+		ClientID:      client.ID,
+		RedirectURI:   redirectURI,
+		UserID:        token.UserID,
+		Scopes:        scopes,
+		Nonce:         r.Form.Get("nonce"),
+		CodeChallenge: challenge,
+		ExpiresAt:     time.Now().Add(oidcCodeValidity),
+	})
+	h.logger.Printf("Issued an OIDC authorization code for client %v", client.ID)
+	return redirect(url.Values{"code": {code}})
+}
+
+// serveOIDCToken exchanges an authorization code for an ID token and an access token.
+// The client authenticates with its secret, as HTTP basic authentication or in the form,
+// or for public clients, with the PKCE code verifier.
+func (h AuthByEmailHandler) serveOIDCToken(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != "POST" {
+		return h.serveAPIError(w, 405, "invalid_request")
+	}
+	r.ParseForm()
+
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		// The ID and secret are form-encoded before they are put in the header
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	client := h.config.oidcClient(clientID)
+	if client == nil || (client.Secret != "" && subtle.ConstantTimeCompare([]byte(client.Secret), []byte(secret)) != 1) {
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+h.oidcIssuer()+`"`)
+		}
+		return h.serveAPIError(w, 401, "invalid_client")
+	}
+
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		return h.serveAPIError(w, 400, "unsupported_grant_type")
+	}
+
+	code := h.oidcCodes.take(r.PostForm.Get("code"))
+	if code == nil || code.ClientID != client.ID || code.RedirectURI != r.PostForm.Get("redirect_uri") {
+		return h.serveAPIError(w, 400, "invalid_grant")
+	}
+	if code.CodeChallenge != "" && subtle.ConstantTimeCompare([]byte(code.CodeChallenge), []byte(pkceChallenge(r.PostForm.Get("code_verifier")))) != 1 {
+		return h.serveAPIError(w, 400, "invalid_grant")
+	}
+	if !h.database.IsKnownUser(code.UserID) {
+		return h.serveAPIError(w, 400, "invalid_grant")
+	}
+
+	now := time.Now()
+	idClaims := h.oidcUserClaims(code.UserID, code.Scopes)
+	idClaims.Audience = client.ID
+	idClaims.IssuedAt = now.Unix()
+	idClaims.ExpiresAt = now.Add(oidcTokenValidity).Unix()
+	idClaims.Nonce = code.Nonce
+	idToken, err := CRYPTO.signJWT(idClaims)
+	if err != nil {
+		h.logger.Printf("Could not sign an ID token, %v", err)
+		return 500, err
+	}
+
+	// The access token only lets the client ask for the same information at the
+	// userinfo endpoint, so it can be checked without looking it up anywhere.
+	accessToken, err := CRYPTO.signJWT(oidcClaims{
+		Issuer:    h.oidcIssuer(),
+		Subject:   code.UserID,
+		Audience:  h.oidcIssuer(),
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(oidcTokenValidity).Unix(),
+		Scope:     strings.Join(code.Scopes, " "),
+	})
+	if err != nil {
+		h.logger.Printf("Could not sign an access token, %v", err)
+		return 500, err
+	}
+
+	h.logger.Printf("Issued OIDC tokens for client %v", client.ID)
+	w.Header().Set("Cache-Control", "no-store")
+	return h.serveJSON(w, 200, struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int    `json:"expires_in"`
+		IDToken     string `json:"id_token"`
+		Scope       string `json:"scope"`
+	}{accessToken, "Bearer", int(oidcTokenValidity.Seconds()), idToken, strings.Join(code.Scopes, " ")})
+}
+
+// serveOIDCUserinfo tells a client with an access token from serveOIDCToken who the user is.
+func (h AuthByEmailHandler) serveOIDCUserinfo(w http.ResponseWriter, r *http.Request) (int, error) {
+	var claims oidcClaims
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") ||
+		CRYPTO.verifyJWT(strings.TrimSpace(header[7:]), &claims) != nil ||
+		claims.Audience != h.oidcIssuer() ||
+		time.Now().Unix() > claims.ExpiresAt ||
+		!h.database.IsKnownUser(claims.Subject) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		return h.serveAPIError(w, 401, "invalid_token")
+	}
+
+	userClaims := h.oidcUserClaims(claims.Subject, strings.Fields(claims.Scope))
+	return h.serveJSON(w, 200, struct {
+		Subject       UserID   `json:"sub"`
+		Email         string   `json:"email,omitempty"`
+		EmailVerified bool     `json:"email_verified,omitempty"`
+		Groups        []string `json:"groups,omitempty"`
+	}{userClaims.Subject, userClaims.Email, userClaims.EmailVerified, userClaims.Groups})
+}
+
+// oidcUserClaims gives the claims about a user that the given scopes ask for.
+func (h AuthByEmailHandler) oidcUserClaims(user UserID, scopes []string) oidcClaims {
+	claims := oidcClaims{Issuer: h.oidcIssuer(), Subject: user}
+	if hasScope(scopes, "email") {
+		// Users who logged in before e-mail addresses were stored have none
+		if email := h.database.GetUserEmail(user); email != nil {
+			claims.Email = email.String()
+			claims.EmailVerified = true
+		}
+	}
+	if hasScope(scopes, "groups") {
+		claims.Groups = h.database.GetUserGroups(user)
+	}
+	return claims
+}
+
+// serveRedirectAfterLogin sends a user who just logged in to the configured redirect
+// location, or back to the authorization request of an OIDC client, if they came from one.
+func (h AuthByEmailHandler) serveRedirectAfterLogin(w http.ResponseWriter, r *http.Request) (int, error) {
+	cookie, err := r.Cookie(oidcReturnCookie)
+	if err != nil || cookie.Value == "" || len(h.config.OIDCClients) == 0 {
+		return h.serveRedirect(w, h.config.Redirect)
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   oidcReturnCookie,
+		Path:   "/auth/",
+		MaxAge: -1,
+	})
+
+	// Only the query is taken from the cookie, so that it can not send users elsewhere
+	query, err := url.ParseQuery(cookie.Value)
+	if err != nil {
+		return h.serveRedirect(w, h.config.Redirect)
+	}
+	return h.serveRedirect(w, "/auth/oidc/authorize?"+query.Encode())
+}
+
+// hasScope checks whether the given scope is among the requested ones.
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
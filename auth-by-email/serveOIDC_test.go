@@ -0,0 +1,238 @@
+package authbyemail
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeHTTPOIDC(t *testing.T) {
+	h := NewTestHandler()
+	h.config.OIDCClients = []OIDCClient{
+		{ID: "wiki", Secret: "wikisecretwikisecretwikisecretwikisecret", RedirectURIs: []string{"https://wiki.example.com/callback"}},
+		{ID: "app", RedirectURIs: []string{"https://app.example.com/callback"}},
+	}
+	email, _ := NewEmailAddrFromString("user@example.com")
+	userID := CRYPTO.UserIDfromEmail(email)
+	h.database.AddUser(userID)
+	h.database.SetUserEmail(email)
+	h.database.SetUserGroups(userID, []string{"finance"})
+	cookie, _ := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: "current browser"})
+
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	authorize := func(cookie string, values url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com/auth/oidc/authorize?"+values.Encode(), nil)
+		if cookie != "" {
+			req.Header.Add("Cookie", "authByEmailToken="+cookie)
+		}
+		return serve(req)
+	}
+
+	exchange := func(values url.Values, basicID, basicSecret string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		req := httptest.NewRequest("POST", "http://example.com/auth/oidc/token", strings.NewReader(values.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		if basicID != "" {
+			req.SetBasicAuth(basicID, basicSecret)
+		}
+		w := serve(req)
+		var response map[string]interface{}
+		json.NewDecoder(w.Result().Body).Decode(&response)
+		return w, response
+	}
+
+	// codeFrom returns the code in the location of a redirect back to the client
+	codeFrom := func(t *testing.T, w *httptest.ResponseRecorder, redirectURI string) string {
+		location, err := url.Parse(w.Header().Get("Location"))
+		if w.Code != 303 || err != nil || !strings.HasPrefix(location.String(), redirectURI+"?") || location.Query().Get("code") == "" {
+			t.Fatalf("Expected a redirect to %v with a code, got %v %v", redirectURI, w.Code, w.Header().Get("Location"))
+		}
+		if location.Query().Get("state") != "xyz" {
+			t.Errorf("State not passed back, got %v", location)
+		}
+		return location.Query().Get("code")
+	}
+
+	wikiRequest := url.Values{
+		"response_type": {"code"},
+		"client_id":     {"wiki"},
+		"redirect_uri":  {"https://wiki.example.com/callback"},
+		"scope":         {"openid email groups"},
+		"state":         {"xyz"},
+		"nonce":         {"abc"},
+	}
+
+	t.Run("Discovery and keys", func(t *testing.T) {
+		w := serve(httptest.NewRequest("GET", "http://example.com/auth/oidc/.well-known/openid-configuration", nil))
+		var discovery map[string]interface{}
+		json.NewDecoder(w.Result().Body).Decode(&discovery)
+		if w.Code != 200 || discovery["issuer"] != "http://example.com/auth/oidc" || discovery["token_endpoint"] != "http://example.com/auth/oidc/token" {
+			t.Errorf("Discovery document is wrong, got %v %#v", w.Code, discovery)
+		}
+
+		w = serve(httptest.NewRequest("GET", "http://example.com/auth/oidc/jwks", nil))
+		var jwks struct{ Keys []jsonWebKey }
+		json.NewDecoder(w.Result().Body).Decode(&jwks)
+		if w.Code != 200 || len(jwks.Keys) != 1 || jwks.Keys[0] != CRYPTO.publicJWK() {
+			t.Errorf("Key set is wrong, got %v %#v", w.Code, jwks)
+		}
+	})
+
+	t.Run("Correct request (confidential client)", func(t *testing.T) {
+		code := codeFrom(t, authorize(cookie, wikiRequest), "https://wiki.example.com/callback")
+
+		w, response := exchange(url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {"https://wiki.example.com/callback"}}, "wiki", "wikisecretwikisecretwikisecretwikisecret")
+		if w.Code != 200 || response["token_type"] != "Bearer" {
+			t.Fatalf("Code not exchanged for tokens, got %v %#v", w.Code, response)
+		}
+
+		var claims oidcClaims
+		if err := CRYPTO.verifyJWT(response["id_token"].(string), &claims); err != nil {
+			t.Fatalf("ID token not signed correctly, %v", err)
+		}
+		if claims.Issuer != "http://example.com/auth/oidc" || claims.Audience != "wiki" || claims.Subject != userID || claims.Nonce != "abc" ||
+			claims.Email != "user@example.com" || !claims.EmailVerified || len(claims.Groups) != 1 || claims.ExpiresAt < time.Now().Unix() {
+			t.Errorf("ID token has the wrong claims, got %#v", claims)
+		}
+
+		req := httptest.NewRequest("GET", "http://example.com/auth/oidc/userinfo", nil)
+		req.Header.Add("Authorization", "Bearer "+response["access_token"].(string))
+		w = serve(req)
+		var userinfo map[string]interface{}
+		json.NewDecoder(w.Result().Body).Decode(&userinfo)
+		if w.Code != 200 || userinfo["sub"] != string(userID) || userinfo["email"] != "user@example.com" {
+			t.Errorf("Userinfo is wrong, got %v %#v", w.Code, userinfo)
+		}
+
+		// A code can only be used once
+		if w, _ := exchange(url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {"https://wiki.example.com/callback"}}, "wiki", "wikisecretwikisecretwikisecretwikisecret"); w.Code != 400 {
+			t.Errorf("Code was exchanged twice, got %v", w.Code)
+		}
+	})
+
+	t.Run("Correct request (public client with PKCE)", func(t *testing.T) {
+		verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+		code := codeFrom(t, authorize(cookie, url.Values{
+			"response_type":         {"code"},
+			"client_id":             {"app"},
+			"redirect_uri":          {"https://app.example.com/callback"},
+			"scope":                 {"openid"},
+			"state":                 {"xyz"},
+			"code_challenge":        {pkceChallenge(verifier)},
+			"code_challenge_method": {"S256"},
+		}), "https://app.example.com/callback")
+
+		values := url.Values{"grant_type": {"authorization_code"}, "client_id": {"app"}, "code": {code}, "redirect_uri": {"https://app.example.com/callback"}, "code_verifier": {verifier}}
+		w, response := exchange(values, "", "")
+		if w.Code != 200 {
+			t.Fatalf("Code not exchanged for tokens, got %v %#v", w.Code, response)
+		}
+		var claims oidcClaims
+		if err := CRYPTO.verifyJWT(response["id_token"].(string), &claims); err != nil || claims.Email != "" || claims.Groups != nil {
+			t.Errorf("ID token has claims that were not asked for, got %#v (%v)", claims, err)
+		}
+	})
+
+	t.Run("Correct request (not logged in)", func(t *testing.T) {
+		w := authorize("", wikiRequest)
+		if w.Code != 200 || !strings.Contains(w.Body.String(), "/auth/login") {
+			t.Fatalf("Login page not shown, got %v", w.Code)
+		}
+		var returnCookie *http.Cookie
+		for _, c := range w.Result().Cookies() {
+			if c.Name == oidcReturnCookie {
+				returnCookie = c
+			}
+		}
+		if returnCookie == nil {
+			t.Fatal("Authorization request not kept in a cookie")
+		}
+
+		// After logging in, the user is sent back to the authorization request
+		req := httptest.NewRequest("GET", "http://example.com/auth/wait", nil)
+		req.Header.Add("Cookie", "authByEmailToken="+cookie)
+		req.AddCookie(returnCookie)
+		w = serve(req)
+		location, _ := url.Parse(w.Header().Get("Location"))
+		if w.Code != 303 || location.Path != "/auth/oidc/authorize" || location.Query().Get("client_id") != "wiki" {
+			t.Errorf("Not sent back to the authorization request, got %v %v", w.Code, location)
+		}
+
+		w = authorize("", url.Values{"response_type": {"code"}, "client_id": {"wiki"}, "redirect_uri": {"https://wiki.example.com/callback"}, "scope": {"openid"}, "prompt": {"none"}})
+		if !strings.Contains(w.Header().Get("Location"), "error=login_required") {
+			t.Errorf("Expected a login_required error, got %v %v", w.Code, w.Header().Get("Location"))
+		}
+	})
+
+	t.Run("Malformed request (authorize)", func(t *testing.T) {
+		for _, values := range []url.Values{
+			{"response_type": {"code"}, "client_id": {"problem"}, "redirect_uri": {"https://wiki.example.com/callback"}, "scope": {"openid"}},
+			{"response_type": {"code"}, "client_id": {"wiki"}, "redirect_uri": {"https://evil.example.com/callback"}, "scope": {"openid"}},
+		} {
+			if w := authorize(cookie, values); w.Code != 400 {
+				t.Errorf("Expected a 400 for %v, got %v", values, w.Code)
+			}
+		}
+
+		for _, values := range []url.Values{
+			{"response_type": {"token"}, "client_id": {"wiki"}, "redirect_uri": {"https://wiki.example.com/callback"}, "scope": {"openid"}},
+			{"response_type": {"code"}, "client_id": {"wiki"}, "redirect_uri": {"https://wiki.example.com/callback"}, "scope": {"email"}},
+			{"response_type": {"code"}, "client_id": {"app"}, "redirect_uri": {"https://app.example.com/callback"}, "scope": {"openid"}},
+			{"response_type": {"code"}, "client_id": {"app"}, "redirect_uri": {"https://app.example.com/callback"}, "scope": {"openid"}, "code_challenge": {"abc"}, "code_challenge_method": {"plain"}},
+		} {
+			if w := authorize(cookie, values); w.Code != 303 || !strings.Contains(w.Header().Get("Location"), "error=") {
+				t.Errorf("Expected an error sent to the client for %v, got %v %v", values, w.Code, w.Header().Get("Location"))
+			}
+		}
+	})
+
+	t.Run("Malformed request (token)", func(t *testing.T) {
+		code := codeFrom(t, authorize(cookie, wikiRequest), "https://wiki.example.com/callback")
+		if w, _ := exchange(url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {"https://wiki.example.com/callback"}}, "wiki", "problem"); w.Code != 401 {
+			t.Errorf("Expected a 401 for a wrong secret, got %v", w.Code)
+		}
+		if w, _ := exchange(url.Values{"grant_type": {"authorization_code"}, "client_id": {"wiki"}, "code": {code}, "redirect_uri": {"https://wiki.example.com/callback"}}, "", ""); w.Code != 401 {
+			t.Errorf("Expected a 401 without a secret, got %v", w.Code)
+		}
+		if w, _ := exchange(url.Values{"grant_type": {"authorization_code"}, "code": {"problem"}, "redirect_uri": {"https://wiki.example.com/callback"}}, "wiki", "wikisecretwikisecretwikisecretwikisecret"); w.Code != 400 {
+			t.Errorf("Expected a 400 for an unknown code, got %v", w.Code)
+		}
+
+		code = codeFrom(t, authorize(cookie, url.Values{
+			"response_type": {"code"}, "client_id": {"app"}, "redirect_uri": {"https://app.example.com/callback"}, "scope": {"openid"}, "state": {"xyz"},
+			"code_challenge": {pkceChallenge("right")}, "code_challenge_method": {"S256"},
+		}), "https://app.example.com/callback")
+		if w, _ := exchange(url.Values{"grant_type": {"authorization_code"}, "client_id": {"app"}, "code": {code}, "redirect_uri": {"https://app.example.com/callback"}, "code_verifier": {"wrong"}}, "", ""); w.Code != 400 {
+			t.Errorf("Expected a 400 for a wrong code verifier, got %v", w.Code)
+		}
+	})
+
+	t.Run("Malformed request (userinfo)", func(t *testing.T) {
+		idToken, _ := CRYPTO.signJWT(oidcClaims{Issuer: h.oidcIssuer(), Subject: userID, Audience: "wiki", ExpiresAt: time.Now().Add(time.Hour).Unix()})
+		expired, _ := CRYPTO.signJWT(oidcClaims{Issuer: h.oidcIssuer(), Subject: userID, Audience: h.oidcIssuer(), ExpiresAt: time.Now().Add(-time.Hour).Unix()})
+		for _, token := range []string{"problem", idToken, expired} {
+			req := httptest.NewRequest("GET", "http://example.com/auth/oidc/userinfo", nil)
+			req.Header.Add("Authorization", "Bearer "+token)
+			if w := serve(req); w.Code != 401 {
+				t.Errorf("Expected a 401 for token %v, got %v", token, w.Code)
+			}
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		h := NewTestHandler()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/auth/oidc/jwks", nil))
+		if w.Code != 404 {
+			t.Errorf("Expected a 404 without OIDC clients, got %v", w.Code)
+		}
+	})
+}
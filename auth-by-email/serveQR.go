@@ -0,0 +1,148 @@
+package authbyemail
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"time"
+
+	"rsc.io/qr"
+)
+
+// qrRequestValidity is how long a QR code shown on a shared screen can be used to log
+// that screen in.
+const qrRequestValidity = 10 * time.Minute
+
+// serveQR shows a QR code on a shared screen (such as a kiosk), which a user can scan
+// with a phone on which they are already logged in. The screen is given an anonymous
+// cookie, and the QR code links to a page that lets the phone claim this cookie. No
+// e-mail is sent at all, but new cookies are limited per client like log-in attempts, so
+// that the page can not be used to fill the database.
+func (h AuthByEmailHandler) serveQR(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !h.config.QRLogin {
+		return h.serveNotFound(w)
+	}
+
+	if h.isCookieValid(r) {
+		return h.serveRedirectAfterLogin(w, r)
+	}
+
+	// Reuse this screen's anonymous cookie if it has one, so reloading the page does not
+	// fill the database with cookies
+	cookie := GetCookie(r)
+	if token := h.database.GetCookieToken(cookie); token == nil || token.UserID != "" || token.IsValidated {
+		if allowed, retryAfter := h.takeRateLimit("qr/"+CRYPTO.computeHmac([]byte(clientAddress(r))), h.config.LoginRateLimitIP); !allowed {
+			h.logger.Printf("Too many QR codes asked for from %v", clientAddress(r))
+			return h.serveRateLimited(w, TplTooManyRequests, retryAfter)
+		}
+
+		var err error
+		cookie, err = h.database.NewCookieToken(CookieToken{UserID: "", IsValidated: false, BrowserContext: GetBrowserContext(r)})
+		if err != nil {
+			h.logger.Printf("Database error trying to make an anonymous cookie, %v\n", err)
+			return 500, err
+		}
+
+		// The cookie is only of use while the QR code is; once the phone confirmed the
+		// login, the wait page gives it the full validity
+		h.setCookie(w, r, cookie, qrRequestValidity)
+	}
+
+	// The request token is encrypted, so whoever sees the QR code can not learn the cookie
+	request := CRYPTO.serialize(linkTokenInternal{
+		LinkToken:  LinkToken{UserID: "", CorrespondingCookie: cookie},
+		ValidUntil: time.Now().Add(qrRequestValidity),
+	})
+	link := h.config.SiteURL + "/auth/qr/confirm?request=" + request
+
+	code, err := qr.Encode(link, qr.M)
+	if err != nil {
+		h.logger.Printf("Could not encode a QR code, %v\n", err)
+		return 500, err
+	}
+
+	data := struct {
+		Image, Link template.URL
+	}{
+		Image: template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(code.PNG())),
+		Link:  template.URL(link),
+	}
+
+	return h.serveTemplate(w, TplQR, &data)
+}
+
+// serveQRConfirm is called when a logged-in user scans the QR code on a shared screen.
+// Much like the kiosk page, it asks whether they would like to log in that screen, and
+// a POST request to the same endpoint executes their decision. It must carry a token bound
+// to the user's cookie, so that other websites can not make their browser log in a screen.
+func (h AuthByEmailHandler) serveQRConfirm(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !h.config.QRLogin {
+		return h.serveNotFound(w)
+	}
+
+	// Only logged-in users can log in a shared screen
+	if !h.isCookieValid(r) {
+		return h.serveStaticPage(w, r, 403, TplLogin)
+	}
+
+	// Check if the request was filled correctly, and refers to a screen that is still waiting
+	r.ParseForm()
+	if len(r.Form["request"]) == 0 {
+		return h.serveBadRequest(w)
+	}
+
+	var request linkTokenInternal
+	if err := CRYPTO.deserialize(r.Form["request"][0], &request); err != nil {
+		h.logger.Printf("Could not decrypt QR login request %v. Error %v", r.Form["request"][0], err)
+		return h.serveBadRequest(w)
+	}
+	if request.UserID != "" || !request.ValidUntil.After(time.Now()) {
+		return h.serveNotAuthenticated(w)
+	}
+
+	screenCookieToken := h.database.GetCookieToken(request.CorrespondingCookie)
+	if screenCookieToken == nil || screenCookieToken.UserID != "" || screenCookieToken.IsValidated {
+		return h.serveBadRequest(w)
+	}
+
+	csrf := csrfToken(GetCookie(r))
+	if r.Method != "POST" {
+		data := struct{ Browser, Request, CSRFToken string }{
+			Browser:   screenCookieToken.BrowserContext,
+			Request:   r.Form["request"][0],
+			CSRFToken: csrf,
+		}
+
+		return h.serveTemplate(w, TplQRConfirm, &data)
+	}
+
+	if len(r.PostForm["csrf"]) == 0 || subtle.ConstantTimeCompare([]byte(r.PostForm["csrf"][0]), []byte(csrf)) != 1 {
+		h.logger.Printf("QR login attempted without a proper CSRF token")
+		return h.serveBadRequest(w)
+	}
+	if len(r.PostForm["action"]) == 0 {
+		return h.serveBadRequest(w)
+	}
+
+	if r.PostForm["action"][0] == "approve" {
+		token := h.database.GetCookieToken(GetCookie(r))
+		if token == nil {
+			// This can not occur given the implementation of isCookieValid
+			return h.serveBadRequest(w)
+		}
+
+		if err := h.database.ClaimCookieToken(request.CorrespondingCookie, token.UserID); err != nil {
+			h.logger.Printf("Database error trying to claim a cookie, %v\n", err)
+			return 500, err
+		}
+	} else {
+		// Delete the screen's cookie from the database, making it useless
+		if err := h.database.DeleteCookieToken(request.CorrespondingCookie); err != nil {
+			h.logger.Printf("Database error trying to delete a cookie, %v\n", err)
+			return 500, err
+		}
+	}
+
+	return h.serveRedirect(w, h.config.Redirect)
+}
@@ -0,0 +1,187 @@
+package authbyemail
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeHTTPQR(t *testing.T) {
+	h := NewTestHandler()
+	userID := CRYPTO.UserIDfromEmail(h.config.MailerFrom)
+	h.database.AddUser(userID)
+	cookieLoggedIn, _ := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: "abc"})
+
+	test := func(t *testing.T, desiredStatus int, req *http.Request) *http.Response {
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		statusCode, _ := h.ServeHTTP(w, req)
+		if statusCode != 0 || w.Result().StatusCode != desiredStatus {
+			t.Errorf("Status code should be %v but was %v. %#v", desiredStatus, w.Result().StatusCode, w.Result())
+		}
+		return w.Result()
+	}
+
+	// newRequest makes an anonymous screen cookie and a QR request token for it
+	newRequest := func(validity time.Duration) (string, string) {
+		screen, _ := h.database.NewCookieToken(CookieToken{UserID: "", IsValidated: false, BrowserContext: "screen"})
+		return screen, CRYPTO.serialize(linkTokenInternal{
+			LinkToken:  LinkToken{UserID: "", CorrespondingCookie: screen},
+			ValidUntil: time.Now().Add(validity),
+		})
+	}
+
+	t.Run("Malformed request (disabled)", func(t *testing.T) {
+		test(t, 404, httptest.NewRequest("GET", "http://example.com/auth/qr", nil))
+		_, request := newRequest(time.Minute)
+		req := httptest.NewRequest("GET", "http://example.com/auth/qr/confirm?"+url.Values{"request": {request}}.Encode(), nil)
+		req.Header.Add("Cookie", "authByEmailToken="+cookieLoggedIn)
+		test(t, 404, req)
+	})
+
+	h.config.QRLogin = true
+
+	t.Run("Correct request (show code)", func(t *testing.T) {
+		rsp := test(t, 200, httptest.NewRequest("GET", "http://example.com/auth/qr", nil))
+		cookie := GetResponseCookie(rsp)
+		if cookie == nil {
+			t.Fatal("No cookie in response")
+		}
+		if ct := h.database.GetCookieToken(cookie.Value); ct == nil || ct.UserID != "" || ct.IsValidated {
+			t.Errorf("Response cookie should be anonymous and unvalidated, but is %+v", ct)
+		}
+		if cookie.MaxAge != int(qrRequestValidity.Seconds()) {
+			t.Errorf("Response cookie should be kept as long as the code is valid, but has MaxAge %v", cookie.MaxAge)
+		}
+
+		// Reloading the page keeps the same cookie
+		req := httptest.NewRequest("GET", "http://example.com/auth/qr", nil)
+		req.Header.Add("Cookie", "authByEmailToken="+cookie.Value)
+		if rsp = test(t, 200, req); GetResponseCookie(rsp) != nil {
+			t.Error("Reloading the QR page gave a new cookie")
+		}
+	})
+
+	t.Run("Malformed request (too many codes)", func(t *testing.T) {
+		limit := h.config.LoginRateLimitIP
+		h.config.LoginRateLimitIP = RateLimit{Count: 1, Period: time.Hour}
+		h.rateLimits = newMemoryRateLimits()
+		defer func() { h.config.LoginRateLimitIP = limit }()
+
+		test(t, 200, httptest.NewRequest("GET", "http://example.com/auth/qr", nil))
+		if rsp := test(t, 429, httptest.NewRequest("GET", "http://example.com/auth/qr", nil)); GetResponseCookie(rsp) != nil {
+			t.Error("Cookie given beyond the limit")
+		}
+	})
+
+	t.Run("Correct request (show code when logged in)", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://example.com/auth/qr", nil)
+		req.Header.Add("Cookie", "authByEmailToken="+cookieLoggedIn)
+		test(t, 303, req)
+	})
+
+	t.Run("Correct request (confirmation page)", func(t *testing.T) {
+		_, request := newRequest(time.Minute)
+		req := httptest.NewRequest("GET", "http://example.com/auth/qr/confirm?"+url.Values{"request": {request}}.Encode(), nil)
+		req.Header.Add("Cookie", "authByEmailToken="+cookieLoggedIn)
+		test(t, 200, req)
+	})
+
+	t.Run("Correct request (approval)", func(t *testing.T) {
+		screen, request := newRequest(time.Minute)
+		req := httptest.NewRequest("POST", "http://example.com/auth/qr/confirm",
+			strings.NewReader(url.Values{"request": {request}, "action": {"approve"}, "csrf": {csrfToken(cookieLoggedIn)}}.Encode()))
+		req.Header.Add("Cookie", "authByEmailToken="+cookieLoggedIn)
+		test(t, 303, req)
+		if ct := h.database.GetCookieToken(screen); ct == nil || ct.UserID != userID || !ct.IsValidated {
+			t.Errorf("Screen cookie should be validated for the user, but is %+v", ct)
+		}
+
+		// Once logged in, the screen keeps its cookie for the full validity
+		req = httptest.NewRequest("GET", "http://example.com/auth/wait", nil)
+		req.Header.Add("Cookie", "authByEmailToken="+screen)
+		rsp := test(t, 303, req)
+		if cookie := GetResponseCookie(rsp); cookie == nil || cookie.Value != screen || cookie.MaxAge != int(h.config.CookieValidity.Seconds()) {
+			t.Errorf("Screen cookie should be kept for the full validity, but is %+v", cookie)
+		}
+
+		// The same code can not be used twice
+		req = httptest.NewRequest("POST", "http://example.com/auth/qr/confirm",
+			strings.NewReader(url.Values{"request": {request}, "action": {"approve"}, "csrf": {csrfToken(cookieLoggedIn)}}.Encode()))
+		req.Header.Add("Cookie", "authByEmailToken="+cookieLoggedIn)
+		test(t, 400, req)
+	})
+
+	t.Run("Correct request (revocation)", func(t *testing.T) {
+		screen, request := newRequest(time.Minute)
+		req := httptest.NewRequest("POST", "http://example.com/auth/qr/confirm",
+			strings.NewReader(url.Values{"request": {request}, "action": {"revoke"}, "csrf": {csrfToken(cookieLoggedIn)}}.Encode()))
+		req.Header.Add("Cookie", "authByEmailToken="+cookieLoggedIn)
+		test(t, 303, req)
+		if ct := h.database.GetCookieToken(screen); ct != nil {
+			t.Errorf("Screen cookie is not deleted, but is %+v", ct)
+		}
+	})
+
+	t.Run("Malformed request (bad CSRF token)", func(t *testing.T) {
+		screen, request := newRequest(time.Minute)
+		for _, values := range []url.Values{
+			{"request": {request}, "action": {"approve"}},
+			{"request": {request}, "action": {"approve"}, "csrf": {csrfToken(screen)}},
+		} {
+			req := httptest.NewRequest("POST", "http://example.com/auth/qr/confirm", strings.NewReader(values.Encode()))
+			req.Header.Add("Cookie", "authByEmailToken="+cookieLoggedIn)
+			test(t, 400, req)
+		}
+		if ct := h.database.GetCookieToken(screen); ct == nil || ct.IsValidated {
+			t.Errorf("Screen cookie was validated without a proper CSRF token, and is %+v", ct)
+		}
+	})
+
+	t.Run("Malformed request (not logged in)", func(t *testing.T) {
+		screen, request := newRequest(time.Minute)
+		req := httptest.NewRequest("POST", "http://example.com/auth/qr/confirm",
+			strings.NewReader(url.Values{"request": {request}, "action": {"approve"}, "csrf": {csrfToken(cookieLoggedIn)}}.Encode()))
+		req.Header.Add("Cookie", "authByEmailToken="+screen)
+		test(t, 403, req)
+		if ct := h.database.GetCookieToken(screen); ct == nil || ct.IsValidated {
+			t.Errorf("Screen cookie was affected by a user that is not logged in, and is %+v", ct)
+		}
+	})
+
+	t.Run("Malformed request (expired code)", func(t *testing.T) {
+		screen, request := newRequest(-time.Minute)
+		req := httptest.NewRequest("POST", "http://example.com/auth/qr/confirm",
+			strings.NewReader(url.Values{"request": {request}, "action": {"approve"}, "csrf": {csrfToken(cookieLoggedIn)}}.Encode()))
+		req.Header.Add("Cookie", "authByEmailToken="+cookieLoggedIn)
+		test(t, 403, req)
+		if ct := h.database.GetCookieToken(screen); ct == nil || ct.IsValidated {
+			t.Errorf("Screen cookie was validated by an expired code, and is %+v", ct)
+		}
+	})
+
+	t.Run("Malformed request (bad encryption)", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "http://example.com/auth/qr/confirm",
+			strings.NewReader(url.Values{"request": {"problem"}, "action": {"approve"}}.Encode()))
+		req.Header.Add("Cookie", "authByEmailToken="+cookieLoggedIn)
+		test(t, 400, req)
+	})
+
+	t.Run("Malformed request (code for a user's cookie)", func(t *testing.T) {
+		other, _ := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: false, BrowserContext: "def"})
+		request := CRYPTO.serialize(linkTokenInternal{
+			LinkToken:  LinkToken{UserID: "", CorrespondingCookie: other},
+			ValidUntil: time.Now().Add(time.Minute),
+		})
+		req := httptest.NewRequest("POST", "http://example.com/auth/qr/confirm",
+			strings.NewReader(url.Values{"request": {request}, "action": {"approve"}, "csrf": {csrfToken(cookieLoggedIn)}}.Encode()))
+		req.Header.Add("Cookie", "authByEmailToken="+cookieLoggedIn)
+		test(t, 400, req)
+		if ct := h.database.GetCookieToken(other); ct == nil || ct.IsValidated {
+			t.Errorf("Non-anonymous cookie was validated through a QR code, and is %+v", ct)
+		}
+	})
+}
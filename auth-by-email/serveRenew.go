@@ -0,0 +1,37 @@
+package authbyemail
+
+import (
+	"net/http"
+)
+
+// serveRenew is called when a user follows the link in the reminder that their access
+// ends. Their renewal is requested from the admins like a new user's access, who can set
+// a new end on the approval page. If an admin has already changed when their access ends,
+// the link only leads to the site.
+func (h AuthByEmailHandler) serveRenew(w http.ResponseWriter, r *http.Request) (int, error) {
+	r.ParseForm()
+	if len(r.Form["token"]) == 0 {
+		return h.serveBadRequest(w)
+	}
+
+	renewal, err := parseRenewal(r.Form["token"][0])
+	if err != nil {
+		h.logger.Printf("Renewal not requested, %v", err)
+		return h.serveNotAuthenticated(w)
+	}
+	email, err := NewEmailAddrFromString(renewal.Email)
+	if err != nil {
+		return h.serveBadRequest(w)
+	}
+	userID := CRYPTO.UserIDfromEmail(email)
+
+	if !h.database.GetUserExpiry(userID).Equal(renewal.ExpiresAt) {
+		return h.serveRedirect(w, h.config.Redirect)
+	}
+
+	h.logger.Printf("%v asked for their access to be renewed", email.String())
+	if err := h.requestApproval(email); err != nil {
+		return 500, err
+	}
+	return h.serveStaticPage(w, r, 200, TplAckRenew)
+}
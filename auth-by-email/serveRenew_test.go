@@ -0,0 +1,116 @@
+package authbyemail
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeHTTPRenew(t *testing.T) {
+	h := NewTestHandler()
+	h.config.Admins = []*EmailAddr{h.config.MailerFrom}
+
+	email, _ := NewEmailAddrFromString("contractor@example.com")
+	userID := CRYPTO.UserIDfromEmail(email)
+	h.addUser(email)
+	h.database.SetUserExpiry(userID, time.Now().Add(3*24*time.Hour))
+
+	test := func(t *testing.T, desiredStatus int, token string) *http.Response {
+		w := httptest.NewRecorder()
+		statusCode, _ := h.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/auth/renew?"+url.Values{"token": {token}}.Encode(), nil))
+		if statusCode != 0 || w.Result().StatusCode != desiredStatus {
+			t.Errorf("Status code should be %v but was %v. %#v", desiredStatus, w.Result().StatusCode, w.Result())
+		}
+		return w.Result()
+	}
+
+	h.sendExpiryReminders()
+	token := h.mailer.(*MockMailer).code
+
+	t.Run("Correct request", func(t *testing.T) {
+		h.mailer.(*MockMailer).mail = ""
+		test(t, 200, token)
+		if h.mailer.(*MockMailer).mail != "admin" {
+			t.Error("Admins not asked for the renewal")
+		}
+		if !h.hasPendingRequest(userID) {
+			t.Error("Renewal not queued for the admins")
+		}
+
+		// Asking again does not mail the admins again
+		h.mailer.(*MockMailer).mail = ""
+		test(t, 200, token)
+		if h.mailer.(*MockMailer).mail != "" {
+			t.Error("Admins asked twice for the same renewal")
+		}
+	})
+
+	t.Run("Correct request (renewed by an admin)", func(t *testing.T) {
+		date := time.Now().AddDate(1, 0, 0).Format("2006-01-02")
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "http://example.com/auth/approve",
+			strings.NewReader(url.Values{"email": {CRYPTO.encrypt(email.String())}, "admin": {approvalVote{User: email.String(), Admin: h.config.MailerFrom.String()}.serialize()}, "action": {"approve"}, "expires": {date}}.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		h.ServeHTTP(w, req)
+		if expiresAt, _ := ParseExpiry(date); w.Result().StatusCode != 200 || !h.database.GetUserExpiry(userID).Equal(expiresAt) {
+			t.Errorf("Access not renewed by the admin, got %v", h.database.GetUserExpiry(userID))
+		}
+		if h.hasPendingRequest(userID) {
+			t.Error("Renewal still pending after the admin approved it")
+		}
+
+		// Afterwards, the link only leads to the site
+		h.mailer.(*MockMailer).mail = ""
+		test(t, 303, token)
+		if h.mailer.(*MockMailer).mail != "" || h.hasPendingRequest(userID) {
+			t.Error("Renewal asked for again after it was granted")
+		}
+	})
+
+	t.Run("Correct request (renewed by an admin after the access ended)", func(t *testing.T) {
+		endedAt := time.Unix(time.Now().Add(-24*time.Hour).Unix(), 0)
+		h.database.SetUserExpiry(userID, endedAt)
+		approve := func(t *testing.T, desiredStatus int, expires string) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("POST", "http://example.com/auth/approve",
+				strings.NewReader(url.Values{"email": {CRYPTO.encrypt(email.String())}, "admin": {approvalVote{User: email.String(), Admin: h.config.MailerFrom.String()}.serialize()}, "action": {"approve"}, "expires": {expires}}.Encode()))
+			req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+			h.ServeHTTP(w, req)
+			if w.Result().StatusCode != desiredStatus {
+				t.Errorf("Status code should be %v but was %v", desiredStatus, w.Result().StatusCode)
+			}
+		}
+
+		// Leaving the end empty would let their access go on for ever
+		approve(t, 400, "")
+		if h.database.IsKnownUser(userID) || !h.database.GetUserExpiry(userID).Equal(endedAt) {
+			t.Errorf("Access renewed without a new end, expiry now %v", h.database.GetUserExpiry(userID))
+		}
+
+		date := time.Now().AddDate(0, 6, 0).Format("2006-01-02")
+		approve(t, 200, date)
+		if expiresAt, _ := ParseExpiry(date); !h.database.IsKnownUser(userID) || !h.database.GetUserExpiry(userID).Equal(expiresAt) {
+			t.Errorf("Access not renewed with the new end, got %v", h.database.GetUserExpiry(userID))
+		}
+	})
+
+	t.Run("Malformed request (expired link)", func(t *testing.T) {
+		test(t, 403, renewal{Email: email.String(), ExpiresAt: time.Now().Add(-31 * 24 * time.Hour), ValidUntil: time.Now().Add(-time.Hour)}.serialize())
+	})
+
+	t.Run("Malformed request (not a renewal)", func(t *testing.T) {
+		test(t, 403, invitation{Email: email.String(), ValidUntil: time.Now().Add(time.Hour)}.serialize())
+		test(t, 403, "problem")
+	})
+
+	t.Run("Malformed request (no token)", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/auth/renew", nil))
+		if w.Result().StatusCode != 400 {
+			t.Errorf("Status code should be 400 but was %v", w.Result().StatusCode)
+		}
+	})
+}
@@ -0,0 +1,104 @@
+package authbyemail
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+)
+
+// serveSessions lists the sessions (cookies) of the logged-in user, so that they can
+// recognise and revoke them. A POST request with action=revoke and a session= field
+// revokes that session; action=revokeothers logs out everywhere else. These forms carry
+// a token bound to the user's cookie, so that other websites can not submit them.
+func (h AuthByEmailHandler) serveSessions(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !h.isCookieValid(r) {
+		return h.serveNotAuthenticated(w)
+	}
+
+	cookie := GetCookie(r)
+	token := h.database.GetCookieToken(cookie)
+	if token == nil {
+		// This can not occur given the implementation of isCookieValid
+		return h.serveBadRequest(w)
+	}
+
+	if r.Method == "POST" {
+		return h.serveSessionsByRevoking(w, r, cookie, token.UserID)
+	}
+
+	type sessionData struct {
+		ID, Browser                     string
+		CreatedAt, LastUsed, ValidUntil time.Time
+		IsValidated, IsCurrent          bool
+	}
+	data := struct {
+		CSRFToken string
+		Sessions  []sessionData
+	}{
+		CSRFToken: csrfToken(cookie),
+	}
+	for _, session := range h.database.GetSessions(token.UserID) {
+		data.Sessions = append(data.Sessions, sessionData{
+			ID:          sessionID(session.Cookie),
+			Browser:     session.BrowserContext,
+			CreatedAt:   session.CreatedAt,
+			LastUsed:    session.LastUsed,
+			ValidUntil:  session.ValidUntil,
+			IsValidated: session.IsValidated,
+			IsCurrent:   session.Cookie == cookie,
+		})
+	}
+
+	return h.serveTemplate(w, TplSessions, &data)
+}
+
+// serveSessionsByRevoking executes the choice made in the session list.
+func (h AuthByEmailHandler) serveSessionsByRevoking(w http.ResponseWriter, r *http.Request, cookie string, user UserID) (int, error) {
+	r.ParseForm()
+	if len(r.PostForm["csrf"]) == 0 || subtle.ConstantTimeCompare([]byte(r.PostForm["csrf"][0]), []byte(csrfToken(cookie))) != 1 {
+		h.logger.Printf("Session action attempted without a proper CSRF token")
+		return h.serveBadRequest(w)
+	}
+	if len(r.PostForm["action"]) == 0 {
+		return h.serveBadRequest(w)
+	}
+
+	switch r.PostForm["action"][0] {
+	case "revoke":
+		if len(r.PostForm["session"]) == 0 {
+			return h.serveBadRequest(w)
+		}
+
+		// Look the session up among this user's own sessions only
+		for _, session := range h.database.GetSessions(user) {
+			if sessionID(session.Cookie) == r.PostForm["session"][0] {
+				if err := h.database.DeleteCookieToken(session.Cookie); err != nil {
+					h.logger.Printf("Database error trying to delete a cookie, %v\n", err)
+					return 500, err
+				}
+				return h.serveRedirect(w, "/auth/sessions")
+			}
+		}
+		return h.serveBadRequest(w)
+
+	case "revokeothers":
+		for _, session := range h.database.GetSessions(user) {
+			if session.Cookie == cookie {
+				continue
+			}
+			if err := h.database.DeleteCookieToken(session.Cookie); err != nil {
+				h.logger.Printf("Database error trying to delete a cookie, %v\n", err)
+				return 500, err
+			}
+		}
+		return h.serveRedirect(w, "/auth/sessions")
+
+	default:
+		return h.serveBadRequest(w)
+	}
+}
+
+// sessionID identifies a session in the session list without revealing its cookie.
+func sessionID(cookie string) string {
+	return CRYPTO.computeHmac([]byte("session/" + cookie))
+}
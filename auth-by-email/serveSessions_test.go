@@ -0,0 +1,125 @@
+package authbyemail
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestServeHTTPSessions(t *testing.T) {
+	h := NewTestHandler()
+	userID := CRYPTO.UserIDfromEmail(h.config.MailerFrom)
+	h.database.AddUser(userID)
+	otherUserID := UserID("other")
+	h.database.AddUser(otherUserID)
+
+	test := func(t *testing.T, desiredStatus int, req *http.Request) *http.Response {
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		statusCode, _ := h.ServeHTTP(w, req)
+		if statusCode != 0 || w.Result().StatusCode != desiredStatus {
+			t.Errorf("Status code should be %v but was %v. %#v", desiredStatus, w.Result().StatusCode, w.Result())
+		}
+		return w.Result()
+	}
+
+	cookieLoggedIn, _ := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: "current browser"})
+	cookieOther, _ := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: "other browser"})
+	cookieOtherUser, _ := h.database.NewCookieToken(CookieToken{UserID: otherUserID, IsValidated: true, BrowserContext: "other user"})
+
+	t.Run("Correct request (list)", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://example.com/auth/sessions", nil)
+		req.Header.Add("Cookie", "authByEmailToken="+cookieLoggedIn)
+		rsp := test(t, 200, req)
+		body, _ := ioutil.ReadAll(rsp.Body)
+		if !strings.Contains(string(body), "current browser") || !strings.Contains(string(body), "other browser") {
+			t.Errorf("Session list does not contain both sessions: %v", string(body))
+		}
+		if strings.Contains(string(body), "other user") {
+			t.Errorf("Session list contains a session of another user: %v", string(body))
+		}
+		if strings.Contains(string(body), cookieOther) {
+			t.Errorf("Session list reveals a cookie: %v", string(body))
+		}
+	})
+
+	t.Run("Correct request (revoke)", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "http://example.com/auth/sessions",
+			strings.NewReader(url.Values{"csrf": {csrfToken(cookieLoggedIn)}, "action": {"revoke"}, "session": {sessionID(cookieOther)}}.Encode()))
+		req.Header.Add("Cookie", "authByEmailToken="+cookieLoggedIn)
+		test(t, 303, req)
+		if h.database.GetCookieToken(cookieOther) != nil {
+			t.Error("Revoked session still exists")
+		}
+		if h.database.GetCookieToken(cookieLoggedIn) == nil {
+			t.Error("Current session was revoked as well")
+		}
+	})
+
+	t.Run("Correct request (revoke others)", func(t *testing.T) {
+		cookieOther, _ = h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: "other browser"})
+		cookieUnvalidated, _ := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: false, BrowserContext: "kiosk"})
+		req := httptest.NewRequest("POST", "http://example.com/auth/sessions",
+			strings.NewReader(url.Values{"csrf": {csrfToken(cookieLoggedIn)}, "action": {"revokeothers"}}.Encode()))
+		req.Header.Add("Cookie", "authByEmailToken="+cookieLoggedIn)
+		test(t, 303, req)
+		if h.database.GetCookieToken(cookieOther) != nil || h.database.GetCookieToken(cookieUnvalidated) != nil {
+			t.Error("Other sessions still exist")
+		}
+		if h.database.GetCookieToken(cookieLoggedIn) == nil {
+			t.Error("Current session was revoked as well")
+		}
+		if h.database.GetCookieToken(cookieOtherUser) == nil {
+			t.Error("Session of another user was revoked")
+		}
+	})
+
+	t.Run("Malformed request (session of another user)", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "http://example.com/auth/sessions",
+			strings.NewReader(url.Values{"csrf": {csrfToken(cookieLoggedIn)}, "action": {"revoke"}, "session": {sessionID(cookieOtherUser)}}.Encode()))
+		req.Header.Add("Cookie", "authByEmailToken="+cookieLoggedIn)
+		test(t, 400, req)
+		if h.database.GetCookieToken(cookieOtherUser) == nil {
+			t.Error("Session of another user was revoked")
+		}
+	})
+
+	t.Run("Malformed request (bad CSRF token)", func(t *testing.T) {
+		cookieOther, _ = h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: "other browser"})
+		for _, values := range []url.Values{
+			{"action": {"revokeothers"}},
+			{"csrf": {"problem"}, "action": {"revokeothers"}},
+			{"action": {"revoke"}, "session": {sessionID(cookieOther)}},
+		} {
+			req := httptest.NewRequest("POST", "http://example.com/auth/sessions", strings.NewReader(values.Encode()))
+			req.Header.Add("Cookie", "authByEmailToken="+cookieLoggedIn)
+			test(t, 400, req)
+		}
+		if h.database.GetCookieToken(cookieOther) == nil {
+			t.Error("Session revoked without a proper CSRF token")
+		}
+	})
+
+	t.Run("Malformed request (no action)", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "http://example.com/auth/sessions",
+			strings.NewReader(url.Values{"csrf": {csrfToken(cookieLoggedIn)}}.Encode()))
+		req.Header.Add("Cookie", "authByEmailToken="+cookieLoggedIn)
+		test(t, 400, req)
+	})
+
+	t.Run("Malformed request (not logged in)", func(t *testing.T) {
+		test(t, 403, httptest.NewRequest("GET", "http://example.com/auth/sessions", nil))
+
+		cookieUnvalidated, _ := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: false, BrowserContext: "kiosk"})
+		req := httptest.NewRequest("POST", "http://example.com/auth/sessions",
+			strings.NewReader(url.Values{"action": {"revokeothers"}}.Encode()))
+		req.Header.Add("Cookie", "authByEmailToken="+cookieUnvalidated)
+		test(t, 403, req)
+		if h.database.GetCookieToken(cookieLoggedIn) == nil {
+			t.Error("Session was revoked by a user that is not logged in")
+		}
+	})
+}
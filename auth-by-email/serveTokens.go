@@ -0,0 +1,84 @@
+package authbyemail
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The longest name a user may give to a personal access token
+const maxAccessTokenNameLength = 100
+
+// serveTokens lists the personal access tokens of the logged-in user. A POST request with
+// action=create, a name=, optional scopes= (paths separated by commas or spaces) and a
+// days= field makes a new token, which is shown only once; action=revoke and a token=
+// field with its ID revokes one.
+//
+// Only a cookie gives access to this page, so that a token can not be used to make more.
+// All forms carry a token bound to the cookie, like those on the admin dashboard.
+func (h AuthByEmailHandler) serveTokens(w http.ResponseWriter, r *http.Request) (int, error) {
+	if !h.config.AccessTokens {
+		return h.serveNotFound(w)
+	}
+	if !h.isCookieValid(r) {
+		return h.serveNotAuthenticated(w)
+	}
+
+	cookie := GetCookie(r)
+	token := h.database.GetCookieToken(cookie)
+	if token == nil {
+		// This can not occur given the implementation of isCookieValid
+		return h.serveBadRequest(w)
+	}
+
+	data := struct {
+		CSRFToken string
+		MaxDays   int
+		NewToken  string
+		Tokens    []AccessToken
+	}{
+		CSRFToken: csrfToken(cookie),
+		MaxDays:   int(h.config.MaxAccessTokenValidity / (24 * time.Hour)),
+	}
+
+	if r.Method == "POST" {
+		r.ParseForm()
+		if len(r.PostForm["csrf"]) == 0 || subtle.ConstantTimeCompare([]byte(r.PostForm["csrf"][0]), []byte(data.CSRFToken)) != 1 {
+			h.logger.Printf("Token action attempted without a proper CSRF token")
+			return h.serveBadRequest(w)
+		}
+
+		switch r.PostForm.Get("action") {
+		case "create":
+			name := strings.TrimSpace(r.PostForm.Get("name"))
+			days, err := strconv.Atoi(r.PostForm.Get("days"))
+			if name == "" || len(name) > maxAccessTokenNameLength || err != nil || days < 1 || days > data.MaxDays {
+				return h.serveBadRequest(w)
+			}
+
+			accessToken := AccessToken{
+				UserID: token.UserID,
+				Name:   name,
+				Scopes: ParseScopes(r.PostForm.Get("scopes")),
+			}
+			if data.NewToken, err = h.database.NewAccessToken(accessToken, time.Duration(days*24)*time.Hour); err != nil {
+				h.logger.Printf("Database error trying to make an access token, %v\n", err)
+				return 500, err
+			}
+
+		case "revoke":
+			if err := h.database.DelAccessToken(token.UserID, r.PostForm.Get("token")); err != nil {
+				return h.serveBadRequest(w)
+			}
+			return h.serveRedirect(w, "/auth/tokens")
+
+		default:
+			return h.serveBadRequest(w)
+		}
+	}
+
+	data.Tokens = h.database.GetAccessTokens(token.UserID)
+	return h.serveTemplate(w, TplTokens, &data)
+}
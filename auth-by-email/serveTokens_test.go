@@ -0,0 +1,201 @@
+package authbyemail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeHTTPTokens(t *testing.T) {
+	h := NewTestHandler()
+	h.config.AccessTokens = true
+	userID := UserID("test")
+	h.database.AddUser(userID)
+	cookie, _ := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: "current browser"})
+
+	test := func(t *testing.T, desiredStatus int, req *http.Request) string {
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		statusCode, _ := h.ServeHTTP(w, req)
+		if statusCode != 0 || w.Result().StatusCode != desiredStatus {
+			t.Errorf("Status code should be %v but was %v. %#v", desiredStatus, w.Result().StatusCode, w.Result())
+		}
+		body, _ := ioutil.ReadAll(w.Result().Body)
+		return string(body)
+	}
+
+	post := func(cookie string, values url.Values) *http.Request {
+		req := httptest.NewRequest("POST", "http://example.com/auth/tokens", strings.NewReader(values.Encode()))
+		req.Header.Add("Cookie", "authByEmailToken="+cookie)
+		return req
+	}
+
+	t.Run("Correct request (create)", func(t *testing.T) {
+		body := test(t, 200, post(cookie, url.Values{"csrf": {csrfToken(cookie)}, "action": {"create"}, "name": {"ci"}, "scopes": {"/API/*, /status"}, "days": {"30"}}))
+		token := regexp.MustCompile(accessTokenPrefix + "[0-9a-f]+").FindString(body)
+		at := h.database.GetAccessToken(token)
+		if at == nil || at.UserID != userID || at.Name != "ci" || strings.Join(at.Scopes, " ") != "api/* status" {
+			t.Fatalf("New access token not shown or not stored correctly, got %#v from %v", at, body)
+		}
+		if at.ExpiresAt.Before(time.Now().Add(29*24*time.Hour)) || at.ExpiresAt.After(time.Now().Add(31*24*time.Hour)) {
+			t.Errorf("New access token expires at %v", at.ExpiresAt)
+		}
+	})
+
+	t.Run("Correct request (list)", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://example.com/auth/tokens", nil)
+		req.Header.Add("Cookie", "authByEmailToken="+cookie)
+		body := test(t, 200, req)
+		if !strings.Contains(body, "ci") || !strings.Contains(body, "/api/*") || strings.Contains(body, accessTokenPrefix) {
+			t.Errorf("Token list does not show the token by name only: %v", body)
+		}
+	})
+
+	t.Run("Correct request (revoke)", func(t *testing.T) {
+		tokens := h.database.GetAccessTokens(userID)
+		if len(tokens) != 1 {
+			t.Fatalf("Expected one access token, got %#v", tokens)
+		}
+		test(t, 303, post(cookie, url.Values{"csrf": {csrfToken(cookie)}, "action": {"revoke"}, "token": {tokens[0].ID}}))
+		if tokens := h.database.GetAccessTokens(userID); len(tokens) != 0 {
+			t.Errorf("Access token still exists after being revoked, got %#v", tokens)
+		}
+	})
+
+	t.Run("Malformed request (bad data)", func(t *testing.T) {
+		for _, values := range []url.Values{
+			{"action": {"create"}, "name": {"ci"}, "days": {"30"}},
+			{"csrf": {"problem"}, "action": {"create"}, "name": {"ci"}, "days": {"30"}},
+			{"csrf": {csrfToken(cookie)}, "action": {"create"}, "name": {""}, "days": {"30"}},
+			{"csrf": {csrfToken(cookie)}, "action": {"create"}, "name": {"ci"}, "days": {"0"}},
+			{"csrf": {csrfToken(cookie)}, "action": {"create"}, "name": {"ci"}, "days": {"366"}},
+			{"csrf": {csrfToken(cookie)}, "action": {"revoke"}, "token": {"problem"}},
+			{"csrf": {csrfToken(cookie)}, "action": {"problem"}},
+		} {
+			test(t, 400, post(cookie, values))
+		}
+		if tokens := h.database.GetAccessTokens(userID); len(tokens) != 0 {
+			t.Errorf("Access token made by a malformed request, got %#v", tokens)
+		}
+	})
+
+	t.Run("Malformed request (not logged in)", func(t *testing.T) {
+		test(t, 403, httptest.NewRequest("GET", "http://example.com/auth/tokens", nil))
+
+		// A token can not be used to make more tokens
+		token, _ := h.database.NewAccessToken(AccessToken{UserID: userID, Name: "ci"}, time.Hour)
+		req := httptest.NewRequest("GET", "http://example.com/auth/tokens", nil)
+		req.Header.Add("Authorization", "Bearer "+token)
+		test(t, 403, req)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		h.config.AccessTokens = false
+		req := httptest.NewRequest("GET", "http://example.com/auth/tokens", nil)
+		req.Header.Add("Cookie", "authByEmailToken="+cookie)
+		test(t, 404, req)
+	})
+}
+
+// AuthorizationNext serves the Authorization header it receives, so that we can check
+// that our access tokens are not passed on.
+type AuthorizationNext struct{}
+
+func (an AuthorizationNext) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	fmt.Fprintf(w, "Page for %v", r.Header.Get("Authorization"))
+	return 0, nil
+}
+
+func TestServeHTTPAccessTokens(t *testing.T) {
+	h := NewTestHandler()
+	h.Next = AuthorizationNext{}
+	h.config.AccessTokens = true
+	h.config.GroupRules = []GroupRule{{Group: "finance", Paths: []string{"reports/*"}}}
+	userID := UserID("test")
+	h.database.AddUser(userID)
+
+	token, _ := h.database.NewAccessToken(AccessToken{UserID: userID, Name: "all"}, time.Hour)
+	scoped, _ := h.database.NewAccessToken(AccessToken{UserID: userID, Name: "api", Scopes: []string{"api/*"}}, time.Hour)
+	expired, _ := h.database.NewAccessToken(AccessToken{UserID: userID, Name: "old"}, -time.Hour)
+
+	test := func(t *testing.T, path string, authorization string, desiredStatus int, desiredBody string) {
+		req := httptest.NewRequest("GET", "http://example.com"+path, nil)
+		if authorization != "" {
+			req.Header.Add("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Result().StatusCode != desiredStatus {
+			t.Errorf("Request of %v with %q should be %v but was %v", path, authorization, desiredStatus, w.Result().StatusCode)
+		}
+		if desiredBody != "" && w.Body.String() != desiredBody {
+			t.Errorf("Request of %v with %q should serve %q but served %q", path, authorization, desiredBody, w.Body.String())
+		}
+	}
+
+	t.Run("Valid token", func(t *testing.T) {
+		test(t, "/", "Bearer "+token, 200, "Page for ")
+		test(t, "/api/users", "Bearer "+scoped, 200, "Page for ")
+		if tokens := h.database.GetAccessTokens(userID); len(tokens) != 2 || tokens[0].LastUsed.IsZero() {
+			t.Errorf("Use of the access token was not recorded, got %#v", tokens)
+		}
+	})
+
+	t.Run("Invalid token", func(t *testing.T) {
+		test(t, "/", "", 403, PAGEDATA_LOGIN)
+		test(t, "/", "Bearer "+expired, 403, PAGEDATA_LOGIN)
+		test(t, "/", "Bearer abe_doesnotexist", 403, PAGEDATA_LOGIN)
+		test(t, "/", "Basic "+token, 403, PAGEDATA_LOGIN)
+	})
+
+	t.Run("Outside of the scopes", func(t *testing.T) {
+		test(t, "/", "Bearer "+scoped, 403, PAGEDATA_LOGIN)
+	})
+
+	t.Run("Group rules apply", func(t *testing.T) {
+		test(t, "/reports/2020", "Bearer "+token, 403, PAGEDATA_NO_ACCESS)
+		h.database.SetUserGroups(userID, []string{"finance"})
+		test(t, "/reports/2020", "Bearer "+token, 200, "Page for ")
+	})
+
+	t.Run("Other bearer tokens are passed on", func(t *testing.T) {
+		cookie, _ := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: ""})
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Add("Cookie", "authByEmailToken="+cookie)
+		req.Header.Add("Authorization", "Bearer upstream")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Body.String() != "Page for Bearer upstream" {
+			t.Errorf("Authorization header for the next handler was not passed on, got %q", w.Body.String())
+		}
+	})
+
+	t.Run("Verify", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "http://example.com/auth/verify", nil)
+		req.Header.Add("Authorization", "Bearer "+scoped)
+		req.Header.Add("X-Forwarded-Uri", "/api/users")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Result().StatusCode != 200 {
+			t.Errorf("Verifying a scoped token for its scope gave %v", w.Result().StatusCode)
+		}
+	})
+
+	t.Run("Access of the user ended", func(t *testing.T) {
+		h.database.SetUserExpiry(userID, time.Now().Add(-time.Minute))
+		test(t, "/", "Bearer "+token, 403, PAGEDATA_LOGIN)
+		h.database.SetUserExpiry(userID, time.Time{})
+		test(t, "/", "Bearer "+token, 200, "Page for ")
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		h.config.AccessTokens = false
+		test(t, "/", "Bearer "+token, 403, PAGEDATA_LOGIN)
+	})
+}
@@ -0,0 +1,69 @@
+package authbyemail
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// serveVerify lets other reverse proxies, such as nginx (with auth_request) and Traefik
+// (with ForwardAuth), use us to protect their sites. They pass on the headers of each
+// request they receive, and let it through if we answer with a 2xx status.
+//
+// If the request has a validated cookie or a personal access token, we answer 200 with
+// identity headers describing the user, which the proxy can pass on to its site. If not, we answer 401 with the login
+// page, which Traefik shows as is, and nginx can show using error_page. If the proxy tells
+// us the original path (in X-Forwarded-Uri or X-Original-URI), unprotected paths are let
+// through, and group rules are applied, answering 403 to users who are not a member. If
+// there are group rules but no path is given, we can not tell whether they apply, so we
+// answer 403 as well.
+func (h AuthByEmailHandler) serveVerify(w http.ResponseWriter, r *http.Request) (int, error) {
+	// These answers are about one user, and must not be reused for others
+	w.Header().Set("Cache-Control", "no-store")
+
+	path, pathGiven := forwardedPath(r)
+	if pathGiven && h.isUnprotectedPath(path) {
+		w.WriteHeader(200)
+		return 0, nil
+	}
+
+	user, _, ok := h.requestUser(path, r)
+	if !ok {
+		return h.serveStaticPage(w, r, 401, TplLogin)
+	}
+
+	if !pathGiven && len(h.config.GroupRules) > 0 {
+		h.logger.Printf("Verification refused, the proxy did not give the original path to apply the group rules to")
+		return h.serveStaticPage(w, r, 403, TplNoAccess)
+	}
+	if pathGiven && !h.checkAuthorization(path, user) {
+		return h.serveStaticPage(w, r, 403, TplNoAccess)
+	}
+
+	h.addIdentityHeaders(w.Header(), user)
+	w.WriteHeader(200)
+	return 0, nil
+}
+
+// forwardedPath returns the sanitised path of the original request, as given by the
+// reverse proxy that asks us to verify it, and whether it was given.
+func forwardedPath(r *http.Request) (string, bool) {
+	uri := r.Header.Get("X-Forwarded-Uri") // Traefik
+	if uri == "" {
+		uri = r.Header.Get("X-Original-Uri") // Commonly set in nginx configurations
+	}
+	if uri == "" {
+		return "", false
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", false
+	}
+
+	path := strings.ToLower(u.Path)
+	for strings.HasPrefix(path, "/") {
+		path = path[1:]
+	}
+	return path, true
+}
@@ -0,0 +1,79 @@
+package authbyemail
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeHTTPVerify(t *testing.T) {
+	h := NewTestHandler()
+	h.config.GroupRules = []GroupRule{{Group: "finance", Paths: []string{"reports/*"}}}
+
+	email, _ := NewEmailAddrFromString("user@example.com")
+	userID := CRYPTO.UserIDfromEmail(email)
+	h.addUser(email)
+	h.database.SetUserGroups(userID, []string{"hr"})
+	cookie, _ := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: ""})
+	unvalidated, _ := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: false, BrowserContext: ""})
+
+	test := func(t *testing.T, desiredStatus int, cookie string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://auth.example.com/auth/verify", nil)
+		if cookie != "" {
+			req.Header.Add("Cookie", "authByEmailToken="+cookie)
+		}
+		for name, value := range headers {
+			req.Header.Add(name, value)
+		}
+		w := httptest.NewRecorder()
+		statusCode, _ := h.ServeHTTP(w, req)
+		if statusCode != 0 || w.Result().StatusCode != desiredStatus {
+			t.Errorf("Status code should be %v but was %v. %#v", desiredStatus, w.Result().StatusCode, w.Result())
+		}
+		if w.Result().Header.Get("Cache-Control") != "no-store" {
+			t.Error("Verification answer may be cached")
+		}
+		return w
+	}
+
+	t.Run("Correct request (logged in)", func(t *testing.T) {
+		w := test(t, 200, cookie, map[string]string{"X-Forwarded-Uri": "/other"})
+		if w.Result().Header.Get("X-Auth-User-Id") != string(userID) || w.Result().Header.Get("X-Auth-Email") != email.String() || w.Result().Header.Get("X-Auth-Groups") != "hr" {
+			t.Errorf("Verification answer has wrong identity headers, %#v", w.Result().Header)
+		}
+	})
+
+	t.Run("Correct request (not logged in)", func(t *testing.T) {
+		w := test(t, 401, "", nil)
+		if w.Body.String() != PAGEDATA_LOGIN {
+			t.Errorf("Verification answer should contain the login page, but was %v", w.Body.String())
+		}
+		test(t, 401, unvalidated, nil)
+		test(t, 401, "does not exist", nil)
+	})
+
+	t.Run("Correct request (unprotected path)", func(t *testing.T) {
+		w := test(t, 200, "", map[string]string{"X-Forwarded-Uri": "/testpath?a=b"})
+		if w.Result().Header.Get("X-Auth-User-Id") != "" {
+			t.Error("Verification answer of an anonymous request has identity headers")
+		}
+	})
+
+	t.Run("Correct request (group rules)", func(t *testing.T) {
+		test(t, 403, cookie, map[string]string{"X-Forwarded-Uri": "/reports/q1"})
+		test(t, 403, cookie, map[string]string{"X-Original-URI": "/Reports/q1"})
+		test(t, 200, cookie, map[string]string{"X-Forwarded-Uri": "/other"})
+
+		h.database.SetUserGroups(userID, []string{"finance"})
+		test(t, 200, cookie, map[string]string{"X-Forwarded-Uri": "/reports/q1"})
+	})
+
+	t.Run("Malformed request (no path with group rules)", func(t *testing.T) {
+		// Without the path, the group rules can not be applied, so no one is let through
+		test(t, 403, cookie, nil)
+
+		rules := h.config.GroupRules
+		h.config.GroupRules = nil
+		defer func() { h.config.GroupRules = rules }()
+		test(t, 200, cookie, nil)
+	})
+}
@@ -1,15 +1,105 @@
 package authbyemail
 
 import (
+	"context"
+	"io"
 	"net/http"
+	"strings"
+	"time"
 )
 
+// waitEventsTimeout is how long a request to auth/wait/events is held open before
+// the browser is told to try again.
+var waitEventsTimeout = 30 * time.Second
+
+// loginCodeUserLimit limits the wrong one-time codes for one user, over all of their
+// cookies. Each cookie may only try loginCodeAttempts codes, but logging in again gives
+// a new one; unlike the login rate limits, this limit can not be turned off.
+var loginCodeUserLimit = RateLimit{Count: 3 * loginCodeAttempts, Period: rateLimitMaxPeriod}
+
 // serveWait is the page you see after logging in. If you approve the login from your
-// phone and F5 this page, you will be logged in.
+// phone and F5 this page, you will be logged in. Alternatively, you can POST the
+// one-time code from the login e-mail to this page. Cookies that were given for a short
+// time before they were validated, like those of QR codes, are kept for the full
+// validity from then on.
 func (h AuthByEmailHandler) serveWait(w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method == "POST" {
+		return h.serveWaitWithCode(w, r)
+	}
+
 	if !h.isCookieValid(r) {
 		return h.serveStaticPage(w, r, 200, TplAckLogin)
 	}
 
-	return h.serveRedirect(w, h.config.Redirect)
+	h.setCookie(w, r, GetCookie(r), h.config.CookieValidity)
+	return h.serveRedirectAfterLogin(w, r)
+}
+
+// serveWaitWithCode is called when a user types the one-time code from their login
+// e-mail into the wait page. If the code belongs to this browser's cookie, the
+// cookie is validated and the user is logged in.
+func (h AuthByEmailHandler) serveWaitWithCode(w http.ResponseWriter, r *http.Request) (int, error) {
+	// Parse the form data in the request body
+	r.ParseForm()
+
+	if len(r.PostForm["code"]) == 0 {
+		return h.serveBadRequest(w)
+	}
+
+	cookie := GetCookie(r)
+	ct := h.database.GetCookieToken(cookie)
+	if ct == nil {
+		return h.serveStaticPage(w, r, 403, TplBadCode)
+	}
+
+	// Every attempt counts against the user until the code turns out to be correct
+	key := "code/" + string(ct.UserID)
+	if allowed, _ := h.takeRateLimit(key, loginCodeUserLimit); !allowed {
+		h.logger.Printf("Too many wrong login codes for %v", ct.UserID)
+		return h.serveStaticPage(w, r, 403, TplBadCode)
+	}
+
+	err := h.database.ValidateLoginCode(cookie, strings.TrimSpace(r.PostForm["code"][0]))
+	if err != nil {
+		h.logger.Printf("Could not log in with a one-time code, %v", err)
+		return h.serveStaticPage(w, r, 403, TplBadCode)
+	}
+	h.giveRateLimit(key, loginCodeUserLimit)
+
+	return h.serveRedirectAfterLogin(w, r)
+}
+
+// serveWaitEvents lets the wait page move on by itself. It holds the request open as a
+// stream of Server-Sent Events, and sends a `validated` event as soon as this browser's
+// cookie is validated (e.g. because the user approved the login on their phone). If that
+// does not happen within waitEventsTimeout, a `timeout` event is sent instead and the
+// browser is expected to reconnect.
+//
+// Unknown and deleted cookies also lead to a timeout, so that this endpoint can not be
+// used to find out whether an e-mail address is known to us.
+func (h AuthByEmailHandler) serveWaitEvents(w http.ResponseWriter, r *http.Request) (int, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), waitEventsTimeout)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	io.WriteString(w, ": waiting\n\n")
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	var token *CookieToken
+	if cookie := GetCookie(r); cookie != "" {
+		token = h.database.AwaitCookieToken(ctx, cookie)
+	}
+
+	if token != nil && token.IsValidated {
+		io.WriteString(w, "event: validated\ndata: /auth/wait\n\n")
+	} else {
+		<-ctx.Done()
+		io.WriteString(w, "event: timeout\ndata: \n\n")
+	}
+
+	return 0, nil
 }
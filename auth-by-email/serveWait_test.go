@@ -1,8 +1,12 @@
 package authbyemail
 
 import (
+	"io/ioutil"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestServeHTTPWait(t *testing.T) {
@@ -40,4 +44,146 @@ func TestServeHTTPWait(t *testing.T) {
 			t.Errorf("Request of auth/wait with a cookie should be Redirect but was %v. %#v", w.Result().StatusCode, w.Result())
 		}
 	})
+
+	t.Run("Correct request (one-time code)", func(t *testing.T) {
+		cookie, _ := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: false, BrowserContext: ""})
+		code, _ := h.database.NewLoginCode(cookie, time.Hour)
+		req := httptest.NewRequest("POST", "http://example.com/auth/wait",
+			strings.NewReader(url.Values{"code": {code}}.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Add("Cookie", "authByEmailToken="+cookie)
+		w := httptest.NewRecorder()
+		statusCode, _ := h.ServeHTTP(w, req)
+		if statusCode != 0 || w.Result().StatusCode != 303 {
+			t.Errorf("Request of auth/wait with a correct code should be Redirect but was %v. %#v", w.Result().StatusCode, w.Result())
+		}
+		if ct := h.database.GetCookieToken(cookie); ct == nil || !ct.IsValidated {
+			t.Errorf("Cookie not validated by correct code, but %+v", ct)
+		}
+	})
+
+	t.Run("Malformed request (wrong one-time code)", func(t *testing.T) {
+		cookie, _ := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: false, BrowserContext: ""})
+		h.database.NewLoginCode(cookie, time.Hour)
+		req := httptest.NewRequest("POST", "http://example.com/auth/wait",
+			strings.NewReader(url.Values{"code": {"problem"}}.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Add("Cookie", "authByEmailToken="+cookie)
+		w := httptest.NewRecorder()
+		statusCode, _ := h.ServeHTTP(w, req)
+		if statusCode != 0 || w.Result().StatusCode != 403 {
+			t.Errorf("Request of auth/wait with a wrong code should be Forbidden but was %v. %#v", w.Result().StatusCode, w.Result())
+		}
+		if ct := h.database.GetCookieToken(cookie); ct == nil || ct.IsValidated {
+			t.Errorf("Cookie validated by wrong code, and is %+v", ct)
+		}
+	})
+
+	postCode := func(cookie, code string) int {
+		req := httptest.NewRequest("POST", "http://example.com/auth/wait",
+			strings.NewReader(url.Values{"code": {code}}.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Add("Cookie", "authByEmailToken="+cookie)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Result().StatusCode
+	}
+
+	t.Run("Malformed request (one-time code tried too often)", func(t *testing.T) {
+		// The login rate limits do not matter for the attempts
+		h.config.LoginRateLimitIP, h.config.LoginRateLimitEmail = RateLimit{}, RateLimit{}
+		defer func() {
+			h.config.LoginRateLimitIP, h.config.LoginRateLimitEmail = NewConfig().LoginRateLimitIP, NewConfig().LoginRateLimitEmail
+		}()
+
+		cookie, _ := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: false, BrowserContext: ""})
+		code, _ := h.database.NewLoginCode(cookie, time.Hour)
+		for i := 0; i < loginCodeAttempts; i++ {
+			postCode(cookie, "wrong")
+		}
+		if status := postCode(cookie, code); status != 403 {
+			t.Errorf("Request of auth/wait with a used up code should be Forbidden but was %v", status)
+		}
+		if ct := h.database.GetCookieToken(cookie); ct == nil || ct.IsValidated {
+			t.Errorf("Cookie validated by a used up code, and is %+v", ct)
+		}
+	})
+
+	t.Run("Malformed request (too many wrong codes for a user)", func(t *testing.T) {
+		other := UserID("other")
+		h.database.AddUser(other)
+
+		// Logging in again gives a new code, but the wrong codes of earlier ones still count
+		for i := 0; i < loginCodeUserLimit.Count; i++ {
+			cookie, _ := h.database.NewCookieToken(CookieToken{UserID: other, IsValidated: false, BrowserContext: ""})
+			h.database.NewLoginCode(cookie, time.Hour)
+			postCode(cookie, "wrong")
+		}
+		cookie, _ := h.database.NewCookieToken(CookieToken{UserID: other, IsValidated: false, BrowserContext: ""})
+		code, _ := h.database.NewLoginCode(cookie, time.Hour)
+		if status := postCode(cookie, code); status != 403 {
+			t.Errorf("Request of auth/wait beyond the wrong codes of a user should be Forbidden but was %v", status)
+		}
+		if ct := h.database.GetCookieToken(cookie); ct == nil || ct.IsValidated {
+			t.Errorf("Cookie validated beyond the wrong codes of a user, and is %+v", ct)
+		}
+
+		// Other users are not affected, and correct codes do not count
+		for i := 0; i < loginCodeUserLimit.Count+1; i++ {
+			cookie, _ := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: false, BrowserContext: ""})
+			code, _ := h.database.NewLoginCode(cookie, time.Hour)
+			if status := postCode(cookie, code); status != 303 {
+				t.Fatalf("Request of auth/wait with a correct code should be Redirect but was %v", status)
+			}
+		}
+	})
+
+	t.Run("Malformed request (one-time code without cookie)", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "http://example.com/auth/wait",
+			strings.NewReader(url.Values{"code": {"123456"}}.Encode()))
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		statusCode, _ := h.ServeHTTP(w, req)
+		if statusCode != 0 || w.Result().StatusCode != 403 {
+			t.Errorf("Request of auth/wait with a code but no cookie should be Forbidden but was %v. %#v", w.Result().StatusCode, w.Result())
+		}
+	})
+
+	t.Run("Events (validated elsewhere)", func(t *testing.T) {
+		cookie, _ := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: false, BrowserContext: ""})
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			h.database.ValidateCookieToken(cookie)
+		}()
+		req := httptest.NewRequest("GET", "http://example.com/auth/wait/events", nil)
+		req.Header.Add("Cookie", "authByEmailToken="+cookie)
+		w := httptest.NewRecorder()
+		statusCode, _ := h.ServeHTTP(w, req)
+		if statusCode != 0 || w.Result().StatusCode != 200 {
+			t.Errorf("Request of auth/wait/events should be Ok but was %v. %#v", w.Result().StatusCode, w.Result())
+		}
+		if body, _ := ioutil.ReadAll(w.Result().Body); !strings.Contains(string(body), "event: validated") {
+			t.Errorf("Request of auth/wait/events did not get a validated event, but %q", string(body))
+		}
+	})
+
+	t.Run("Events (timeout)", func(t *testing.T) {
+		defer func(timeout time.Duration) { waitEventsTimeout = timeout }(waitEventsTimeout)
+		waitEventsTimeout = 10 * time.Millisecond
+
+		for _, cookie := range []string{"problem", ""} {
+			req := httptest.NewRequest("GET", "http://example.com/auth/wait/events", nil)
+			if cookie != "" {
+				req.Header.Add("Cookie", "authByEmailToken="+cookie)
+			}
+			w := httptest.NewRecorder()
+			statusCode, _ := h.ServeHTTP(w, req)
+			if statusCode != 0 || w.Result().StatusCode != 200 {
+				t.Errorf("Request of auth/wait/events should be Ok but was %v. %#v", w.Result().StatusCode, w.Result())
+			}
+			if body, _ := ioutil.ReadAll(w.Result().Body); !strings.Contains(string(body), "event: timeout") {
+				t.Errorf("Request of auth/wait/events with cookie %q did not time out, but got %q", cookie, string(body))
+			}
+		}
+	})
 }
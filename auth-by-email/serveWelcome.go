@@ -2,6 +2,7 @@ package authbyemail
 
 import (
 	"net/http"
+	"time"
 )
 
 // serveWelcome is called when a user clicks a login link in their e-mail.
@@ -57,7 +58,7 @@ func (h AuthByEmailHandler) serveWelcome(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	return h.serveRedirect(w, h.config.Redirect)
+	return h.serveRedirectAfterLogin(w, r)
 }
 
 // serveKioskWelcome receives the form response form serveWelcome, in case the browser that logged in
@@ -110,14 +111,19 @@ func (h AuthByEmailHandler) makeAndSendNewCookie(w http.ResponseWriter, r *http.
 		return err
 	}
 
+	h.setCookie(w, r, cookie, h.config.CookieValidity)
+	return nil
+}
+
+// setCookie gives the browser the given cookie, to be kept for the given time.
+func (h AuthByEmailHandler) setCookie(w http.ResponseWriter, r *http.Request, cookie string, validity time.Duration) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     "authByEmailToken",
 		Path:     "/",
+		Domain:   h.config.CookieDomain,
 		Value:    cookie,
-		MaxAge:   int(h.config.CookieValidity.Seconds()), // seconds
+		MaxAge:   int(validity.Seconds()), // seconds
 		Secure:   r.URL.Scheme == "https",
 		HttpOnly: true,
 	})
-
-	return nil
 }
@@ -0,0 +1,137 @@
+package authbyemail
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The cookie holding the session token, next to the authByEmailToken cookie.
+const sessionTokenCookie = "authByEmailSession"
+
+// The header of all session tokens, which are JSON Web Tokens signed with HS256.
+var sessionTokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// sessionClaims are the contents of a session token. It vouches that the cookie with the
+// given hash belonged to the user when the token was made, until it expires.
+type sessionClaims struct {
+	Subject    UserID `json:"sub"`
+	CookieHash string `json:"sid"`
+	ExpiresAt  int64  `json:"exp"`
+}
+
+// signSessionToken makes a session token with the given claims.
+func (c *Crypto) signSessionToken(claims sessionClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := sessionTokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	mac := hmac.New(sha256.New, c.sessionKey)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verifySessionToken checks that the given session token was made by signSessionToken,
+// and if so, returns its claims. It does not check whether the token expired.
+func (c *Crypto) verifySessionToken(token string) (*sessionClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != sessionTokenHeader {
+		return nil, errors.New("verifySessionToken: token is not a session token")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, c.sessionKey)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("verifySessionToken: signature is not valid")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims sessionClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+// sessionCookieHash binds a session token to the cookie it was made for, so that it is
+// worthless next to any other cookie.
+func sessionCookieHash(cookie string) string {
+	hash := sha256.Sum256([]byte("session/" + cookie))
+	return base64.RawURLEncoding.EncodeToString(hash[:16])
+}
+
+// sessionTokenUser returns the user vouched for by the session token of the request,
+// without using the database, and whether there is a valid one.
+func (h AuthByEmailHandler) sessionTokenUser(r *http.Request) (UserID, bool) {
+	if !h.config.SessionTokens {
+		return "", false
+	}
+	sessionCookie, err := r.Cookie(sessionTokenCookie)
+	if err != nil {
+		return "", false
+	}
+	cookie := GetCookie(r)
+	if cookie == "" {
+		return "", false
+	}
+
+	claims, err := CRYPTO.verifySessionToken(sessionCookie.Value)
+	if err != nil || claims.CookieHash != sessionCookieHash(cookie) || time.Now().Unix() >= claims.ExpiresAt {
+		return "", false
+	}
+	return claims.Subject, true
+}
+
+// refreshSessionToken gives the browser a new session token if its own is missing or
+// expired. It should only be called once the given user was identified by checking the
+// cookie of the request against the database. Tokens are only valid for
+// SessionTokenValidity, so that revoked cookies stop working within that time.
+func (h AuthByEmailHandler) refreshSessionToken(w http.ResponseWriter, r *http.Request, user UserID) {
+	if !h.config.SessionTokens {
+		return
+	}
+
+	sessionToken, err := CRYPTO.signSessionToken(sessionClaims{
+		Subject:    user,
+		CookieHash: sessionCookieHash(GetCookie(r)),
+		ExpiresAt:  time.Now().Add(h.config.SessionTokenValidity).Unix(),
+	})
+	if err != nil {
+		h.logger.Printf("Could not sign a session token, %v", err)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionTokenCookie,
+		Path:     "/",
+		Domain:   h.config.CookieDomain,
+		Value:    sessionToken,
+		MaxAge:   int(h.config.SessionTokenValidity.Seconds()), // seconds
+		Secure:   r.URL.Scheme == "https",
+		HttpOnly: true,
+	})
+}
+
+// clearSessionToken removes the session token from the browser, e.g. when logging out.
+func (h AuthByEmailHandler) clearSessionToken(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:   sessionTokenCookie,
+		Path:   "/",
+		Domain: h.config.CookieDomain,
+		MaxAge: -1,
+	})
+}
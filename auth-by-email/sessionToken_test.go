@@ -0,0 +1,87 @@
+package authbyemail
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeHTTPSessionTokens(t *testing.T) {
+	h := NewTestHandler()
+	h.config.SessionTokens = true
+	userID := UserID("test")
+	h.database.AddUser(userID)
+	cookie, _ := h.database.NewCookieToken(CookieToken{UserID: userID, IsValidated: true, BrowserContext: "current browser"})
+
+	get := func(cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://example.com/page", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	sessionCookieFrom := func(w *httptest.ResponseRecorder) *http.Cookie {
+		for _, c := range w.Result().Cookies() {
+			if c.Name == sessionTokenCookie {
+				return c
+			}
+		}
+		return nil
+	}
+
+	mainCookie := &http.Cookie{Name: "authByEmailToken", Value: cookie}
+	var sessionCookie *http.Cookie
+
+	t.Run("Correct request (session token issued)", func(t *testing.T) {
+		w := get(mainCookie)
+		sessionCookie = sessionCookieFrom(w)
+		if w.Code != 200 || sessionCookie == nil || sessionCookie.MaxAge != 300 {
+			t.Fatalf("Expected the page and a session token, got %v %#v", w.Code, sessionCookie)
+		}
+
+		// A valid session token is not replaced
+		if w := get(mainCookie, sessionCookie); w.Code != 200 || sessionCookieFrom(w) != nil {
+			t.Errorf("Session token was replaced, got %v %#v", w.Code, w.Result().Cookies())
+		}
+	})
+
+	t.Run("Correct request (no database needed)", func(t *testing.T) {
+		// The cookie is revoked, but the session token vouches for it until it expires
+		h.database.DeleteCookieToken(cookie)
+		if w := get(mainCookie, sessionCookie); w.Code != 200 || !strings.Contains(w.Body.String(), "Page") {
+			t.Errorf("Session token not accepted without the cookie in the database, got %v", w.Code)
+		}
+		if w := get(mainCookie); w.Code != 403 {
+			t.Errorf("Revoked cookie accepted without a session token, got %v", w.Code)
+		}
+	})
+
+	t.Run("Malformed request (session token)", func(t *testing.T) {
+		expired, _ := CRYPTO.signSessionToken(sessionClaims{Subject: userID, CookieHash: sessionCookieHash(cookie), ExpiresAt: time.Now().Add(-time.Minute).Unix()})
+		otherCookie, _ := CRYPTO.signSessionToken(sessionClaims{Subject: userID, CookieHash: sessionCookieHash("other"), ExpiresAt: time.Now().Add(time.Minute).Unix()})
+		tampered := sessionCookie.Value[:strings.LastIndex(sessionCookie.Value, ".")] + ".problem"
+		for _, token := range []string{expired, otherCookie, tampered, "problem"} {
+			if w := get(mainCookie, &http.Cookie{Name: sessionTokenCookie, Value: token}); w.Code != 403 {
+				t.Errorf("Expected a 403 for session token %v, got %v", token, w.Code)
+			}
+		}
+
+		// Without the cookie it was made for, a session token is worthless
+		if w := get(sessionCookie); w.Code != 403 {
+			t.Errorf("Session token accepted without a cookie, got %v", w.Code)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		h.config.SessionTokens = false
+		defer func() { h.config.SessionTokens = true }()
+		if w := get(mainCookie, sessionCookie); w.Code != 403 || sessionCookieFrom(w) != nil {
+			t.Errorf("Session token used while disabled, got %v", w.Code)
+		}
+	})
+}
@@ -87,6 +87,21 @@ const (
 	TplAckRemove
 	TplMailLogin
 	TplMailApprove
+	TplBadCode
+	TplQR
+	TplQRConfirm
+	TplSessions
+	TplAdmin
+	TplNoAccess
+	TplTokens
+	TplAlreadySent
+	TplTooManyRequests
+	TplChallengeFailed
+	TplBlocked
+	TplAckVote
+	TplMailInvite
+	TplAckRenew
+	TplMailExpiry
 )
 
 // This is a mapping from TemplateIDs to HTML templates used in this package.
@@ -127,11 +142,72 @@ var Templates = map[TemplateID]HtmlTemplate{
 		Filename:    "auth/mail_approve.html",
 		DefaultText: MAILDATA_APPROVE,
 	},
+	TplBadCode: {
+		Filename:    "auth/bad_code.html",
+		DefaultText: PAGEDATA_BAD_CODE,
+	},
+	TplQR: {
+		Filename:    "auth/qr.html",
+		DefaultText: PAGEDATA_QR,
+	},
+	TplQRConfirm: {
+		Filename:    "auth/qr_confirm.html",
+		DefaultText: PAGEDATA_QR_CONFIRM,
+	},
+	TplSessions: {
+		Filename:    "auth/sessions.html",
+		DefaultText: PAGEDATA_SESSIONS,
+	},
+	TplAdmin: {
+		Filename:    "auth/admin.html",
+		DefaultText: PAGEDATA_ADMIN,
+	},
+	TplNoAccess: {
+		Filename:    "auth/no_access.html",
+		DefaultText: PAGEDATA_NO_ACCESS,
+	},
+	TplTokens: {
+		Filename:    "auth/tokens.html",
+		DefaultText: PAGEDATA_TOKENS,
+	},
+	TplAlreadySent: {
+		Filename:    "auth/already_sent.html",
+		DefaultText: PAGEDATA_ALREADY_SENT,
+	},
+	TplTooManyRequests: {
+		Filename:    "auth/too_many_requests.html",
+		DefaultText: PAGEDATA_TOO_MANY_REQUESTS,
+	},
+	TplChallengeFailed: {
+		Filename:    "auth/challenge_failed.html",
+		DefaultText: PAGEDATA_CHALLENGE_FAILED,
+	},
+	TplBlocked: {
+		Filename:    "auth/blocked.html",
+		DefaultText: PAGEDATA_BLOCKED,
+	},
+	TplAckVote: {
+		Filename:    "auth/ack_vote.html",
+		DefaultText: PAGEDATA_ACK_VOTE,
+	},
+	TplMailInvite: {
+		Filename:    "auth/mail_invite.html",
+		DefaultText: MAILDATA_INVITE,
+	},
+	TplAckRenew: {
+		Filename:    "auth/ack_renew.html",
+		DefaultText: PAGEDATA_ACK_RENEW,
+	},
+	TplMailExpiry: {
+		Filename:    "auth/mail_expiry.html",
+		DefaultText: MAILDATA_EXPIRY,
+	},
 }
 
 // This page is shown to any non-logged in user when they try to access a protected
 // resource. You can replace this page with your own by putting a file called
-// `login.html` in the `auth` subdirectory of your website root.
+// `login.html` in the `auth` subdirectory of your website root. Keep the script
+// /auth/challenge.js after the form if you use the `challenge` directive.
 const PAGEDATA_LOGIN = `<!DOCTYPE html>
 <html lang="en">
 <head>
@@ -146,6 +222,7 @@ const PAGEDATA_LOGIN = `<!DOCTYPE html>
         <input type="submit" name="submit" value="Get login link">
     </p>
 </form>
+<script src="/auth/challenge.js"></script>
 </body>
 </html>
 `
@@ -154,8 +231,13 @@ const PAGEDATA_LOGIN = `<!DOCTYPE html>
 // to approve or reject a new user. You can replace this page with your own by putting
 // a file called `approve.html` in the `auth` subdirectory of your website root.
 //
-// When supplying your own template, take care to include the fields {{.User}} and
-// {{.EncEmail}} as shown below.
+// When supplying your own template, take care to include the fields {{.User}},
+// {{.EncEmail}} and {{.EncAdmin}} as shown below; the last tells which admin decided.
+// Include {{.Decisions}} to show what the other admins decided. If several admins
+// must approve new users, {{.Approvals}} of the {{.ApprovalsNeeded}} have done so. The
+// optional expires field sets when the user's access ends; {{.Expires}} is its current
+// value, and {{.ExpiresAt}} when their access ends or ended (the zero time if never).
+// Users whose access ended can only be approved with a new end.
 const PAGEDATA_APPROVE = `<!DOCTYPE html>
 <html lang="en">
 <head>
@@ -171,6 +253,20 @@ const PAGEDATA_APPROVE = `<!DOCTYPE html>
 	{{else}}
 	<p>This user does not exist in the database.</p>
 	{{end}}
+	{{if not .ExpiresAt.IsZero}}
+	<p>The access of this user {{if .Expires}}ends{{else}}ended{{end}} on {{.ExpiresAt.Format "2006-01-02 15:04"}}. To renew it, approve them with a later end{{if .Expires}}, or none{{end}}.</p>
+	{{end}}
+	{{if .Decisions}}
+	<p>Decisions so far:</p>
+	<ul>
+	{{range .Decisions}}
+		<li>{{if .Admin}}{{.Admin}}{{else}}An admin{{end}} {{if .Approved}}approved{{else}}rejected{{end}} this user on {{.DecidedAt.Format "2006-01-02 15:04"}}.</li>
+	{{end}}
+	</ul>
+	{{end}}
+	{{if and (not .Exists) (gt .ApprovalsNeeded 1)}}
+	<p>{{.Approvals}} of the {{.ApprovalsNeeded}} approvals needed have been given. A single rejection turns the user down.</p>
+	{{end}}
 	{{if .SafeAddress}}{{else}}
 	<p style="font-weight: bold;">
 		This e-mail address contains non-ascii characters. Be aware of <a href="https://en.wikipedia.org/wiki/IDN_homograph_attack">homograph attacks</a>.
@@ -179,8 +275,13 @@ const PAGEDATA_APPROVE = `<!DOCTYPE html>
 	<form method="post" action="/auth/approve">
 	<p>
 		<input type="hidden" name="email" value="{{.EncEmail}}" />
+		<input type="hidden" name="admin" value="{{.EncAdmin}}" />
 		<input type="radio" name="action" value="approve" id="action-approve" />
 			<label for="action-approve">Yes, approve</label> <br />
+		<label for="groups">Groups (separated by commas)</label>
+			<input type="text" id="groups" name="groups" value="{{.Groups}}" /> <br />
+		<label for="expires">Access ends on (leave empty for never)</label>
+			<input type="date" id="expires" name="expires" value="{{.Expires}}" {{if and (not .ExpiresAt.IsZero) (not .Expires)}}required {{end}}/> <br />
 		<input type="radio" name="action" value="revoke"  id="action-revoke" />
 			<label for="action-revoke">No, revoke</label> <br />
 		<input type="submit" value="Submit" />
@@ -223,6 +324,307 @@ const PAGEDATA_KIOSK = `<!DOCTYPE html>
 </html>
 `
 
+// This page is shown on a shared screen (such as a kiosk) when it visits the /auth/qr endpoint.
+// Users can log in the screen by scanning the QR code with a phone on which they are logged in.
+// You can replace this page with your own by putting a file called `qr.html` in the `auth`
+// subdirectory of your website root.
+//
+// When supplying your own template, take care to include the field {{.Image}} (a data URI of
+// the QR code) as shown below; {{.Link}} contains the link encoded in it. The script moves on
+// once the screen has been logged in.
+const PAGEDATA_QR = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<title>Auth-by-email: Log in with your phone</title>
+</head>
+<body>
+	<p>Scan this code with a phone on which you are logged in to log in on this screen as well.</p>
+	<p><img src="{{.Image}}" alt="QR code" /></p>
+	<p>The code is valid for ten minutes. You can also <a href="/">log in using your e-mail address</a>.</p>
+	<script>
+		if (window.EventSource) {
+			new EventSource("/auth/wait/events").addEventListener("validated", function (e) {
+				window.location = e.data;
+			});
+		}
+	</script>
+</body>
+</html>
+`
+
+// This page is shown to a logged-in user when they scan the QR code on a shared screen. It asks
+// whether they want to log in that screen.
+//
+// When supplying your own template, take care to include the fields {{.Browser}},
+// {{.Request}} and {{.CSRFToken}} as shown below.
+const PAGEDATA_QR_CONFIRM = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<title>Auth-by-email: Log in a shared screen</title>
+</head>
+<body>
+	<p>Hi,</p>
+	<p>You scanned a code to log in the following device:</p>
+	<p style="margin-left: 10px;">{{.Browser}}</p>
+	<p>If you recognise this device, and would like to log it in, you may indicate so below.</p>
+	<form method="post" action="/auth/qr/confirm">
+	<p>
+		<input type="hidden" name="request" value="{{.Request}}" />
+		<input type="hidden" name="csrf" value="{{.CSRFToken}}" />
+		<input type="radio" name="action" value="revoke" id="action-revoke" />
+			<label for="action-revoke">Do not log in the other device</label> <br />
+		<input type="radio" name="action" value="approve"  id="action-approve" />
+			<label for="action-approve">I recognise the other device, log it in</label> <br />
+		<input type="submit" value="Submit" />
+	</p>
+	</form>
+</body>
+</html>
+`
+
+// This page lists the sessions of a logged-in user when they visit the /auth/sessions endpoint.
+// You can replace this page with your own by putting a file called `sessions.html` in the
+// `auth` subdirectory of your website root.
+//
+// When supplying your own template, take care to iterate over {{.Sessions}} as shown below,
+// to POST the {{.ID}} of a session to be revoked, and to include the field {{.CSRFToken}}
+// as csrf in every form.
+const PAGEDATA_SESSIONS = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<title>Auth-by-email: Your sessions</title>
+</head>
+<body>
+	<p>You are logged in on the following devices.</p>
+	<table>
+		<tr><th>Device</th><th>Logged in</th><th>Last used</th><th></th></tr>
+		{{range .Sessions}}
+		<tr>
+			<td>{{.Browser}}{{if not .IsValidated}} (waiting for log-in){{end}}</td>
+			<td>{{if .CreatedAt.IsZero}}unknown{{else}}{{.CreatedAt.Format "2006-01-02 15:04"}}{{end}}</td>
+			<td>{{if .LastUsed.IsZero}}unknown{{else}}{{.LastUsed.Format "2006-01-02 15:04"}}{{end}}</td>
+			<td>
+			{{if .IsCurrent}}
+				This device
+			{{else}}
+				<form method="post" action="/auth/sessions">
+					<input type="hidden" name="csrf" value="{{$.CSRFToken}}" />
+					<input type="hidden" name="session" value="{{.ID}}" />
+					<input type="hidden" name="action" value="revoke" />
+					<input type="submit" value="Log out" />
+				</form>
+			{{end}}
+			</td>
+		</tr>
+		{{end}}
+	</table>
+	<form method="post" action="/auth/sessions">
+	<p>
+		<input type="hidden" name="csrf" value="{{.CSRFToken}}" />
+		<input type="hidden" name="action" value="revokeothers" />
+		<input type="submit" value="Log out everywhere else" />
+	</p>
+	</form>
+</body>
+</html>
+`
+
+// This page lists the personal access tokens of a user, when they visit the /auth/tokens
+// endpoint. You can replace this page with your own by putting a file called `tokens.html`
+// in the `auth` subdirectory of your website root.
+//
+// When supplying your own template, take care to include the field {{.CSRFToken}} as csrf
+// in every form, as shown below.
+const PAGEDATA_TOKENS = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<title>Auth-by-email: Your access tokens</title>
+</head>
+<body>
+	{{if .NewToken}}
+	<p style="font-weight: bold;">Your new access token is <code>{{.NewToken}}</code>. Copy it now, since it will not be shown again.</p>
+	{{end}}
+	<p>Scripts can use these tokens instead of logging in, by sending a header <code>Authorization: Bearer</code> followed by the token.</p>
+	<table>
+		<tr><th>Name</th><th>Paths</th><th>Made</th><th>Last used</th><th>Expires</th><th></th></tr>
+		{{range .Tokens}}
+		<tr>
+			<td>{{.Name}}</td>
+			<td>{{if .Scopes}}{{range $i, $s := .Scopes}}{{if $i}}, {{end}}/{{$s}}{{end}}{{else}}all{{end}}</td>
+			<td>{{.CreatedAt.Format "2006-01-02 15:04"}}</td>
+			<td>{{if .LastUsed.IsZero}}never{{else}}{{.LastUsed.Format "2006-01-02 15:04"}}{{end}}</td>
+			<td>{{.ExpiresAt.Format "2006-01-02 15:04"}}</td>
+			<td>
+				<form method="post" action="/auth/tokens">
+					<input type="hidden" name="csrf" value="{{$.CSRFToken}}" />
+					<input type="hidden" name="token" value="{{.ID}}" />
+					<button type="submit" name="action" value="revoke">Revoke</button>
+				</form>
+			</td>
+		</tr>
+		{{end}}
+	</table>
+	<h2>New token</h2>
+	<form method="post" action="/auth/tokens">
+	<p>
+		<input type="hidden" name="csrf" value="{{.CSRFToken}}" />
+		<label for="name">Name</label>
+		<input type="text" id="name" name="name" placeholder="Nightly backup" />
+		<label for="scopes">Only for paths</label>
+		<input type="text" id="scopes" name="scopes" placeholder="/api/*" />
+		<label for="days">Valid for days</label>
+		<input type="number" id="days" name="days" min="1" max="{{.MaxDays}}" value="30" />
+		<button type="submit" name="action" value="create">Make token</button>
+	</p>
+	</form>
+</body>
+</html>
+`
+
+// This page is the admin dashboard, shown to administrators when they visit the /auth/admin
+// endpoint. You can replace this page with your own by putting a file called `admin.html` in
+// the `auth` subdirectory of your website root.
+//
+// When supplying your own template, take care to POST the fields email and action, and to
+// include the field {{.CSRFToken}} as csrf in every form, as shown below.
+const PAGEDATA_ADMIN = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<title>Auth-by-email: Administration</title>
+</head>
+<body>
+	<h1>Administration</h1>
+	<p>There are {{.Users}} users, with {{.Sessions}} active sessions.</p>
+	{{if .Message}}<p style="font-weight: bold;">{{.Message}}</p>{{end}}
+	{{if .Pending}}
+	<h2>Waiting for approval</h2>
+	<table>
+		<tr><th>E-mail address</th><th>First asked</th><th>Last asked</th><th>Times</th><th></th></tr>
+		{{range .Pending}}
+		<tr>
+			<td>{{.Email}}</td>
+			<td>{{.FirstRequest.Format "2006-01-02 15:04"}}</td>
+			<td>{{.LastRequest.Format "2006-01-02 15:04"}}</td>
+			<td>{{.Count}}</td>
+			<td>
+				<form method="post" action="/auth/admin">
+					<input type="hidden" name="csrf" value="{{$.CSRFToken}}" />
+					<input type="hidden" name="email" value="{{.Email}}" />
+					<button type="submit" name="action" value="approve">Approve</button>
+					<button type="submit" name="action" value="reject">Reject</button>
+				</form>
+			</td>
+		</tr>
+		{{end}}
+	</table>
+	{{end}}
+	<form method="post" action="/auth/admin">
+	<p>
+		<input type="hidden" name="csrf" value="{{.CSRFToken}}" />
+		<label for="email">E-mail address or user ID</label>
+		<input type="text" id="email" name="email" placeholder="user@example.com" />
+		<button type="submit" name="action" value="lookup">Look up</button>
+		<button type="submit" name="action" value="approve">Approve</button> <br />
+		<label for="expires">Access ends on (optional, when approving)</label>
+		<input type="date" id="expires" name="expires" />
+	</p>
+	</form>
+	<h2>Invite someone</h2>
+	<form method="post" action="/auth/admin">
+	<p>
+		<input type="hidden" name="csrf" value="{{.CSRFToken}}" />
+		<label for="invite-email">E-mail address</label>
+		<input type="email" id="invite-email" name="email" placeholder="user@example.com" /> <br />
+		<label for="invite-message">Personal message (optional)</label> <br />
+		<textarea id="invite-message" name="message" rows="4" cols="60"></textarea> <br />
+		<label for="invite-days">Valid for (days)</label>
+		<input type="number" id="invite-days" name="days" value="7" min="1" max="90" />
+		<button type="submit" name="action" value="invite">Send invitation</button>
+	</p>
+	</form>
+	{{with .User}}
+	<h2>{{.Email}}</h2>
+	{{if and (not .Exists) (gt .ApprovalsNeeded 1)}}
+	<p>{{.Approvals}} of the {{.ApprovalsNeeded}} approvals needed have been given. A single rejection turns the user down.</p>
+	{{end}}
+	{{if .SafeAddress}}{{else}}
+	<p style="font-weight: bold;">
+		This e-mail address contains non-ascii characters. Be aware of <a href="https://en.wikipedia.org/wiki/IDN_homograph_attack">homograph attacks</a>.
+	</p>
+	{{end}}
+	{{if .Exists}}
+	<p>This user (ID {{.UserID}}) is approved{{if .Groups}}, is a member of {{range $i, $g := .Groups}}{{if $i}}, {{end}}{{$g}}{{end}}{{end}}, and is logged in on the following devices.</p>
+	{{if not .ExpiresAt.IsZero}}<p>Their access ends on {{.ExpiresAt.Format "2006-01-02 15:04"}}.</p>{{end}}
+	<table>
+		<tr><th>Device</th><th>Logged in</th><th>Last used</th></tr>
+		{{range .Sessions}}
+		<tr>
+			<td>{{.Browser}}{{if not .IsValidated}} (waiting for log-in){{end}}</td>
+			<td>{{if .CreatedAt.IsZero}}unknown{{else}}{{.CreatedAt.Format "2006-01-02 15:04"}}{{end}}</td>
+			<td>{{if .LastUsed.IsZero}}unknown{{else}}{{.LastUsed.Format "2006-01-02 15:04"}}{{end}}</td>
+		</tr>
+		{{end}}
+	</table>
+	{{if .AccessTokens}}
+	<p>This user has the following personal access tokens.</p>
+	<table>
+		<tr><th>Name</th><th>Paths</th><th>Last used</th><th>Expires</th><th></th></tr>
+		{{range .AccessTokens}}
+		<tr>
+			<td>{{.Name}}</td>
+			<td>{{if .Scopes}}{{range $i, $s := .Scopes}}{{if $i}}, {{end}}/{{$s}}{{end}}{{else}}all{{end}}</td>
+			<td>{{if .LastUsed.IsZero}}never{{else}}{{.LastUsed.Format "2006-01-02 15:04"}}{{end}}</td>
+			<td>{{.ExpiresAt.Format "2006-01-02 15:04"}}</td>
+			<td>
+				<form method="post" action="/auth/admin">
+					<input type="hidden" name="csrf" value="{{$.CSRFToken}}" />
+					<input type="hidden" name="email" value="{{$.User.Email}}" />
+					<input type="hidden" name="token" value="{{.ID}}" />
+					<button type="submit" name="action" value="revoketoken">Revoke</button>
+				</form>
+			</td>
+		</tr>
+		{{end}}
+	</table>
+	{{end}}
+	<form method="post" action="/auth/admin">
+	<p>
+		<input type="hidden" name="csrf" value="{{$.CSRFToken}}" />
+		<input type="hidden" name="email" value="{{.Email}}" />
+		<button type="submit" name="action" value="sendlink">Send log-in link</button>
+		<button type="submit" name="action" value="logout">Log out everywhere</button>
+		<button type="submit" name="action" value="revoke">Revoke access</button>
+	</p>
+	</form>
+	<form method="post" action="/auth/admin">
+	<p>
+		<input type="hidden" name="csrf" value="{{$.CSRFToken}}" />
+		<input type="hidden" name="email" value="{{.Email}}" />
+		<label for="user-expires">Access ends on (leave empty for never)</label>
+		<input type="date" id="user-expires" name="expires" value="{{if not .ExpiresAt.IsZero}}{{.ExpiresAt.Format "2006-01-02"}}{{end}}" />
+		<button type="submit" name="action" value="setexpiry">Set end of access</button>
+	</p>
+	</form>
+	{{else}}
+	<p>This user does not exist in the database.{{if not .ExpiresAt.IsZero}} Their access ended on {{.ExpiresAt.Format "2006-01-02 15:04"}}.{{end}}</p>
+	{{end}}
+	{{end}}
+	<h2>Users</h2>
+	<table>
+		<tr><th>E-mail address</th><th>User ID</th><th>Groups</th><th>Access ends</th></tr>
+		{{range .UserList}}
+		<tr>
+			<td>{{if .Email}}{{.Email}}{{else}}unknown until they log in again{{end}}</td>
+			<td>{{.UserID}}</td>
+			<td>{{range $i, $g := .Groups}}{{if $i}}, {{end}}{{$g}}{{end}}</td>
+			<td>{{if not .ExpiresAt.IsZero}}{{.ExpiresAt.Format "2006-01-02"}}{{end}}</td>
+		</tr>
+		{{end}}
+	</table>
+</body>
+</html>
+`
+
 // This page is shown to a user when they visit the /auth/delete endpoint with a GET request.
 // It should ask them if they're sure.
 const PAGEDATA_DELETE = `<!DOCTYPE html>
@@ -243,6 +645,10 @@ const PAGEDATA_DELETE = `<!DOCTYPE html>
 // This page is shown to any non-logged in user when they log in by entering their e-mail
 // address, and are recognised as an existing user. You can replace this page with your own
 // by putting a file called `ack_login.html` in the `auth` subdirectory of your website root.
+//
+// The form allows the user to type over the one-time code from their login e-mail; it
+// should be POSTed to /auth/wait with the field `code`. The script listens for the user
+// approving this browser from another device, and then moves on by itself.
 const PAGEDATA_ACK_LOGIN = `<!DOCTYPE html>
 <html lang="en">
 <head>
@@ -251,6 +657,123 @@ const PAGEDATA_ACK_LOGIN = `<!DOCTYPE html>
 </head>
 <body>
 	<p>If and when you are given access, you will receive e-mail.</p>
+	<form action="/auth/wait" method="post">
+	<p>
+		<label for="code">Or enter the code from the e-mail</label>
+		<input type="text" id="code" name="code" inputmode="numeric" autocomplete="one-time-code" />
+		<input type="submit" value="Log in" />
+	</p>
+	</form>
+	<script>
+		if (window.EventSource) {
+			new EventSource("/auth/wait/events").addEventListener("validated", function (e) {
+				window.location = e.data;
+			});
+		}
+	</script>
+</body>
+</html>
+`
+
+// This page is shown to a user when the one-time code they entered on the /auth/wait page
+// is incorrect, has expired, or has been tried too often. You can replace this page with
+// your own by putting a file called `bad_code.html` in the `auth` subdirectory of your
+// website root.
+const PAGEDATA_BAD_CODE = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<title>Auth-by-email: Incorrect code</title>
+</head>
+<body>
+	<p>This code is incorrect or no longer valid.</p>
+	<form action="/auth/wait" method="post">
+	<p>
+		<label for="code">Please try again</label>
+		<input type="text" id="code" name="code" inputmode="numeric" autocomplete="one-time-code" />
+		<input type="submit" value="Log in" />
+	</p>
+	</form>
+	<p>If this keeps happening, please <a href="/">request a new log-in link</a>.</p>
+</body>
+</html>
+`
+
+// This page is shown when a user asks for another log-in link shortly after the last one,
+// or too often for the same address. You can replace this page with your own by putting a
+// file called `already_sent.html` in the `auth` subdirectory of your website root.
+const PAGEDATA_ALREADY_SENT = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<title>Auth-by-email: Link already sent</title>
+</head>
+<body>
+	<p>A log-in link was already sent to this address. Please check your inbox, and your spam folder.</p>
+	<form action="/auth/wait" method="post">
+	<p>
+		<label for="code">If you asked for it in this browser, you can also enter the code from the e-mail</label>
+		<input type="text" id="code" name="code" inputmode="numeric" autocomplete="one-time-code" />
+		<input type="submit" value="Log in" />
+	</p>
+	</form>
+	<p>If the e-mail does not arrive, you can ask for a new one in {{.Wait}}.</p>
+</body>
+</html>
+`
+
+// This page is shown when too many log-in links were asked for from the same network.
+// You can replace this page with your own by putting a file called `too_many_requests.html`
+// in the `auth` subdirectory of your website root.
+const PAGEDATA_TOO_MANY_REQUESTS = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<title>Auth-by-email: Too many requests</title>
+</head>
+<body>
+	<p>Too many log-in links were asked for from your network. Please try again in {{.Wait}}.</p>
+</body>
+</html>
+`
+
+// This page is shown when a login form was posted without the right answer to the
+// challenge. You can replace this page with your own by putting a file called
+// `challenge_failed.html` in the `auth` subdirectory of your website root.
+const PAGEDATA_CHALLENGE_FAILED = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<title>Auth-by-email: Please try again</title>
+</head>
+<body>
+	<p>We could not check that you are not a robot. Please go back and try again.</p>
+	<p>Logging in on this website needs JavaScript, so please make sure it is enabled.</p>
+</body>
+</html>
+`
+
+// This page is shown when someone asks for a log-in link for an address that matches
+// `blockdomains`. You can replace this page with your own by putting a file called
+// `blocked.html` in the `auth` subdirectory of your website root.
+const PAGEDATA_BLOCKED = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<title>Auth-by-email: Address not accepted</title>
+</head>
+<body>
+	<p>Log-in links cannot be sent to this e-mail address. Please go back and use another one.</p>
+</body>
+</html>
+`
+
+// This page is shown to a logged-in user when they try to access a resource that requires
+// membership of a group they are not in. You can replace this page with your own by putting
+// a file called `no_access.html` in the `auth` subdirectory of your website root.
+const PAGEDATA_NO_ACCESS = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<title>Auth-by-email: No access</title>
+</head>
+<body>
+	<p>You are logged in, but you do not have access to this page.</p>
+	<p>Please ask the administrator of this website if you think you should.</p>
 </body>
 </html>
 `
@@ -283,11 +806,27 @@ const PAGEDATA_ACK_REMOVE = `<!DOCTYPE html>
 </html>
 `
 
+// This page is shown to an administrator when they approve a new user who must be approved
+// by more admins before they are added. You can replace this page with your own by putting a
+// file called `ack_vote.html` in the `auth` subdirectory of your website root.
+const PAGEDATA_ACK_VOTE = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<title>Auth-by-email: Approval recorded</title>
+</head>
+<body>
+	<p>Your approval has been recorded. The user will be added once enough administrators have approved them.</p>
+</body>
+</html>
+`
+
 // This is an e-mail sent to a user that wishes to log in. You can replace this page with your own
 // by putting a file called `mail_login.html` in the `auth` subdirectory of your website root.
 //
-// When supplying your own template, take care to include the fields {{.User}}, {{.SiteName}} and
-// {{.Link}} as shown below. Be mindful of the fact that many e-mail clients block external resources.
+// When supplying your own template, take care to include the fields {{.User}}, {{.SiteName}},
+// {{.Link}} and {{.Code}} as shown below. The code is empty if the user did not request the link
+// themselves (e.g. when an administrator approved them). Be mindful of the fact that many e-mail
+// clients block external resources.
 const MAILDATA_LOGIN = `<!DOCTYPE html>
 <html lang="en">
     <head>
@@ -296,6 +835,10 @@ const MAILDATA_LOGIN = `<!DOCTYPE html>
         <p>Hi {{.User}},</p>
         <p>You requested a log-in link to {{.SiteName}}. Please click the following link to log in:<br />
         {{.Link}}</p>
+        {{if .Code}}
+        <p>Alternatively, enter the following code on the page where you requested the link:<br />
+        <strong>{{.Code}}</strong></p>
+        {{end}}
         <p>Kind regards,</p>
         <p>{{.SiteName}} administration</p>
     </body>
@@ -323,3 +866,65 @@ const MAILDATA_APPROVE = `<!DOCTYPE html>
     </body>
 </html>
 `
+
+// This is an e-mail sent to someone an administrator invited to the site. You can replace this
+// page with your own by putting a file called `mail_invite.html` in the `auth` subdirectory of
+// your website root.
+//
+// When supplying your own template, take care to include the fields {{.User}}, {{.SiteName}} and
+// {{.Link}} as shown below. {{.Inviter}} and {{.Message}} may be empty, and {{.ValidUntil}} is
+// when the link expires. Be mindful of the fact that many e-mail clients block external resources.
+const MAILDATA_INVITE = `<!DOCTYPE html>
+<html lang="en">
+    <head>
+    </head>
+    <body>
+        <p>Hi {{.User}},</p>
+        <p>{{if .Inviter}}{{.Inviter}} has invited you{{else}}You have been invited{{end}} to {{.SiteName}}.</p>
+        {{if .Message}}
+        <p style="white-space: pre-wrap;">{{.Message}}</p>
+        {{end}}
+        <p>Please click the following link to log in for the first time:<br />
+        {{.Link}}</p>
+        <p>This link is valid until {{.ValidUntil.Format "2006-01-02 15:04 MST"}}. Afterwards, you can log in with your e-mail address on the site.</p>
+        <p>Kind regards,</p>
+        <p>{{.SiteName}} administration</p>
+    </body>
+</html>
+`
+
+// This page is shown to a user who asked for their access to be renewed, by following the link
+// in the e-mail that reminded them it ends. You can replace this page with your own by putting
+// a file called `ack_renew.html` in the `auth` subdirectory of your website root.
+const PAGEDATA_ACK_RENEW = `<!DOCTYPE html>
+<html lang="en">
+<head>
+	<title>Auth-by-email: Renewal requested</title>
+</head>
+<body>
+	<p>The administrators have been asked to extend your access. You will not be notified of their decision; if they approve, you can keep logging in as before.</p>
+</body>
+</html>
+`
+
+// This is an e-mail sent to a user whose access ends within a week. You can replace this page
+// with your own by putting a file called `mail_expiry.html` in the `auth` subdirectory of your
+// website root.
+//
+// When supplying your own template, take care to include the fields {{.User}}, {{.SiteName}},
+// {{.Link}} and {{.ExpiresAt}} as shown below. Be mindful of the fact that many e-mail clients
+// block external resources.
+const MAILDATA_EXPIRY = `<!DOCTYPE html>
+<html lang="en">
+    <head>
+    </head>
+    <body>
+        <p>Hi {{.User}},</p>
+        <p>Your access to {{.SiteName}} ends on {{.ExpiresAt.Format "2006-01-02 15:04 MST"}}.</p>
+        <p>If you still need access, please click the following link to ask the administrators for a renewal:<br />
+        {{.Link}}</p>
+        <p>Kind regards,</p>
+        <p>{{.SiteName}} administration</p>
+    </body>
+</html>
+`
@@ -73,4 +73,28 @@ func (lt *linkTokenInternal) UnmarshalBinary(data []byte) error {
 type cookieTokenInternal struct {
 	CookieToken
 	ValidUntil time.Time
+	CreatedAt  time.Time
+	LastUsed   time.Time
+}
+
+// A Session describes a cookie of a user, so that they can recognise and revoke it.
+type Session struct {
+	CookieToken
+
+	// The cookie itself.
+	Cookie string
+
+	// When the cookie was made, last used, and when it will expire. The first two may be
+	// zero for cookies made by older versions.
+	CreatedAt  time.Time
+	LastUsed   time.Time
+	ValidUntil time.Time
+}
+
+// A loginCodeInternal is a one-time code that can validate the cookie it belongs to.
+// Only a hash of the code is kept.
+type loginCodeInternal struct {
+	CodeHash     string
+	AttemptsLeft int
+	ValidUntil   time.Time
 }
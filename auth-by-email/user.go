@@ -0,0 +1,30 @@
+package authbyemail
+
+import (
+	"errors"
+	"time"
+)
+
+// A User is an approved user, as listed for admins.
+type User struct {
+	UserID UserID
+
+	// The user's e-mail address, encrypted. It is empty for users who were added
+	// before addresses were stored, until they log in again.
+	EncryptedEmail string
+
+	// When the user loses access, or the zero time if never.
+	ExpiresAt time.Time
+}
+
+// Email decrypts the e-mail address of the user, if it is known.
+func (u *User) Email() (*EmailAddr, error) {
+	if u.EncryptedEmail == "" {
+		return nil, errors.New("The e-mail address of this user is not known")
+	}
+	res, err := CRYPTO.decrypt(u.EncryptedEmail)
+	if err != nil {
+		return nil, err
+	}
+	return NewEmailAddrFromString(res)
+}
@@ -5,7 +5,7 @@ import (
 	"github.com/caddyserver/caddy/caddyhttp/httpserver"
 
 	// plug in plugins here, for example:
-	_ "github.com/TNO/auth-by-email/auth-by-email"
+	_ "github.com/TNO/auth-by-email/auth-by-email/caddyplugin"
 )
 
 func main() {
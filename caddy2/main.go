@@ -0,0 +1,16 @@
+package main
+
+import (
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+
+	// plug in Caddy modules here
+	_ "github.com/TNO/auth-by-email/auth-by-email/caddyv2"
+	_ "github.com/caddyserver/caddy/v2/modules/standard"
+)
+
+func main() {
+	// This is the main package that xcaddy would generate. The `authbyemail` directive
+	// is ordered before `basic_auth` by the module itself, so unlike with Caddy v1 the
+	// Caddyfile needs no further changes.
+	caddycmd.Main()
+}
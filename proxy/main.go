@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/TNO/auth-by-email/auth-by-email"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// proxy runs auth-by-email as its own web server in front of another website, which is
+// only reachable for users who have logged in. The parameters can be given in a file
+// with one parameter per line, as in the `authbyemail` block of a Caddyfile, and most
+// of them as flags, which take precedence.
+func main() {
+	listen := flag.String("listen", ":8080", "Address on which to serve, like :8080")
+	upstream := flag.String("upstream", "", "URL of the website to protect, like http://localhost:3000")
+	configFile := flag.String("config", "", "File with one parameter per line, like 'admin sysadmin@example.com'; see README.md for all parameters")
+	tlsCert := flag.String("tlscert", "", "Certificate file, to serve https instead of http")
+	tlsKey := flag.String("tlskey", "", "Key file belonging to --tlscert")
+	flag.String("sitename", "", "Name of the website used in e-mails")
+	flag.String("siteurl", "", "URL at which users reach this proxy, like https://example.com")
+	flag.String("mailerfrom", "", "E-mail address from which e-mails are sent")
+	flag.String("admin", "", "E-mail addresses of the admins, separated by commas")
+	flag.String("whitelistdomains", "", "Domains of which users need no approval, separated by commas")
+	flag.String("blockdomains", "", "Domains and addresses that can not log in, separated by commas")
+	flag.String("database", "", "File in which the database lives; if not given, users are forgotten on exit")
+	flag.String("unprotected", "", "Paths that need no log-in, separated by commas")
+	flag.String("root", "", "Directory with custom template files")
+	flag.Parse()
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	config := authbyemail.NewConfig()
+	if *configFile != "" {
+		fileListen, fileUpstream, err := readConfigFile(*configFile, config)
+		if err != nil {
+			log.Fatalf("Could not read %v: %v", *configFile, err)
+		}
+		if fileListen != "" && !given["listen"] {
+			*listen = fileListen
+		}
+		if fileUpstream != "" && !given["upstream"] {
+			*upstream = fileUpstream
+		}
+	}
+
+	// The flags for parameters are passed on as if they were in the configuration file
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen", "upstream", "config", "tlscert", "tlskey":
+			return
+		case "sitename", "siteurl", "mailerfrom", "database", "root":
+			if err := config.ParseDirective(f.Name, []string{f.Value.String()}); err != nil {
+				log.Fatalf("Invalid --%v: %v", f.Name, err)
+			}
+		default:
+			if err := config.ParseDirective(f.Name, strings.FieldsFunc(f.Value.String(), isSeparator)); err != nil {
+				log.Fatalf("Invalid --%v: %v", f.Name, err)
+			}
+		}
+	})
+
+	if err := config.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if *upstream == "" {
+		log.Fatalf("Please specify the website to protect with --upstream")
+	}
+	target, err := url.Parse(*upstream)
+	if err != nil || target.Scheme == "" || target.Host == "" {
+		log.Fatalf("Could not parse upstream URL `%v`", *upstream)
+	}
+
+	protect := authbyemail.NewMiddleware(config)
+	server := &http.Server{
+		Addr:    *listen,
+		Handler: protect(httputil.NewSingleHostReverseProxy(target)),
+	}
+
+	log.Printf("Serving %v on %v, protecting %v", config.SiteURL, *listen, target)
+	if *tlsCert != "" || *tlsKey != "" {
+		err = server.ListenAndServeTLS(*tlsCert, *tlsKey)
+	} else {
+		err = server.ListenAndServe()
+	}
+	log.Fatal(err)
+}
+
+// readConfigFile reads the parameters in the given file into the configuration. Besides
+// those of auth-by-email, `listen` and `upstream` lines may be given, like the flags,
+// whose values are returned. Empty lines and lines starting with # are skipped.
+func readConfigFile(filename string, config *authbyemail.Config) (listen, upstream string, err error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		switch fields[0] {
+		case "listen", "upstream":
+			if len(fields) != 2 {
+				return "", "", fmt.Errorf("line %v: Please give one (1) address after '%v'", lineNumber, fields[0])
+			}
+			if fields[0] == "listen" {
+				listen = fields[1]
+			} else {
+				upstream = fields[1]
+			}
+		default:
+			if err := config.ParseDirective(fields[0], fields[1:]); err != nil {
+				return "", "", fmt.Errorf("line %v: %v", lineNumber, err)
+			}
+		}
+	}
+	return listen, upstream, scanner.Err()
+}
+
+// isSeparator tells whether a character separates the values of a flag
+func isSeparator(c rune) bool {
+	return c == ',' || c == ' '
+}
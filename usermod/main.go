@@ -3,19 +3,69 @@ package main
 import (
     "bufio"
     "flag"
+    "fmt"
     "github.com/TNO/auth-by-email/auth-by-email"
     "log"
     "os"
     "strings"
+    "time"
 )
 
 func main() {
     database := flag.String("database", "/tmp/database", "Directory in which the database lives")
-    mode := flag.String("mode", "add", "What to do with input e-mail addresses {add|delete|invalidate|debug} (the latter invalidates cookies and e-mails but doesn't delete the user)")
+    mode := flag.String("mode", "add", "What to do with input e-mail addresses {add|delete|invalidate|reject|invite|pending|export|newapitoken|delapitoken|debug} (invalidate invalidates cookies and e-mails but doesn't delete the user, reject drops a request for access, invite mails the addresses an invitation, pending lists those requests, export lists all users; the apitoken modes read token names instead of e-mail addresses)")
+    groupsFlag := flag.String("groups", "", "With --mode add, set the groups of the users to this list separated by commas (an empty list removes them from all groups)")
+    expiresFlag := flag.String("expires", "", "With --mode add, set the date on which the access of the users ends, like 2006-01-02 (an empty date means it does not end)")
+    inviter := flag.String("inviter", "", "With --mode invite, the e-mail address of the admin who invites, which is named in the invitation")
+    message := flag.String("message", "", "With --mode invite, a personal message to include in the invitation")
+    days := flag.Int("days", 7, "With --mode invite, the number of days the invitation is valid")
+    siteURL := flag.String("siteurl", "", "With --mode invite, the URL of the site, like https://example.com (as in the Caddyfile)")
+    siteName := flag.String("sitename", "", "With --mode invite, the name of the site (as in the Caddyfile)")
+    mailerFrom := flag.String("mailerfrom", "", "With --mode invite, the address the invitations are sent from (as in the Caddyfile)")
     flag.Parse()
 
-    if !(*mode == "add" || *mode == "delete" || *mode == "invalidate" || *mode == "debug") {
-        log.Fatalf("Please specify --mode {add|delete|invalidate}, you specified `%v`", *mode)
+    // Only touch the groups and the expiry if the flag was given, so that "-groups ''" and
+    // "-expires ''" can clear them
+    var groups []string
+    var expiresAt time.Time
+    setExpiry := false
+    flag.Visit(func(f *flag.Flag) {
+        var err error
+        if f.Name == "groups" {
+            if groups, err = authbyemail.ParseGroups(*groupsFlag); err != nil {
+                log.Fatalf("Could not parse --groups: %v", err)
+            }
+        }
+        if f.Name == "expires" {
+            if expiresAt, err = authbyemail.ParseExpiry(*expiresFlag); err != nil {
+                log.Fatalf("Could not parse --expires: %v", err)
+            }
+            setExpiry = true
+        }
+    })
+
+    if !(*mode == "add" || *mode == "delete" || *mode == "invalidate" || *mode == "reject" || *mode == "invite" || *mode == "pending" || *mode == "export" || *mode == "newapitoken" || *mode == "delapitoken" || *mode == "debug") {
+        log.Fatalf("Please specify --mode {add|delete|invalidate|reject|invite|pending|export|newapitoken|delapitoken}, you specified `%v`", *mode)
+    }
+
+    // "invite" mails through the handler like the site does, so it needs the same configuration
+    // and the SENDINBLUE_API_KEY in the environment
+    var handler authbyemail.AuthByEmailHandler
+    if *mode == "invite" {
+        config := authbyemail.NewConfig()
+        for _, directive := range []struct{ name, value string }{{"siteurl", *siteURL}, {"sitename", *siteName}, {"mailerfrom", *mailerFrom}, {"database", *database}} {
+            if err := config.ParseDirective(directive.name, []string{directive.value}); err != nil {
+                log.Fatalf("Could not use --%v: %v", directive.name, err)
+            }
+        }
+        if err := config.Validate(); err != nil {
+            log.Fatalf("Please give --siteurl, --sitename and --mailerfrom with --mode invite: %v", err)
+        }
+        if *days < 1 || *days > 90 {
+            log.Fatalf("Please give --days between 1 and 90")
+        }
+        handler = authbyemail.NewHandler(nil, config)
+        defer handler.Close()
     }
 
     authbyemail.InitializeCrypto()
@@ -28,6 +78,38 @@ func main() {
         return
     }
 
+    // "pending" lists the users waiting for approval, which can then be fed back with --mode add or reject
+    if *mode == "pending" {
+        for _, request := range db.GetPendingRequests() {
+            email, err := request.Email()
+            if err != nil {
+                log.Printf("Could not decrypt the e-mail address of user %v: %v", request.UserID, err)
+                continue
+            }
+            fmt.Println(email.String())
+            log.Printf("%v asked %v times, first on %v, last on %v", email.String(), request.Count,
+                request.FirstRequest.Format("2006-01-02 15:04"), request.LastRequest.Format("2006-01-02 15:04"))
+        }
+        return
+    }
+
+    // "export" lists the e-mail addresses of all users, as far as they are known
+    if *mode == "export" {
+        unknown := 0
+        for _, user := range db.GetUsers() {
+            email, err := user.Email()
+            if err != nil {
+                unknown += 1
+                continue
+            }
+            fmt.Println(email.String())
+        }
+        if unknown > 0 {
+            log.Printf("%v users were skipped, since their e-mail addresses will only be known once they log in again.", unknown)
+        }
+        return
+    }
+
     successes := 0
     stdin := bufio.NewReader(os.Stdin)
     for {
@@ -36,6 +118,27 @@ func main() {
             break
         }
 
+        // The apitoken modes make or delete tokens for the API, one per name
+        if *mode == "newapitoken" || *mode == "delapitoken" {
+            name := strings.TrimSpace(line)
+            if name == "" {
+                continue
+            }
+            if *mode == "newapitoken" {
+                token, err := db.NewAPIToken(name)
+                if err != nil {
+                    log.Printf("Could not make API token %v: %v", name, err)
+                    continue
+                }
+                fmt.Printf("%v %v\n", name, token)
+            } else if err := db.DelAPIToken(name); err != nil {
+                log.Printf("Could not delete API token %v: %v", name, err)
+                continue
+            }
+            successes += 1
+            continue
+        }
+
         email, err := authbyemail.NewEmailAddrFromString(strings.TrimSpace(line))
         if err != nil {
             log.Printf("Can not parse e-mail address `%v`", line)
@@ -43,7 +146,22 @@ func main() {
         }
         userid := authbyemail.CRYPTO.UserIDfromEmail(email)
 
+        if *mode == "invite" {
+            if db.IsKnownUser(userid) {
+                log.Printf("User %v is already known, not inviting them", email.String())
+                continue
+            }
+            if err := handler.Invite(email, *inviter, *message, time.Duration(*days)*24*time.Hour); err != nil {
+                log.Printf("Could not invite %v: %v", email.String(), err)
+                continue
+            }
+            successes += 1
+            continue
+        }
+
         // "invalidate" means to delete the user (which removes all tokens), and then to add them back
+        oldGroups := db.GetUserGroups(userid)
+        oldExpiry := db.GetUserExpiry(userid)
         if *mode == "delete" || *mode == "invalidate" {
             err := db.DelUser(userid)
             if err != nil {
@@ -53,6 +171,30 @@ func main() {
         }
         if *mode == "add" || *mode == "invalidate" {
             db.AddUser(userid)
+            if err := db.SetUserEmail(email); err != nil {
+                log.Printf("Could not store the e-mail address of user %v (%v): %v", email.String(), userid, err)
+            }
+        }
+        if *mode == "invalidate" {
+            db.SetUserGroups(userid, oldGroups)
+            if !oldExpiry.IsZero() {
+                db.SetUserExpiry(userid, oldExpiry)
+            }
+        }
+        if *mode == "add" && groups != nil {
+            if err := db.SetUserGroups(userid, groups); err != nil {
+                log.Printf("Could not set the groups of user %v (%v): %v", email.String(), userid, err)
+                continue
+            }
+        }
+        if *mode == "add" && setExpiry {
+            if err := db.SetUserExpiry(userid, expiresAt); err != nil {
+                log.Printf("Could not set the expiry of user %v (%v): %v", email.String(), userid, err)
+                continue
+            }
+        }
+        if *mode == "reject" {
+            db.DelPendingRequest(userid)
         }
 
         successes += 1